@@ -1012,7 +1012,16 @@ func (t *Loki) initCompactor() (services.Service, error) {
 		return nil, err
 	}
 
-	t.compactor.RegisterIndexCompactor(config.BoltDBShipperType, boltdb_shipper_compactor.NewIndexCompactor())
+	boltdbShipperCompactor, err := boltdb_shipper_compactor.NewIndexCompactor(boltdb_shipper_compactor.Options{
+		MaxDecompressedSourceFileBytes: int64(t.Cfg.CompactorConfig.MaxDecompressedSourceFileSize),
+		BoltdbOpenTimeout:              t.Cfg.CompactorConfig.BoltdbOpenTimeout,
+		VerifySourceFilesAccounting:    t.Cfg.CompactorConfig.VerifySourceFilesAccounting,
+	}, prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, err
+	}
+
+	t.compactor.RegisterIndexCompactor(config.BoltDBShipperType, boltdbShipperCompactor)
 	t.compactor.RegisterIndexCompactor(config.TSDBType, tsdb.NewIndexCompactor())
 	t.Server.HTTP.Path("/compactor/ring").Methods("GET", "POST").Handler(t.compactor)
 
@@ -401,6 +401,7 @@ func minimalWorkingConfig(t *testing.T, dir, target string, cfgTransformers ...f
 	cfg.Ruler.Config.Ring.InstanceAddr = localhost
 	cfg.Ruler.Config.StoreConfig.Type = config.StorageTypeLocal
 	cfg.Ruler.Config.StoreConfig.Local.Directory = dir
+	cfg.Ingester.WAL.Dir = filepath.Join(dir, "wal")
 
 	cfg.Common.CompactorAddress = "http://localhost:0"
 
@@ -432,6 +432,7 @@ func (a *S3ObjectClient) List(ctx context.Context, prefix, delimiter string) ([]
 					storageObjects = append(storageObjects, client.StorageObject{
 						Key:        *content.Key,
 						ModifiedAt: *content.LastModified,
+						Size:       aws.Int64Value(content.Size),
 					})
 				}
 
@@ -194,6 +194,7 @@ func (s *GCSObjectClient) List(ctx context.Context, prefix, delimiter string) ([
 		storageObjects = append(storageObjects, client.StorageObject{
 			Key:        attr.Name,
 			ModifiedAt: attr.Updated,
+			Size:       attr.Size,
 		})
 	}
 
@@ -124,7 +124,7 @@ func (f *FSObjectClient) List(ctx context.Context, prefix, delimiter string) ([]
 	}
 	if !info.IsDir() {
 		// When listing single file, return this file only.
-		return []client.StorageObject{{Key: info.Name(), ModifiedAt: info.ModTime()}}, nil, nil
+		return []client.StorageObject{{Key: info.Name(), ModifiedAt: info.ModTime(), Size: info.Size()}}, nil, nil
 	}
 
 	var storageObjects []client.StorageObject
@@ -164,7 +164,7 @@ func (f *FSObjectClient) List(ctx context.Context, prefix, delimiter string) ([]
 			return filepath.SkipDir
 		}
 
-		storageObjects = append(storageObjects, client.StorageObject{Key: relPath, ModifiedAt: info.ModTime()})
+		storageObjects = append(storageObjects, client.StorageObject{Key: relPath, ModifiedAt: info.ModTime(), Size: info.Size()})
 		return nil
 	})
 
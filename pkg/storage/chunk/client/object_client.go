@@ -41,6 +41,8 @@ type ObjectClient interface {
 type StorageObject struct {
 	Key        string
 	ModifiedAt time.Time
+	// Size is the size of the object in bytes, 0 when not reported by the Object Store.
+	Size int64
 }
 
 // StorageCommonPrefix represents a common prefix aka a synthetic directory in Object Store.
@@ -172,6 +172,7 @@ func (s *SwiftObjectClient) List(ctx context.Context, prefix, delimiter string)
 		storageObjects = append(storageObjects, client.StorageObject{
 			Key:        obj.Name,
 			ModifiedAt: obj.LastModified,
+			Size:       obj.Bytes,
 		})
 	}
 
@@ -98,6 +98,8 @@ type PeriodConfig struct {
 	IndexTables PeriodicTableConfig `yaml:"index" doc:"description=Configures how the index is updated and stored."`
 	ChunkTables PeriodicTableConfig `yaml:"chunks" doc:"description=Configured how the chunks are updated and stored."`
 	RowShards   uint32              `yaml:"row_shards" doc:"description=How many shards will be created. Only used if schema is v10 or greater."`
+	// PerUserIndex sets whether the index of the period is built per user, which is only enforced by the compactor when explicitly set.
+	PerUserIndex *bool `yaml:"per_user_index,omitempty" doc:"description=Whether the boltdb-shipper index of the period is built per user. When set, the compactor fails to compact tables with index files in a format inconsistent with it. When unset, the format is detected from the index files."`
 
 	// Integer representation of schema used for hot path calculation. Populated on unmarshaling.
 	schemaInt *int `yaml:"-"`
@@ -32,6 +32,7 @@ import (
 	shipper_storage "github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
 	"github.com/grafana/loki/pkg/usagestats"
 	"github.com/grafana/loki/pkg/util"
+	util_flagext "github.com/grafana/loki/pkg/util/flagext"
 	util_log "github.com/grafana/loki/pkg/util/log"
 )
 
@@ -91,6 +92,16 @@ type Config struct {
 	TablesToCompact           int             `yaml:"tables_to_compact"`
 	SkipLatestNTables         int             `yaml:"skip_latest_n_tables"`
 
+	KeepConsumedSourceFilesFor time.Duration `yaml:"keep_consumed_source_files_for"`
+	UploadCompression          string        `yaml:"upload_compression"`
+	UploadCompressionLevel     int           `yaml:"upload_compression_level"`
+	SourceFileReadRateLimit    float64       `yaml:"source_file_read_rate_limit"`
+	SourceFileReadBurst        int           `yaml:"source_file_read_burst"`
+
+	MaxDecompressedSourceFileSize util_flagext.ByteSize `yaml:"max_decompressed_source_file_size"`
+	BoltdbOpenTimeout             time.Duration         `yaml:"boltdb_open_timeout"`
+	VerifySourceFilesAccounting   bool                  `yaml:"verify_source_files_accounting"`
+
 	// Deprecated
 	DeletionMode string `yaml:"deletion_mode" doc:"deprecated|description=Use deletion_mode per tenant configuration instead."`
 }
@@ -119,6 +130,14 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.CompactorRing.RegisterFlagsWithPrefix("boltdb.shipper.compactor.", "collectors/", f)
 	f.IntVar(&cfg.TablesToCompact, "boltdb.shipper.compactor.tables-to-compact", 0, "Number of tables that compactor will try to compact. Newer tables are chosen when this is less than the number of tables available.")
 	f.IntVar(&cfg.SkipLatestNTables, "boltdb.shipper.compactor.skip-latest-n-tables", 0, "Do not compact N latest tables. Together with -boltdb.shipper.compactor.run-once and -boltdb.shipper.compactor.tables-to-compact, this is useful when clearing compactor backlogs.")
+	f.DurationVar(&cfg.KeepConsumedSourceFilesFor, "boltdb.shipper.compactor.keep-consumed-source-files-for", 0, "Keep the index files removed from the shared store by compaction under the consumed/ prefix added before the shared store key prefix for this long before deleting them, for debugging the output of compaction. 0 deletes them right away.")
+	f.StringVar(&cfg.UploadCompression, "boltdb.shipper.compactor.upload-compression", uploadCompressionGzip, "Compression of the compacted index files uploaded to the shared store. Supported values: gzip, zstd.")
+	f.IntVar(&cfg.UploadCompressionLevel, "boltdb.shipper.compactor.upload-compression-level", 0, "Level of the compression of the compacted index files uploaded to the shared store, from 1 to 9 for gzip and from 1 to 22 for zstd. 0 uses the default level of the compression.")
+	f.Float64Var(&cfg.SourceFileReadRateLimit, "boltdb.shipper.compactor.source-file-read-rate-limit", 0, "Maximum number of index files per second downloaded from the shared store for compacting tables, for not throttling other users of the shared store. 0 means no limit.")
+	f.Var(&cfg.MaxDecompressedSourceFileSize, "boltdb.shipper.compactor.max-decompressed-source-file-size", "Maximum size of a compressed index file downloaded from the shared store for compacting tables after decompressing it. Compaction of a table fails with an error when one of its index files decompresses beyond it, which guards against decompression bombs. 0 means no limit.")
+	f.IntVar(&cfg.SourceFileReadBurst, "boltdb.shipper.compactor.source-file-read-burst", 1, "Maximum number of index files downloaded from the shared store at once for compacting tables, above the rate of -boltdb.shipper.compactor.source-file-read-rate-limit.")
+	f.DurationVar(&cfg.BoltdbOpenTimeout, "boltdb.shipper.compactor.boltdb-open-timeout", 5*time.Second, "Timeout for acquiring the file lock while opening the boltdb files of the tables being compacted. Compaction of a table fails with an error when a file stays locked by another process, like with a working directory shared by multiple processes.")
+	f.BoolVar(&cfg.VerifySourceFilesAccounting, "boltdb.shipper.compactor.verify-source-files-accounting", false, "Fail the compaction of a table when some of the index files of its common index were neither compacted nor skipped, instead of removing them from the shared store along with the compacted ones.")
 
 }
 
@@ -127,6 +146,18 @@ func (cfg *Config) Validate() error {
 	if cfg.MaxCompactionParallelism < 1 {
 		return errors.New("max compaction parallelism must be >= 1")
 	}
+	if cfg.KeepConsumedSourceFilesFor < 0 {
+		return errors.New("keep consumed source files for must be >= 0")
+	}
+	if err := validateUploadCompression(cfg.UploadCompression, cfg.UploadCompressionLevel); err != nil {
+		return err
+	}
+	if err := validateSourceFileReadRateLimit(cfg.SourceFileReadRateLimit, cfg.SourceFileReadBurst); err != nil {
+		return err
+	}
+	if cfg.BoltdbOpenTimeout <= 0 {
+		return errors.New("boltdb open timeout must be > 0")
+	}
 	if cfg.RetentionEnabled && cfg.ApplyRetentionInterval != 0 && cfg.ApplyRetentionInterval%cfg.CompactionInterval != 0 {
 		return errors.New("interval for applying retention should either be set to a 0 or a multiple of compaction interval")
 	}
@@ -147,6 +178,9 @@ type Compactor struct {
 
 	cfg                       Config
 	indexStorageClient        shipper_storage.Client
+	consumedSourceFiles       *consumedSourceFiles
+	uploadCompression         *uploadCompression
+	sourceFileReadLimiter     *sourceFileReadLimiter
 	tableMarker               retention.TableMarker
 	sweeper                   *retention.Sweeper
 	deleteRequestsStore       deletion.DeleteRequestsStore
@@ -242,7 +276,10 @@ func (c *Compactor) init(objectClient client.ObjectClient, schemaConfig config.S
 		return err
 	}
 	c.indexStorageClient = shipper_storage.NewIndexStorageClient(objectClient, c.cfg.SharedStoreKeyPrefix)
+	c.consumedSourceFiles = newConsumedSourceFiles(objectClient, c.cfg.SharedStoreKeyPrefix, c.cfg.KeepConsumedSourceFilesFor)
 	c.metrics = newMetrics(r)
+	c.uploadCompression = newUploadCompression(c.cfg.UploadCompression, c.cfg.UploadCompressionLevel, c.metrics)
+	c.sourceFileReadLimiter = newSourceFileReadLimiter(newSourceFileReadRateLimiter(c.cfg.SourceFileReadRateLimit, c.cfg.SourceFileReadBurst), c.metrics)
 
 	if c.cfg.RetentionEnabled {
 		var encoder client.KeyEncoder
@@ -510,7 +547,8 @@ func (c *Compactor) CompactTable(ctx context.Context, tableName string, applyRet
 	}
 
 	table, err := newTable(ctx, filepath.Join(c.cfg.WorkingDirectory, tableName), c.indexStorageClient, indexCompactor,
-		schemaCfg, c.tableMarker, c.expirationChecker, c.cfg.UploadParallelism)
+		schemaCfg, c.tableMarker, c.expirationChecker, c.cfg.UploadParallelism, c.consumedSourceFiles, c.uploadCompression, c.sourceFileReadLimiter,
+		int64(c.cfg.MaxDecompressedSourceFileSize))
 	if err != nil {
 		level.Error(util_log.Logger).Log("msg", "failed to initialize table for compaction", "table", tableName, "err", err)
 		return err
@@ -642,6 +680,11 @@ func (c *Compactor) RunCompaction(ctx context.Context, applyRetention bool) erro
 		}
 	}
 
+	// failing to remove the expired consumed source files does not fail the compaction, they get removed by the next run.
+	if err := c.consumedSourceFiles.sweep(ctx); err != nil {
+		level.Error(util_log.Logger).Log("msg", "failed to remove expired consumed source files", "err", err)
+	}
+
 	return firstErr
 }
 
@@ -0,0 +1,127 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// consumedSourceFilesPrefix is prepended to the prefix of the index for the keys of the source files kept as per
+// Config.KeepConsumedSourceFilesFor, which keeps them out of the tables listed for compaction.
+const consumedSourceFilesPrefix = "consumed/"
+
+// consumedSourceFiles keeps the source files consumed by the compaction of tables in the object store for a grace period,
+// instead of deleting them right away, for reconstructing what the compaction saw. They are kept with the same table,
+// user and file names under consumedSourceFilesPrefix. A nil consumedSourceFiles keeps nothing.
+type consumedSourceFiles struct {
+	client  storage.Client
+	keepFor time.Duration
+	now     func() time.Time
+}
+
+// newConsumedSourceFiles returns a consumedSourceFiles for the index stored with the given prefix,
+// or nil when the consumed source files are not to be kept.
+func newConsumedSourceFiles(objectClient client.ObjectClient, indexPrefix string, keepFor time.Duration) *consumedSourceFiles {
+	if keepFor <= 0 {
+		return nil
+	}
+
+	return &consumedSourceFiles{
+		client:  storage.NewIndexStorageClient(objectClient, consumedSourceFilesPrefix+indexPrefix),
+		keepFor: keepFor,
+		now:     time.Now,
+	}
+}
+
+// keep copies the given source file of the index set under consumedSourceFilesPrefix before it gets removed from the storage.
+// The file is downloaded as is to the working dir of the index set since uploads need to be seekable.
+func (c *consumedSourceFiles) keep(ctx context.Context, is *indexSet, fileName string) error {
+	if c == nil {
+		return nil
+	}
+
+	tmpPath := filepath.Join(is.workingDir, fileName+".consumed")
+	err := storage.DownloadFileFromStorage(tmpPath, false, false, is.logger, func() (io.ReadCloser, error) {
+		return is.baseIndexSet.GetFile(ctx, is.tableName, is.userID, fileName)
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmpPath); err != nil {
+			level.Error(is.logger).Log("msg", "failed to remove consumed source file", "path", tmpPath, "err", err)
+		}
+	}()
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if is.userID != "" {
+		return c.client.PutUserFile(ctx, is.tableName, is.userID, fileName, f)
+	}
+	return c.client.PutFile(ctx, is.tableName, fileName, f)
+}
+
+// sweep removes the consumed source files kept for longer than Config.KeepConsumedSourceFilesFor.
+func (c *consumedSourceFiles) sweep(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+
+	c.client.RefreshIndexListCache(ctx)
+	tables, err := c.client.ListTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	keepAfter := c.now().Add(-c.keepFor)
+	removed := 0
+	for _, tableName := range tables {
+		files, users, err := c.client.ListFiles(ctx, tableName, true)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.ModifiedAt.Before(keepAfter) {
+				continue
+			}
+			if err := c.client.DeleteFile(ctx, tableName, file.Name); err != nil {
+				return err
+			}
+			removed++
+		}
+
+		for _, userID := range users {
+			files, err := c.client.ListUserFiles(ctx, tableName, userID, true)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				if !file.ModifiedAt.Before(keepAfter) {
+					continue
+				}
+				if err := c.client.DeleteUserFile(ctx, tableName, userID, file.Name); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+	}
+
+	if removed > 0 {
+		level.Info(util_log.Logger).Log("msg", fmt.Sprintf("removed %d consumed source files kept for longer than %s", removed, c.keepFor))
+	}
+	return nil
+}
@@ -6,13 +6,11 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/pkg/errors"
 
-	"github.com/grafana/loki/pkg/chunkenc"
 	"github.com/grafana/loki/pkg/storage/chunk/client/util"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor/retention"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/index"
@@ -24,6 +22,8 @@ type IndexSet interface {
 	GetTableName() string
 	ListSourceFiles() []storage.IndexFile
 	GetSourceFile(indexFile storage.IndexFile) (string, error)
+	// GetLogger returns the logger for the index set, which includes the table name and, for user index sets, the user id,
+	// for correlating the log lines of tables compacted concurrently.
 	GetLogger() log.Logger
 	GetWorkingDir() string
 	// SetCompactedIndex sets the CompactedIndex for upload/applying retention and making the compactor remove the source files.
@@ -63,27 +63,33 @@ type indexSet struct {
 	compactedIndex CompactedIndex
 	sourceObjects  []storage.IndexFile
 	logger         log.Logger
+
+	// removedSourceFiles are the names of the source files removed from the storage by done.
+	removedSourceFiles []string
+
+	readLimiter          *sourceFileReadLimiter
+	maxDecompressedBytes int64
 }
 
 // newUserIndexSet intializes a new index set for user index.
-func newUserIndexSet(ctx context.Context, tableName, userID string, baseUserIndexSet storage.IndexSet, workingDir string, logger log.Logger) (*indexSet, error) {
+func newUserIndexSet(ctx context.Context, tableName, userID string, baseUserIndexSet storage.IndexSet, workingDir string, logger log.Logger, readLimiter *sourceFileReadLimiter, maxDecompressedBytes int64) (*indexSet, error) {
 	if !baseUserIndexSet.IsUserBasedIndexSet() {
 		return nil, fmt.Errorf("base index set is not for user index")
 	}
 
-	return newIndexSet(ctx, tableName, userID, baseUserIndexSet, workingDir, log.With(logger, "user-id", userID))
+	return newIndexSet(ctx, tableName, userID, baseUserIndexSet, workingDir, logger, readLimiter, maxDecompressedBytes)
 }
 
 // newCommonIndexSet intializes a new index set for common index.
-func newCommonIndexSet(ctx context.Context, tableName string, baseUserIndexSet storage.IndexSet, workingDir string, logger log.Logger) (*indexSet, error) {
+func newCommonIndexSet(ctx context.Context, tableName string, baseUserIndexSet storage.IndexSet, workingDir string, logger log.Logger, readLimiter *sourceFileReadLimiter, maxDecompressedBytes int64) (*indexSet, error) {
 	if baseUserIndexSet.IsUserBasedIndexSet() {
 		return nil, fmt.Errorf("base index set is not for common index")
 	}
 
-	return newIndexSet(ctx, tableName, "", baseUserIndexSet, workingDir, logger)
+	return newIndexSet(ctx, tableName, "", baseUserIndexSet, workingDir, logger, readLimiter, maxDecompressedBytes)
 }
 
-func newIndexSet(ctx context.Context, tableName, userID string, baseIndexSet storage.IndexSet, workingDir string, logger log.Logger) (*indexSet, error) {
+func newIndexSet(ctx context.Context, tableName, userID string, baseIndexSet storage.IndexSet, workingDir string, logger log.Logger, readLimiter *sourceFileReadLimiter, maxDecompressedBytes int64) (*indexSet, error) {
 	if err := util.EnsureDirectory(workingDir); err != nil {
 		return nil, err
 	}
@@ -95,6 +101,9 @@ func newIndexSet(ctx context.Context, tableName, userID string, baseIndexSet sto
 		workingDir:   workingDir,
 		baseIndexSet: baseIndexSet,
 		logger:       logger,
+		readLimiter:  readLimiter,
+
+		maxDecompressedBytes: maxDecompressedBytes,
 	}
 
 	if userID != "" {
@@ -123,14 +132,18 @@ func (is *indexSet) ListSourceFiles() []storage.IndexFile {
 }
 
 func (is *indexSet) GetSourceFile(indexFile storage.IndexFile) (string, error) {
+	if err := is.readLimiter.wait(is.ctx); err != nil {
+		return "", err
+	}
+
 	decompress := storage.IsCompressedFile(indexFile.Name)
 	dst := filepath.Join(is.workingDir, indexFile.Name)
 	if decompress {
-		dst = strings.Trim(dst, gzipExtension)
+		dst = storage.DecompressedFileName(dst)
 	}
 
-	err := storage.DownloadFileFromStorage(dst, storage.IsCompressedFile(indexFile.Name),
-		false, storage.LoggerWithFilename(is.logger, indexFile.Name),
+	err := storage.DownloadFileFromStorageWithLimit(dst, storage.IsCompressedFile(indexFile.Name),
+		false, is.maxDecompressedBytes, indexFile.Size, storage.LoggerWithFilename(is.logger, indexFile.Name),
 		func() (io.ReadCloser, error) {
 			return is.baseIndexSet.GetFile(is.ctx, is.tableName, is.userID, indexFile.Name)
 		})
@@ -182,8 +195,8 @@ func (is *indexSet) runRetention(tableMarker retention.TableMarker) error {
 	return nil
 }
 
-// upload uploads the compacted index in compressed format.
-func (is *indexSet) upload() error {
+// upload uploads the compacted index in the format of the given uploadCompression.
+func (is *indexSet) upload(uploadCompression *uploadCompression) error {
 	if is.compactedIndex == nil {
 		return errors.New("can't upload nil or empty compacted index")
 	}
@@ -229,8 +242,11 @@ func (is *indexSet) upload() error {
 		}
 	}()
 
-	compressedWriter := chunkenc.Gzip.GetWriter(f)
-	defer chunkenc.Gzip.PutWriter(compressedWriter)
+	compressedWriter, releaseWriter, err := uploadCompression.getWriter(f)
+	if err != nil {
+		return err
+	}
+	defer releaseWriter()
 
 	idxReader, err := idx.Reader()
 	if err != nil {
@@ -242,7 +258,7 @@ func (is *indexSet) upload() error {
 		return err
 	}
 
-	_, err = io.Copy(compressedWriter, idxReader)
+	uncompressedBytes, err := io.Copy(compressedWriter, idxReader)
 	if err != nil {
 		return err
 	}
@@ -257,22 +273,35 @@ func (is *indexSet) upload() error {
 		return err
 	}
 
+	compressedBytes, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
 	if _, err := f.Seek(0, 0); err != nil {
 		return err
 	}
 
-	return is.baseIndexSet.PutFile(is.ctx, is.tableName, is.userID, fmt.Sprintf("%s.gz", fileName), f)
+	if err := is.baseIndexSet.PutFile(is.ctx, is.tableName, is.userID, fileName+uploadCompression.extension(), f); err != nil {
+		return err
+	}
+	uploadCompression.observe(uncompressedBytes, compressedBytes)
+	return nil
 }
 
-// removeFilesFromStorage deletes source objects from storage.
-func (is *indexSet) removeFilesFromStorage() error {
+// removeFilesFromStorage deletes source objects from storage, after keeping a copy of them with consumedSourceFiles if configured.
+func (is *indexSet) removeFilesFromStorage(consumedSourceFiles *consumedSourceFiles) error {
 	level.Info(is.logger).Log("msg", "removing source db files from storage", "count", len(is.sourceObjects))
 
 	for _, object := range is.sourceObjects {
+		if err := consumedSourceFiles.keep(is.ctx, is, object.Name); err != nil {
+			return err
+		}
+
 		err := is.baseIndexSet.DeleteFile(is.ctx, is.tableName, is.userID, object.Name)
 		if err != nil {
 			return err
 		}
+		is.removedSourceFiles = append(is.removedSourceFiles, object.Name)
 	}
 
 	return nil
@@ -281,16 +310,16 @@ func (is *indexSet) removeFilesFromStorage() error {
 // done takes care of file operations which includes:
 // - recreate the compacted db if required.
 // - upload the compacted db if required.
-// - remove the source objects from storage if required.
-func (is *indexSet) done() error {
+// - remove the source objects from storage if required, keeping them with the given consumedSourceFiles.
+func (is *indexSet) done(consumedSourceFiles *consumedSourceFiles, uploadCompression *uploadCompression) error {
 	if is.uploadCompactedDB {
-		if err := is.upload(); err != nil {
+		if err := is.upload(uploadCompression); err != nil {
 			return err
 		}
 	}
 
 	if is.removeSourceObjects {
-		return is.removeFilesFromStorage()
+		return is.removeFilesFromStorage(consumedSourceFiles)
 	}
 
 	return nil
@@ -16,6 +16,9 @@ type metrics struct {
 	compactTablesOperationLastSuccess     prometheus.Gauge
 	applyRetentionLastSuccess             prometheus.Gauge
 	compactorRunning                      prometheus.Gauge
+	uploadedIndexUncompressedBytes        *prometheus.CounterVec
+	uploadedIndexCompressedBytes          *prometheus.CounterVec
+	sourceFileReadLimiterWaitSeconds      prometheus.Counter
 }
 
 func newMetrics(r prometheus.Registerer) *metrics {
@@ -45,6 +48,21 @@ func newMetrics(r prometheus.Registerer) *metrics {
 			Name:      "compactor_running",
 			Help:      "Value will be 1 if compactor is currently running on this instance",
 		}),
+		uploadedIndexUncompressedBytes: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compactor_uploaded_index_uncompressed_bytes_total",
+			Help:      "Total size of the compacted index files uploaded by the compactor before compression, by compression",
+		}, []string{"compression"}),
+		uploadedIndexCompressedBytes: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compactor_uploaded_index_compressed_bytes_total",
+			Help:      "Total size of the compacted index files uploaded by the compactor after compression, by compression",
+		}, []string{"compression"}),
+		sourceFileReadLimiterWaitSeconds: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compactor_source_file_read_limiter_wait_seconds_total",
+			Help:      "Total time (in seconds) spent waiting on the rate limit of downloads of index files for compacting tables",
+		}),
 	}
 
 	return &m
@@ -0,0 +1,74 @@
+package compactor
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// SourceFileReadLimiter limits the rate of downloads of source files from the shared store while compacting tables, like for not
+// throttling the ingesters sharing the object store with the compactor. Wait blocks until the next download is allowed, and returns
+// an error when the context is done first. It must be safe for concurrent use, which is the case for *rate.Limiter.
+type SourceFileReadLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// validateSourceFileReadRateLimit verifies the limit configured with Config.SourceFileReadRateLimit and Config.SourceFileReadBurst.
+func validateSourceFileReadRateLimit(limit float64, burst int) error {
+	if limit < 0 {
+		return errors.New("source file read rate limit must be >= 0")
+	}
+	if limit > 0 && burst < 1 {
+		return errors.New("source file read burst must be >= 1 when source file read rate limit is set")
+	}
+	return nil
+}
+
+// newSourceFileReadRateLimiter returns the limiter for the given number of downloads per second with the given burst, or nil for no limit.
+func newSourceFileReadRateLimiter(limit float64, burst int) SourceFileReadLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// sourceFileReadLimiter waits for the SourceFileReadLimiter of the compactor before each download of a source file, and records the
+// time spent waiting on it. A nil sourceFileReadLimiter does not limit downloads.
+type sourceFileReadLimiter struct {
+	limiter SourceFileReadLimiter
+	metrics *metrics
+}
+
+func newSourceFileReadLimiter(limiter SourceFileReadLimiter, metrics *metrics) *sourceFileReadLimiter {
+	if limiter == nil {
+		return nil
+	}
+
+	return &sourceFileReadLimiter{
+		limiter: limiter,
+		metrics: metrics,
+	}
+}
+
+// wait blocks until the next download of a source file is allowed or the context is done.
+func (l *sourceFileReadLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	start := time.Now()
+	err := l.limiter.Wait(ctx)
+	if l.metrics != nil {
+		l.metrics.sourceFileReadLimiterWaitSeconds.Add(time.Since(start).Seconds())
+	}
+	return err
+}
+
+// SetSourceFileReadLimiter replaces the limiter of the downloads of source files built from Config.SourceFileReadRateLimit, like for
+// sharing a limiter with other processes reading from the shared store. A nil limiter removes the limit. It must be called before
+// the compactor gets started.
+func (c *Compactor) SetSourceFileReadLimiter(limiter SourceFileReadLimiter) {
+	c.sourceFileReadLimiter = newSourceFileReadLimiter(limiter, c.metrics)
+}
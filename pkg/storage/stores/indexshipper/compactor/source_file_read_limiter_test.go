@@ -0,0 +1,88 @@
+package compactor
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+type countingReadLimiter struct {
+	waits atomic.Int64
+}
+
+func (l *countingReadLimiter) Wait(_ context.Context) error {
+	l.waits.Inc()
+	return nil
+}
+
+func TestValidateSourceFileReadRateLimit(t *testing.T) {
+	require.NoError(t, validateSourceFileReadRateLimit(0, 0))
+	require.NoError(t, validateSourceFileReadRateLimit(10, 1))
+	require.EqualError(t, validateSourceFileReadRateLimit(-1, 1), "source file read rate limit must be >= 0")
+	require.EqualError(t, validateSourceFileReadRateLimit(10, 0), "source file read burst must be >= 1 when source file read rate limit is set")
+
+	require.Nil(t, newSourceFileReadRateLimiter(0, 1))
+	require.NotNil(t, newSourceFileReadRateLimiter(10, 1))
+}
+
+func TestSourceFileReadLimiter_Wait(t *testing.T) {
+	// no limit by default.
+	var limiter *sourceFileReadLimiter
+	require.NoError(t, limiter.wait(context.Background()))
+	require.Nil(t, newSourceFileReadLimiter(nil, nil))
+
+	metrics := newMetrics(nil)
+	limiter = newSourceFileReadLimiter(newSourceFileReadRateLimiter(20, 1), metrics)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.wait(context.Background()))
+	}
+	// the first download uses the burst, and the following ones wait for 50ms each.
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	require.Greater(t, prom_testutil.ToFloat64(metrics.sourceFileReadLimiterWaitSeconds), 0.09)
+
+	// waiting respects cancellation of the context.
+	limiter = newSourceFileReadLimiter(newSourceFileReadRateLimiter(0.001, 1), metrics)
+	require.NoError(t, limiter.wait(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, limiter.wait(ctx))
+}
+
+func TestTable_SourceFileReadLimiter(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	tablePathInStorage := filepath.Join(objectStoragePath, tableName)
+	tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+	commonDBsConfig := IndexesConfig{NumUnCompactedFiles: 5}
+	perUserDBsConfig := PerUserIndexesConfig{
+		IndexesConfig: IndexesConfig{NumUnCompactedFiles: 5},
+		NumUsers:      2,
+	}
+	SetupTable(t, tablePathInStorage, commonDBsConfig, perUserDBsConfig)
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+	commonIndexFiles, _, err := storage.NewIndexStorageClient(objectClient, "").ListFiles(context.Background(), tableName, false)
+	require.NoError(t, err)
+
+	limiter := &countingReadLimiter{}
+	table, err := newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
+		newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, nil, nil, newSourceFileReadLimiter(limiter, newMetrics(nil)), 0)
+	require.NoError(t, err)
+	require.NoError(t, table.compact(false))
+
+	// each source file downloaded by the table compactor, which only reads the common index, waits for the limiter.
+	require.Equal(t, int64(len(commonIndexFiles)), limiter.waits.Load())
+	verifyCompactedIndexTable(t, commonDBsConfig, perUserDBsConfig, tablePathInStorage)
+}
@@ -19,10 +19,6 @@ import (
 	util_log "github.com/grafana/loki/pkg/util/log"
 )
 
-const (
-	gzipExtension = ".gz"
-)
-
 var errRetentionFileCountNotOne = fmt.Errorf("can't apply retention when index file count is not one")
 
 type tableExpirationChecker interface {
@@ -67,6 +63,20 @@ type TableCompactor interface {
 
 type MakeEmptyUserIndexSetFunc func(userID string) (IndexSet, error)
 
+// TableCompactionObserver can be implemented by an IndexCompactor for getting notified once the compaction of each of its tables is over,
+// with the names of the source files removed from the storage keyed by user id, with an empty user id for the common index,
+// and the error the compaction of the table failed with. Only the files actually removed are reported, so some of them could
+// have been removed before the compaction of the table failed.
+type TableCompactionObserver interface {
+	TableCompactionDone(tableName string, removedSourceFiles map[string][]string, err error)
+}
+
+// DryRunIndexCompactor can be implemented by an IndexCompactor for compacting tables in dry run mode, in which retention
+// is not applied and the index sets are not finalized, so the storage is left untouched.
+type DryRunIndexCompactor interface {
+	DryRun() bool
+}
+
 type table struct {
 	name               string
 	workingDirectory   string
@@ -77,6 +87,15 @@ type table struct {
 	expirationChecker  tableExpirationChecker
 	periodConfig       config.PeriodConfig
 
+	// consumedSourceFiles keeps the source files removed from the storage as per Config.KeepConsumedSourceFilesFor.
+	consumedSourceFiles *consumedSourceFiles
+	// uploadCompression compresses the compacted index files uploaded to the storage as per Config.UploadCompression.
+	uploadCompression *uploadCompression
+	// sourceFileReadLimiter limits the rate of downloads of source files as per Config.SourceFileReadRateLimit.
+	sourceFileReadLimiter *sourceFileReadLimiter
+	// maxDecompressedBytes limits the size of the source files after decompressing them as per Config.MaxDecompressedSourceFileSize.
+	maxDecompressedBytes int64
+
 	baseUserIndexSet, baseCommonIndexSet storage.IndexSet
 
 	indexSets             map[string]*indexSet
@@ -89,7 +108,8 @@ type table struct {
 func newTable(ctx context.Context, workingDirectory string, indexStorageClient storage.Client,
 	indexCompactor IndexCompactor, periodConfig config.PeriodConfig,
 	tableMarker retention.TableMarker, expirationChecker tableExpirationChecker,
-	uploadConcurrency int,
+	uploadConcurrency int, consumedSourceFiles *consumedSourceFiles, uploadCompression *uploadCompression,
+	sourceFileReadLimiter *sourceFileReadLimiter, maxDecompressedBytes int64,
 ) (*table, error) {
 	err := chunk_util.EnsureDirectory(workingDirectory)
 	if err != nil {
@@ -109,13 +129,19 @@ func newTable(ctx context.Context, workingDirectory string, indexStorageClient s
 		baseUserIndexSet:   storage.NewIndexSet(indexStorageClient, true),
 		baseCommonIndexSet: storage.NewIndexSet(indexStorageClient, false),
 		uploadConcurrency:  uploadConcurrency,
+
+		consumedSourceFiles: consumedSourceFiles,
+		uploadCompression:   uploadCompression,
+
+		sourceFileReadLimiter: sourceFileReadLimiter,
+		maxDecompressedBytes:  maxDecompressedBytes,
 	}
 	table.logger = log.With(util_log.Logger, "table-name", table.name)
 
 	return &table, nil
 }
 
-func (t *table) compact(applyRetention bool) error {
+func (t *table) compact(applyRetention bool) (err error) {
 	indexFiles, usersWithPerUserIndex, err := t.indexStorageClient.ListFiles(t.ctx, t.name, false)
 	if err != nil {
 		return err
@@ -131,6 +157,10 @@ func (t *table) compact(applyRetention bool) error {
 	level.Info(t.logger).Log("msg", "listed files", "count", len(indexFiles))
 
 	defer func() {
+		if observer, ok := t.indexCompactor.(TableCompactionObserver); ok {
+			observer.TableCompactionDone(t.name, t.removedSourceFiles(), err)
+		}
+
 		for _, is := range t.indexSets {
 			is.cleanup()
 		}
@@ -140,7 +170,7 @@ func (t *table) compact(applyRetention bool) error {
 		}
 	}()
 
-	t.indexSets[""], err = newCommonIndexSet(t.ctx, t.name, t.baseCommonIndexSet, t.workingDirectory, t.logger)
+	t.indexSets[""], err = newCommonIndexSet(t.ctx, t.name, t.baseCommonIndexSet, t.workingDirectory, t.logger, t.sourceFileReadLimiter, t.maxDecompressedBytes)
 	if err != nil {
 		return err
 	}
@@ -150,7 +180,7 @@ func (t *table) compact(applyRetention bool) error {
 
 	for _, userID := range t.usersWithPerUserIndex {
 		var err error
-		t.indexSets[userID], err = newUserIndexSet(t.ctx, t.name, userID, t.baseUserIndexSet, filepath.Join(t.workingDirectory, userID), t.logger)
+		t.indexSets[userID], err = newUserIndexSet(t.ctx, t.name, userID, t.baseUserIndexSet, filepath.Join(t.workingDirectory, userID), t.logger, t.sourceFileReadLimiter, t.maxDecompressedBytes)
 		if err != nil {
 			return err
 		}
@@ -164,7 +194,7 @@ func (t *table) compact(applyRetention bool) error {
 		defer indexSetsMtx.Unlock()
 
 		var err error
-		t.indexSets[userID], err = newUserIndexSet(t.ctx, t.name, userID, t.baseUserIndexSet, filepath.Join(t.workingDirectory, userID), t.logger)
+		t.indexSets[userID], err = newUserIndexSet(t.ctx, t.name, userID, t.baseUserIndexSet, filepath.Join(t.workingDirectory, userID), t.logger, t.sourceFileReadLimiter, t.maxDecompressedBytes)
 		return t.indexSets[userID], err
 	}, t.periodConfig)
 
@@ -173,6 +203,11 @@ func (t *table) compact(applyRetention bool) error {
 		return err
 	}
 
+	if dryRunCompactor, ok := t.indexCompactor.(DryRunIndexCompactor); ok && dryRunCompactor.DryRun() {
+		level.Info(t.logger).Log("msg", "dry run, not applying retention and leaving the storage untouched")
+		return nil
+	}
+
 	if applyRetention {
 		err := t.applyRetention()
 		if err != nil {
@@ -198,14 +233,14 @@ func (t *table) done() error {
 	}
 
 	err := concurrency.ForEachJob(t.ctx, len(userIDs), t.uploadConcurrency, func(ctx context.Context, idx int) error {
-		return t.indexSets[userIDs[idx]].done()
+		return t.indexSets[userIDs[idx]].done(t.consumedSourceFiles, t.uploadCompression)
 	})
 	if err != nil {
 		return err
 	}
 
 	if commonIndexSet, ok := t.indexSets[""]; ok {
-		if err := commonIndexSet.done(); err != nil {
+		if err := commonIndexSet.done(t.consumedSourceFiles, t.uploadCompression); err != nil {
 			return err
 		}
 	}
@@ -213,6 +248,17 @@ func (t *table) done() error {
 	return nil
 }
 
+// removedSourceFiles returns the names of the source files removed from the storage by the index sets, keyed by user id.
+func (t *table) removedSourceFiles() map[string][]string {
+	removed := map[string][]string{}
+	for userID, is := range t.indexSets {
+		if len(is.removedSourceFiles) > 0 {
+			removed[userID] = is.removedSourceFiles
+		}
+	}
+	return removed
+}
+
 // applyRetention applies retention on the index sets
 func (t *table) applyRetention() error {
 	tableInterval := retention.ExtractIntervalFromTableName(t.name)
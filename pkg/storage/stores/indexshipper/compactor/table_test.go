@@ -2,11 +2,13 @@ package compactor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/common/model"
@@ -199,7 +201,7 @@ func TestTable_Compaction(t *testing.T) {
 					require.NoError(t, err)
 
 					table, err := newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
-						newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10)
+						newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, nil, nil, nil, 0)
 					require.NoError(t, err)
 
 					require.NoError(t, table.compact(false))
@@ -236,7 +238,7 @@ func TestTable_Compaction(t *testing.T) {
 
 					// running compaction again should not do anything.
 					table, err = newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
-						newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10)
+						newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, nil, nil, nil, 0)
 					require.NoError(t, err)
 
 					require.NoError(t, table.compact(false))
@@ -379,7 +381,7 @@ func TestTable_CompactionRetention(t *testing.T) {
 					newTestIndexCompactor(), config.PeriodConfig{},
 					tt.tableMarker, IntervalMayHaveExpiredChunksFunc(func(interval model.Interval, userID string) bool {
 						return true
-					}), 10)
+					}), 10, nil, nil, nil, 0)
 				require.NoError(t, err)
 
 				require.NoError(t, table.compact(true))
@@ -452,7 +454,7 @@ func TestTable_CompactionFailure(t *testing.T) {
 	require.NoError(t, err)
 
 	table, err := newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
-		newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10)
+		newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, nil, nil, nil, 0)
 	require.NoError(t, err)
 
 	// compaction should fail due to a non-boltdb file.
@@ -470,10 +472,231 @@ func TestTable_CompactionFailure(t *testing.T) {
 	require.NoError(t, os.Remove(filepath.Join(tablePathInStorage, "fail.gz")))
 
 	table, err = newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
-		newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10)
+		newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, nil, nil, nil, 0)
 	require.NoError(t, err)
 	require.NoError(t, table.compact(false))
 
 	// ensure that we have cleanup the local working directory after successful compaction.
 	require.NoFileExists(t, tableWorkingDirectory)
 }
+
+func TestIndexSet_Logger(t *testing.T) {
+	tempDir := t.TempDir()
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: filepath.Join(tempDir, objectsStorageDirName)})
+	require.NoError(t, err)
+	indexStorageClient := storage.NewIndexStorageClient(objectClient, "")
+
+	var buf strings.Builder
+	tableLogger := log.With(log.NewLogfmtLogger(&buf), "table-name", tableName)
+
+	commonIndexSet, err := newCommonIndexSet(context.Background(), tableName, storage.NewIndexSet(indexStorageClient, false), filepath.Join(tempDir, workingDirName), tableLogger, nil, 0)
+	require.NoError(t, err)
+	userIndexSet, err := newUserIndexSet(context.Background(), tableName, "user1", storage.NewIndexSet(indexStorageClient, true), filepath.Join(tempDir, workingDirName, "user1"), tableLogger, nil, 0)
+	require.NoError(t, err)
+
+	commonIndexSet.GetLogger().Log("msg", "common")
+	userIndexSet.GetLogger().Log("msg", "user")
+	require.Equal(t, "table-name=test msg=common\ntable-name=test user-id=user1 msg=user\n", buf.String())
+}
+
+func TestTable_KeepConsumedSourceFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	tablePathInStorage := filepath.Join(objectStoragePath, "index", tableName)
+	consumedTablePath := filepath.Join(objectStoragePath, "consumed", "index", tableName)
+	tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+	numUsers := 2
+	SetupTable(t, tablePathInStorage, IndexesConfig{NumCompactedFiles: 2}, PerUserIndexesConfig{
+		IndexesConfig: IndexesConfig{NumCompactedFiles: 2},
+		NumUsers:      numUsers,
+	})
+	sourceFiles := map[string][]byte{}
+	require.NoError(t, filepath.WalkDir(tablePathInStorage, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(tablePathInStorage, path)
+		require.NoError(t, err)
+		sourceFiles[rel] = readFile(t, path)
+		return nil
+	}))
+	require.Len(t, sourceFiles, 2+2*numUsers)
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+	consumedSourceFiles := newConsumedSourceFiles(objectClient, "index/", time.Hour)
+
+	table, err := newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, "index/"),
+		newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, consumedSourceFiles, nil, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, table.compact(false))
+
+	// the source files removed from the table are kept as is under the consumed prefix.
+	for rel, content := range sourceFiles {
+		require.NoFileExists(t, filepath.Join(tablePathInStorage, rel))
+		require.Equal(t, content, readFile(t, filepath.Join(consumedTablePath, rel)))
+	}
+
+	// only the files kept for longer than the grace period get removed.
+	require.NoError(t, consumedSourceFiles.sweep(context.Background()))
+	for rel := range sourceFiles {
+		require.FileExists(t, filepath.Join(consumedTablePath, rel))
+	}
+
+	consumedSourceFiles.now = func() time.Time {
+		return time.Now().Add(2 * time.Hour)
+	}
+	require.NoError(t, consumedSourceFiles.sweep(context.Background()))
+	for rel := range sourceFiles {
+		require.NoFileExists(t, filepath.Join(consumedTablePath, rel))
+	}
+}
+
+type observingIndexCompactor struct {
+	testIndexCompactor
+	tableName          string
+	removedSourceFiles map[string][]string
+	err                error
+}
+
+func (o *observingIndexCompactor) TableCompactionDone(tableName string, removedSourceFiles map[string][]string, err error) {
+	o.tableName = tableName
+	o.removedSourceFiles = removedSourceFiles
+	o.err = err
+}
+
+// failingDeleteStorageClient fails the removal of the given common index file.
+type failingDeleteStorageClient struct {
+	storage.Client
+	failFile string
+}
+
+func (c failingDeleteStorageClient) DeleteFile(ctx context.Context, tableName, fileName string) error {
+	if fileName == c.failFile {
+		return errors.New("failed to delete file")
+	}
+	return c.Client.DeleteFile(ctx, tableName, fileName)
+}
+
+func TestTable_TableCompactionObserver(t *testing.T) {
+	for _, failRemoval := range []bool{false, true} {
+		t.Run(fmt.Sprintf("failRemoval=%v", failRemoval), func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			tablePathInStorage := filepath.Join(objectStoragePath, tableName)
+			tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+			numUsers := 2
+			SetupTable(t, tablePathInStorage, IndexesConfig{NumCompactedFiles: 2}, PerUserIndexesConfig{
+				IndexesConfig: IndexesConfig{NumCompactedFiles: 2},
+				NumUsers:      numUsers,
+			})
+			sourceFiles := map[string][]string{}
+			require.NoError(t, filepath.WalkDir(tablePathInStorage, func(path string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(tablePathInStorage, path)
+				require.NoError(t, err)
+				userID := filepath.Dir(rel)
+				if userID == "." {
+					userID = ""
+				}
+				sourceFiles[userID] = append(sourceFiles[userID], filepath.Base(rel))
+				return nil
+			}))
+			require.Len(t, sourceFiles, 1+numUsers)
+
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+			storageClient := storage.NewIndexStorageClient(objectClient, "")
+			if failRemoval {
+				// the common index is finalized last, so the files of the users still get removed.
+				storageClient = failingDeleteStorageClient{Client: storageClient, failFile: sourceFiles[""][0]}
+			}
+
+			indexCompactor := &observingIndexCompactor{}
+			table, err := newTable(context.Background(), tableWorkingDirectory, storageClient,
+				indexCompactor, config.PeriodConfig{}, nil, nil, 10, nil, nil, nil, 0)
+			require.NoError(t, err)
+
+			err = table.compact(false)
+			require.Equal(t, tableName, indexCompactor.tableName)
+			require.Equal(t, err, indexCompactor.err)
+			if !failRemoval {
+				require.NoError(t, err)
+				for userID, files := range indexCompactor.removedSourceFiles {
+					require.ElementsMatch(t, sourceFiles[userID], files)
+				}
+				require.Len(t, indexCompactor.removedSourceFiles, len(sourceFiles))
+				return
+			}
+
+			require.Error(t, err)
+			require.Len(t, indexCompactor.removedSourceFiles, len(sourceFiles)-1)
+			for userID, files := range indexCompactor.removedSourceFiles {
+				require.NotEqual(t, "", userID)
+				require.ElementsMatch(t, sourceFiles[userID], files)
+				for _, file := range files {
+					require.NoFileExists(t, filepath.Join(tablePathInStorage, userID, file))
+				}
+			}
+			// the common index file failing to be removed stays in the storage and is not reported.
+			require.FileExists(t, filepath.Join(tablePathInStorage, sourceFiles[""][0]))
+		})
+	}
+}
+
+type dryRunIndexCompactor struct {
+	testIndexCompactor
+}
+
+func (dryRunIndexCompactor) DryRun() bool {
+	return true
+}
+
+func TestTable_DryRun(t *testing.T) {
+	tempDir := t.TempDir()
+	tableName := fmt.Sprintf("%s12345", tableName)
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	tablePathInStorage := filepath.Join(objectStoragePath, tableName)
+	tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+	SetupTable(t, tablePathInStorage, IndexesConfig{NumUnCompactedFiles: 3, NumCompactedFiles: 1}, PerUserIndexesConfig{
+		IndexesConfig: IndexesConfig{NumCompactedFiles: 1},
+		NumUsers:      2,
+	})
+	readStorage := func() map[string][]byte {
+		files := map[string][]byte{}
+		require.NoError(t, filepath.WalkDir(objectStoragePath, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			files[path] = readFile(t, path)
+			return nil
+		}))
+		return files
+	}
+	sourceFiles := readStorage()
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	marked := false
+	table, err := newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
+		dryRunIndexCompactor{}, config.PeriodConfig{},
+		TableMarkerFunc(func(ctx context.Context, tableName, userID string, indexFile retention.IndexProcessor, logger log.Logger) (bool, bool, error) {
+			marked = true
+			return true, true, nil
+		}), IntervalMayHaveExpiredChunksFunc(func(interval model.Interval, userID string) bool {
+			return true
+		}), 10, nil, nil, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, table.compact(true))
+
+	// neither retention got applied nor the compacted files got uploaded, and the source files are left in the storage.
+	require.False(t, marked)
+	require.Equal(t, sourceFiles, readStorage())
+	require.NoFileExists(t, tableWorkingDirectory)
+}
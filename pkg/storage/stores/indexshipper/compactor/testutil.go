@@ -22,6 +22,7 @@ import (
 	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor/retention"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/index"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
 	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
 )
 
@@ -415,6 +416,12 @@ func readFile(t *testing.T, path string) []byte {
 		decompressedFilePath := filepath.Join(tempDir, "decompressed")
 		testutil.DecompressFile(t, path, decompressedFilePath)
 		path = decompressedFilePath
+	} else if strings.HasSuffix(path, storage.ZstdExtension) {
+		decompressedFilePath := filepath.Join(t.TempDir(), "decompressed")
+		require.NoError(t, storage.DownloadFileFromStorage(decompressedFilePath, true, false, log.NewNopLogger(), func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}))
+		path = decompressedFilePath
 	}
 
 	fileContent, err := os.ReadFile(path)
@@ -0,0 +1,107 @@
+package compactor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/grafana/loki/pkg/chunkenc"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+const (
+	uploadCompressionGzip = "gzip"
+	uploadCompressionZstd = "zstd"
+
+	maxGzipCompressionLevel = gzip.BestCompression
+	maxZstdCompressionLevel = 22
+)
+
+// validateUploadCompression verifies the compression and its level configured with Config.UploadCompression and Config.UploadCompressionLevel.
+func validateUploadCompression(compression string, level int) error {
+	switch compression {
+	case uploadCompressionGzip:
+		if level < 0 || level > maxGzipCompressionLevel {
+			return fmt.Errorf("upload compression level must be between 1 and %d for gzip, or 0 for the default level", maxGzipCompressionLevel)
+		}
+	case uploadCompressionZstd:
+		if level < 0 || level > maxZstdCompressionLevel {
+			return fmt.Errorf("upload compression level must be between 1 and %d for zstd, or 0 for the default level", maxZstdCompressionLevel)
+		}
+	default:
+		return errors.New("upload compression must be either gzip or zstd")
+	}
+
+	return nil
+}
+
+// uploadCompression compresses the compacted index files uploaded to the storage as per Config.UploadCompression, and records their
+// sizes before and after compression. A nil uploadCompression compresses with gzip at its default level without recording the sizes.
+type uploadCompression struct {
+	compression string
+	level       int
+	metrics     *metrics
+}
+
+func newUploadCompression(compression string, level int, metrics *metrics) *uploadCompression {
+	return &uploadCompression{
+		compression: compression,
+		level:       level,
+		metrics:     metrics,
+	}
+}
+
+// extension returns the extension added to the name of the uploaded index files.
+func (c *uploadCompression) extension() string {
+	if c != nil && c.compression == uploadCompressionZstd {
+		return storage.ZstdExtension
+	}
+	return storage.GzipExtension
+}
+
+// getWriter returns a writer compressing to dst, and a function releasing it once it got closed.
+// Writers for the default level of the compression are pooled.
+func (c *uploadCompression) getWriter(dst io.Writer) (io.WriteCloser, func(), error) {
+	if c == nil {
+		return pooledWriter(&chunkenc.Gzip, dst)
+	}
+
+	switch c.compression {
+	case uploadCompressionZstd:
+		if c.level == 0 {
+			return pooledWriter(&chunkenc.Zstd, dst)
+		}
+		w, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		if err != nil {
+			return nil, nil, err
+		}
+		return w, func() {}, nil
+	default:
+		if c.level == 0 {
+			return pooledWriter(&chunkenc.Gzip, dst)
+		}
+		w, err := gzip.NewWriterLevel(dst, c.level)
+		if err != nil {
+			return nil, nil, err
+		}
+		return w, func() {}, nil
+	}
+}
+
+func pooledWriter(pool chunkenc.WriterPool, dst io.Writer) (io.WriteCloser, func(), error) {
+	w := pool.GetWriter(dst)
+	return w, func() { pool.PutWriter(w) }, nil
+}
+
+// observe records the size of an uploaded index file before and after compression.
+func (c *uploadCompression) observe(uncompressedBytes, compressedBytes int64) {
+	if c == nil || c.metrics == nil {
+		return
+	}
+
+	c.metrics.uploadedIndexUncompressedBytes.WithLabelValues(c.compression).Add(float64(uncompressedBytes))
+	c.metrics.uploadedIndexCompressedBytes.WithLabelValues(c.compression).Add(float64(compressedBytes))
+}
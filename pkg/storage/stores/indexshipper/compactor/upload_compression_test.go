@@ -0,0 +1,94 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+func TestValidateUploadCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		level       int
+		expectedErr string
+	}{
+		{compression: uploadCompressionGzip},
+		{compression: uploadCompressionGzip, level: 9},
+		{compression: uploadCompressionGzip, level: 10, expectedErr: "upload compression level must be between 1 and 9 for gzip, or 0 for the default level"},
+		{compression: uploadCompressionZstd, level: 22},
+		{compression: uploadCompressionZstd, level: -1, expectedErr: "upload compression level must be between 1 and 22 for zstd, or 0 for the default level"},
+		{compression: "snappy", expectedErr: "upload compression must be either gzip or zstd"},
+	} {
+		err := validateUploadCompression(tc.compression, tc.level)
+		if tc.expectedErr == "" {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, tc.expectedErr)
+		}
+	}
+}
+
+func TestTable_UploadCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression       string
+		level             int
+		expectedExtension string
+	}{
+		{compression: uploadCompressionGzip, expectedExtension: storage.GzipExtension},
+		{compression: uploadCompressionGzip, level: 9, expectedExtension: storage.GzipExtension},
+		{compression: uploadCompressionZstd, expectedExtension: storage.ZstdExtension},
+		{compression: uploadCompressionZstd, level: 19, expectedExtension: storage.ZstdExtension},
+	} {
+		t.Run(fmt.Sprintf("%s-level-%d", tc.compression, tc.level), func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			tablePathInStorage := filepath.Join(objectStoragePath, tableName)
+			tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+			commonDBsConfig := IndexesConfig{NumUnCompactedFiles: 5}
+			perUserDBsConfig := PerUserIndexesConfig{
+				IndexesConfig: IndexesConfig{NumUnCompactedFiles: 5},
+				NumUsers:      2,
+			}
+			SetupTable(t, tablePathInStorage, commonDBsConfig, perUserDBsConfig)
+
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+
+			metrics := newMetrics(nil)
+			table, err := newTable(context.Background(), tableWorkingDirectory, storage.NewIndexStorageClient(objectClient, ""),
+				newTestIndexCompactor(), config.PeriodConfig{}, nil, nil, 10, nil, newUploadCompression(tc.compression, tc.level, metrics), nil, 0)
+			require.NoError(t, err)
+			require.NoError(t, table.compact(false))
+
+			// the uploaded files get the extension of the compression and can be read back.
+			var uncompressedBytes, compressedBytes int
+			validateTable(t, tablePathInStorage, 1, 2, func(filename string) {
+				require.True(t, strings.HasSuffix(filename, tc.expectedExtension), filename)
+			})
+			require.NoError(t, filepath.WalkDir(tablePathInStorage, func(path string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				uncompressedBytes += len(readFile(t, path))
+				info, err := d.Info()
+				compressedBytes += int(info.Size())
+				return err
+			}))
+			verifyCompactedIndexTable(t, commonDBsConfig, perUserDBsConfig, tablePathInStorage)
+
+			require.Equal(t, float64(uncompressedBytes), prom_testutil.ToFloat64(metrics.uploadedIndexUncompressedBytes.WithLabelValues(tc.compression)))
+			require.Equal(t, float64(compressedBytes), prom_testutil.ToFloat64(metrics.uploadedIndexCompressedBytes.WithLabelValues(tc.compression)))
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
@@ -24,7 +23,6 @@ import (
 )
 
 const (
-	gzipExtension  = ".gz"
 	maxSyncRetries = 1
 )
 
@@ -297,7 +295,7 @@ func (t *indexSet) sync(ctx context.Context, lock, bypassListCache bool) (err er
 		return err
 	}
 
-	level.Debug(t.logger).Log("msg", fmt.Sprintf("updates for table %s. toDownload: %s, toDelete: %s", t.tableName, toDownload, toDelete))
+	level.Debug(t.logger).Log("msg", fmt.Sprintf("updates for table %s. toDownload: %v, toDelete: %s", t.tableName, toDownload, toDelete))
 
 	downloadedFiles, err := t.doConcurrentDownload(ctx, toDownload)
 	if err != nil {
@@ -361,7 +359,7 @@ func (t *indexSet) checkStorageForUpdates(ctx context.Context, lock, bypassListC
 	}
 
 	for _, file := range files {
-		normalized := strings.TrimSuffix(file.Name, gzipExtension)
+		normalized := storage.DecompressedFileName(file.Name)
 		listedDBs[normalized] = struct{}{}
 
 		// Checking whether file was already downloaded, if not, download it.
@@ -389,7 +387,7 @@ func (t *indexSet) downloadFileFromStorage(ctx context.Context, fileName, folder
 	decompress := storage.IsCompressedFile(fileName)
 	dst := filepath.Join(folderPathForTable, fileName)
 	if decompress {
-		dst = strings.Trim(dst, gzipExtension)
+		dst = storage.DecompressedFileName(dst)
 	}
 	return filepath.Base(dst), storage.DownloadFileFromStorage(
 		dst,
@@ -46,6 +46,8 @@ type indexStorageClient struct {
 type IndexFile struct {
 	Name       string
 	ModifiedAt time.Time
+	// Size is the size of the file in the storage in bytes, 0 when not reported by the object store.
+	Size int64
 }
 
 func NewIndexStorageClient(origObjectClient client.ObjectClient, storagePrefix string) Client {
@@ -89,6 +91,7 @@ func (s *indexStorageClient) ListFiles(ctx context.Context, tableName string, by
 		files = append(files, IndexFile{
 			Name:       path.Base(object.Key),
 			ModifiedAt: object.ModifiedAt,
+			Size:       object.Size,
 		})
 	}
 
@@ -118,6 +121,7 @@ func (s *indexStorageClient) ListUserFiles(ctx context.Context, tableName, userI
 		files = append(files, IndexFile{
 			Name:       path.Base(object.Key),
 			ModifiedAt: object.ModifiedAt,
+			Size:       object.Size,
 		})
 	}
 
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -11,11 +13,33 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 )
 
+const (
+	// GzipExtension is the extension of index files compressed with gzip.
+	GzipExtension = ".gz"
+	// ZstdExtension is the extension of index files compressed with zstd.
+	ZstdExtension = ".zst"
+
+	// CompressionGzip and CompressionZstd are the compressions of index files detected by DetectCompression.
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ErrDecompressedSizeLimitExceeded is returned when an index file decompresses beyond the limit of its decompressed size.
+var ErrDecompressedSizeLimitExceeded = errors.New("decompressed size limit exceeded")
+
+// ErrFileSizeMismatch is returned when the size of a downloaded file does not match the size listed by the object store,
+// like with a truncated download not surfaced as an error.
+var ErrFileSizeMismatch = errors.New("downloaded file size does not match the listed size")
+
 var (
 	gzipReader = sync.Pool{}
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
 // getGzipReader gets or creates a new CompressionReader and reset it to read from src
@@ -44,6 +68,16 @@ type GetFileFunc func() (io.ReadCloser, error)
 
 // DownloadFileFromStorage downloads a file from storage to given location.
 func DownloadFileFromStorage(destination string, decompressFile bool, sync bool, logger log.Logger, getFileFunc GetFileFunc) error {
+	return DownloadFileFromStorageWithLimit(destination, decompressFile, sync, 0, 0, logger, getFileFunc)
+}
+
+// DownloadFileFromStorageWithLimit downloads a file from storage to given location like DownloadFileFromStorage, failing with an error
+// wrapping ErrDecompressedSizeLimitExceeded once a decompressed file gets larger than maxDecompressedBytes, like for gzip bombs.
+// The decompressed size is not limited when maxDecompressedBytes is not positive.
+// When expectedSize is positive, the bytes of the file read from the storage, before decompressing them, are compared with it and
+// an error wrapping ErrFileSizeMismatch is returned on a mismatch, after removing the downloaded file. The mismatch takes precedence
+// over failing to decompress the file since a truncated compressed file fails to decompress as well.
+func DownloadFileFromStorageWithLimit(destination string, decompressFile bool, sync bool, maxDecompressedBytes, expectedSize int64, logger log.Logger, getFileFunc GetFileFunc) (err error) {
 	start := time.Now()
 	readCloser, err := getFileFunc()
 	if err != nil {
@@ -61,24 +95,49 @@ func DownloadFileFromStorage(destination string, decompressFile bool, sync bool,
 		return err
 	}
 
+	defer func() {
+		if !errors.Is(err, ErrFileSizeMismatch) {
+			return
+		}
+		if removeErr := os.Remove(destination); removeErr != nil {
+			level.Error(logger).Log("msg", "failed to remove downloaded file with mismatching size", "file", destination, "err", removeErr)
+		}
+	}()
 	defer func() {
 		if err := f.Close(); err != nil {
 			level.Warn(logger).Log("msg", "failed to close file", "file", destination)
 		}
 	}()
-	var objectReader io.Reader = readCloser
+
+	objectReader := &countingReader{r: readCloser}
+	// verifySize replaces the given error with ErrFileSizeMismatch when the size of the file in the storage does not match expectedSize.
+	verifySize := func(err error) error {
+		if expectedSize <= 0 {
+			return err
+		}
+		// read what is left of the file, like after failing to decompress it, for comparing the whole size of the file.
+		if _, drainErr := io.Copy(io.Discard, objectReader); drainErr != nil && err == nil {
+			return drainErr
+		}
+		if objectReader.n != expectedSize {
+			return fmt.Errorf("%w: downloaded %d bytes, listed %d bytes", ErrFileSizeMismatch, objectReader.n, expectedSize)
+		}
+		return err
+	}
+
+	var reader io.Reader = objectReader
 	if decompressFile {
-		decompressedReader, err := getGzipReader(readCloser)
+		decompressedReader, release, err := NewDecompressedReader(objectReader)
 		if err != nil {
-			return err
+			return verifySize(err)
 		}
-		defer putGzipReader(decompressedReader)
+		defer release()
 
-		objectReader = decompressedReader
+		reader = NewDecompressedSizeLimitReader(decompressedReader, maxDecompressedBytes)
 	}
 
-	_, err = io.Copy(f, objectReader)
-	if err != nil {
+	_, err = io.Copy(f, reader)
+	if err := verifySize(err); err != nil {
 		return err
 	}
 
@@ -89,8 +148,91 @@ func DownloadFileFromStorage(destination string, decompressFile bool, sync bool,
 	return nil
 }
 
+// DetectCompression returns the compression of the content starting with the given header as per its magic number, which is either
+// CompressionGzip or CompressionZstd, or an empty string for content compressed with neither of them.
+func DetectCompression(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return CompressionZstd
+	}
+
+	return ""
+}
+
+// NewDecompressedReader returns a reader decompressing src, detecting zstd from its magic number and assuming gzip otherwise,
+// and a function releasing the reader once done with it.
+func NewDecompressedReader(src io.Reader) (io.Reader, func(), error) {
+	bufReader := bufio.NewReader(src)
+	header, err := bufReader.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	if DetectCompression(header) == CompressionZstd {
+		zstdReader, err := zstd.NewReader(bufReader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zstdReader, zstdReader.Close, nil
+	}
+
+	gzipReader, err := getGzipReader(bufReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gzipReader, func() { putGzipReader(gzipReader) }, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewDecompressedSizeLimitReader returns a reader of the decompressed content read from r which fails with an error wrapping
+// ErrDecompressedSizeLimitExceeded once more than maxBytes got read, without reading more than one byte past it from r.
+// The reader is returned as is when maxBytes is not positive.
+func NewDecompressedSizeLimitReader(r io.Reader, maxBytes int64) io.Reader {
+	if maxBytes <= 0 {
+		return r
+	}
+	return &decompressedSizeLimitReader{r: io.LimitReader(r, maxBytes+1), maxBytes: maxBytes}
+}
+
+type decompressedSizeLimitReader struct {
+	r        io.Reader
+	maxBytes int64
+	read     int64
+}
+
+func (l *decompressedSizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.maxBytes {
+		return n - int(l.read-l.maxBytes), fmt.Errorf("%w: decompressed to more than %d bytes", ErrDecompressedSizeLimitExceeded, l.maxBytes)
+	}
+	return n, err
+}
+
+// IsCompressedFile returns true if the given file name has the extension of an index file compressed with gzip or zstd.
 func IsCompressedFile(filename string) bool {
-	return strings.HasSuffix(filename, ".gz")
+	return strings.HasSuffix(filename, GzipExtension) || strings.HasSuffix(filename, ZstdExtension)
+}
+
+// DecompressedFileName returns the given file name without the extension of the compression of the index file, if any.
+func DecompressedFileName(filename string) string {
+	if strings.HasSuffix(filename, ZstdExtension) {
+		return strings.TrimSuffix(filename, ZstdExtension)
+	}
+	return strings.TrimSuffix(filename, GzipExtension)
 }
 
 func LoggerWithFilename(logger log.Logger, filename string) log.Logger {
@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/stretchr/testify/require"
 
@@ -55,6 +57,125 @@ func Test_GetFileFromStorage(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Equal(t, testData, b)
+
+	// compress the file in storage with zstd
+	zstdFile, err := os.Create(filepath.Join(tempDir, tableName, "src.zst"))
+	require.NoError(t, err)
+	zstdWriter, err := zstd.NewWriter(zstdFile)
+	require.NoError(t, err)
+	_, err = zstdWriter.Write(testData)
+	require.NoError(t, err)
+	require.NoError(t, zstdWriter.Close())
+	require.NoError(t, zstdFile.Close())
+
+	// get the zstd compressed file from storage
+	require.NoError(t, DownloadFileFromStorage(filepath.Join(tempDir, "dest.zst"), true,
+		false, util_log.Logger, func() (io.ReadCloser, error) {
+			return indexStorageClient.GetFile(context.Background(), tableName, "src.zst")
+		}))
+
+	// verify the contents of the downloaded zst file.
+	b, err = os.ReadFile(filepath.Join(tempDir, "dest.zst"))
+	require.NoError(t, err)
+
+	require.Equal(t, testData, b)
+}
+
+func TestDecompressedFileName(t *testing.T) {
+	require.True(t, IsCompressedFile("db1.gz"))
+	require.True(t, IsCompressedFile("db1.zst"))
+	require.False(t, IsCompressedFile("db1"))
+
+	require.Equal(t, "db1", DecompressedFileName("db1.gz"))
+	require.Equal(t, "db1", DecompressedFileName("db1.zst"))
+	require.Equal(t, "db1", DecompressedFileName("db1"))
+}
+
+func TestDetectCompression(t *testing.T) {
+	var gzipped, zstded bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err := gzipWriter.Write([]byte("test data"))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+	zstdWriter, err := zstd.NewWriter(&zstded)
+	require.NoError(t, err)
+	_, err = zstdWriter.Write([]byte("test data"))
+	require.NoError(t, err)
+	require.NoError(t, zstdWriter.Close())
+
+	require.Equal(t, CompressionGzip, DetectCompression(gzipped.Bytes()))
+	require.Equal(t, CompressionZstd, DetectCompression(zstded.Bytes()))
+	require.Equal(t, "", DetectCompression([]byte("db1")))
+	require.Equal(t, "", DetectCompression(nil))
+}
+
+func TestDownloadFileFromStorageWithLimit(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// a highly compressible file like a gzip bomb.
+	testData := bytes.Repeat([]byte{0}, 1<<20)
+	tableName := "test-table"
+	require.NoError(t, util.EnsureDirectory(filepath.Join(tempDir, tableName)))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, tableName, "src"), testData, 0o666))
+	compressFile(t, filepath.Join(tempDir, tableName, "src"), filepath.Join(tempDir, tableName, "src.gz"), false)
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: tempDir})
+	require.NoError(t, err)
+	indexStorageClient := NewIndexStorageClient(objectClient, "")
+	download := func(maxDecompressedBytes int64) error {
+		return DownloadFileFromStorageWithLimit(filepath.Join(tempDir, "dest"), true, false, maxDecompressedBytes, 0, util_log.Logger, func() (io.ReadCloser, error) {
+			return indexStorageClient.GetFile(context.Background(), tableName, "src.gz")
+		})
+	}
+
+	// no limit by default and files up to the limit are downloaded.
+	require.NoError(t, download(0))
+	require.NoError(t, download(int64(len(testData))))
+	b, err := os.ReadFile(filepath.Join(tempDir, "dest"))
+	require.NoError(t, err)
+	require.Equal(t, testData, b)
+
+	// the download is aborted once the file decompresses beyond the limit, without writing more than the limit.
+	err = download(int64(len(testData)) - 1)
+	require.ErrorIs(t, err, ErrDecompressedSizeLimitExceeded)
+	fi, err := os.Stat(filepath.Join(tempDir, "dest"))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(testData))-1, fi.Size())
+}
+
+func TestDownloadFileFromStorageWithExpectedSize(t *testing.T) {
+	tempDir := t.TempDir()
+	testData := []byte("test data of a file compressed with gzip")
+	tableName := "test-table"
+	require.NoError(t, util.EnsureDirectory(filepath.Join(tempDir, tableName)))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, tableName, "src"), testData, 0o666))
+	compressFile(t, filepath.Join(tempDir, tableName, "src"), filepath.Join(tempDir, tableName, "src.gz"), false)
+	fi, err := os.Stat(filepath.Join(tempDir, tableName, "src.gz"))
+	require.NoError(t, err)
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: tempDir})
+	require.NoError(t, err)
+	indexStorageClient := NewIndexStorageClient(objectClient, "")
+	dest := filepath.Join(tempDir, "dest")
+	download := func(expectedSize int64) error {
+		return DownloadFileFromStorageWithLimit(dest, true, false, 0, expectedSize, util_log.Logger, func() (io.ReadCloser, error) {
+			return indexStorageClient.GetFile(context.Background(), tableName, "src.gz")
+		})
+	}
+
+	// the compressed size is compared with the expected size, not the decompressed one.
+	require.NoError(t, download(fi.Size()))
+	b, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, testData, b)
+
+	require.ErrorIs(t, download(fi.Size()+1), ErrFileSizeMismatch)
+	require.NoFileExists(t, dest)
+
+	// a truncated compressed file is reported as a size mismatch rather than failing to decompress it.
+	require.NoError(t, os.Truncate(filepath.Join(tempDir, tableName, "src.gz"), fi.Size()/2))
+	require.ErrorIs(t, download(fi.Size()), ErrFileSizeMismatch)
+	require.NoFileExists(t, dest)
 }
 
 func compressFile(t *testing.T, src, dest string, sync bool) {
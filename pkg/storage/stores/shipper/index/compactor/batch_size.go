@@ -0,0 +1,63 @@
+package compactor
+
+// batchSizer decides when a batch of index entries read from a source file is full as per Options.BatchSize and Options.AdaptiveBatchBytes.
+// It is not safe for concurrent use, each read file gets its own batchSizer.
+type batchSizer struct {
+	maxEntries int
+	maxBytes   int64
+
+	// entries and bytes seen so far for computing the average size of entries.
+	seenEntries, seenBytes int64
+	batchBytes             int64
+}
+
+func (o Options) newBatchSizer() *batchSizer {
+	s := &batchSizer{maxEntries: o.BatchSize, maxBytes: o.AdaptiveBatchBytes}
+	if s.maxEntries == 0 {
+		s.maxEntries = defaultBatchSize
+	}
+
+	return s
+}
+
+// limit returns the number of entries after which the current batch is full.
+// With adaptive sizing, it is the number of entries of average size fitting in maxBytes, capped at maxEntries.
+func (s *batchSizer) limit() int {
+	if s.maxBytes <= 0 || s.seenEntries == 0 {
+		return s.maxEntries
+	}
+
+	avgEntrySize := s.seenBytes / s.seenEntries
+	if avgEntrySize == 0 {
+		return s.maxEntries
+	}
+
+	limit := s.maxBytes / avgEntrySize
+	if limit < 1 {
+		return 1
+	}
+	if limit < int64(s.maxEntries) {
+		return int(limit)
+	}
+
+	return s.maxEntries
+}
+
+// add records an entry added to the current batch and returns true if the batch is full.
+func (s *batchSizer) add(batchLen int, entry indexEntry) bool {
+	entrySize := int64(len(entry.k) + len(entry.v))
+	s.seenEntries++
+	s.seenBytes += entrySize
+	s.batchBytes += entrySize
+
+	if s.maxBytes > 0 && s.batchBytes >= s.maxBytes {
+		return true
+	}
+
+	return batchLen >= s.limit()
+}
+
+// reset starts a new batch.
+func (s *batchSizer) reset() {
+	s.batchBytes = 0
+}
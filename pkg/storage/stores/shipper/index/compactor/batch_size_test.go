@@ -0,0 +1,89 @@
+package compactor
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+func TestReadFile_BatchSize(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		opts               Options
+		valueSizes         []int
+		expectedBatchSizes []int
+	}{
+		{
+			name:               "default batch size",
+			valueSizes:         repeatValueSize(90, 103),
+			expectedBatchSizes: []int{103},
+		},
+		{
+			name:               "configured batch size",
+			opts:               Options{BatchSize: 25},
+			valueSizes:         repeatValueSize(90, 103),
+			expectedBatchSizes: []int{25, 25, 25, 25, 3},
+		},
+		{
+			name:               "adaptive batch size",
+			opts:               Options{AdaptiveBatchBytes: 1000},
+			valueSizes:         repeatValueSize(90, 103),
+			expectedBatchSizes: []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 3},
+		},
+		{
+			name:               "adaptive batch size capped by configured batch size",
+			opts:               Options{BatchSize: 5, AdaptiveBatchBytes: 1000},
+			valueSizes:         repeatValueSize(90, 13),
+			expectedBatchSizes: []int{5, 5, 3},
+		},
+		{
+			name:               "adaptive batch size capped by batch bytes",
+			opts:               Options{AdaptiveBatchBytes: 1000},
+			valueSizes:         append(repeatValueSize(90, 5), 990, 990, 90),
+			expectedBatchSizes: []int{6, 1, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "db")
+			db, err := openBoltdbFileWithNoSync(dbPath)
+			require.NoError(t, err)
+			defer db.Close()
+
+			// entries have 10 byte keys for making them add up to 100 bytes with values of 90 bytes.
+			require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+				b, err := tx.CreateBucket(local.IndexBucketName)
+				if err != nil {
+					return err
+				}
+				for i, valueSize := range tc.valueSizes {
+					if err := b.Put([]byte(fmt.Sprintf("%010d", i)), []byte(strings.Repeat("v", valueSize))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+
+			var batchSizes []int
+			require.NoError(t, readFile(util_log.Logger, downloadedDb{path: dbPath, db: db}, tc.opts.newBatchSizer(), func(_ string, batch []indexEntry) error {
+				batchSizes = append(batchSizes, len(batch))
+				return nil
+			}))
+			require.Equal(t, tc.expectedBatchSizes, batchSizes)
+		})
+	}
+}
+
+func repeatValueSize(valueSize, n int) []int {
+	valueSizes := make([]int, n)
+	for i := range valueSizes {
+		valueSizes[i] = valueSize
+	}
+	return valueSizes
+}
@@ -0,0 +1,60 @@
+package compactor
+
+import (
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+// observeBoltStats logs the bbolt stats of the compacted file of the given CompactedIndex of a user, or of the common index for an empty
+// user id, at debug level and records its page counts, for understanding why some tables produce bloated files and how much recreating them
+// helps. The stats are taken while the compacted file is still open, before its index set uploads and closes it. The transaction stats only
+// cover the transactions since the compacted file got opened, which is since it got recreated for recreated files.
+func (t *tableCompactor) observeBoltStats(logger log.Logger, userID string, compactedIndex compactor.CompactedIndex) error {
+	c, ok := compactedIndex.(*CompactedIndex)
+	if !ok || c == nil {
+		return nil
+	}
+
+	var size int64
+	if err := c.compactedFile.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	pageSize := int64(c.compactedFile.Info().PageSize)
+	pages := size / pageSize
+	stats := c.compactedFile.Stats()
+
+	format := indexFormatPerUser
+	if userID == "" {
+		format = indexFormatCommon
+	}
+	t.metrics.compactTablesCompactedFilePages.WithLabelValues(format).Set(float64(pages))
+	t.metrics.compactTablesCompactedFileFreePages.WithLabelValues(format).Set(float64(stats.FreePageN + stats.PendingPageN))
+
+	level.Debug(logger).Log(
+		"msg", "bolt stats of compacted file",
+		"size", size,
+		"page_size", pageSize,
+		"pages", pages,
+		"free_pages", stats.FreePageN,
+		"pending_pages", stats.PendingPageN,
+		"free_alloc", stats.FreeAlloc,
+		"freelist_inuse", stats.FreelistInuse,
+		"page_allocs", stats.TxStats.PageCount,
+		"node_allocs", stats.TxStats.NodeCount,
+		"rebalances", stats.TxStats.Rebalance,
+		"rebalance_time", stats.TxStats.RebalanceTime,
+		"splits", stats.TxStats.Split,
+		"spills", stats.TxStats.Spill,
+		"spill_time", stats.TxStats.SpillTime,
+		"writes", stats.TxStats.Write,
+		"write_time", stats.TxStats.WriteTime,
+	)
+	return nil
+}
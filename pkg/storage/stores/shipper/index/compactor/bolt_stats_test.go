@@ -0,0 +1,50 @@
+package compactor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-kit/log"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_BoltStats(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 5,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: 2,
+	}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	// page counts are recorded for both common and per user index.
+	require.Equal(t, 2, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesCompactedFilePages))
+	require.Equal(t, 2, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesCompactedFileFreePages))
+
+	compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+	var size int64
+	require.NoError(t, compactedIndex.compactedFile.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}))
+	expectedPages := size / int64(compactedIndex.compactedFile.Info().PageSize)
+	require.Equal(t, float64(expectedPages), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesCompactedFilePages.WithLabelValues(indexFormatCommon)))
+
+	// the stats get logged while the compacted file is still open.
+	var buf bytes.Buffer
+	require.NoError(t, tCompactor.observeBoltStats(log.NewLogfmtLogger(&buf), "", compactedIndex))
+	require.Contains(t, buf.String(), `msg="bolt stats of compacted file"`)
+	require.Contains(t, buf.String(), "free_pages=")
+	require.Contains(t, buf.String(), "splits=")
+
+	// nothing is recorded for index sets left without a compacted index.
+	require.NoError(t, tCompactor.observeBoltStats(log.NewNopLogger(), "", nil))
+}
@@ -0,0 +1,110 @@
+package compactor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// maxLoggedRoutedBuckets is the maximum number of bucket names and users listed per source file by Options.LogBucketRouting,
+// for not logging huge lines with thousands of tenants.
+const maxLoggedRoutedBuckets = 20
+
+// bucketRouting accumulates the distinct bucket names of a source file of the common index and the number of entries routed to each
+// user while merging it, for logging them at debug level as per Options.LogBucketRouting. A nil bucketRouting records nothing.
+// It is safe for concurrent use.
+type bucketRouting struct {
+	mtx           sync.Mutex
+	buckets       map[string]struct{}
+	routedEntries map[string]int
+	commonEntries int
+}
+
+// newBucketRouting returns a bucketRouting for a source file of the common index, or nil when Options.LogBucketRouting is not set.
+func (t *tableCompactor) newBucketRouting() *bucketRouting {
+	if !t.opts.LogBucketRouting {
+		return nil
+	}
+
+	return &bucketRouting{
+		buckets:       map[string]struct{}{},
+		routedEntries: map[string]int{},
+	}
+}
+
+// addBucket records a bucket name read from the source file.
+func (r *bucketRouting) addBucket(bucketName string) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.buckets[bucketName] = struct{}{}
+}
+
+// route records entries routed to the index of the given user, or kept in the common index for an empty user id.
+func (r *bucketRouting) route(userID string, entries int) {
+	if r == nil || entries == 0 {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if userID == "" {
+		r.commonEntries += entries
+		return
+	}
+	r.routedEntries[userID] += entries
+}
+
+// log logs the bucket names and the entries routed per user for the given source file once it got merged.
+func (r *bucketRouting) log(logger log.Logger, fileName string) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	buckets := make([]string, 0, len(r.buckets))
+	for bucketName := range r.buckets {
+		buckets = append(buckets, bucketName)
+	}
+	sort.Strings(buckets)
+
+	users := make([]string, 0, len(r.routedEntries))
+	for userID := range r.routedEntries {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+
+	routed := make([]string, 0, maxLoggedRoutedBuckets)
+	for _, userID := range firstRoutedBuckets(users) {
+		routed = append(routed, fmt.Sprintf("%s=%d", userID, r.routedEntries[userID]))
+	}
+
+	level.Debug(logger).Log(
+		"msg", "routed entries of common index source file",
+		"file", fileName,
+		"num_buckets", len(buckets),
+		"buckets", strings.Join(firstRoutedBuckets(buckets), ","),
+		"common_entries", r.commonEntries,
+		"num_users", len(users),
+		"routed_entries", strings.Join(routed, ","),
+	)
+}
+
+// firstRoutedBuckets returns up to maxLoggedRoutedBuckets of the given sorted names.
+func firstRoutedBuckets(names []string) []string {
+	if len(names) > maxLoggedRoutedBuckets {
+		return names[:maxLoggedRoutedBuckets]
+	}
+	return names
+}
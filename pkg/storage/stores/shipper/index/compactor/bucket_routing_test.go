@@ -0,0 +1,60 @@
+package compactor
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestBucketRouting(t *testing.T) {
+	var routing *bucketRouting
+	routing.addBucket("user1")
+	routing.route("user1", 10)
+	routing.log(log.NewNopLogger(), "file")
+
+	routing = &bucketRouting{buckets: map[string]struct{}{}, routedEntries: map[string]int{}}
+	routing.addBucket("index")
+	routing.addBucket("user2")
+	routing.addBucket("user1")
+	routing.route("", 5)
+	routing.route("user1", 10)
+	routing.route("user1", 2)
+	routing.route("user2", 3)
+
+	var buf bytes.Buffer
+	routing.log(log.NewLogfmtLogger(&buf), "file1")
+	require.Equal(t, `level=debug msg="routed entries of common index source file" file=file1 num_buckets=3 buckets=index,user1,user2 common_entries=5 num_users=2 routed_entries="user1=12,user2=3"`+"\n", buf.String())
+
+	// the number of listed bucket names and users is capped.
+	routing = &bucketRouting{buckets: map[string]struct{}{}, routedEntries: map[string]int{}}
+	for i := 0; i < 2*maxLoggedRoutedBuckets; i++ {
+		routing.addBucket(fmt.Sprintf("user%03d", i))
+		routing.route(fmt.Sprintf("user%03d", i), 1)
+	}
+	buf.Reset()
+	routing.log(log.NewLogfmtLogger(&buf), "file2")
+	require.Contains(t, buf.String(), fmt.Sprintf("num_buckets=%d ", 2*maxLoggedRoutedBuckets))
+	require.Contains(t, buf.String(), fmt.Sprintf("user%03d=1\"\n", maxLoggedRoutedBuckets-1))
+	require.NotContains(t, buf.String(), fmt.Sprintf("user%03d", maxLoggedRoutedBuckets))
+}
+
+func TestTable_LogBucketRouting(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: 3,
+	}, Options{LogBucketRouting: true})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NotNil(t, tCompactor.newBucketRouting())
+	require.NoError(t, tCompactor.CompactTable())
+	require.Len(t, tCompactor.userCompactedIndexSet.all(), 3)
+}
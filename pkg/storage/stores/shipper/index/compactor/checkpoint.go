@@ -0,0 +1,211 @@
+package compactor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// checkpointFileName is the name of the file in the working dir of the common index recording the checkpoint of merging its source files.
+const checkpointFileName = "compaction-checkpoint.json"
+
+// compactionCheckpoint records the source files of the common index of a table merged so far and the compacted files they got merged into,
+// for resuming the compaction of the table with the files left in its working dir after the compactor process got killed.
+// It is only advisory: it is discarded for compacting the table from scratch whenever it does not match the source files anymore.
+type compactionCheckpoint struct {
+	// CompactedFile is the path of the compacted file of the common index.
+	CompactedFile string `json:"compacted_file"`
+	// UserCompactedFiles are the paths of the compacted files of the users getting entries from the common index, by user id.
+	UserCompactedFiles map[string]string `json:"user_compacted_files,omitempty"`
+	// ConsumedFiles are the names of the source files of the common index which got completely merged into the compacted files.
+	ConsumedFiles []string `json:"consumed_files"`
+	// SourceFiles are the names of all the source files of the common index when its compaction started.
+	SourceFiles []string `json:"source_files,omitempty"`
+
+	consumed map[string]struct{}
+}
+
+// isConsumed returns true if the given source file was merged before the checkpoint. A nil checkpoint has no consumed files.
+func (c *compactionCheckpoint) isConsumed(name string) bool {
+	if c == nil {
+		return false
+	}
+
+	_, ok := c.consumed[name]
+	return ok
+}
+
+// resumeCheckpoint loads the checkpoint left in the working dir of the common index as per Options.CheckpointEveryNFiles and reopens
+// the compacted files of the users recorded in it. It returns nil for compacting the table from scratch when there is no checkpoint,
+// or when it does not match the given source files since the previous compaction of the table, or retention, could have removed
+// source files after it.
+func (t *tableCompactor) resumeCheckpoint(idxSet compactor.IndexSet, sourceFiles []storage.IndexFile) (*compactionCheckpoint, error) {
+	if t.opts.CheckpointEveryNFiles <= 0 {
+		return nil, nil
+	}
+
+	checkpointPath := filepath.Join(idxSet.GetWorkingDir(), checkpointFileName)
+	data, err := os.ReadFile(checkpointPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	checkpoint := &compactionCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil || !checkpoint.matches(sourceFiles) {
+		level.Warn(idxSet.GetLogger()).Log("msg", "discarding checkpoint not matching the source files of the common index", "err", err)
+		return nil, os.Remove(checkpointPath)
+	}
+
+	for userID, path := range checkpoint.UserCompactedFiles {
+		userIndexSet, ok := t.existingUserIndexSet[userID]
+		if !ok {
+			userIndexSet, err = t.userIndexSetFactoryFunc(userID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		compactedFile, err := t.openCompactedDB(path)
+		if err != nil {
+			return nil, err
+		}
+		t.userCompactedIndexSet.set(userID, newCompactedIndexSet(userIndexSet, t.newCompactedIndex(compactedFile, userIndexSet)))
+	}
+
+	level.Info(idxSet.GetLogger()).Log("msg", "resuming compaction of common index from checkpoint", "consumed_files", len(checkpoint.ConsumedFiles))
+	return checkpoint, nil
+}
+
+// matches returns true if all the files recorded in the checkpoint still exist. Source files uploaded after the checkpoint do not
+// invalidate it since they get merged after resuming from it.
+func (c *compactionCheckpoint) matches(sourceFiles []storage.IndexFile) bool {
+	names := make(map[string]struct{}, len(sourceFiles))
+	for _, sourceFile := range sourceFiles {
+		names[sourceFile.Name] = struct{}{}
+	}
+
+	for _, name := range c.SourceFiles {
+		if _, ok := names[name]; !ok {
+			return false
+		}
+	}
+
+	c.consumed = make(map[string]struct{}, len(c.ConsumedFiles))
+	for _, name := range c.ConsumedFiles {
+		if _, ok := names[name]; !ok {
+			return false
+		}
+		c.consumed[name] = struct{}{}
+	}
+
+	if _, err := os.Stat(c.CompactedFile); err != nil {
+		return false
+	}
+	for _, path := range c.UserCompactedFiles {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkpointer writes a checkpoint after every Options.CheckpointEveryNFiles source files of the common index got merged.
+// Each batch of entries is committed to the compacted files once written, so entries of the files merged before a checkpoint are
+// kept in the compacted files. Files getting merged while writing a checkpoint are merged again after resuming from it, which is
+// safe since writing the same entries again leaves the compacted files unchanged. A nil checkpointer writes no checkpoints.
+type checkpointer struct {
+	t              *tableCompactor
+	checkpointPath string
+	compactedFile  string
+	sourceFiles    []string
+	everyNFiles    int
+
+	mtx            sync.Mutex
+	consumedFiles  []string
+	sinceLastWrite int
+}
+
+// newCheckpointer builds a checkpointer for the given source files of the common index being compacted into the given compacted file,
+// starting with the given consumed files, or returns nil when Options.CheckpointEveryNFiles is not configured.
+func (t *tableCompactor) newCheckpointer(idxSet compactor.IndexSet, sourceFiles []storage.IndexFile, compactedFile string, consumedFiles []string) *checkpointer {
+	if t.opts.CheckpointEveryNFiles <= 0 {
+		return nil
+	}
+
+	sourceFileNames := make([]string, 0, len(sourceFiles))
+	for _, sourceFile := range sourceFiles {
+		sourceFileNames = append(sourceFileNames, sourceFile.Name)
+	}
+
+	return &checkpointer{
+		t:              t,
+		checkpointPath: filepath.Join(idxSet.GetWorkingDir(), checkpointFileName),
+		compactedFile:  compactedFile,
+		sourceFiles:    sourceFileNames,
+		everyNFiles:    t.opts.CheckpointEveryNFiles,
+		consumedFiles:  consumedFiles,
+	}
+}
+
+// fileDone records a merged source file and writes a checkpoint once enough files got merged since the last one.
+func (c *checkpointer) fileDone(name string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.consumedFiles = append(c.consumedFiles, name)
+	c.sinceLastWrite++
+	if c.sinceLastWrite < c.everyNFiles {
+		return nil
+	}
+	c.sinceLastWrite = 0
+
+	checkpoint := compactionCheckpoint{
+		CompactedFile:      c.compactedFile,
+		UserCompactedFiles: map[string]string{},
+		ConsumedFiles:      c.consumedFiles,
+		SourceFiles:        c.sourceFiles,
+	}
+	for userID, userIndexSet := range c.t.userCompactedIndexSet.all() {
+		if userIndexSet.compactedIndex != nil {
+			checkpoint.UserCompactedFiles[userID] = userIndexSet.compactedIndex.compactedFile.Path()
+		}
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	// write the checkpoint to a temporary file first for not leaving a partially written checkpoint behind.
+	tmpPath := c.checkpointPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.checkpointPath)
+}
+
+// remove removes the checkpoint once all the source files got merged.
+func (c *checkpointer) remove() error {
+	if c == nil {
+		return nil
+	}
+
+	if err := os.Remove(c.checkpointPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
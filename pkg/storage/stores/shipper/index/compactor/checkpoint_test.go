@@ -0,0 +1,143 @@
+package compactor
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_ResumeFromCheckpoint(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	tablePathInStorage := filepath.Join(objectStoragePath, tableName)
+	tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+	// 5 source files of the common index, where the last 2 have per user buckets.
+	testutil.SetupTable(t, tablePathInStorage, testutil.DBsConfig{
+		NumUnCompactedDBs: 3,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   1,
+		},
+		NumUsers: 2,
+	})
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	// merge files one at a time in the order of their names and kill the compaction after merging 4 of them.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	killedCompactor := newTestTableCompactor(t, objectClient, tableWorkingDirectory, Options{
+		DeterministicOutput:   true,
+		CheckpointEveryNFiles: 2,
+		ProgressInterval:      time.Nanosecond,
+		ProgressCallback: func(_ string, done, _ int) {
+			if done == 4 {
+				cancel()
+			}
+		},
+	})
+	_, _, err = killedCompactor.compactCommonIndexes(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	for _, db := range killedCompactor.tempDBs.dbs {
+		require.NoError(t, db.Close())
+	}
+
+	data, err := os.ReadFile(filepath.Join(tableWorkingDirectory, checkpointFileName))
+	require.NoError(t, err)
+	var checkpoint compactionCheckpoint
+	require.NoError(t, json.Unmarshal(data, &checkpoint))
+	require.Equal(t, []string{"0", "1", "2", "per-user-bucket-db-0"}, checkpoint.ConsumedFiles)
+	require.Len(t, checkpoint.UserCompactedFiles, 2)
+	require.ElementsMatch(t, []string{"0", "1", "2", "per-user-bucket-db-0", "per-user-bucket-db-1"}, checkpoint.SourceFiles)
+
+	// resuming only merges the remaining file.
+	var totals []int
+	tCompactor := newTestTableCompactor(t, objectClient, tableWorkingDirectory, Options{
+		CheckpointEveryNFiles:       2,
+		VerifySourceFilesAccounting: true,
+		ProgressCallback: func(_ string, _, total int) {
+			totals = append(totals, total)
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, []int{1, 1}, totals)
+	require.NoFileExists(t, filepath.Join(tableWorkingDirectory, checkpointFileName))
+	compareCompactedTable(t, tablePathInStorage, tCompactor)
+}
+
+func TestTable_DiscardCheckpointNotMatchingSourceFiles(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{}, Options{CheckpointEveryNFiles: 1})
+	defer cleanupTableCompactor(tCompactor)
+
+	checkpointPath := filepath.Join(tCompactor.commonIndexSet.GetWorkingDir(), checkpointFileName)
+	data, err := json.Marshal(compactionCheckpoint{
+		CompactedFile: filepath.Join(tCompactor.commonIndexSet.GetWorkingDir(), "missing"),
+		ConsumedFiles: []string{"removed"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(checkpointPath, data, 0o644))
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.NoFileExists(t, checkpointPath)
+
+	records := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+	require.Len(t, records[string(local.IndexBucketName)], 200)
+}
+
+func TestCompactionCheckpoint_Matches(t *testing.T) {
+	compactedFile := filepath.Join(t.TempDir(), "compacted")
+	require.NoError(t, os.WriteFile(compactedFile, nil, 0o644))
+
+	sourceFiles := func(names ...string) []storage.IndexFile {
+		files := make([]storage.IndexFile, 0, len(names))
+		for _, name := range names {
+			files = append(files, storage.IndexFile{Name: name})
+		}
+		return files
+	}
+
+	for name, tc := range map[string]struct {
+		sourceFiles []storage.IndexFile
+		matches     bool
+	}{
+		"same source files": {
+			sourceFiles: sourceFiles("0", "1", "2"),
+			matches:     true,
+		},
+		"source file uploaded after the checkpoint": {
+			sourceFiles: sourceFiles("0", "1", "2", "3"),
+			matches:     true,
+		},
+		"consumed source file removed": {
+			sourceFiles: sourceFiles("1", "2"),
+		},
+		"source file not consumed yet removed": {
+			sourceFiles: sourceFiles("0", "1"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			checkpoint := compactionCheckpoint{
+				CompactedFile: compactedFile,
+				ConsumedFiles: []string{"0"},
+				SourceFiles:   []string{"0", "1", "2"},
+			}
+			require.Equal(t, tc.matches, checkpoint.matches(tc.sourceFiles))
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+// TableIndexSets holds the index sets of a table to compact with CompactTables, as passed to NewTableCompactor.
+type TableIndexSets struct {
+	CommonIndexSet          compactor.IndexSet
+	ExistingUserIndexSet    map[string]compactor.IndexSet
+	UserIndexSetFactoryFunc compactor.MakeEmptyUserIndexSetFunc
+	PeriodConfig            config.PeriodConfig
+}
+
+// TablesCompactor compacts multiple tables at the same time with a shared concurrency budget.
+// It is implemented by the IndexCompactor returned by NewIndexCompactor.
+type TablesCompactor interface {
+	// CompactTables compacts the given tables concurrently while downloading at most totalConcurrency source files at the same time
+	// across all of them, for a predictable resource usage instead of each table downloading up to 50 files at the same time.
+	// A failure to compact a table does not stop the compaction of the other tables. It returns the error of compacting each table,
+	// in the order of the tables, which is nil for the tables compacted successfully.
+	CompactTables(ctx context.Context, tables []TableIndexSets, totalConcurrency int) []error
+}
+
+func (i indexCompactor) CompactTables(ctx context.Context, tables []TableIndexSets, totalConcurrency int) []error {
+	downloads := newDownloadLimiter(totalConcurrency)
+	errs := make([]error, len(tables))
+
+	var wg sync.WaitGroup
+	for idx, table := range tables {
+		wg.Add(1)
+		go func(idx int, table TableIndexSets) {
+			defer wg.Done()
+
+			tCompactor := i.NewTableCompactor(ctx, table.CommonIndexSet, table.ExistingUserIndexSet, table.UserIndexSetFactoryFunc, table.PeriodConfig)
+			// the tables of the periods using another IndexCompactor do not share the budget.
+			if t, ok := tCompactor.(*tableCompactor); ok {
+				t.downloads = downloads
+			}
+			errs[idx] = tCompactor.CompactTable()
+		}(idx, table)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// downloadLimiter bounds the number of source files downloaded at the same time across the tables compacted with CompactTables.
+// A nil downloadLimiter does not limit downloads.
+type downloadLimiter struct {
+	sem *semaphore.Weighted
+}
+
+func newDownloadLimiter(size int) *downloadLimiter {
+	if size <= 0 {
+		return nil
+	}
+
+	return &downloadLimiter{sem: semaphore.NewWeighted(int64(size))}
+}
+
+// acquire blocks until a source file can be downloaded without exceeding the limit, or until the context is done.
+func (l *downloadLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	return l.sem.Acquire(ctx, 1)
+}
+
+// release gives back the slot taken with acquire once the download is done.
+func (l *downloadLimiter) release() {
+	if l != nil {
+		l.sem.Release(1)
+	}
+}
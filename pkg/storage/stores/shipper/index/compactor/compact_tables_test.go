@@ -0,0 +1,71 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// downloadCountingIndexSet records the maximum number of source files downloaded at the same time across the index sets sharing the counters.
+type downloadCountingIndexSet struct {
+	*latencyIndexSet
+	inFlight, maxInFlight *atomic.Int64
+
+	mtx            sync.Mutex
+	compactedIndex compactor.CompactedIndex
+}
+
+func (d *downloadCountingIndexSet) GetSourceFile(indexFile storage.IndexFile) (string, error) {
+	inFlight := d.inFlight.Inc()
+	defer d.inFlight.Dec()
+	for maxInFlight := d.maxInFlight.Load(); inFlight > maxInFlight && !d.maxInFlight.CAS(maxInFlight, inFlight); {
+		maxInFlight = d.maxInFlight.Load()
+	}
+
+	return d.latencyIndexSet.GetSourceFile(indexFile)
+}
+
+func (d *downloadCountingIndexSet) SetCompactedIndex(compactedIndex compactor.CompactedIndex, _ bool) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.compactedIndex = compactedIndex
+	return nil
+}
+
+func TestIndexCompactor_CompactTables(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int64
+	indexSets := make([]*downloadCountingIndexSet, 3)
+	tables := make([]TableIndexSets, len(indexSets))
+	for i := range indexSets {
+		indexSets[i] = &downloadCountingIndexSet{
+			latencyIndexSet: newLatencyIndexSet(t, 10, 10, 10*time.Millisecond),
+			inFlight:        &inFlight,
+			maxInFlight:     &maxInFlight,
+		}
+		tables[i] = TableIndexSets{CommonIndexSet: indexSets[i]}
+	}
+	// the failure of a table does not stop the compaction of the others.
+	indexSets[1].failSourceFile = "db-5"
+
+	errs := newTestIndexCompactor(t, Options{}).(TablesCompactor).CompactTables(context.Background(), tables, 4)
+	require.Len(t, errs, 3)
+	require.NoError(t, errs[0])
+	require.ErrorContains(t, errs[1], "failed to download db-5")
+	require.NoError(t, errs[2])
+	require.LessOrEqual(t, maxInFlight.Load(), int64(4))
+	require.Greater(t, maxInFlight.Load(), int64(1))
+
+	for _, i := range []int{0, 2} {
+		compactedIndex := indexSets[i].compactedIndex.(*CompactedIndex)
+		require.Len(t, readDB(t, compactedIndex.compactedFile)["index"], 100)
+		compactedIndex.Cleanup()
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/grafana/loki/pkg/storage/chunk"
 	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	chunk_util "github.com/grafana/loki/pkg/storage/chunk/client/util"
 	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor/retention"
 	shipper_index "github.com/grafana/loki/pkg/storage/stores/indexshipper/index"
@@ -30,6 +31,36 @@ type CompactedIndex struct {
 	logger                 log.Logger
 	periodConfig           config.PeriodConfig
 
+	// writeIntegrityMarker is set for storing an integrity marker in the file while converting it to an index file for upload.
+	writeIntegrityMarker bool
+	// recordSchemaVersion is set for storing the schema version of the period config in the file while converting it to an index file for upload.
+	recordSchemaVersion bool
+	// deterministicOutput is set for naming the index file for upload after the checksum of its content instead of time.
+	deterministicOutput bool
+	// contentHashInFileName is set for appending the hash of the bucket names and their number of entries to the name of the index file for upload.
+	contentHashInFileName bool
+	// syncRecreatedDB is set for syncing the db to disk on each commit while recreating it.
+	syncRecreatedDB bool
+	// uploaderName is the prefix of the name of the index file for upload.
+	uploaderName string
+	// verifyRecreatedDB is set for verifying the content of the recreated db against the old db before replacing it.
+	verifyRecreatedDB bool
+	// fillPercent is the fill percent of the pages of the buckets written to.
+	fillPercent float64
+	// now returns the current time for naming the recreated db and the index file for upload.
+	now func() time.Time
+	// openDBs tracks the compacted file as open until it gets closed or handed over for upload.
+	openDBs *openDBLimiter
+	// modified is set when buckets got deleted from the compacted file with DeleteBucket.
+	modified bool
+	// recreateSkipped is set when the recreation of the compacted file got skipped as per Options.RecreateMinReclaimableBytes,
+	// for naming the index file for upload like a recreated one.
+	recreateSkipped bool
+	// stagingDir is set for recreating the compacted file in it instead of the working dir as per Options.StagingDir.
+	stagingDir string
+	// splitPart is the position, starting from 1, of a compacted index split from another one with Split, for naming its index file apart.
+	splitPart int
+
 	// used for applying retention and deletion
 	boltdbTx      *bbolt.Tx
 	chunkIndexer  *chunkIndexer
@@ -37,14 +68,39 @@ type CompactedIndex struct {
 }
 
 func newCompactedIndex(compactedFile *bbolt.DB, tableName, workingDir string, periodConfig config.PeriodConfig, logger log.Logger) *CompactedIndex {
-	return &CompactedIndex{compactedFile: compactedFile, tableName: tableName, workingDir: workingDir, periodConfig: periodConfig, logger: logger}
+	return &CompactedIndex{compactedFile: compactedFile, tableName: tableName, workingDir: workingDir, periodConfig: periodConfig, logger: logger, uploaderName: defaultUploaderName, now: time.Now}
+}
+
+// newCompactedIndexWithOptions builds a CompactedIndex for the given compacted file configured as per the given Options, the same way
+// for the compacted files built while compacting a table and the ones opened with OpenCompactedIndexFile.
+// The compacted file is tracked as open with openDBs, and gets recreated in stagingDir instead of its working dir when set.
+func newCompactedIndexWithOptions(compactedFile *bbolt.DB, tableName, workingDir, stagingDir string, periodConfig config.PeriodConfig, logger log.Logger, opts Options, openDBs *openDBLimiter) *CompactedIndex {
+	compactedIndex := newCompactedIndex(compactedFile, tableName, workingDir, periodConfig, logger)
+	compactedIndex.writeIntegrityMarker = opts.IntegrityMarkers
+	compactedIndex.recordSchemaVersion = opts.SeedSchemaPolicy != SeedSchemaPolicyDisabled
+	compactedIndex.deterministicOutput = opts.DeterministicOutput
+	compactedIndex.contentHashInFileName = opts.ContentHashInFileName
+	compactedIndex.syncRecreatedDB = opts.SyncRecreatedCompactedDBs
+	compactedIndex.verifyRecreatedDB = opts.VerifyRecreatedCompactedDBs
+	compactedIndex.uploaderName = opts.uploaderName()
+	compactedIndex.now = opts.now
+	compactedIndex.fillPercent = opts.compactedFileFillPercent()
+	compactedIndex.openDBs = openDBs
+	compactedIndex.stagingDir = stagingDir
+
+	return compactedIndex
 }
 
 func (c *CompactedIndex) isEmpty() (bool, error) {
-	empty := false
+	empty := true
 	err := c.compactedFile.View(func(tx *bbolt.Tx) error {
-		empty = tx.Bucket(local.IndexBucketName) == nil
-		return nil
+		// the common index could keep buckets of tenants not selected for compaction besides the index bucket.
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			if !isMetaBucket(string(name)) {
+				empty = false
+			}
+			return nil
+		})
 	})
 
 	if err != nil {
@@ -54,6 +110,14 @@ func (c *CompactedIndex) isEmpty() (bool, error) {
 	return empty, nil
 }
 
+// EstimateReclaimableBytes returns an estimate of the bytes reclaimed by recreating the compacted db, which is the size of the pages on
+// its freelist as per the bbolt stats. The space left unused in partially filled pages, which recreating the db reclaims as well, is not
+// accounted for, so the estimate is a lower bound.
+func (c *CompactedIndex) EstimateReclaimableBytes() int64 {
+	stats := c.compactedFile.Stats()
+	return int64(stats.FreePageN+stats.PendingPageN) * int64(c.compactedFile.Info().PageSize)
+}
+
 // recreateCompactedDB just copies the old db to the new one using bbolt.Compact for following reasons:
 //  1. When index entries are deleted, boltdb leaves free pages in the file. The only way to drop those free pages is to re-create the file.
 //     See https://github.com/boltdb/bolt/issues/308 for more details.
@@ -61,17 +125,43 @@ func (c *CompactedIndex) isEmpty() (bool, error) {
 //     This setting is optimal for unordered writes.
 //     bbolt.Compact fills the whole page by setting FillPercent to 1 which works well here since while copying the data, it receives the index entries in order.
 //     The storage space goes down from anywhere between 25% to 50% as per my(Sandeep) tests.
-func (c *CompactedIndex) recreateCompactedDB() error {
-	destDB, err := openBoltdbFileWithNoSync(filepath.Join(c.workingDir, fmt.Sprint(time.Now().Unix())))
+//
+// The copy is committed each time txMaxSize bytes have been copied. It returns the number of bytes reclaimed by recreating the db.
+// With verifyRecreatedDB set, the old db is kept and a *recreatedDBMismatchError is returned when the content of the copy does not match it.
+func (c *CompactedIndex) recreateCompactedDB(txMaxSize int64) (int64, error) {
+	destDir := c.workingDir
+	if c.stagingDir != "" {
+		destDir = c.stagingDir
+		if err := chunk_util.EnsureDirectory(destDir); err != nil {
+			return 0, err
+		}
+	}
+	destPath := filepath.Join(destDir, fmt.Sprint(c.now().Unix()))
+	if destPath == c.compactedFile.Path() {
+		// the db got built in the same second, like while rewriting it right after compaction as per Options.RewriteInKeyOrder.
+		destPath += recreatedCompactedDBSuffix
+	}
+	destDB, err := openBoltdbFileWithOptions(destPath, nil, !c.syncRecreatedDB)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	// the recreated db is neither tracked nor holding a slot of openDBs until it replaces the compacted file,
+	// so it has to be removed on any failure before that.
+	dest := downloadedDb{path: destPath, db: destDB}
 
-	level.Info(c.logger).Log("msg", "recreating compacted db")
+	level.Info(c.logger).Log("msg", "recreating compacted db", "sync", c.syncRecreatedDB)
 
-	err = bbolt.Compact(destDB, c.compactedFile, dropFreePagesTxMaxSize)
+	err = bbolt.Compact(destDB, c.compactedFile, txMaxSize)
 	if err != nil {
-		return err
+		dest.cleanup(c.logger)
+		return 0, err
+	}
+
+	if c.verifyRecreatedDB {
+		if err := verifyRecreatedDB(c.compactedFile, destDB); err != nil {
+			dest.cleanup(c.logger)
+			return 0, err
+		}
 	}
 
 	sourceSize := int64(0)
@@ -81,26 +171,33 @@ func (c *CompactedIndex) recreateCompactedDB() error {
 		sourceSize = tx.Size()
 		return nil
 	}); err != nil {
-		return err
+		dest.cleanup(c.logger)
+		return 0, err
 	}
 
 	if err := destDB.View(func(tx *bbolt.Tx) error {
 		destSize = tx.Size()
 		return nil
 	}); err != nil {
-		return err
+		dest.cleanup(c.logger)
+		return 0, err
 	}
 
 	level.Info(c.logger).Log("msg", "recreated compacted db", "src_size_bytes", sourceSize, "dest_size_bytes", destSize)
 
 	err = c.compactedFile.Close()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	c.openDBs.replace(c.compactedFile, destDB)
 	c.compactedFile = destDB
 	c.compactedFileRecreated = true
-	return nil
+	if destSize > sourceSize {
+		return 0, nil
+	}
+
+	return sourceSize - destSize, nil
 }
 
 // setupIndexProcessors sets things for processing index for applying retention
@@ -149,6 +246,135 @@ func (c *CompactedIndex) ForEachChunk(ctx context.Context, callback retention.Ch
 	return ForEachChunk(ctx, bucket, c.periodConfig, callback)
 }
 
+// ForEachEntry calls the callback for each index entry of each bucket in the compacted index, except the bucket holding meta information of the file.
+// Keys and values are copied, so they remain valid after the callback returns.
+// The context is checked between the buckets.
+func (c *CompactedIndex) ForEachEntry(ctx context.Context, callback func(bucketName string, k, v []byte) error) error {
+	forEachEntry := func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			bucketName := string(name)
+			if isMetaBucket(bucketName) {
+				return nil
+			}
+
+			return b.ForEach(func(k, v []byte) error {
+				return callback(bucketName, append([]byte(nil), k...), append([]byte(nil), v...))
+			})
+		})
+	}
+
+	// reuse the transaction opened for applying retention and deletion since opening another one could deadlock.
+	if c.boltdbTx != nil {
+		return forEachEntry(c.boltdbTx)
+	}
+
+	return c.compactedFile.View(forEachEntry)
+}
+
+// Merge copies the index entries of each bucket of the other compacted index into the bucket of the same name in the compacted index,
+// except the bucket holding meta information of the other file. Entries are written in batches like while compacting source files and
+// existing entries with the same key get overwritten, so merging the same index repeatedly is safe.
+// The context is checked between the buckets, and the entries merged until then are kept when it gets cancelled.
+func (c *CompactedIndex) Merge(ctx context.Context, other *CompactedIndex) error {
+	if other.compactedFile == c.compactedFile {
+		return fmt.Errorf("can't merge compacted index %s into itself", c.compactedFile.Path())
+	}
+
+	batch := make([]indexEntry, 0, defaultBatchSize)
+	batchBucket := ""
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := c.writeBatchToBucket(batchBucket, batch)
+		batch = batch[:0]
+		return err
+	}
+
+	err := other.ForEachEntry(ctx, func(bucketName string, k, v []byte) error {
+		if bucketName != batchBucket || len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return err
+			}
+			batchBucket = bucketName
+		}
+
+		batch = append(batch, indexEntry{k: k, v: v})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// writeBatchToBucket writes the batch to the given bucket of the compacted file.
+func (c *CompactedIndex) writeBatchToBucket(bucketName string, batch []indexEntry) error {
+	// reuse the transaction opened for applying retention and deletion since opening another one would deadlock.
+	if c.boltdbTx != nil {
+		return putBatchInBucket(c.boltdbTx, []byte(bucketName), c.fillPercent, batch)
+	}
+
+	write := c.compactedFile.Batch
+	if c.deterministicOutput {
+		write = c.compactedFile.Update
+	}
+
+	return write(func(tx *bbolt.Tx) error {
+		return putBatchInBucket(tx, []byte(bucketName), c.fillPercent, batch)
+	})
+}
+
+// DeleteBucket removes the bucket of the given user from the compacted index, like while offboarding a tenant, and marks the index
+// as modified for uploading it. It is a no-op when the bucket does not exist.
+// boltdb keeps the pages freed by deleting the bucket in the file, so a recreated file is not considered recreated anymore for
+// having its freed pages reclaimed by recreating it again as per Options.RecreateCompactedDBOlderThan after its upload.
+func (c *CompactedIndex) DeleteBucket(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deleted := false
+	deleteBucket := func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(userID)) == nil {
+			return nil
+		}
+
+		deleted = true
+		return tx.DeleteBucket([]byte(userID))
+	}
+
+	// reuse the transaction opened for applying retention and deletion since opening another one would deadlock.
+	var err error
+	if c.boltdbTx != nil {
+		err = deleteBucket(c.boltdbTx)
+	} else {
+		err = c.compactedFile.Update(deleteBucket)
+	}
+	if err != nil {
+		return err
+	}
+
+	if deleted {
+		c.modified = true
+		c.compactedFileRecreated = false
+		c.recreateSkipped = false
+	}
+	return nil
+}
+
+// Modified returns true if buckets got deleted from the compacted index with DeleteBucket, in which case it needs to be handed over to
+// its index set with SetCompactedIndex for uploading it.
+func (c *CompactedIndex) Modified() bool {
+	return c.modified
+}
+
 func (c *CompactedIndex) IndexChunk(chunk chunk.Chunk) (bool, error) {
 	if err := c.setupIndexProcessors(); err != nil {
 		return false, err
@@ -174,13 +400,48 @@ func (c *CompactedIndex) ToIndexFile() (shipper_index.Index, error) {
 		c.boltdbTx = nil
 	}
 
+	// the file could have been built from a seed file with an integrity marker which would be stale now, so either update or remove it.
+	if c.writeIntegrityMarker {
+		if err := writeIntegrityMarker(c.compactedFile); err != nil {
+			return nil, err
+		}
+	} else if err := removeIntegrityMarker(c.compactedFile); err != nil {
+		return nil, err
+	}
+
+	if c.recordSchemaVersion {
+		if err := writeSchemaVersion(c.compactedFile, c.periodConfig.Schema); err != nil {
+			return nil, err
+		}
+	}
+
 	fileNameFormat := "%s"
-	if c.compactedFileRecreated {
+	if c.compactedFileRecreated || c.recreateSkipped {
 		fileNameFormat = "%s" + recreatedCompactedDBSuffix
 	}
-	fileName := fmt.Sprintf(fileNameFormat, shipper_util.BuildIndexFileName(c.tableName, uploaderName, fmt.Sprint(time.Now().Unix())))
+	dbName := fmt.Sprint(c.now().Unix())
+	if c.deterministicOutput {
+		if err := c.compactedFile.View(func(tx *bbolt.Tx) error {
+			dbName = fmt.Sprintf("%016x", computeContentChecksum(tx))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	} else if c.contentHashInFileName {
+		if err := c.compactedFile.View(func(tx *bbolt.Tx) error {
+			dbName = fmt.Sprintf("%s-%016x", dbName, computeBucketsHash(tx))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if c.splitPart > 0 {
+		dbName = fmt.Sprintf("%s-%d", dbName, c.splitPart)
+	}
+	fileName := fmt.Sprintf(fileNameFormat, shipper_util.BuildIndexFileName(c.tableName, c.uploaderName, dbName))
 
 	idxFile := indexfile.BoltDBToIndexFile(c.compactedFile, fileName)
+	c.openDBs.release(c.compactedFile)
 	c.compactedFile = nil
 	return idxFile, nil
 }
@@ -200,6 +461,7 @@ func (c *CompactedIndex) Cleanup() {
 	if err := c.compactedFile.Close(); err != nil {
 		level.Error(c.logger).Log("msg", "failed to close compacted index file", "err", err)
 	}
+	c.openDBs.release(c.compactedFile)
 
 	if err := os.Remove(compactedFilePath); err != nil {
 		level.Error(c.logger).Log("msg", "failed to remove compacted index file", "err", err)
@@ -251,20 +513,39 @@ func (c *chunkIndexer) IndexChunk(newChunk chunk.Chunk) (bool, error) {
 	return chunkIndexed, nil
 }
 
-func writeBatch(indexFile *bbolt.DB, batch []indexEntry) error {
+func writeBatch(indexFile *bbolt.DB, fillPercent float64, batch []indexEntry) error {
 	return indexFile.Batch(func(tx *bbolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(local.IndexBucketName)
+		return putBatch(tx, fillPercent, batch)
+	})
+}
+
+// writeBatchInOwnTx is like writeBatch but always writes the batch in a transaction of its own instead of
+// coalescing it with concurrent writes, which makes the layout of the file depend only on the order of the writes.
+func writeBatchInOwnTx(indexFile *bbolt.DB, fillPercent float64, batch []indexEntry) error {
+	return indexFile.Update(func(tx *bbolt.Tx) error {
+		return putBatch(tx, fillPercent, batch)
+	})
+}
+
+func putBatch(tx *bbolt.Tx, fillPercent float64, batch []indexEntry) error {
+	return putBatchInBucket(tx, local.IndexBucketName, fillPercent, batch)
+}
+
+// putBatchInBucket writes the batch to the given bucket with the pages of the bucket filled up to fillPercent.
+// The fill percent of a bucket is not persisted, so it needs to be set in each transaction.
+func putBatchInBucket(tx *bbolt.Tx, bucketName []byte, fillPercent float64, batch []indexEntry) error {
+	b, err := tx.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		return err
+	}
+	b.FillPercent = fillPercent
+
+	for _, w := range batch {
+		err = b.Put(w.k, w.v)
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, w := range batch {
-			err = b.Put(w.k, w.v)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
-	})
+	return nil
 }
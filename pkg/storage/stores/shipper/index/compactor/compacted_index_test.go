@@ -3,7 +3,9 @@ package compactor
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
@@ -18,6 +20,7 @@ import (
 	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor/retention"
 	"github.com/grafana/loki/pkg/storage/stores/shipper/index/indexfile"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
 	util_log "github.com/grafana/loki/pkg/util/log"
 )
 
@@ -116,3 +119,289 @@ func TestCompactedIndex_IndexProcessor(t *testing.T) {
 		})
 	}
 }
+
+func TestCompactedIndex_ForEachEntry(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, dbPath, 100, 50, []byte("user1"))
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, writeIntegrityMarker(db))
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), t.TempDir(), allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	expectedRecords := readDB(t, db)
+	delete(expectedRecords, string(metaBucketName))
+
+	// keys and values are retained after the callback returns to check that they are copied
+	entries := map[string][][2][]byte{}
+	require.NoError(t, compactedIndex.ForEachEntry(context.Background(), func(bucketName string, k, v []byte) error {
+		entries[bucketName] = append(entries[bucketName], [2][]byte{k, v})
+		return nil
+	}))
+
+	records := map[string]map[string]string{}
+	for bucketName, bucketEntries := range entries {
+		records[bucketName] = map[string]string{}
+		for _, entry := range bucketEntries {
+			records[bucketName][string(entry[0])] = string(entry[1])
+		}
+	}
+	require.Equal(t, expectedRecords, records)
+	require.Len(t, records[string(local.IndexBucketName)], 100)
+	require.Len(t, records["user1"], 50)
+
+	// entries should be iterated within the open transaction after setting up the index processors
+	require.NoError(t, compactedIndex.setupIndexProcessors())
+	numEntries := 0
+	require.NoError(t, compactedIndex.ForEachEntry(context.Background(), func(_ string, _, _ []byte) error {
+		numEntries++
+		return nil
+	}))
+	require.Equal(t, 150, numEntries)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, compactedIndex.ForEachEntry(ctx, func(_ string, _, _ []byte) error {
+		return nil
+	}), context.Canceled)
+}
+
+func TestCompactedIndex_Merge(t *testing.T) {
+	tempDir := t.TempDir()
+	tableName := allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from)
+	openCompactedIndex := func(dbPath string) *CompactedIndex {
+		db, err := openBoltdbFileWithNoSync(dbPath)
+		require.NoError(t, err)
+		return newCompactedIndex(db, tableName, t.TempDir(), allSchemas[0].config, util_log.Logger)
+	}
+
+	dstPath := filepath.Join(tempDir, "dst")
+	testutil.AddRecordsToDB(t, dstPath, 0, 100, local.IndexBucketName)
+	dst := openCompactedIndex(dstPath)
+	defer dst.Cleanup()
+
+	srcPath := filepath.Join(tempDir, "src")
+	testutil.AddRecordsToDB(t, srcPath, 50, 2000, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, srcPath, 0, 50, []byte("user1"))
+	src := openCompactedIndex(srcPath)
+	defer src.Cleanup()
+	require.NoError(t, writeIntegrityMarker(src.compactedFile))
+
+	// merging repeatedly should not change the result
+	for i := 0; i < 2; i++ {
+		require.NoError(t, dst.Merge(context.Background(), src))
+
+		records := readDB(t, dst.compactedFile)
+		require.Len(t, records, 2)
+		require.Len(t, records[string(local.IndexBucketName)], 2050)
+		require.Len(t, records["user1"], 50)
+	}
+
+	require.Error(t, dst.Merge(context.Background(), dst))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, dst.Merge(ctx, src), context.Canceled)
+}
+
+func TestCompactedIndex_DeleteBucket(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, dbPath, 100, 50, []byte("user1"))
+	testutil.AddRecordsToDB(t, dbPath, 150, 50, []byte("user2"))
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), t.TempDir(), allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	_, err = compactedIndex.recreateCompactedDB(defaultDropFreePagesTxMaxSize)
+	require.NoError(t, err)
+	require.True(t, compactedIndex.compactedFileRecreated)
+
+	// deleting a missing bucket is a no-op.
+	require.NoError(t, compactedIndex.DeleteBucket(context.Background(), "user3"))
+	require.False(t, compactedIndex.Modified())
+	require.True(t, compactedIndex.compactedFileRecreated)
+
+	require.NoError(t, compactedIndex.DeleteBucket(context.Background(), "user1"))
+	require.True(t, compactedIndex.Modified())
+	// the file needs to be recreated again for reclaiming the pages freed by deleting the bucket.
+	require.False(t, compactedIndex.compactedFileRecreated)
+
+	records := readDB(t, compactedIndex.compactedFile)
+	require.Len(t, records, 2)
+	require.Len(t, records[string(local.IndexBucketName)], 100)
+	require.Len(t, records["user2"], 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, compactedIndex.DeleteBucket(ctx, "user2"), context.Canceled)
+}
+
+func TestCompactedIndex_RecreateCompactedDBSync(t *testing.T) {
+	for _, syncRecreatedDB := range []bool{false, true} {
+		t.Run(fmt.Sprintf("syncRecreatedDB=%v", syncRecreatedDB), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "db")
+			testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+
+			db, err := openBoltdbFileWithNoSync(dbPath)
+			require.NoError(t, err)
+
+			compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), t.TempDir(), allSchemas[0].config, util_log.Logger)
+			compactedIndex.syncRecreatedDB = syncRecreatedDB
+			defer compactedIndex.Cleanup()
+
+			_, err = compactedIndex.recreateCompactedDB(defaultDropFreePagesTxMaxSize)
+			require.NoError(t, err)
+			require.Equal(t, !syncRecreatedDB, compactedIndex.compactedFile.NoSync)
+			require.Len(t, readDB(t, compactedIndex.compactedFile)[string(local.IndexBucketName)], 100)
+		})
+	}
+}
+
+func TestCompactedIndex_EstimateReclaimableBytes(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, dbPath, 0, 1000, []byte("user1"))
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), t.TempDir(), allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	before := compactedIndex.EstimateReclaimableBytes()
+
+	// deleting a bucket leaves its pages on the freelist.
+	require.NoError(t, compactedIndex.DeleteBucket(context.Background(), "user1"))
+	reclaimable := compactedIndex.EstimateReclaimableBytes()
+	require.Greater(t, reclaimable, before)
+	require.Zero(t, reclaimable%int64(db.Info().PageSize))
+
+	_, err = compactedIndex.recreateCompactedDB(defaultDropFreePagesTxMaxSize)
+	require.NoError(t, err)
+	require.Less(t, compactedIndex.EstimateReclaimableBytes(), reclaimable)
+}
+
+func TestCompactedIndex_RecreateCompactedDBVerify(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), t.TempDir(), allSchemas[0].config, util_log.Logger)
+	compactedIndex.verifyRecreatedDB = true
+	defer compactedIndex.Cleanup()
+
+	_, err = compactedIndex.recreateCompactedDB(defaultDropFreePagesTxMaxSize)
+	require.NoError(t, err)
+	require.True(t, compactedIndex.compactedFileRecreated)
+	require.Len(t, readDB(t, compactedIndex.compactedFile)[string(local.IndexBucketName)], 100)
+}
+
+func TestCompactedIndex_RecreateCompactedDBFailure(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+
+	workingDir := t.TempDir()
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), workingDir, allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	// compacting from a closed db fails after the recreated db got created.
+	require.NoError(t, db.Close())
+	_, err = compactedIndex.recreateCompactedDB(defaultDropFreePagesTxMaxSize)
+	require.Error(t, err)
+	require.False(t, compactedIndex.compactedFileRecreated)
+
+	// the recreated db must not be left behind.
+	files, err := os.ReadDir(workingDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestVerifyRecreatedDB(t *testing.T) {
+	tempDir := t.TempDir()
+	openDB := func(name string, numRecords int, buckets ...[]byte) *bbolt.DB {
+		dbPath := filepath.Join(tempDir, name)
+		for _, bucket := range buckets {
+			testutil.AddRecordsToDB(t, dbPath, 0, numRecords, bucket)
+		}
+		db, err := openBoltdbFileWithNoSync(dbPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, db.Close())
+		})
+		return db
+	}
+
+	source := openDB("source", 100, local.IndexBucketName)
+	require.NoError(t, verifyRecreatedDB(source, openDB("same", 100, local.IndexBucketName)))
+
+	var mismatchErr *recreatedDBMismatchError
+	require.ErrorAs(t, verifyRecreatedDB(source, openDB("fewer-entries", 99, local.IndexBucketName)), &mismatchErr)
+	require.Equal(t, int64(100), mismatchErr.sourceEntries)
+	require.Equal(t, int64(99), mismatchErr.recreatedEntries)
+
+	require.ErrorAs(t, verifyRecreatedDB(source, openDB("other-bucket", 100, []byte("user1"))), &mismatchErr)
+
+	changedValue := openDB("changed-value", 100, local.IndexBucketName)
+	require.NoError(t, changedValue.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(local.IndexBucketName)
+		k, _ := b.Cursor().First()
+		return b.Put(k, []byte("changed"))
+	}))
+	require.ErrorAs(t, verifyRecreatedDB(source, changedValue), &mismatchErr)
+	require.Equal(t, mismatchErr.sourceEntries, mismatchErr.recreatedEntries)
+}
+
+func TestCompactedIndex_Stats(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, dbPath, 100, 50, []byte("user1"))
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, writeIntegrityMarker(db))
+
+	expectedStats := IndexStats{Buckets: map[string]BucketStats{}}
+	for bucketName, records := range readDB(t, db) {
+		if isMetaBucket(bucketName) {
+			continue
+		}
+		bucketStats := BucketStats{}
+		for k := range records {
+			bucketStats.Entries++
+			bucketStats.KeyBytes += int64(len(k))
+		}
+		expectedStats.Buckets[bucketName] = bucketStats
+	}
+
+	// standalone on the boltdb file
+	stats, err := ReadIndexStats(db)
+	require.NoError(t, err)
+	require.Equal(t, expectedStats, stats)
+	require.Equal(t, int64(150), stats.Entries())
+	require.Equal(t, expectedStats.Buckets[string(local.IndexBucketName)].KeyBytes+expectedStats.Buckets["user1"].KeyBytes, stats.KeyBytes())
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), t.TempDir(), allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	stats, err = compactedIndex.Stats()
+	require.NoError(t, err)
+	require.Equal(t, expectedStats, stats)
+
+	// stats should be read within the open transaction after setting up the index processors
+	require.NoError(t, compactedIndex.setupIndexProcessors())
+	stats, err = compactedIndex.Stats()
+	require.NoError(t, err)
+	require.Equal(t, expectedStats, stats)
+}
@@ -0,0 +1,242 @@
+// Package compactortest provides an implementation of compactor.IndexSet backed by local files for testing and benchmarking
+// the compaction of tables, with helpers for seeding their source files.
+package compactortest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+// IndexSet is a compactor.IndexSet serving source files from a local directory, which records the compacted index set for it.
+// It is safe for concurrent use.
+type IndexSet struct {
+	tableName, userID     string
+	sourceDir, workingDir string
+	logger                log.Logger
+
+	mtx               sync.Mutex
+	sourceFiles       []storage.IndexFile
+	compactedIndex    compactor.CompactedIndex
+	removeSourceFiles bool
+}
+
+// NewIndexSet returns an empty IndexSet of the given table for the given user, or for the common index for an empty user id,
+// with its source and working dirs in temp dirs of t.
+func NewIndexSet(t testing.TB, tableName, userID string) *IndexSet {
+	logger := log.With(log.NewNopLogger(), "table-name", tableName)
+	if userID != "" {
+		logger = log.With(logger, "user-id", userID)
+	}
+
+	return &IndexSet{
+		tableName:  tableName,
+		userID:     userID,
+		sourceDir:  t.TempDir(),
+		workingDir: t.TempDir(),
+		logger:     logger,
+	}
+}
+
+// AddSourceFile adds a source file with numRecords index entries starting from start to the given bucket, and returns its path.
+// Adding entries to an existing source file adds them to the same file.
+func (s *IndexSet) AddSourceFile(t testing.TB, name string, start, numRecords int, bucketName []byte) string {
+	path := filepath.Join(s.sourceDir, name)
+	testutil.AddRecordsToDB(t, path, start, numRecords, bucketName)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, sourceFile := range s.sourceFiles {
+		if sourceFile.Name == name {
+			return path
+		}
+	}
+	s.sourceFiles = append(s.sourceFiles, storage.IndexFile{Name: name, ModifiedAt: time.Now()})
+	return path
+}
+
+func (s *IndexSet) GetTableName() string {
+	return s.tableName
+}
+
+func (s *IndexSet) ListSourceFiles() []storage.IndexFile {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]storage.IndexFile(nil), s.sourceFiles...)
+}
+
+// GetSourceFile copies the source file to the working dir like downloading it.
+func (s *IndexSet) GetSourceFile(indexFile storage.IndexFile) (string, error) {
+	src, err := os.Open(filepath.Join(s.sourceDir, indexFile.Name))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst := filepath.Join(s.workingDir, indexFile.Name)
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, src); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func (s *IndexSet) GetLogger() log.Logger {
+	return s.logger
+}
+
+func (s *IndexSet) GetWorkingDir() string {
+	return s.workingDir
+}
+
+func (s *IndexSet) SetCompactedIndex(compactedIndex compactor.CompactedIndex, removeSourceFiles bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.compactedIndex = compactedIndex
+	s.removeSourceFiles = removeSourceFiles
+	return nil
+}
+
+// CompactedIndex returns the compacted index last set for the index set, and whether its source files got set for removal.
+func (s *IndexSet) CompactedIndex() (compactor.CompactedIndex, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.compactedIndex, s.removeSourceFiles
+}
+
+// Table holds the common and user IndexSets of a table for passing them to compactor.IndexCompactor.NewTableCompactor.
+// It is safe for concurrent use.
+type Table struct {
+	t              testing.TB
+	name           string
+	commonIndexSet *IndexSet
+
+	mtx           sync.Mutex
+	userIndexSets map[string]*IndexSet
+}
+
+// NewTable returns a table without any source files.
+func NewTable(t testing.TB, name string) *Table {
+	return &Table{
+		t:              t,
+		name:           name,
+		commonIndexSet: NewIndexSet(t, name, ""),
+		userIndexSets:  map[string]*IndexSet{},
+	}
+}
+
+// SeedCommonIndex adds numFiles source files to the common index with numRecords entries each in the index bucket, which is the
+// layout of the common index files without per user buckets, like the ones built by ingesters before per user index was introduced.
+func (tb *Table) SeedCommonIndex(numFiles, numRecords int) {
+	for i := 0; i < numFiles; i++ {
+		tb.commonIndexSet.AddSourceFile(tb.t, fmt.Sprintf("common-%d", i), i*numRecords, numRecords, local.IndexBucketName)
+	}
+}
+
+// SeedUserBuckets adds numFiles source files to the common index with numRecords entries each in the buckets of the given users,
+// which is the layout of the common index files with per user buckets, whose entries get moved to the index of their user.
+func (tb *Table) SeedUserBuckets(numFiles, numRecords int, userIDs ...string) {
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("user-buckets-%d", i)
+		for _, userID := range userIDs {
+			tb.commonIndexSet.AddSourceFile(tb.t, name, i*numRecords, numRecords, []byte(userID))
+		}
+	}
+}
+
+// SeedUserIndex adds numFiles source files with numRecords entries each in the index bucket to the existing index of the given user.
+func (tb *Table) SeedUserIndex(userID string, numFiles, numRecords int) {
+	userIndexSet := tb.ExistingUserIndexSet(userID)
+	for i := 0; i < numFiles; i++ {
+		userIndexSet.AddSourceFile(tb.t, fmt.Sprintf("%s-%d", userID, i), i*numRecords, numRecords, local.IndexBucketName)
+	}
+}
+
+// ExistingUserIndexSet returns the IndexSet of the existing index of the given user, creating it if needed, for adding source files
+// to it with IndexSet.AddSourceFile.
+func (tb *Table) ExistingUserIndexSet(userID string) *IndexSet {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	userIndexSet, ok := tb.userIndexSets[userID]
+	if !ok {
+		userIndexSet = NewIndexSet(tb.t, tb.name, userID)
+		tb.userIndexSets[userID] = userIndexSet
+	}
+	return userIndexSet
+}
+
+// CommonIndexSet returns the IndexSet of the common index.
+func (tb *Table) CommonIndexSet() *IndexSet {
+	return tb.commonIndexSet
+}
+
+// ExistingUserIndexSets returns the IndexSets of the users with an existing index, seeded with SeedUserIndex. The IndexSets
+// created with MakeEmptyUserIndexSet are left out for compacting the table again.
+func (tb *Table) ExistingUserIndexSets() map[string]compactor.IndexSet {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	userIndexSets := make(map[string]compactor.IndexSet, len(tb.userIndexSets))
+	for userID, userIndexSet := range tb.userIndexSets {
+		if len(userIndexSet.ListSourceFiles()) != 0 {
+			userIndexSets[userID] = userIndexSet
+		}
+	}
+	return userIndexSets
+}
+
+// UserIndexSet returns the IndexSet of the given user, including the ones created with MakeEmptyUserIndexSet.
+func (tb *Table) UserIndexSet(userID string) (*IndexSet, bool) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	userIndexSet, ok := tb.userIndexSets[userID]
+	return userIndexSet, ok
+}
+
+// MakeEmptyUserIndexSet is a compactor.MakeEmptyUserIndexSetFunc creating the IndexSets of users without an existing index.
+func (tb *Table) MakeEmptyUserIndexSet(userID string) (compactor.IndexSet, error) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	userIndexSet := NewIndexSet(tb.t, tb.name, userID)
+	tb.userIndexSets[userID] = userIndexSet
+	return userIndexSet, nil
+}
+
+// Cleanup cleans up the compacted indexes set for the index sets of the table.
+func (tb *Table) Cleanup() {
+	cleanup := func(idxSet *IndexSet) {
+		if compactedIndex, _ := idxSet.CompactedIndex(); compactedIndex != nil {
+			compactedIndex.Cleanup()
+		}
+	}
+
+	cleanup(tb.commonIndexSet)
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+	for _, userIndexSet := range tb.userIndexSets {
+		cleanup(userIndexSet)
+	}
+}
@@ -0,0 +1,69 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/index/compactor/compactortest"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func compactTestTable(t testing.TB, table *compactortest.Table, opts Options) {
+	tCompactor := newTestIndexCompactor(t, opts).NewTableCompactor(context.Background(), table.CommonIndexSet(),
+		table.ExistingUserIndexSets(), table.MakeEmptyUserIndexSet, config.PeriodConfig{})
+	require.NoError(t, tCompactor.CompactTable())
+}
+
+func TestCompactorTest_Table(t *testing.T) {
+	user1, user2 := testutil.BuildUserID(0), testutil.BuildUserID(1)
+
+	table := compactortest.NewTable(t, tableName)
+	defer table.Cleanup()
+	table.SeedCommonIndex(2, 10)
+	table.SeedUserBuckets(2, 10, user1, user2)
+	table.SeedUserIndex(user1, 2, 10)
+
+	compactTestTable(t, table, Options{})
+
+	compactedIndex, removeSourceFiles := table.CommonIndexSet().CompactedIndex()
+	require.True(t, removeSourceFiles)
+	commonRecords := readDB(t, compactedIndex.(*CompactedIndex).compactedFile)
+	require.Len(t, commonRecords, 1)
+	require.Len(t, commonRecords[string(local.IndexBucketName)], 20)
+
+	// entries of the user buckets of the common index got moved to the index of their user, along with its existing index.
+	for userID, numRecords := range map[string]int{user1: 20, user2: 20} {
+		userIndexSet, ok := table.UserIndexSet(userID)
+		require.True(t, ok)
+		compactedIndex, _ := userIndexSet.CompactedIndex()
+		require.NotNil(t, compactedIndex)
+		require.Len(t, readDB(t, compactedIndex.(*CompactedIndex).compactedFile)[string(local.IndexBucketName)], numRecords)
+	}
+}
+
+func Benchmark_CompactTable(b *testing.B) {
+	for name, seed := range map[string]func(table *compactortest.Table){
+		"common index": func(table *compactortest.Table) {
+			table.SeedCommonIndex(1000, 100)
+		},
+		"user buckets": func(table *compactortest.Table) {
+			table.SeedUserBuckets(1000, 100, testutil.BuildUserID(0), testutil.BuildUserID(1))
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			table := compactortest.NewTable(b, tableName)
+			seed(table)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				compactTestTable(b, table, Options{})
+				table.Cleanup()
+			}
+		})
+	}
+}
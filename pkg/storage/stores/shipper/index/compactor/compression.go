@@ -0,0 +1,171 @@
+package compactor
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+type fileCompression string
+
+const (
+	fileCompressionNone  fileCompression = "none"
+	fileCompressionGzip  fileCompression = storage.CompressionGzip
+	fileCompressionZstd  fileCompression = storage.CompressionZstd
+	fileCompressionBzip2 fileCompression = "bzip2"
+
+	// boltdb files start with a meta page having the magic after the 16 bytes page header.
+	boltdbMagicOffset = 16
+	boltdbMagic       = 0xED0CDAED
+)
+
+// bzip2Magic is the magic of bzip2 files, which are not decompressed by storage.NewDecompressedReader unlike the gzip and zstd ones.
+var bzip2Magic = []byte("BZh")
+
+// getSourceFile downloads the given source file and decompresses it in place if it is still compressed after the download,
+// which is the case for index files uploaded with a compression other than gzip or without the gzip extension.
+// It waits for the download budget shared by the tables compacted with CompactTables, and records the downloads failing the verification
+// of their size by the index set.
+// A source file decompressing beyond Options.MaxDecompressedSourceFileBytes, or beyond the limit of the index set while downloading it,
+// is rejected with an error wrapping storage.ErrDecompressedSizeLimitExceeded which is not skipped like a corrupt file.
+func (t *tableCompactor) getSourceFile(idxSet compactor.IndexSet, sourceFile storage.IndexFile) (string, error) {
+	if err := t.downloads.acquire(t.ctx); err != nil {
+		return "", err
+	}
+	downloadAt, err := idxSet.GetSourceFile(sourceFile)
+	t.downloads.release()
+	if err != nil {
+		if errors.Is(err, storage.ErrDecompressedSizeLimitExceeded) {
+			return "", t.rejectOversizedSourceFile(idxSet, sourceFile, err)
+		}
+		if errors.Is(err, ErrSourceFileSizeMismatch) {
+			return "", t.rejectSourceFileSizeMismatch(idxSet, sourceFile, err)
+		}
+		return "", err
+	}
+
+	if err := decompressSourceFile(idxSet.GetLogger(), downloadAt, t.opts.MaxDecompressedSourceFileBytes); err != nil {
+		// callers only take care of cleaning up the source files which got downloaded successfully.
+		if removeErr := os.Remove(downloadAt); removeErr != nil {
+			level.Error(idxSet.GetLogger()).Log("msg", "failed to remove index file which failed decompression", "file", downloadAt, "err", removeErr)
+		}
+		if errors.Is(err, storage.ErrDecompressedSizeLimitExceeded) {
+			return "", t.rejectOversizedSourceFile(idxSet, sourceFile, err)
+		}
+		return "", newCorruptSourceFileError(sourceFile.Name, err)
+	}
+
+	return downloadAt, nil
+}
+
+// rejectOversizedSourceFile records the given source file which decompressed beyond the size limit and returns the error failing the
+// compaction of its table, which leaves the file in the storage for inspecting it.
+func (t *tableCompactor) rejectOversizedSourceFile(idxSet compactor.IndexSet, sourceFile storage.IndexFile, err error) error {
+	level.Error(idxSet.GetLogger()).Log("msg", "rejecting source file which decompressed beyond the size limit", "file", sourceFile.Name, "err", err)
+	t.metrics.compactTablesOversizedFilesRejected.Inc()
+	return fmt.Errorf("rejected source file %s: %w", sourceFile.Name, err)
+}
+
+// detectFileCompression detects the compression of the file at the given path by its magic bytes.
+// Empty files are considered to be uncompressed boltdb files.
+func detectFileCompression(path string) (fileCompression, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, boltdbMagicOffset+4)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+	if compression := storage.DetectCompression(header); compression != "" {
+		return fileCompression(compression), nil
+	}
+
+	switch {
+	case n == 0:
+		return fileCompressionNone, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return fileCompressionBzip2, nil
+	case n == len(header) && isBoltdbMagic(header[boltdbMagicOffset:]):
+		return fileCompressionNone, nil
+	}
+
+	return "", fmt.Errorf("unknown format of index file %s: neither a boltdb file nor compressed with gzip, zstd or bzip2", path)
+}
+
+// isBoltdbMagic checks the magic in the byte order of the host which wrote the file.
+func isBoltdbMagic(b []byte) bool {
+	return binary.LittleEndian.Uint32(b) == boltdbMagic || binary.BigEndian.Uint32(b) == boltdbMagic
+}
+
+// decompressSourceFile replaces the compressed file at the given path with its decompressed content, failing with an error wrapping
+// storage.ErrDecompressedSizeLimitExceeded once it decompresses beyond maxDecompressedBytes when positive.
+// Uncompressed files are left untouched.
+func decompressSourceFile(logger log.Logger, path string, maxDecompressedBytes int64) error {
+	compression, err := detectFileCompression(path)
+	if err != nil {
+		return err
+	}
+
+	if compression == fileCompressionNone {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var reader io.Reader
+	switch compression {
+	case fileCompressionGzip, fileCompressionZstd:
+		decompressedReader, release, err := storage.NewDecompressedReader(src)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s index file %s: %w", compression, path, err)
+		}
+		defer release()
+		reader = decompressedReader
+	case fileCompressionBzip2:
+		reader = bzip2.NewReader(src)
+	}
+
+	decompressedPath := path + ".decompressed"
+	if err := writeDecompressedFile(decompressedPath, storage.NewDecompressedSizeLimitReader(reader, maxDecompressedBytes)); err != nil {
+		if removeErr := os.Remove(decompressedPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			level.Error(logger).Log("msg", "failed to remove partially decompressed index file", "file", decompressedPath, "err", removeErr)
+		}
+		return fmt.Errorf("failed to decompress %s index file %s: %w", compression, path, err)
+	}
+
+	level.Debug(logger).Log("msg", "decompressed index file", "file", path, "compression", compression)
+	return os.Rename(decompressedPath, path)
+}
+
+func writeDecompressedFile(path string, reader io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, reader); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,157 @@
+package compactor
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// compressFile replaces the file at the given path with its content compressed by the writer built by newWriter.
+func compressFile(t *testing.T, path string, newWriter func(w io.Writer) (io.WriteCloser, error)) {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	w, err := newWriter(f)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func zstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func gzipWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func TestTable_CompressedSourceFiles(t *testing.T) {
+	idxSet := newLatencyIndexSet(t, 4, 100, 0)
+	compressFile(t, filepath.Join(idxSet.sourceDir, "db-0"), zstdWriter)
+	compressFile(t, filepath.Join(idxSet.sourceDir, "db-1"), zstdWriter)
+	compressFile(t, filepath.Join(idxSet.sourceDir, "db-2"), gzipWriter)
+
+	compactedIndex, err := newReadAheadTableCompactor(Options{}).compactUserIndexes(context.Background(), "user1", idxSet)
+	require.NoError(t, err)
+	defer compactedIndex.Cleanup()
+
+	records := readDB(t, compactedIndex.compactedFile)
+	require.Len(t, records[string(local.IndexBucketName)], 400)
+}
+
+func TestDecompressSourceFile(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("zstd", func(t *testing.T) {
+		idxSet := newLatencyIndexSet(t, 1, 100, 0)
+		path := filepath.Join(idxSet.sourceDir, "db-0")
+		uncompressed, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		compressFile(t, path, zstdWriter)
+		compression, err := detectFileCompression(path)
+		require.NoError(t, err)
+		require.Equal(t, fileCompressionZstd, compression)
+
+		require.NoError(t, decompressSourceFile(util_log.Logger, path, 0))
+		decompressed, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, uncompressed, decompressed)
+
+		// decompressing an uncompressed file should be a noop
+		require.NoError(t, decompressSourceFile(util_log.Logger, path, 0))
+		decompressed, err = os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, uncompressed, decompressed)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		path := filepath.Join(dir, "unknown")
+		require.NoError(t, os.WriteFile(path, []byte("not an index file, just some text"), 0o666))
+
+		err := decompressSourceFile(util_log.Logger, path, 0)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), path)
+	})
+
+	t.Run("corrupt zstd", func(t *testing.T) {
+		path := filepath.Join(dir, "corrupt")
+		// the zstd magic followed by garbage.
+		require.NoError(t, os.WriteFile(path, append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "corrupt"...), 0o666))
+
+		require.Error(t, decompressSourceFile(util_log.Logger, path, 0))
+		_, err := os.Stat(path + ".decompressed")
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("decompressed size limit", func(t *testing.T) {
+		idxSet := newLatencyIndexSet(t, 1, 100, 0)
+		path := filepath.Join(idxSet.sourceDir, "db-0")
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		compressFile(t, path, gzipWriter)
+
+		err = decompressSourceFile(util_log.Logger, path, info.Size()-1)
+		require.ErrorIs(t, err, storage.ErrDecompressedSizeLimitExceeded)
+		_, err = os.Stat(path + ".decompressed")
+		require.True(t, os.IsNotExist(err))
+
+		require.NoError(t, decompressSourceFile(util_log.Logger, path, info.Size()))
+		decompressed, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, info.Size(), decompressed.Size())
+	})
+}
+
+func TestTable_OversizedSourceFileRejected(t *testing.T) {
+	idxSet := newLatencyIndexSet(t, 2, 100, 0)
+	info, err := os.Stat(filepath.Join(idxSet.sourceDir, "db-1"))
+	require.NoError(t, err)
+	// a gzip bomb decompressing way beyond the size of the other source files.
+	compressFile(t, filepath.Join(idxSet.sourceDir, "db-1"), func(w io.Writer) (io.WriteCloser, error) {
+		gw := gzip.NewWriter(w)
+		_, err := gw.Write(make([]byte, 100*info.Size()))
+		return gw, err
+	})
+
+	// oversized source files are never skipped like corrupt ones.
+	tCompactor := newReadAheadTableCompactor(Options{MaxDecompressedSourceFileBytes: 10 * info.Size(), SkipCorruptSourceFiles: true})
+	_, err = tCompactor.compactUserIndexes(context.Background(), "user1", idxSet)
+	require.ErrorIs(t, err, storage.ErrDecompressedSizeLimitExceeded)
+	require.Contains(t, err.Error(), "db-1")
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesOversizedFilesRejected))
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesCorruptFiles))
+}
+
+func TestTable_UnknownSourceFileFormat(t *testing.T) {
+	idxSet := newLatencyIndexSet(t, 2, 100, time.Millisecond)
+	require.NoError(t, os.WriteFile(filepath.Join(idxSet.sourceDir, "db-1"), []byte("not an index file, just some text"), 0o666))
+
+	_, err := newReadAheadTableCompactor(Options{}).compactUserIndexes(context.Background(), "user1", idxSet)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), filepath.Join(idxSet.workingDir, "db-1"))
+
+	// the downloaded file which failed decompression should be cleaned up
+	files, err := os.ReadDir(idxSet.workingDir)
+	require.NoError(t, err)
+	for _, file := range files {
+		require.NotContains(t, file.Name(), "db-")
+	}
+}
@@ -0,0 +1,30 @@
+package compactor
+
+import (
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// consumedFilesStats summarizes the source files of the common index consumed by its compaction.
+type consumedFilesStats struct {
+	// Files is the number of source files merged, including the seed file. Skipped corrupt or empty source files are not included.
+	Files int
+	// Bytes is the total size of the merged source files after decompressing them.
+	Bytes int64
+	// UserBuckets is the number of distinct user buckets found in the source files, with invalid tenants counted as a single bucket.
+	UserBuckets int
+}
+
+func (s *consumedFilesStats) add(bytes int64) {
+	s.Files++
+	s.Bytes += bytes
+}
+
+func (s consumedFilesStats) log(logger log.Logger) {
+	level.Info(logger).Log(
+		"msg", "compacted common index",
+		"consumed_files", s.Files,
+		"consumed_bytes", s.Bytes,
+		"user_buckets", s.UserBuckets,
+	)
+}
@@ -0,0 +1,45 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_ConsumedFilesStats(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+		NumCompactedDBs:   1,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: 3,
+	}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	// measure the source files before they get merged.
+	expectedBytes := int64(0)
+	for _, sourceFile := range tCompactor.commonIndexSet.ListSourceFiles() {
+		dbPair, err := tCompactor.downloadSourceFile(context.Background(), "", tCompactor.commonIndexSet, sourceFile)
+		require.NoError(t, err)
+		require.NoError(t, dbPair.db.View(func(tx *bbolt.Tx) error {
+			expectedBytes += tx.Size()
+			return nil
+		}))
+		dbPair.cleanup(tCompactor.commonIndexSet.GetLogger())
+	}
+
+	commonIndex, consumedFiles, err := tCompactor.compactCommonIndexes(context.Background())
+	require.NoError(t, err)
+	defer commonIndex.Cleanup()
+
+	// the seed file, 2 uncompacted files of the common index and 2 uncompacted files with per user buckets
+	require.Equal(t, 5, consumedFiles.Files)
+	require.Equal(t, 3, consumedFiles.UserBuckets)
+	require.Equal(t, expectedBytes, consumedFiles.Bytes)
+}
@@ -0,0 +1,89 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// setupFileWithCorruptBucket builds a source file with 100 entries in the index bucket, 50 in the bucket of user1 and a corrupt bucket
+// for user2. The bucket of user2 is small enough to get inlined in the file, and its page gets flagged as a branch page for reading it
+// to fail on accessing its first entry.
+func setupFileWithCorruptBucket(t *testing.T) downloadedDb {
+	path := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, path, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, path, 0, 50, []byte("user1"))
+	testutil.AddRecordsToDB(t, path, 0, 5, []byte("user2"))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	// the value of an inline bucket is its header with a zero root page and sequence, followed by the header of its leaf page.
+	inlineBucket := append([]byte("user2"), make([]byte, 24)...)
+	idx := bytes.Index(content, append(inlineBucket, 0x02, 0x00))
+	require.NotEqual(t, -1, idx)
+	content[idx+len(inlineBucket)] = 0x01
+	require.NoError(t, os.WriteFile(path, content, 0o666))
+
+	db, err := openBoltdbFileWithNoSync(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	return downloadedDb{path: path, db: db}
+}
+
+func TestReadFileSkippingBuckets(t *testing.T) {
+	db := setupFileWithCorruptBucket(t)
+
+	// reading the corrupt bucket fails by default.
+	require.Panics(t, func() {
+		_ = readFile(util_log.Logger, db, Options{}.newBatchSizer(), func(string, []indexEntry) error { return nil })
+	})
+
+	entries := map[string]int{}
+	var skipped []string
+	err := readFileSkippingBuckets(util_log.Logger, db, Options{}.newBatchSizer(), func(bucketName string, batch []indexEntry) error {
+		entries[bucketName] += len(batch)
+		return nil
+	}, func(bucketName string, err error) {
+		require.Error(t, err)
+		skipped = append(skipped, bucketName)
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{string(local.IndexBucketName): 100, "user1": 50}, entries)
+	require.Equal(t, []string{"user2"}, skipped)
+
+	// failures writing the entries are not skipped.
+	writeErr := errors.New("write failure")
+	err = readFileSkippingBuckets(util_log.Logger, db, Options{}.newBatchSizer(), func(string, []indexEntry) error {
+		return writeErr
+	}, func(string, error) {
+		t.Fatal("write failures should not skip buckets")
+	})
+	require.ErrorIs(t, err, writeErr)
+}
+
+func TestTable_SkipCorruptBuckets(t *testing.T) {
+	db := setupFileWithCorruptBucket(t)
+
+	for _, maxWriteBatchErrors := range []int{0, 2} {
+		tCompactor := newReadAheadTableCompactor(Options{SkipCorruptBuckets: true, MaxWriteBatchErrors: maxWriteBatchErrors})
+		entries := 0
+		require.NoError(t, tCompactor.readSourceFile(context.Background(), util_log.Logger, db, func(_ string, batch []indexEntry) error {
+			entries += len(batch)
+			return nil
+		}))
+		require.Equal(t, 150, entries)
+		require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesCorruptBucketsSkipped))
+	}
+}
@@ -0,0 +1,61 @@
+package compactor
+
+import (
+	"fmt"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// QuarantineCorruptSourceFileFunc receives a corrupt source file of the index of a user, or of the common index for an empty user id,
+// before it gets skipped by the compaction of its table. It is meant for copying the file from the storage to a "corrupt/" prefix
+// for inspecting it later, since the file gets removed from the storage along with the other source files of its index set.
+type QuarantineCorruptSourceFileFunc func(tableName, userID string, sourceFile storage.IndexFile) error
+
+// corruptSourceFileError is the error for a source file which got downloaded but could not be decompressed or opened as a boltdb file.
+type corruptSourceFileError struct {
+	file string
+	err  error
+}
+
+func newCorruptSourceFileError(file string, err error) error {
+	return &corruptSourceFileError{file: file, err: err}
+}
+
+func (e *corruptSourceFileError) Error() string {
+	return fmt.Sprintf("corrupt source file %s: %s", e.file, e.err)
+}
+
+func (e *corruptSourceFileError) Unwrap() error {
+	return e.err
+}
+
+// isCorruptBoltdbOpenErr returns true if the error of opening a downloaded boltdb file is caused by its content.
+func isCorruptBoltdbOpenErr(err error) bool {
+	return !errors.Is(err, bbolt.ErrTimeout)
+}
+
+// skipCorruptSourceFile returns true if the given error is caused by a corrupt source file which should be skipped as per
+// Options.SkipCorruptSourceFiles. Skipped files are recorded, and quarantined with Options.QuarantineCorruptSourceFile when set.
+// A file failing to be quarantined is not skipped to not lose it.
+func (t *tableCompactor) skipCorruptSourceFile(userID string, idxSet compactor.IndexSet, sourceFile storage.IndexFile, err error) bool {
+	var corruptErr *corruptSourceFileError
+	if !t.opts.SkipCorruptSourceFiles || !errors.As(err, &corruptErr) {
+		return false
+	}
+
+	if t.opts.QuarantineCorruptSourceFile != nil {
+		if err := t.opts.QuarantineCorruptSourceFile(idxSet.GetTableName(), userID, sourceFile); err != nil {
+			level.Error(idxSet.GetLogger()).Log("msg", "failed to quarantine corrupt source file", "file", sourceFile.Name, "err", err)
+			return false
+		}
+	}
+
+	level.Warn(idxSet.GetLogger()).Log("msg", "skipping corrupt source file", "file", sourceFile.Name, "err", err)
+	t.metrics.compactTablesCorruptFiles.Inc()
+	return true
+}
@@ -0,0 +1,115 @@
+package compactor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_CorruptSourceFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		opts           Options
+		quarantineErr  error
+		expectedErr    bool
+		expectedSkips  float64
+		expectedRecord int
+	}{
+		{
+			name:        "fail by default",
+			expectedErr: true,
+		},
+		{
+			name:           "skip corrupt files",
+			opts:           Options{SkipCorruptSourceFiles: true},
+			expectedSkips:  2,
+			expectedRecord: 200,
+		},
+		{
+			name:           "skip corrupt files with read ahead",
+			opts:           Options{SkipCorruptSourceFiles: true, CompactionReadAhead: 2},
+			expectedSkips:  2,
+			expectedRecord: 200,
+		},
+		{
+			name:          "fail when quarantine fails",
+			opts:          Options{SkipCorruptSourceFiles: true},
+			quarantineErr: errors.New("quarantine failed"),
+			expectedErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idxSet := newLatencyIndexSet(t, 4, 100, time.Millisecond)
+			require.NoError(t, os.WriteFile(filepath.Join(idxSet.sourceDir, "db-1"), []byte("not an index file, just some text"), 0o666))
+			// truncated boltdb file
+			require.NoError(t, os.Truncate(filepath.Join(idxSet.sourceDir, "db-2"), 64))
+
+			var (
+				quarantined   []string
+				quarantinedMx sync.Mutex
+			)
+			tc.opts.QuarantineCorruptSourceFile = func(tableName, userID string, sourceFile storage.IndexFile) error {
+				quarantinedMx.Lock()
+				defer quarantinedMx.Unlock()
+				quarantined = append(quarantined, sourceFile.Name)
+				return tc.quarantineErr
+			}
+
+			tableCompactor := newReadAheadTableCompactor(tc.opts)
+			compactedIndex, err := tableCompactor.compactUserIndexes(context.Background(), "user1", idxSet)
+			require.Equal(t, tc.expectedSkips, prom_testutil.ToFloat64(tableCompactor.metrics.compactTablesCorruptFiles))
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer compactedIndex.Cleanup()
+
+			sort.Strings(quarantined)
+			require.Equal(t, []string{"db-1", "db-2"}, quarantined)
+			records := readDB(t, compactedIndex.compactedFile)
+			require.Len(t, records[string(local.IndexBucketName)], tc.expectedRecord)
+
+			// only the compacted file should be left in the working dir
+			files, err := os.ReadDir(idxSet.workingDir)
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+		})
+	}
+}
+
+func TestTable_CorruptCommonSourceFiles(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+		NumCompactedDBs:   2,
+	}, testutil.PerUserDBsConfig{}, Options{SkipCorruptSourceFiles: true})
+	defer cleanupTableCompactor(tCompactor)
+
+	// corrupt the seed file and one of the uncompacted files.
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	for _, name := range []string{"compactor-0", "0"} {
+		require.NoError(t, commonIndexSet.objectClient.PutObject(context.Background(), path.Join(tableName, name), strings.NewReader("not an index file, just some text")))
+	}
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, float64(2), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesCorruptFiles))
+
+	// only the records of the remaining files should be in the compacted file.
+	compactedIndex := commonIndexSet.compactedIndex.(*CompactedIndex)
+	records := readDB(t, compactedIndex.compactedFile)
+	require.Len(t, records[string(local.IndexBucketName)], 400)
+}
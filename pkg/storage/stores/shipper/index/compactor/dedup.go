@@ -0,0 +1,112 @@
+package compactor
+
+import (
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+// dedupEntry identifies an index entry written to a bucket of a compacted file.
+type dedupEntry struct {
+	bucketName, k, v string
+}
+
+// entryDeduper drops the index entries already written to a compacted file from the batches getting written to it as per
+// Options.DedupEntriesWindow, like the entries found in multiple source files after ingester replays. It remembers up to window
+// entries, forgetting the oldest ones first, so duplicates written further apart than that are still written, which is safe since
+// writing the same entry again leaves the compacted file unchanged.
+type entryDeduper struct {
+	mtx    sync.Mutex
+	seen   map[dedupEntry]struct{}
+	ring   []dedupEntry
+	next   int
+	window int
+}
+
+func newEntryDeduper(window int) *entryDeduper {
+	return &entryDeduper{
+		seen:   make(map[dedupEntry]struct{}, window),
+		ring:   make([]dedupEntry, 0, window),
+		window: window,
+	}
+}
+
+// filter returns the entries of the batch which are neither already written nor duplicated in the batch, and the number of dropped entries.
+// The kept entries are remembered right away for dropping them from batches of other source files getting written concurrently,
+// evicting the oldest entries beyond the window.
+func (d *entryDeduper) filter(bucketName string, batch []indexEntry) ([]indexEntry, int) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	kept := make([]indexEntry, 0, len(batch))
+	for _, entry := range batch {
+		e := dedupEntry{bucketName: bucketName, k: string(entry.k), v: string(entry.v)}
+		if _, ok := d.seen[e]; ok {
+			continue
+		}
+
+		if len(d.ring) < d.window {
+			d.ring = append(d.ring, e)
+		} else {
+			delete(d.seen, d.ring[d.next])
+			d.ring[d.next] = e
+			d.next = (d.next + 1) % d.window
+		}
+		d.seen[e] = struct{}{}
+		kept = append(kept, entry)
+	}
+
+	return kept, len(batch) - len(kept)
+}
+
+// forget forgets the entries of a batch which failed to be written for not dropping them when they are seen again.
+func (d *entryDeduper) forget(bucketName string, batch []indexEntry) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, entry := range batch {
+		delete(d.seen, dedupEntry{bucketName: bucketName, k: string(entry.k), v: string(entry.v)})
+	}
+}
+
+// deduper returns the entryDeduper of the given compacted file, or nil when Options.DedupEntriesWindow is not configured.
+func (t *tableCompactor) deduper(indexFile *bbolt.DB) *entryDeduper {
+	if t.opts.DedupEntriesWindow <= 0 {
+		return nil
+	}
+
+	t.dedupersMtx.Lock()
+	defer t.dedupersMtx.Unlock()
+
+	d, ok := t.dedupers[indexFile]
+	if !ok {
+		d = newEntryDeduper(t.opts.DedupEntriesWindow)
+		t.dedupers[indexFile] = d
+	}
+
+	return d
+}
+
+// writeDedupedBatch drops the entries of the batch already written to the given compacted file as per Options.DedupEntriesWindow
+// before writing the rest of them with write.
+func (t *tableCompactor) writeDedupedBatch(indexFile *bbolt.DB, bucketName string, batch []indexEntry, write func(batch []indexEntry) error) error {
+	d := t.deduper(indexFile)
+	if d == nil {
+		return write(batch)
+	}
+
+	batch, dropped := d.filter(bucketName, batch)
+	if dropped > 0 {
+		t.metrics.compactTablesDuplicateEntriesDropped.Add(float64(dropped))
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := write(batch); err != nil {
+		d.forget(bucketName, batch)
+		return err
+	}
+
+	return nil
+}
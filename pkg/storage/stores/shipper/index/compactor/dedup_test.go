@@ -0,0 +1,86 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestEntryDeduper(t *testing.T) {
+	entry := func(k string) indexEntry {
+		return indexEntry{k: []byte(k), v: []byte("v")}
+	}
+
+	d := newEntryDeduper(2)
+	kept, dropped := d.filter("index", []indexEntry{entry("a"), entry("b"), entry("a")})
+	require.Equal(t, []indexEntry{entry("a"), entry("b")}, kept)
+	require.Equal(t, 1, dropped)
+
+	kept, dropped = d.filter("index", []indexEntry{entry("a"), entry("b")})
+	require.Empty(t, kept)
+	require.Equal(t, 2, dropped)
+
+	// the same entry in another bucket is not a duplicate.
+	kept, _ = d.filter("user1", []indexEntry{entry("a")})
+	require.Len(t, kept, 1)
+
+	// the oldest entries get forgotten beyond the window.
+	d = newEntryDeduper(2)
+	kept, _ = d.filter("index", []indexEntry{entry("a"), entry("b"), entry("c")})
+	require.Len(t, kept, 3)
+	kept, dropped = d.filter("index", []indexEntry{entry("c"), entry("a")})
+	require.Equal(t, []indexEntry{entry("a")}, kept)
+	require.Equal(t, 1, dropped)
+
+	// entries which failed to be written are not dropped when they are seen again.
+	d.forget("index", []indexEntry{entry("a")})
+	kept, _ = d.filter("index", []indexEntry{entry("a")})
+	require.Len(t, kept, 1)
+}
+
+func TestTable_DedupEntries(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts            Options
+		expectedDropped float64
+	}{
+		"disabled": {},
+		"enabled": {
+			opts:            Options{DedupEntriesWindow: 1000},
+			expectedDropped: 100,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+
+			// source files with the same entries, like after an ingester replay.
+			for _, name := range []string{"1", "2"} {
+				dbPath := filepath.Join(tempDir, name)
+				testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+				f, err := os.Open(dbPath)
+				require.NoError(t, err)
+				require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, name), f))
+				require.NoError(t, f.Close())
+			}
+
+			tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), tc.opts)
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+			require.Equal(t, tc.expectedDropped, prom_testutil.ToFloat64(tCompactor.metrics.compactTablesDuplicateEntriesDropped))
+
+			compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+			require.Len(t, readDB(t, compactedIndex.compactedFile)[string(local.IndexBucketName)], 100)
+		})
+	}
+}
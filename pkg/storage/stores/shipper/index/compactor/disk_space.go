@@ -0,0 +1,27 @@
+package compactor
+
+import (
+	"github.com/go-kit/log/level"
+)
+
+// hasMinFreeDiskSpace returns false if the free space of the filesystem of the working dir of the table is below Options.MinFreeDiskBytes.
+// Failures in getting the free space are logged without preventing the compaction.
+func (t *tableCompactor) hasMinFreeDiskSpace() bool {
+	if t.opts.MinFreeDiskBytes <= 0 {
+		return true
+	}
+
+	workingDir := t.commonIndexSet.GetWorkingDir()
+	freeBytes, err := freeDiskBytes(workingDir)
+	if err != nil {
+		level.Warn(t.commonIndexSet.GetLogger()).Log("msg", "failed to get free disk space of working dir, ignoring min free disk space", "working_dir", workingDir, "err", err)
+		return true
+	}
+
+	if freeBytes < uint64(t.opts.MinFreeDiskBytes) {
+		level.Warn(t.commonIndexSet.GetLogger()).Log("msg", "deferring compaction of table due to low free disk space in working dir", "working_dir", workingDir, "free_bytes", freeBytes, "min_free_bytes", t.opts.MinFreeDiskBytes)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package compactor
+
+import (
+	"syscall"
+)
+
+// freeDiskBytes returns the space available to unprivileged users on the filesystem of the given path.
+func freeDiskBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	//nolint:unconvert
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package compactor
+
+import (
+	"errors"
+)
+
+// freeDiskBytes is not supported on windows.
+func freeDiskBytes(_ string) (uint64, error) {
+	return 0, errors.New("getting free disk space is not supported on windows")
+}
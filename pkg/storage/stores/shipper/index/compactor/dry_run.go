@@ -0,0 +1,116 @@
+package compactor
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// DryRunReport lists the changes the compaction of a table would make to the storage.
+type DryRunReport struct {
+	// IndexSets holds the index sets whose source files would be replaced by a compacted index,
+	// keyed by user id with an empty user id for the common index.
+	IndexSets map[string]DryRunIndexSetReport
+}
+
+// DryRunIndexSetReport holds the changes the compaction of a table would make to an index set.
+type DryRunIndexSetReport struct {
+	// SourceFiles are the names of the source files which would be removed from the storage.
+	SourceFiles []string
+	// Upload is set when a compacted file would be uploaded. It is not set for the common index
+	// when all of its entries would move to user indexes.
+	Upload bool
+	// Recreated is set when the compacted file would be recreated to reclaim the space used by free pages.
+	Recreated bool
+	// RewrittenBytes is the size of the compacted file which would be uploaded.
+	RewrittenBytes int64
+}
+
+// RewrittenBytes returns the total size of the compacted files which would be uploaded.
+func (r DryRunReport) RewrittenBytes() int64 {
+	total := int64(0)
+	for _, idxSet := range r.IndexSets {
+		total += idxSet.RewrittenBytes
+	}
+
+	return total
+}
+
+// DryRunCallback receives the report of the changes the compaction of a table would make to the storage.
+type DryRunCallback func(tableName string, report DryRunReport)
+
+// DryRun returns true with Options.DryRunCallback, for the compactor to neither apply retention nor make any change to the storage.
+func (i indexCompactor) DryRun() bool {
+	return i.opts.DryRunCallback != nil
+}
+
+// dryRunReporter builds a DryRunReport from the compacted indexes of the index sets. It is safe for concurrent use.
+type dryRunReporter struct {
+	mtx       sync.Mutex
+	indexSets map[string]DryRunIndexSetReport
+}
+
+func newDryRunReporter() *dryRunReporter {
+	return &dryRunReporter{
+		indexSets: map[string]DryRunIndexSetReport{},
+	}
+}
+
+// add records the changes to the given index set and cleans up the compacted index, which never gets handed over to the index set.
+func (d *dryRunReporter) add(userID string, sourceFiles []storage.IndexFile, compactedIndex compactor.CompactedIndex) error {
+	idxSetReport := DryRunIndexSetReport{
+		SourceFiles: make([]string, 0, len(sourceFiles)),
+	}
+	for _, sourceFile := range sourceFiles {
+		idxSetReport.SourceFiles = append(idxSetReport.SourceFiles, sourceFile.Name)
+	}
+	sort.Strings(idxSetReport.SourceFiles)
+
+	if compactedIndex != nil {
+		if c, ok := compactedIndex.(*CompactedIndex); ok {
+			if err := c.compactedFile.View(func(tx *bbolt.Tx) error {
+				idxSetReport.RewrittenBytes = tx.Size()
+				return nil
+			}); err != nil {
+				return err
+			}
+			idxSetReport.Recreated = c.compactedFileRecreated
+		}
+		idxSetReport.Upload = true
+		compactedIndex.Cleanup()
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.indexSets[userID] = idxSetReport
+
+	return nil
+}
+
+func (d *dryRunReporter) report() DryRunReport {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	report := DryRunReport{IndexSets: make(map[string]DryRunIndexSetReport, len(d.indexSets))}
+	for userID, idxSetReport := range d.indexSets {
+		report.IndexSets[userID] = idxSetReport
+	}
+
+	return report
+}
+
+// reportDryRun logs the report of the dry run and passes it to Options.DryRunCallback.
+func (t *tableCompactor) reportDryRun() {
+	if t.dryRun == nil {
+		return
+	}
+
+	report := t.dryRun.report()
+	level.Info(t.commonIndexSet.GetLogger()).Log("msg", "dry run of table compaction", "index_sets", len(report.IndexSets), "rewritten_bytes", report.RewrittenBytes())
+	t.opts.DryRunCallback(t.commonIndexSet.GetTableName(), report)
+}
@@ -0,0 +1,31 @@
+package compactor
+
+import (
+	"os"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// skipEmptySourceFile returns true if the source file downloaded at the given path is empty, like when a flaky object store listed
+// an object with an empty body, in which case the downloaded file gets removed with a warning. The source file is skipped like a
+// corrupt one, while it still gets removed from the storage along with the other source files of its index set for not processing
+// it again.
+func (t *tableCompactor) skipEmptySourceFile(idxSet compactor.IndexSet, sourceFile storage.IndexFile, downloadAt string) (bool, error) {
+	fi, err := os.Stat(downloadAt)
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() > 0 {
+		return false, nil
+	}
+
+	level.Warn(idxSet.GetLogger()).Log("msg", "skipping empty source file", "file", sourceFile.Name)
+	t.metrics.compactTablesEmptyFilesSkipped.Inc()
+	if err := os.Remove(downloadAt); err != nil {
+		level.Error(idxSet.GetLogger()).Log("msg", "failed to remove empty source file", "file", downloadAt, "err", err)
+	}
+	return true, nil
+}
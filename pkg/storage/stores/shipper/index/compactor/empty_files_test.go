@@ -0,0 +1,58 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_EmptySourceFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	userID := testutil.BuildUserID(0)
+	for _, name := range []string{"1", "2"} {
+		dbPath := filepath.Join(tempDir, name)
+		testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+		testutil.AddRecordsToDB(t, dbPath, 0, 50, []byte(userID))
+		f, err := os.Open(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, name), f))
+		require.NoError(t, f.Close())
+	}
+	// an object listed with an empty body, in the common index and in the index of a user with another source file.
+	require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, "empty"), bytes.NewReader(nil)))
+	require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, userID, "empty"), bytes.NewReader(nil)))
+	userDBPath := filepath.Join(tempDir, "user")
+	testutil.AddRecordsToDB(t, userDBPath, 100, 50, local.IndexBucketName)
+	f, err := os.Open(userDBPath)
+	require.NoError(t, err)
+	require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, userID, "1"), f))
+	require.NoError(t, f.Close())
+
+	tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, float64(2), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesEmptyFilesSkipped))
+
+	// the empty files are removed along with the other source files.
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	require.True(t, commonIndexSet.removeSourceFiles)
+	require.Len(t, readDB(t, commonIndexSet.compactedIndex.(*CompactedIndex).compactedFile)[string(local.IndexBucketName)], 100)
+
+	userIndexSet := tCompactor.existingUserIndexSet[userID].(*mockIndexSet)
+	require.True(t, userIndexSet.removeSourceFiles)
+	require.Len(t, readDB(t, tCompactor.userCompactedIndexSet.all()[userID].compactedIndex.compactedFile)[string(local.IndexBucketName)], 100)
+}
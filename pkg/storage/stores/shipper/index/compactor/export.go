@@ -0,0 +1,135 @@
+package compactor
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+// tableExporter merges the compacted indexes of the index sets of a table into a single boltdb file for ExportTo, instead of them
+// getting handed over to the index sets. It is safe for concurrent use.
+type tableExporter struct {
+	ctx         context.Context
+	db          *bbolt.DB
+	fillPercent float64
+	// finalized is set once the compacted indexes of all the index sets got merged, which is not the case when the compaction of the
+	// table got deferred or skipped.
+	finalized bool
+}
+
+// add merges the given compacted index into the export file and cleans it up, since it never gets handed over to the index set.
+// The entries of the index of a user are merged into the bucket named after the user, while the buckets of the common index are
+// merged as they are.
+func (e *tableExporter) add(userID string, compactedIndex compactor.CompactedIndex) error {
+	if compactedIndex == nil {
+		return nil
+	}
+	defer compactedIndex.Cleanup()
+
+	c, ok := compactedIndex.(*CompactedIndex)
+	if !ok {
+		return errors.Errorf("can't export compacted index of type %T", compactedIndex)
+	}
+
+	batch := make([]indexEntry, 0, defaultBatchSize)
+	batchBucket := ""
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := e.db.Batch(func(tx *bbolt.Tx) error {
+			return putBatchInBucket(tx, []byte(batchBucket), e.fillPercent, batch)
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	err := c.ForEachEntry(e.ctx, func(bucketName string, k, v []byte) error {
+		if userID != "" && bucketName == string(local.IndexBucketName) {
+			bucketName = userID
+		}
+		if bucketName != batchBucket || len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return err
+			}
+			batchBucket = bucketName
+		}
+
+		batch = append(batch, indexEntry{k: k, v: v})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// ExportTo compacts the table like CompactTable, but streams the compacted indexes to w as a single boltdb file instead of handing them
+// over to the index sets, for backing up the index of the table without modifying the storage. All the source files get compacted,
+// including the ones which would not need to, and the entries of the index of each user end up in the bucket named after the user
+// like in FORMAT2 files. The file is gzipped with Options.GzipExport. The compacted dbs built in the working dirs and the export file
+// are removed once the file got streamed or the export failed. The export fails when the compaction of the table gets deferred or skipped,
+// like due to Options.ScheduleGate, and with Options.RecreateOnly. It must be called instead of CompactTable.
+func (t *tableCompactor) ExportTo(ctx context.Context, w io.Writer) error {
+	if t.opts.RecreateOnly {
+		return errors.New("can't export a table while only recreating its compacted dbs")
+	}
+
+	f, err := os.CreateTemp(t.commonIndexSet.GetWorkingDir(), "export-")
+	if err != nil {
+		return err
+	}
+	exportPath := f.Name()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(exportPath); err != nil {
+			level.Error(t.commonIndexSet.GetLogger()).Log("msg", "failed to remove export file", "path", exportPath, "err", err)
+		}
+	}()
+
+	db, err := openBoltdbFileWithNoSyncAndOptions(exportPath, &bbolt.Options{Timeout: t.opts.boltdbOpenTimeout()})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			level.Error(t.commonIndexSet.GetLogger()).Log("msg", "failed to close export file", "path", exportPath, "err", err)
+		}
+	}()
+
+	t.export = &tableExporter{ctx: ctx, db: db, fillPercent: t.opts.compactedFileFillPercent()}
+	if err := t.CompactTable(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !t.export.finalized {
+		return errors.Errorf("compaction of table %s got deferred or skipped, nothing to export", t.commonIndexSet.GetTableName())
+	}
+
+	return db.View(func(tx *bbolt.Tx) error {
+		if !t.opts.GzipExport {
+			_, err := tx.WriteTo(w)
+			return err
+		}
+
+		gzipWriter := gzip.NewWriter(w)
+		if _, err := tx.WriteTo(gzipWriter); err != nil {
+			return err
+		}
+		return gzipWriter.Close()
+	})
+}
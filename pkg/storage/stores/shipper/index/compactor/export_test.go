@@ -0,0 +1,119 @@
+package compactor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+var (
+	exportCommonDBsConfig = testutil.DBsConfig{
+		NumUnCompactedDBs: 5,
+		NumCompactedDBs:   1,
+	}
+	exportPerUserDBsConfig = testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{NumUnCompactedDBs: 2, NumCompactedDBs: 1},
+		NumUsers:  3,
+	}
+)
+
+// compactedTableRecords returns the records of the compacted indexes handed over to the index sets, with the index of each user
+// in the bucket named after the user like in an export.
+func compactedTableRecords(t *testing.T, tCompactor *tableCompactor) map[string]map[string]string {
+	records := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+	for userID, idxSet := range tCompactor.userCompactedIndexSet.all() {
+		userRecords := readDB(t, idxSet.compactedIndex.compactedFile)
+		records[userID] = userRecords[string(local.IndexBucketName)]
+	}
+	return records
+}
+
+func readExport(t *testing.T, content []byte) map[string]map[string]string {
+	path := filepath.Join(t.TempDir(), "export")
+	require.NoError(t, os.WriteFile(path, content, 0o640))
+
+	db, err := openBoltdbFileWithNoSyncAndOptions(path, &bbolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	return readDB(t, db)
+}
+
+func requireCleanWorkingDir(t *testing.T, tCompactor *tableCompactor) {
+	files, err := os.ReadDir(tCompactor.commonIndexSet.GetWorkingDir())
+	require.NoError(t, err)
+	for _, file := range files {
+		require.True(t, file.IsDir(), "file %s left in the working dir", file.Name())
+	}
+}
+
+func TestTableCompactor_ExportTo(t *testing.T) {
+	expectedCompactor := setupTableCompactor(t, exportCommonDBsConfig, exportPerUserDBsConfig, Options{})
+	defer cleanupTableCompactor(expectedCompactor)
+	require.NoError(t, expectedCompactor.CompactTable())
+	expected := compactedTableRecords(t, expectedCompactor)
+	require.Len(t, expected, 1+exportPerUserDBsConfig.NumUsers)
+
+	for _, gzipExport := range []bool{false, true} {
+		gzipExport := gzipExport
+		t.Run(fmt.Sprintf("gzip=%t", gzipExport), func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, exportCommonDBsConfig, exportPerUserDBsConfig, Options{GzipExport: gzipExport})
+			defer cleanupTableCompactor(tCompactor)
+
+			var buf bytes.Buffer
+			require.NoError(t, tCompactor.ExportTo(context.Background(), &buf))
+
+			content := buf.Bytes()
+			if gzipExport {
+				r, err := gzip.NewReader(&buf)
+				require.NoError(t, err)
+				content, err = io.ReadAll(r)
+				require.NoError(t, err)
+			}
+			require.Equal(t, expected, readExport(t, content))
+
+			// the index sets are left untouched.
+			require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+			require.False(t, tCompactor.commonIndexSet.(*mockIndexSet).removeSourceFiles)
+			for _, idxSet := range tCompactor.userCompactedIndexSet.all() {
+				require.Nil(t, idxSet.IndexSet.(*mockIndexSet).compactedIndex)
+				require.False(t, idxSet.IndexSet.(*mockIndexSet).removeSourceFiles)
+			}
+			requireCleanWorkingDir(t, tCompactor)
+		})
+	}
+}
+
+func TestTableCompactor_ExportToDeferred(t *testing.T) {
+	tCompactor := setupTableCompactor(t, exportCommonDBsConfig, exportPerUserDBsConfig, Options{
+		ScheduleGate: func(_ time.Time) bool {
+			return false
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	var buf bytes.Buffer
+	require.Error(t, tCompactor.ExportTo(context.Background(), &buf))
+	require.Zero(t, buf.Len())
+	require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+	requireCleanWorkingDir(t, tCompactor)
+
+	tCompactor = setupTableCompactor(t, exportCommonDBsConfig, exportPerUserDBsConfig, Options{RecreateOnly: true})
+	defer cleanupTableCompactor(tCompactor)
+	require.Error(t, tCompactor.ExportTo(context.Background(), &buf))
+	require.Zero(t, buf.Len())
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package compactor
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isFileLocked returns true if the file is locked by an open boltdb file of this or any other process.
+func isFileLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// the lock is released on closing the file.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return false, nil
+}
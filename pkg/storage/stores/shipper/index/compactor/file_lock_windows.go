@@ -0,0 +1,8 @@
+//go:build windows
+
+package compactor
+
+// isFileLocked always returns false on windows since open boltdb files can't be removed there anyway.
+func isFileLocked(_ string) (bool, error) {
+	return false, nil
+}
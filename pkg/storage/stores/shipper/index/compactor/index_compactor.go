@@ -2,36 +2,595 @@ package compactor
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
 
 	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
 )
 
 const (
-	batchSize = 1000
+	defaultBatchSize = 1000
 )
 
 type indexEntry struct {
 	k, v []byte
 }
 
-type indexCompactor struct{}
+// Options holds optional settings for tuning and observing the compaction of boltdb index.
+// The zero value keeps the default behaviour.
+type Options struct {
+	// TenantUsageCallback, when set, is called at the end of each successful table compaction with the
+	// number of entries and bytes seen per tenant bucket while compacting the table.
+	TenantUsageCallback TenantUsageCallback
 
-func NewIndexCompactor() compactor.IndexCompactor {
-	return indexCompactor{}
+	// ScheduleGate, when set, is consulted before starting the compaction of a table and at phase boundaries.
+	// Returning false defers the remaining work of the table to the next compaction run.
+	// Work which is already in-flight is always completed to keep the index consistent.
+	ScheduleGate func(now time.Time) bool
+
+	// Clock, when set, returns the current time used for deciding whether compacted dbs are old enough to be recreated, for the
+	// ScheduleGate and FutureTableGracePeriod, and for naming the files built in the working dirs, like for simulating which tables
+	// would get recreated at a given time with ShouldCompact. Durations of the compaction are still measured with the real clock.
+	// It defaults to time.Now.
+	Clock func() time.Time
+
+	// RetentionPeriod, when set, is used for dropping chunk index entries older than the retention period of their tenant
+	// while merging the source files. Tenants without a positive retention period are left untouched.
+	// Compacting tables of schemas before v9 fails when it is set, since their chunk index entries can't be decoded.
+	RetentionPeriod RetentionPeriodFunc
+
+	// ValidateTenantID, when set, is used for validating the tenant of the user buckets found in the common index.
+	// Entries of tenants failing the validation are routed to the "__invalid__" user index instead of
+	// creating a user index for them. All the tenants are considered valid by default.
+	ValidateTenantID func(userID string) bool
+
+	// NormalizeUserBucket, when set, returns the tenant owning the entries of the given user bucket found in the common index, for
+	// merging the buckets of a tenant sharded across multiple sub-tenant buckets, like "tenant/0" and "tenant/1", into the single
+	// index of the tenant. The tenant it returns is the one validated with ValidateTenantID and filtered with TenantAllowList and
+	// TenantDenyList. It must return the same tenant for a given bucket and defaults to using the bucket name as the tenant.
+	NormalizeUserBucket func(bucketName string) string
+
+	// CompactionReadInterval, when positive, is the minimum interval between the start of reading two source files of a table.
+	// It smooths out the IO caused by opening many files at once at the cost of slower compaction.
+	CompactionReadInterval time.Duration
+
+	// RecreateOnly skips merging of index files and only recreates the compacted dbs which are eligible for recreation
+	// to reclaim the space used by free pages.
+	RecreateOnly bool
+
+	// EnableProfilingLabels sets pprof labels with the table name and the phase of compaction on the hot paths of compaction
+	// for attributing CPU profiles to tables. It adds minor overhead.
+	EnableProfilingLabels bool
+
+	// LogBucketRouting logs at debug level the distinct bucket names of each source file of the common index and the number of its
+	// entries routed to each user, for confirming the split of the common index into per user indexes. Up to 20 bucket names and
+	// users are listed per file.
+	LogBucketRouting bool
+
+	// IntegrityMarkers stores a checksum of the content of compacted files in them before upload and
+	// verifies it when a compacted file is used as seed for compaction.
+	// A seed failing the verification, like in case of a truncated upload, is discarded and the compaction starts fresh.
+	IntegrityMarkers bool
+
+	// SourceFileMmapFlags are the mmap flags used by bbolt for opening the source files read while merging the index,
+	// like syscall.MAP_POPULATE for prefaulting the whole file to speed up sequential scans on fast disks.
+	// The default flags of bbolt are used when it is zero.
+	SourceFileMmapFlags int
+
+	// SeedSchemaPolicy sets whether the schema version is recorded in compacted files and how seed files built with an older
+	// schema version are handled to avoid mixing entries of different schema versions in a compacted file.
+	// It defaults to SeedSchemaPolicyRebuild, which rebuilds the compacted file instead of appending to an outdated seed file.
+	SeedSchemaPolicy SeedSchemaPolicy
+
+	// ValidateSourceSchema checks the structure of the keys of each source file merged while compacting a table, including the seed file,
+	// against the schema version of the period config of the table, like for a table straddling a schema boundary by misconfiguration.
+	// A file with a key not matching the schema version is logged and fails the compaction of the table with an error wrapping
+	// ErrSourceSchemaMismatch, which leaves all its source files in the storage. It costs an extra read of the keys of each source file,
+	// and it requires the v9 schema or later. A user index having a single source file is not compacted, so it is not checked.
+	ValidateSourceSchema bool
+
+	// DeterministicOutput makes compaction of identical source files produce byte-identical compacted files with names
+	// derived from their content instead of time, which is useful for testing and content-addressing of compacted files.
+	// Source files are merged one at a time in the order of their names, which makes compaction of large tables slower.
+	DeterministicOutput bool
+
+	// ContentHashInFileName appends a hash of the bucket names and their number of entries to the time in the names of the compacted
+	// files for upload, like <uploader>-<time>-<hash>, for detecting near-identical uploads of compactors racing on the same table.
+	// The hash is computed without reading the entries, so files with the same number of entries per bucket get the same hash.
+	// It is ignored with DeterministicOutput since the names are derived from the content of the files then.
+	ContentHashInFileName bool
+
+	// RemovedSourceFilesCallback, when set, is called at the end of each table compaction with the names of the source files
+	// removed from the storage after the upload of compacted files, for auditing deletions. It is also called when the compaction
+	// fails, with its error and the files removed until then, if any. It is only called for the tables compacted by the
+	// IndexCompactor returned by NewIndexCompactor, once the compactor is done with them.
+	RemovedSourceFilesCallback RemovedSourceFilesCallback
+
+	// SetCompactedIndexAuditFunc, when set, is called right before each compacted index gets set for an index set of a table,
+	// for keeping an audit trail of the changes made to the index by compaction. It only observes the changes without being able
+	// to prevent them. It is not called in dry run mode since no changes are made then.
+	SetCompactedIndexAuditFunc SetCompactedIndexAuditFunc
+
+	// CompactionReadAhead, when positive, is the number of source files of user indexes to download ahead of merging them,
+	// which overlaps the latency of downloads with merging of already downloaded files for object stores with high latency.
+	// Source files of the common index are always downloaded before merging them.
+	CompactionReadAhead int
+
+	// MinFreeDiskBytes, when positive, is the minimum free space required on the filesystem of the working dir for starting
+	// the compaction of a table. Tables are deferred to the next compaction run while the free space is below it.
+	MinFreeDiskBytes int64
+
+	// FinalizeConcurrency is the number of user indexes of a table to set the compacted index for concurrently
+	// at the end of its compaction, separate from the concurrency of reading source files. It defaults to 1.
+	FinalizeConcurrency int
+
+	// UserIndexSetShards is the number of shards of the compacted index sets of the users of a table being compacted, keyed by a hash
+	// of the user id, for reducing the lock contention between the workers merging source files of tables with thousands of tenants.
+	// It defaults to 16.
+	UserIndexSetShards int
+
+	// MaxOpenCompactedDBs, when positive, bounds the number of compacted dbs open at the same time across the tables being compacted,
+	// for not exhausting the memory or mmap space on very wide multi-tenant tables. Opening a db blocks while the limit is hit.
+	// A db stays open from the start of the compaction of its index until it is uploaded, and the compacted dbs of all the users of a
+	// table getting entries from the common index are open at the same time. So the limit needs to be higher than the number of
+	// users of the widest table, or its compaction blocks until its context is done. There is no limit by default.
+	MaxOpenCompactedDBs int
+
+	// FutureTableGracePeriod, when positive, skips compaction of tables starting later than the grace period from now,
+	// like the ones built by ingesters with a skewed clock, to not race with the ingestion once the table becomes active.
+	FutureTableGracePeriod time.Duration
+
+	// Heartbeat, when set, is called each time compaction of a table starts processing a source file or a user index,
+	// as a liveness signal for detecting tables which stopped making progress. It must be safe for concurrent use and cheap.
+	Heartbeat func()
+
+	// Paused, when set, is checked before processing each source file and before compacting each user index which received no
+	// updates from the common index. It returns nil when the compaction is not paused, or a channel closed once the compaction
+	// gets resumed, which blocks the compaction of the table while its context is not done, keeping the progress of the
+	// compacted dbs being built. Pauser implements it for pausing the compaction on demand. It must be safe for concurrent use.
+	Paused func() <-chan struct{}
+
+	// SeedFileStrategy, when set, selects the previously compacted file of the common index used as seed for copying the other
+	// source files into, like SeedNewestCompactedFile for not picking a stale file left behind by a failed upload.
+	// SeedLargestCompactedFile is used by default.
+	SeedFileStrategy SeedFileStrategy
+
+	// UploaderName is the prefix of the names of the compacted files built by the compactor, which tells them apart from the files
+	// built by ingesters for using them as seed. It defaults to "compactor".
+	UploaderName string
+	// SeedUploaderNames are the prefixes of the names of compacted files built by other trusted processes, like a reindexer,
+	// which are treated as compacted files like the ones named after UploaderName for using them as seed instead of copying them.
+	SeedUploaderNames []string
+
+	// DryRunCallback, when set, runs the compaction of tables in dry run mode for validating the configuration on real data.
+	// Source files still get downloaded and merged in the working dir, but the compacted indexes are not set for their index sets,
+	// so nothing gets uploaded or removed from the storage. Instead, the callback is called at the end of each successful table
+	// compaction with the report of the changes it would have made. Retention is not applied to the tables compacted by the
+	// IndexCompactor returned by NewIndexCompactor in dry run mode, since it would mark chunks for deletion.
+	DryRunCallback DryRunCallback
+
+	// ProgressCallback, when set, is called as the source files of the common index of a table get merged, for surfacing the progress
+	// of compacting tables with many source files. It is called before merging the first file, after merging the last one and otherwise
+	// at most once per ProgressInterval. Calls are serialized, but they block the merge of files so the callback needs to be cheap.
+	ProgressCallback ProgressCallback
+	// ProgressInterval is the minimum interval between the calls to ProgressCallback while merging files. It defaults to 10s.
+	ProgressInterval time.Duration
+
+	// RecreateCompactedDBOlderThan is the minimum age of a compacted file for recreating it to reclaim the space used by free pages,
+	// when it is the only source file of its index set. Lower values reclaim space sooner in clusters with high retention churn at
+	// the cost of recreating large files more often. It defaults to 12h.
+	RecreateCompactedDBOlderThan time.Duration
+
+	// BoltdbOpenTimeout is the timeout for acquiring the file lock while opening the source files and the compacted dbs, for failing
+	// the compaction of a table instead of hanging while another process holds the lock of a file, like with shared working dirs.
+	// It defaults to 5s.
+	BoltdbOpenTimeout time.Duration
+
+	// ExcludeFromRecreate, when set, excludes the compacted dbs of the tables or users it returns true for from being recreated,
+	// like for hot tables which get compacted often enough to not need dropping their free pages. It defaults to no exclusions.
+	ExcludeFromRecreate RecreateExclusionFunc
+
+	// RecreateMinReclaimableBytes, when set, only recreates the compacted dbs due for recreation when the estimate of the bytes reclaimed
+	// by recreating them, as returned by CompactedIndex.EstimateReclaimableBytes, is at least it, for not rewriting large files for marginal
+	// savings. Dbs below it are uploaded as if they got recreated for not considering them again, except with RecreateOnly which leaves
+	// them untouched. It does not apply to RewriteInKeyOrder. It defaults to recreating the dbs regardless of the reclaimable bytes.
+	RecreateMinReclaimableBytes int64
+
+	// DropFreePagesTxMaxSize is the number of bytes after which the transaction copying a compacted file is committed while recreating it.
+	// Larger transactions speed up recreation of large files since the copied pages are kept in memory until the transaction gets
+	// committed, which also increases the memory usage by the same amount. It defaults to 100MB.
+	DropFreePagesTxMaxSize int64
+
+	// StagingDir, when set, is the dir the compacted dbs get built and recreated in instead of the working dirs of their index sets, like
+	// a local SSD for working dirs on slow or network storage. Each index set gets the path of its working dir relative to the one of the
+	// table under it. The compacted dbs are moved to the working dir of their index set before being handed over with SetCompactedIndex,
+	// with a rename on the same file system or by copying them to a temporary file renamed into place otherwise, and the staging dir
+	// of the table is removed once its compaction is done. It defaults to building the compacted dbs in the working dirs.
+	StagingDir string
+
+	// CompactedFileFillPercent is the fill percent of the pages of the buckets written to while merging the source files into the
+	// compacted files, between 0.1 and 1. Higher values reduce the size of the compacted files for append-heavy writes at the cost of
+	// splitting more pages on writes out of order. It defaults to the fill percent of bbolt of 0.5.
+	CompactedFileFillPercent float64
+
+	// CompactedFileInitialMmapSize is the initial size in bytes of the mmap of the compacted files built while merging the source files,
+	// for large tables to remap the compacted files less often as they grow. The default size of bbolt is used when it is zero.
+	CompactedFileInitialMmapSize int
+
+	// BatchSize is the number of index entries read from the source files which are written to the compacted files in a single batch.
+	// Larger batches reduce the overhead of boltdb transactions for tables with small entries at the cost of keeping more entries in memory.
+	// With AdaptiveBatchBytes set, it is the maximum number of entries in a batch. It defaults to 1000.
+	BatchSize int
+
+	// AdaptiveBatchBytes, when positive, sizes the batches by the average size of the entries seen so far in each source file for holding
+	// about AdaptiveBatchBytes of entries, capped at BatchSize entries. A batch is also written as soon as its entries add up to
+	// AdaptiveBatchBytes, which bounds the memory used by batches of tables with huge entries.
+	AdaptiveBatchBytes int64
+
+	// WriteSourceFileInOneTx writes all the batches of entries of a source file merged into a compacted file in a single boltdb transaction,
+	// instead of a transaction per batch, which reduces the overhead of committing transactions for tables with many small batches.
+	// The transaction is committed early when the entries of the file get written to another compacted file, like for the user buckets
+	// of the common index, and once SourceFileTxMaxSize bytes of entries got written in it. Other source files getting merged into
+	// the same compacted file at the same time wait for the transaction to be committed.
+	WriteSourceFileInOneTx bool
+	// SourceFileTxMaxSize is the number of bytes of entries after which the transaction of WriteSourceFileInOneTx is committed,
+	// bounding the memory used by the transactions of large source files. It defaults to 100MB.
+	SourceFileTxMaxSize int64
+
+	// DedupEntriesWindow, when positive, drops the index entries already written to a compacted file while merging the source files,
+	// like the entries found in multiple source files after ingester replays, to save the work of writing them again. Up to
+	// DedupEntriesWindow of the most recently written entries are kept in memory for each compacted file, bounding the memory used by it.
+	// Duplicates are written by default, which leaves the compacted files unchanged since boltdb keeps a single value for each key.
+	DedupEntriesWindow int
+
+	// MaxWriteBatchErrors, when positive, keeps merging a source file after writing a batch of its entries fails, for reporting up to
+	// MaxWriteBatchErrors errors of the file combined like while diagnosing systemic index corruption in validation compactions.
+	// The compaction of the table still fails with the combined errors. By default, the first error fails the compaction right away.
+	MaxWriteBatchErrors int
+
+	// CheckpointEveryNFiles, when positive, records a checkpoint in the working dir after every CheckpointEveryNFiles source files of
+	// the common index of a table got merged, for resuming the compaction of the table from it when the compactor process gets killed
+	// midway instead of merging all the files again. The working dir must be kept across restarts of the compactor for resuming.
+	// Setting it to 1 records every merged file. The checkpoint is only advisory and is discarded for compacting the table from scratch
+	// when any of the source files it recorded got removed since, while files uploaded after it get merged after resuming.
+	// The compacted files are still not synced to disk, so the checkpoint does not survive a crash of the node itself.
+	CheckpointEveryNFiles int
+
+	// RewriteInKeyOrder rewrites the compacted dbs built while compacting a table which did not get recreated already into fresh
+	// files before uploading them, like while recreating them, for keeping the entries sharing a key prefix in physically
+	// contiguous and fully filled pages, which improves the locality of cold cache scans of the compacted index by queries.
+	// It costs an extra copy of each compacted db, done with up to RecreateConcurrency of the user dbs concurrently.
+	RewriteInKeyOrder bool
+
+	// RecreateConcurrency is the number of user indexes of a table which did not receive any updates from the common index
+	// to compact or recreate concurrently, separate from the concurrency of reading source files. It defaults to 1.
+	RecreateConcurrency int
+
+	// SkipCorruptSourceFiles skips the source files which fail to be decompressed or opened as a boltdb file, like truncated files,
+	// instead of failing the compaction of their table. Skipped files get removed from the storage along with the other source
+	// files of their index set once the compacted index is uploaded. A user index having a single source file is not compacted,
+	// so it is not checked. Compaction fails on corrupt source files by default.
+	SkipCorruptSourceFiles bool
+
+	// SkipCorruptBuckets skips the buckets of source files which fail to be read, like a corrupt user bucket of a FORMAT2 file,
+	// instead of failing the compaction of their table, for recovering the other buckets of partially corrupt files. The faults and
+	// panics of reading a bucket are recovered from, and the entries of the bucket read before the failure are still compacted.
+	// Skipped buckets are counted by the compact_tables_corrupt_buckets_skipped_total metric, and the source files get removed from
+	// the storage along with the other source files of their index set once the compacted index is uploaded. Failures writing the
+	// entries are never skipped. Compaction fails on buckets failing to be read by default.
+	SkipCorruptBuckets bool
+
+	// GzipExport gzips the boltdb file streamed by the ExportTo method of the table compactors.
+	GzipExport bool
+
+	// VerifySourceFilesAccounting fails the compaction of a table with an error wrapping ErrSourceFilesUnaccounted when the number
+	// of source files of its common index merged, reused as seed, consumed before a checkpoint or skipped does not add up to the
+	// number of source files listed, which catches source files silently left out while still getting removed from the storage.
+	// The totals are always logged at debug level.
+	VerifySourceFilesAccounting bool
+
+	// MaxDecompressedSourceFileBytes, when positive, is the maximum size of a compressed source file after decompressing it, for guarding
+	// against decompression bombs uploaded by a compromised source. It applies to the source files still compressed after their download,
+	// while the index sets apply their own limit to the files they decompress while downloading them, like
+	// Config.MaxDecompressedSourceFileSize of the compactor. A file decompressing beyond it fails the compaction of its table with an error
+	// wrapping storage.ErrDecompressedSizeLimitExceeded, even with SkipCorruptSourceFiles. The decompressed size is not limited by default.
+	MaxDecompressedSourceFileBytes int64
+
+	// QuarantineCorruptSourceFile, when set, is called with each corrupt source file before skipping it as per SkipCorruptSourceFiles,
+	// for copying it to a "corrupt/" prefix in the storage. Compaction of the table fails when it returns an error to not lose the file.
+	// It must be safe for concurrent use.
+	QuarantineCorruptSourceFile QuarantineCorruptSourceFileFunc
+
+	// TransformEntry, when set, is applied to each index entry read from the source files before writing it to the compacted files,
+	// for rewriting or dropping entries like while renaming tenants. Entries of the common index moved to another bucket are written to
+	// the index of the user named by the bucket, or to the common index for the "index" bucket. Per user index files only have the
+	// "index" bucket and their entries can't be moved to another bucket. It must be safe for concurrent use.
+	TransformEntry EntryTransformFunc
+
+	// SyncRecreatedCompactedDBs syncs the compacted dbs recreated for reclaiming the space used by free pages to disk on each commit,
+	// for ruling out corruption by the disk cache before their upload in forensic investigations. It slows down recreation of dbs.
+	// The files built while compacting are not synced to disk by default since compaction is idempotent and the files are not retained.
+	SyncRecreatedCompactedDBs bool
+
+	// VerifyRecreatedCompactedDBs compares the entries and content checksum of the recreated compacted dbs with the dbs they got recreated from
+	// before discarding the old ones. A mismatch fails the compaction of the table while keeping the old db.
+	// It doubles the cost of reading the dbs while recreating them.
+	VerifyRecreatedCompactedDBs bool
+
+	// SplitCommonIndex, when set, runs compaction in a migration mode for enabling per user index on tables built before with only
+	// the common index. Entries of the common index bucket are moved to the index of the user returned for their key, like by
+	// UserIDFromIndexKey, while entries for which no user is returned stay in the common index. Previously compacted files of the
+	// common index are not used as seed to split them as well. It is meant to be set only until the tables of the schema period
+	// it is used for got compacted once, since each compaction has to read all the source files of the common index.
+	SplitCommonIndex CommonIndexUserIDFunc
+
+	// TenantAllowList and TenantDenyList select the tenants whose index gets compacted, like for compacting tenants with huge indexes
+	// on a separate schedule. All the tenants are selected when both of them are empty, and a tenant in both of them is not selected.
+	// The per user indexes of tenants which are not selected are left untouched, while their entries found in the source files of the
+	// common index are kept in their buckets of the compacted common index since these source files get removed after compaction.
+	// Such buckets are not covered by the retention and deletion applied to the compacted common index until their tenant gets selected.
+	TenantAllowList []string
+	TenantDenyList  []string
+
+	// TenantMetricsAllowList, when set, exports the entries, bytes and source files compacted into per user indexes by tenant for the
+	// tenants in it, like the biggest ones, while all the other tenants are aggregated under the "other" tenant label for bounding the
+	// cardinality of the metrics. No per tenant metrics are exported when it is empty, and it must not contain "other".
+	TenantMetricsAllowList []string
+
+	// MaxEntriesPerUserIndex, when positive, is the number of entries written into the index of a user while compacting a table above
+	// which a warning gets logged and the user gets counted by the compact_tables_tenant_index_over_limit_total metric, with the
+	// tenant label bounded as per TenantMetricsAllowList, as an early warning of cardinality abuse. The entries already in the
+	// compacted index the new ones get merged into are not counted. There is no limit by default.
+	MaxEntriesPerUserIndex int64
+	// RejectUserIndexOverLimit fails the compaction of the tables writing more entries than MaxEntriesPerUserIndex into the index of
+	// a user with an error wrapping ErrUserIndexOverLimit, leaving their source files untouched, instead of only reporting the user.
+	RejectUserIndexOverLimit bool
+
+	// PeriodIndexCompactors, when set, dispatches the compaction of tables of periods with an index type other than boltdb-shipper,
+	// like tsdb, to the IndexCompactor registered for their index type, keyed by index type. It gets the same index sets for downloading
+	// the source files and building the compacted indexes. The index type is decided by the period config of a table as a whole,
+	// so tables spanning periods of different index types are not supported.
+	PeriodIndexCompactors map[string]compactor.IndexCompactor
+}
+
+// Validate returns an error if the Options are invalid. Zero values use the defaults.
+func (o Options) Validate() error {
+	if o.BoltdbOpenTimeout < 0 {
+		return errors.New("boltdb open timeout must not be negative")
+	}
+	if o.RecreateCompactedDBOlderThan < 0 {
+		return errors.New("recreate compacted db older than must not be negative")
+	}
+	if o.RecreateMinReclaimableBytes < 0 {
+		return errors.New("recreate min reclaimable bytes must not be negative")
+	}
+	if o.DropFreePagesTxMaxSize < 0 {
+		return errors.New("drop free pages tx max size must not be negative")
+	}
+	if o.ProgressInterval < 0 {
+		return errors.New("progress interval must not be negative")
+	}
+	if _, ok := o.PeriodIndexCompactors[config.BoltDBShipperType]; ok {
+		return errors.New("period index compactors must not include the boltdb-shipper index type")
+	}
+	if o.CheckpointEveryNFiles < 0 {
+		return errors.New("checkpoint every n files must not be negative")
+	}
+	if o.MaxDecompressedSourceFileBytes < 0 {
+		return errors.New("max decompressed source file bytes must not be negative")
+	}
+	if o.MaxWriteBatchErrors < 0 {
+		return errors.New("max write batch errors must not be negative")
+	}
+	for _, uploaderName := range o.SeedUploaderNames {
+		if uploaderName == "" {
+			return errors.New("seed uploader names must not be empty")
+		}
+	}
+	if o.BatchSize < 0 {
+		return errors.New("batch size must not be negative")
+	}
+	if o.AdaptiveBatchBytes < 0 {
+		return errors.New("adaptive batch bytes must not be negative")
+	}
+	if o.SourceFileTxMaxSize < 0 {
+		return errors.New("source file tx max size must not be negative")
+	}
+	if o.CompactedFileFillPercent != 0 && (o.CompactedFileFillPercent < 0.1 || o.CompactedFileFillPercent > 1) {
+		return errors.New("compacted file fill percent must be between 0.1 and 1")
+	}
+	if o.MaxOpenCompactedDBs < 0 {
+		return errors.New("max open compacted dbs must not be negative")
+	}
+	if o.UserIndexSetShards < 0 {
+		return errors.New("user index set shards must not be negative")
+	}
+	if o.DedupEntriesWindow < 0 {
+		return errors.New("dedup entries window must not be negative")
+	}
+	if o.CompactedFileInitialMmapSize < 0 {
+		return errors.New("compacted file initial mmap size must not be negative")
+	}
+	if o.MaxEntriesPerUserIndex < 0 {
+		return errors.New("max entries per user index must not be negative")
+	}
+	if o.RejectUserIndexOverLimit && o.MaxEntriesPerUserIndex <= 0 {
+		return errors.New("reject user index over limit requires max entries per user index")
+	}
+	for _, userID := range o.TenantMetricsAllowList {
+		if userID == otherTenantsLabel {
+			return errors.New("tenant metrics allow list must not contain the \"other\" tenant label")
+		}
+	}
+
+	return nil
+}
+
+func (o Options) now() time.Time {
+	if o.Clock == nil {
+		return time.Now()
+	}
+
+	return o.Clock()
+}
+
+func (o Options) boltdbOpenTimeout() time.Duration {
+	if o.BoltdbOpenTimeout == 0 {
+		return defaultBoltdbOpenTimeout
+	}
+
+	return o.BoltdbOpenTimeout
+}
+
+func (o Options) recreateCompactedDBOlderThan() time.Duration {
+	if o.RecreateCompactedDBOlderThan == 0 {
+		return defaultRecreateCompactedDBOlderThan
+	}
+
+	return o.RecreateCompactedDBOlderThan
+}
+
+func (o Options) progressInterval() time.Duration {
+	if o.ProgressInterval == 0 {
+		return defaultProgressInterval
+	}
+
+	return o.ProgressInterval
+}
+
+func (o Options) uploaderName() string {
+	if o.UploaderName == "" {
+		return defaultUploaderName
+	}
+
+	return o.UploaderName
+}
+
+// uploaderNames returns the prefixes of the names of source files which are treated as compacted files.
+func (o Options) uploaderNames() []string {
+	return append([]string{o.uploaderName()}, o.SeedUploaderNames...)
+}
+
+func (o Options) compactedFileFillPercent() float64 {
+	if o.CompactedFileFillPercent == 0 {
+		return bbolt.DefaultFillPercent
+	}
+
+	return o.CompactedFileFillPercent
+}
+
+func (o Options) dropFreePagesTxMaxSize() int64 {
+	if o.DropFreePagesTxMaxSize == 0 {
+		return defaultDropFreePagesTxMaxSize
+	}
+
+	return o.DropFreePagesTxMaxSize
+}
+
+func (o Options) sourceFileTxMaxSize() int64 {
+	if o.SourceFileTxMaxSize == 0 {
+		return defaultSourceFileTxMaxSize
+	}
+
+	return o.SourceFileTxMaxSize
+}
+
+type indexCompactor struct {
+	opts    Options
+	metrics *metrics
+	// openDBs is shared by the tables being compacted for bounding the compacted dbs open across them.
+	openDBs *openDBLimiter
+}
+
+// NewIndexCompactor returns the IndexCompactor for boltdb shipper tables, or an error if the Options are invalid.
+func NewIndexCompactor(opts Options, r prometheus.Registerer) (compactor.IndexCompactor, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid boltdb shipper compactor options: %w", err)
+	}
+
+	metrics := newMetrics(r)
+	return indexCompactor{
+		opts:    opts,
+		metrics: metrics,
+		openDBs: newOpenDBLimiter(opts.MaxOpenCompactedDBs, metrics.compactTablesOpenCompactedDBs),
+	}, nil
 }
 
 func (i indexCompactor) NewTableCompactor(ctx context.Context, commonIndexSet compactor.IndexSet, existingUserIndexSet map[string]compactor.IndexSet, userIndexSetFactoryFunc compactor.MakeEmptyUserIndexSetFunc, periodConfig config.PeriodConfig) compactor.TableCompactor {
-	return newTableCompactor(ctx, commonIndexSet, existingUserIndexSet, userIndexSetFactoryFunc, periodConfig)
+	if periodIndexCompactor, ok := i.periodIndexCompactor(periodConfig); ok {
+		return periodIndexCompactor.NewTableCompactor(ctx, commonIndexSet, existingUserIndexSet, userIndexSetFactoryFunc, periodConfig)
+	}
+
+	t := newTableCompactor(ctx, commonIndexSet, existingUserIndexSet, userIndexSetFactoryFunc, periodConfig, i.opts, i.metrics)
+	t.openDBs = i.openDBs
+	return t
 }
 
-func (i indexCompactor) OpenCompactedIndexFile(_ context.Context, path, tableName, _, workingDir string, periodConfig config.PeriodConfig, logger log.Logger) (compactor.CompactedIndex, error) {
-	boltdb, err := openBoltdbFileWithNoSync(path)
+// CompactUserIndexMetrics holds the metrics recorded by CompactUserIndex. They are registered once with NewCompactUserIndexMetrics
+// and shared by all the calls, like while compacting the indexes of many users in a loop.
+type CompactUserIndexMetrics struct {
+	metrics *metrics
+}
+
+// NewCompactUserIndexMetrics registers the metrics recorded by CompactUserIndex with the given Registerer, which can be nil for not
+// exporting them.
+func NewCompactUserIndexMetrics(r prometheus.Registerer) *CompactUserIndexMetrics {
+	return &CompactUserIndexMetrics{metrics: newMetrics(r)}
+}
+
+// CompactUserIndex compacts all the source files of the index of a single user into a single CompactedIndex
+// the same way as it is done while compacting a table, without compacting the rest of the table.
+// A user index with a single source file is opened as is, and a user index without source files is left alone like while compacting
+// a table, returning a nil CompactedIndex without an error.
+// It does not set the CompactedIndex for the IndexSet, so the caller owns the returned CompactedIndex.
+// The metrics of the compaction are recorded in the given CompactUserIndexMetrics, and not exported when it is nil.
+// An error is returned if the Options are invalid.
+func CompactUserIndex(ctx context.Context, userID string, userIndexSet compactor.IndexSet, periodConfig config.PeriodConfig, opts Options, metrics *CompactUserIndexMetrics) (*CompactedIndex, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid boltdb shipper compactor options: %w", err)
+	}
+	if metrics == nil {
+		metrics = NewCompactUserIndexMetrics(nil)
+	}
+
+	t := newTableCompactor(ctx, userIndexSet, nil, nil, periodConfig, opts, metrics.metrics)
+	if t.retentionErr != nil {
+		return nil, t.retentionErr
+	}
+	if len(userIndexSet.ListSourceFiles()) == 0 {
+		return nil, nil
+	}
+	return t.compactUserIndexSet(ctx, userID, userIndexSet)
+}
+
+func (i indexCompactor) OpenCompactedIndexFile(ctx context.Context, path, tableName, userID, workingDir string, periodConfig config.PeriodConfig, logger log.Logger) (compactor.CompactedIndex, error) {
+	if periodIndexCompactor, ok := i.periodIndexCompactor(periodConfig); ok {
+		return periodIndexCompactor.OpenCompactedIndexFile(ctx, path, tableName, userID, workingDir, periodConfig, logger)
+	}
+
+	boltdb, err := openBoltdbFileWithNoSyncAndOptions(path, &bbolt.Options{Timeout: i.opts.boltdbOpenTimeout()})
 	if err != nil {
 		return nil, err
 	}
 
-	return newCompactedIndex(boltdb, tableName, workingDir, periodConfig, logger), nil
+	// the file is opened for applying retention after the compaction of its table, which does not recreate it, so it has no staging dir.
+	// It is not counted against Options.MaxOpenCompactedDBs either since the compacted dbs of the table keep their slots until their
+	// upload, which only happens after applying retention.
+	return newCompactedIndexWithOptions(boltdb, tableName, workingDir, "", periodConfig, logger, i.opts, nil), nil
+}
+
+// periodIndexCompactor returns the IndexCompactor of Options.PeriodIndexCompactors for the index type of the given period config.
+func (i indexCompactor) periodIndexCompactor(periodConfig config.PeriodConfig) (compactor.IndexCompactor, bool) {
+	if periodConfig.IndexType == config.BoltDBShipperType {
+		return nil, false
+	}
+
+	periodIndexCompactor, ok := i.opts.PeriodIndexCompactors[periodConfig.IndexType]
+	return periodIndexCompactor, ok
 }
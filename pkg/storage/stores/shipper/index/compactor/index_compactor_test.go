@@ -0,0 +1,231 @@
+package compactor
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// newTestIndexCompactor returns an IndexCompactor for the given Options, which must be valid.
+func newTestIndexCompactor(t testing.TB, opts Options) compactor.IndexCompactor {
+	indexCompactor, err := NewIndexCompactor(opts, nil)
+	require.NoError(t, err)
+	return indexCompactor
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts        Options
+		expectedErr bool
+	}{
+		"defaults": {},
+		"custom recreate settings": {
+			opts: Options{RecreateCompactedDBOlderThan: time.Hour, DropFreePagesTxMaxSize: 1024},
+		},
+		"negative recreate compacted db older than": {
+			opts:        Options{RecreateCompactedDBOlderThan: -time.Hour},
+			expectedErr: true,
+		},
+		"negative drop free pages tx max size": {
+			opts:        Options{DropFreePagesTxMaxSize: -1},
+			expectedErr: true,
+		},
+		"period index compactor for boltdb-shipper": {
+			opts:        Options{PeriodIndexCompactors: map[string]compactor.IndexCompactor{config.BoltDBShipperType: &mockPeriodIndexCompactor{}}},
+			expectedErr: true,
+		},
+		"negative progress interval": {
+			opts:        Options{ProgressInterval: -time.Second},
+			expectedErr: true,
+		},
+		"negative checkpoint every n files": {
+			opts:        Options{CheckpointEveryNFiles: -1},
+			expectedErr: true,
+		},
+		"negative max write batch errors": {
+			opts:        Options{MaxWriteBatchErrors: -1},
+			expectedErr: true,
+		},
+		"empty seed uploader name": {
+			opts:        Options{SeedUploaderNames: []string{""}},
+			expectedErr: true,
+		},
+		"negative batch size": {
+			opts:        Options{BatchSize: -1},
+			expectedErr: true,
+		},
+		"negative adaptive batch bytes": {
+			opts:        Options{AdaptiveBatchBytes: -1},
+			expectedErr: true,
+		},
+		"negative source file tx max size": {
+			opts:        Options{SourceFileTxMaxSize: -1},
+			expectedErr: true,
+		},
+		"negative recreate min reclaimable bytes": {
+			opts:        Options{RecreateMinReclaimableBytes: -1},
+			expectedErr: true,
+		},
+		"tenant metrics allow list": {
+			opts: Options{TenantMetricsAllowList: []string{"user1"}},
+		},
+		"tenant metrics allow list with the other label": {
+			opts:        Options{TenantMetricsAllowList: []string{"user1", otherTenantsLabel}},
+			expectedErr: true,
+		},
+		"custom compacted file options": {
+			opts: Options{CompactedFileFillPercent: 0.9, CompactedFileInitialMmapSize: 1 << 20},
+		},
+		"compacted file fill percent too low": {
+			opts:        Options{CompactedFileFillPercent: 0.05},
+			expectedErr: true,
+		},
+		"compacted file fill percent too high": {
+			opts:        Options{CompactedFileFillPercent: 1.5},
+			expectedErr: true,
+		},
+		"negative user index set shards": {
+			opts:        Options{UserIndexSetShards: -1},
+			expectedErr: true,
+		},
+		"negative max open compacted dbs": {
+			opts:        Options{MaxOpenCompactedDBs: -1},
+			expectedErr: true,
+		},
+		"negative dedup entries window": {
+			opts:        Options{DedupEntriesWindow: -1},
+			expectedErr: true,
+		},
+		"negative compacted file initial mmap size": {
+			opts:        Options{CompactedFileInitialMmapSize: -1},
+			expectedErr: true,
+		},
+		"max entries per user index rejecting users over it": {
+			opts: Options{MaxEntriesPerUserIndex: 100, RejectUserIndexOverLimit: true},
+		},
+		"negative boltdb open timeout": {
+			opts:        Options{BoltdbOpenTimeout: -1},
+			expectedErr: true,
+		},
+		"negative max entries per user index": {
+			opts:        Options{MaxEntriesPerUserIndex: -1},
+			expectedErr: true,
+		},
+		"reject user index over limit without limit": {
+			opts:        Options{RejectUserIndexOverLimit: true},
+			expectedErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tc.opts.Validate()
+			// the constructors reject invalid Options.
+			indexCompactor, newErr := NewIndexCompactor(tc.opts, nil)
+			compactedIndex, compactErr := CompactUserIndex(context.Background(), "user1", &mockIndexSet{tableName: tableName, workingDir: t.TempDir()}, config.PeriodConfig{}, tc.opts, nil)
+			if tc.expectedErr {
+				require.Error(t, err)
+				require.ErrorContains(t, newErr, err.Error())
+				require.Nil(t, indexCompactor)
+				require.ErrorContains(t, compactErr, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, newErr)
+			require.NotNil(t, indexCompactor)
+			// the index set has no source files to compact.
+			require.NoError(t, compactErr)
+			require.Nil(t, compactedIndex)
+		})
+	}
+
+	require.Equal(t, defaultRecreateCompactedDBOlderThan, Options{}.recreateCompactedDBOlderThan())
+	require.Equal(t, int64(defaultDropFreePagesTxMaxSize), Options{}.dropFreePagesTxMaxSize())
+	require.Equal(t, time.Hour, Options{RecreateCompactedDBOlderThan: time.Hour}.recreateCompactedDBOlderThan())
+	require.Equal(t, int64(1024), Options{DropFreePagesTxMaxSize: 1024}.dropFreePagesTxMaxSize())
+}
+
+type mockPeriodIndexCompactor struct {
+	tableCompactor compactor.TableCompactor
+	compactedIndex compactor.CompactedIndex
+}
+
+func (m *mockPeriodIndexCompactor) NewTableCompactor(context.Context, compactor.IndexSet, map[string]compactor.IndexSet, compactor.MakeEmptyUserIndexSetFunc, config.PeriodConfig) compactor.TableCompactor {
+	return m.tableCompactor
+}
+
+func (m *mockPeriodIndexCompactor) OpenCompactedIndexFile(context.Context, string, string, string, string, config.PeriodConfig, log.Logger) (compactor.CompactedIndex, error) {
+	return m.compactedIndex, nil
+}
+
+func TestIndexCompactor_PeriodIndexCompactors(t *testing.T) {
+	tsdbCompactor := &mockPeriodIndexCompactor{
+		tableCompactor: &tableCompactor{},
+		compactedIndex: &CompactedIndex{},
+	}
+	indexCompactor := newTestIndexCompactor(t, Options{
+		PeriodIndexCompactors: map[string]compactor.IndexCompactor{config.TSDBType: tsdbCompactor},
+	})
+
+	commonIndexSet := &mockIndexSet{tableName: tableName, workingDir: t.TempDir()}
+	tsdbPeriod := config.PeriodConfig{IndexType: config.TSDBType}
+	require.Same(t, tsdbCompactor.tableCompactor, indexCompactor.NewTableCompactor(context.Background(), commonIndexSet, nil, nil, tsdbPeriod))
+	compactedIndex, err := indexCompactor.OpenCompactedIndexFile(context.Background(), "", tableName, "", t.TempDir(), tsdbPeriod, util_log.Logger)
+	require.NoError(t, err)
+	require.Same(t, tsdbCompactor.compactedIndex, compactedIndex)
+
+	boltdbPeriod := config.PeriodConfig{IndexType: config.BoltDBShipperType}
+	tCompactor := indexCompactor.NewTableCompactor(context.Background(), commonIndexSet, nil, nil, boltdbPeriod)
+	require.NotSame(t, tsdbCompactor.tableCompactor, tCompactor)
+	require.IsType(t, &tableCompactor{}, tCompactor)
+}
+
+func TestIndexCompactor_OpenCompactedIndexFileOptions(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	opts := Options{
+		IntegrityMarkers:            true,
+		DeterministicOutput:         true,
+		SyncRecreatedCompactedDBs:   true,
+		VerifyRecreatedCompactedDBs: true,
+		UploaderName:                "uploader",
+		CompactedFileFillPercent:    0.9,
+		Clock:                       func() time.Time { return now },
+	}
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 10, local.IndexBucketName)
+
+	c, err := newTestIndexCompactor(t, opts).OpenCompactedIndexFile(context.Background(), dbPath, tableName, "", t.TempDir(), config.PeriodConfig{}, util_log.Logger)
+	require.NoError(t, err)
+	compactedIndex := c.(*CompactedIndex)
+	defer compactedIndex.Cleanup()
+
+	// the file is configured as per the options the same way as the compacted files built while compacting a table.
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{}, opts)
+	expected := tCompactor.newCompactedIndex(compactedIndex.compactedFile, tCompactor.commonIndexSet)
+	require.True(t, compactedIndex.writeIntegrityMarker)
+	require.True(t, compactedIndex.recordSchemaVersion)
+	require.True(t, compactedIndex.deterministicOutput)
+	require.True(t, compactedIndex.syncRecreatedDB)
+	require.True(t, compactedIndex.verifyRecreatedDB)
+	require.Equal(t, "uploader", compactedIndex.uploaderName)
+	require.Equal(t, 0.9, compactedIndex.fillPercent)
+	require.Equal(t, now, compactedIndex.now())
+
+	require.Equal(t, expected.writeIntegrityMarker, compactedIndex.writeIntegrityMarker)
+	require.Equal(t, expected.recordSchemaVersion, compactedIndex.recordSchemaVersion)
+	require.Equal(t, expected.deterministicOutput, compactedIndex.deterministicOutput)
+	require.Equal(t, expected.contentHashInFileName, compactedIndex.contentHashInFileName)
+	require.Equal(t, expected.syncRecreatedDB, compactedIndex.syncRecreatedDB)
+	require.Equal(t, expected.verifyRecreatedDB, compactedIndex.verifyRecreatedDB)
+	require.Equal(t, expected.uploaderName, compactedIndex.uploaderName)
+	require.Equal(t, expected.fillPercent, compactedIndex.fillPercent)
+	require.Equal(t, expected.now(), compactedIndex.now())
+}
@@ -0,0 +1,40 @@
+package compactor
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+// validateIndexFormat returns an error wrapping ErrIndexFormatMismatch when the table has per user indexes, FORMAT3, while the period
+// config explicitly disables per user index with PeriodConfig.PerUserIndex. The source files of the common index get checked with
+// checkBucketFormat while they are read, since their format is only known from their buckets.
+func validateIndexFormat(periodConfig config.PeriodConfig, existingUserIndexSet map[string]compactor.IndexSet) error {
+	if periodConfig.PerUserIndex == nil || *periodConfig.PerUserIndex || len(existingUserIndexSet) == 0 {
+		return nil
+	}
+
+	return errors.Wrapf(ErrIndexFormatMismatch, "found per user index of %d users while per user index is disabled", len(existingUserIndexSet))
+}
+
+// checkBucketFormat returns an error wrapping ErrIndexFormatMismatch when the given bucket of a source file of the common index is
+// inconsistent with PeriodConfig.PerUserIndex, which is a bucket of a user, FORMAT2, while per user index is disabled, or the common
+// index bucket, FORMAT1, while it is enabled. Nothing is checked when PeriodConfig.PerUserIndex is not set.
+func (t *tableCompactor) checkBucketFormat(fileName, bucketName string) error {
+	perUserIndex := t.periodConfig.PerUserIndex
+	if perUserIndex == nil || isMetaBucket(bucketName) {
+		return nil
+	}
+
+	isCommonBucket := bucketName == string(local.IndexBucketName)
+	if *perUserIndex && isCommonBucket {
+		return errors.Wrapf(ErrIndexFormatMismatch, "found common index bucket in source file %s while per user index is enabled", fileName)
+	}
+	if !*perUserIndex && !isCommonBucket {
+		return errors.Wrapf(ErrIndexFormatMismatch, "found bucket of user %s in source file %s while per user index is disabled", bucketName, fileName)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestValidateIndexFormat(t *testing.T) {
+	enabled, disabled := true, false
+	userIndexSets := map[string]compactor.IndexSet{"user1": nil}
+
+	require.NoError(t, validateIndexFormat(config.PeriodConfig{}, userIndexSets))
+	require.NoError(t, validateIndexFormat(config.PeriodConfig{PerUserIndex: &enabled}, userIndexSets))
+	require.NoError(t, validateIndexFormat(config.PeriodConfig{PerUserIndex: &disabled}, nil))
+	require.ErrorIs(t, validateIndexFormat(config.PeriodConfig{PerUserIndex: &disabled}, userIndexSets), ErrIndexFormatMismatch)
+}
+
+func TestTable_IndexFormat(t *testing.T) {
+	enabled, disabled := true, false
+	userID := testutil.BuildUserID(0)
+
+	for name, tc := range map[string]struct {
+		perUserIndex *bool
+		bucketName   string
+		expectedErr  bool
+	}{
+		"format1 without per user index setting": {
+			bucketName: string(local.IndexBucketName),
+		},
+		"format2 without per user index setting": {
+			bucketName: userID,
+		},
+		"format1 with per user index disabled": {
+			perUserIndex: &disabled,
+			bucketName:   string(local.IndexBucketName),
+		},
+		"format2 with per user index disabled": {
+			perUserIndex: &disabled,
+			bucketName:   userID,
+			expectedErr:  true,
+		},
+		"format1 with per user index enabled": {
+			perUserIndex: &enabled,
+			bucketName:   string(local.IndexBucketName),
+			expectedErr:  true,
+		},
+		"format2 with per user index enabled": {
+			perUserIndex: &enabled,
+			bucketName:   userID,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: filepath.Join(tempDir, objectsStorageDirName)})
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				dbPath := filepath.Join(tempDir, fmt.Sprint(i))
+				testutil.AddRecordsToDB(t, dbPath, i*10, 10, []byte(tc.bucketName))
+				f, err := os.Open(dbPath)
+				require.NoError(t, err)
+				require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, fmt.Sprint(i)), f))
+				require.NoError(t, f.Close())
+			}
+
+			tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{})
+			defer cleanupTableCompactor(tCompactor)
+			tCompactor.periodConfig.PerUserIndex = tc.perUserIndex
+
+			err = tCompactor.CompactTable()
+			if tc.expectedErr {
+				require.ErrorIs(t, err, ErrIndexFormatMismatch)
+				require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
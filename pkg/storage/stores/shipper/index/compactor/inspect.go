@@ -0,0 +1,135 @@
+package compactor
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+)
+
+// IndexFileFormat is the format of the index in a single index file, as described at the top of table_compactor.go.
+type IndexFileFormat string
+
+const (
+	// IndexFileFormatEmpty is the format of files without any index bucket.
+	IndexFileFormatEmpty IndexFileFormat = "empty"
+	// IndexFileFormat1 is the format of files with only the index bucket. It is also the format of the files of FORMAT3,
+	// which can only be told apart by the files being in the folder of a user in the table.
+	IndexFileFormat1 IndexFileFormat = "FORMAT1"
+	// IndexFileFormat2 is the format of files with only user buckets.
+	IndexFileFormat2 IndexFileFormat = "FORMAT2"
+	// IndexFileFormatMixed is the format of files with both the index bucket and user buckets, like compacted files of the common
+	// index keeping the buckets of tenants which were not selected for compaction.
+	IndexFileFormatMixed IndexFileFormat = "FORMAT1+FORMAT2"
+)
+
+// InspectResult describes the content of an index file inspected with InspectCompactedFile.
+type InspectResult struct {
+	// Buckets are the names of the buckets in the file in sorted order, including the meta bucket written by the compactor.
+	Buckets []string
+	// Entries are the number of entries per bucket name.
+	Entries map[string]int
+	// Format is the format detected from the names of the buckets, leaving out the meta bucket.
+	Format IndexFileFormat
+}
+
+// InspectCompactedFile returns the buckets, the number of entries per bucket and the format of the index file at the given path,
+// for debugging index files without a running Loki. The file is opened read-only and is neither modified nor removed.
+// Files compressed with gzip, zstd or bzip2, like the ones uploaded to the object store, are decompressed to a temp file first.
+func InspectCompactedFile(path string) (InspectResult, error) {
+	compression, err := detectFileCompression(path)
+	if err != nil {
+		return InspectResult{}, err
+	}
+
+	dbPath := path
+	if compression != fileCompressionNone {
+		dbPath, err = decompressToTempFile(path)
+		if err != nil {
+			return InspectResult{}, err
+		}
+		defer os.Remove(dbPath)
+	}
+
+	db, err := bbolt.Open(dbPath, 0o444, &bbolt.Options{ReadOnly: true, Timeout: defaultBoltdbOpenTimeout})
+	if err != nil {
+		return InspectResult{}, errors.Wrapf(err, "failed to open index file %s", path)
+	}
+	defer db.Close()
+
+	result := InspectResult{Entries: map[string]int{}}
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			bucketName := string(name)
+			result.Buckets = append(result.Buckets, bucketName)
+			result.Entries[bucketName] = b.Stats().KeyN
+			return nil
+		})
+	})
+	if err != nil {
+		return InspectResult{}, errors.Wrapf(err, "failed to read index file %s", path)
+	}
+
+	sort.Strings(result.Buckets)
+	result.Format = detectIndexFileFormat(result.Buckets)
+	return result, nil
+}
+
+// detectIndexFileFormat detects the format of an index file from the names of its buckets.
+func detectIndexFileFormat(buckets []string) IndexFileFormat {
+	hasIndexBucket, hasUserBuckets := false, false
+	for _, bucketName := range buckets {
+		switch {
+		case isMetaBucket(bucketName):
+		case bucketName == string(local.IndexBucketName):
+			hasIndexBucket = true
+		default:
+			hasUserBuckets = true
+		}
+	}
+
+	switch {
+	case hasIndexBucket && hasUserBuckets:
+		return IndexFileFormatMixed
+	case hasIndexBucket:
+		return IndexFileFormat1
+	case hasUserBuckets:
+		return IndexFileFormat2
+	}
+	return IndexFileFormatEmpty
+}
+
+// decompressToTempFile copies the compressed file at the given path to a temp file and decompresses it there,
+// for leaving the file at the given path untouched.
+func decompressToTempFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "inspect-index-file-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := decompressSourceFile(log.NewNopLogger(), tmp.Name(), 0); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,80 @@
+package compactor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestInspectCompactedFile(t *testing.T) {
+	user1, user2 := testutil.BuildUserID(0), testutil.BuildUserID(1)
+	for name, tc := range map[string]struct {
+		buckets        map[string]int
+		compress       bool
+		expectedFormat IndexFileFormat
+	}{
+		"empty": {
+			expectedFormat: IndexFileFormatEmpty,
+		},
+		"common index": {
+			buckets:        map[string]int{string(local.IndexBucketName): 10},
+			expectedFormat: IndexFileFormat1,
+		},
+		"user buckets": {
+			buckets:        map[string]int{user1: 10, user2: 20},
+			expectedFormat: IndexFileFormat2,
+		},
+		"mixed": {
+			buckets:        map[string]int{string(local.IndexBucketName): 10, user1: 20},
+			expectedFormat: IndexFileFormatMixed,
+		},
+		"compressed": {
+			buckets:        map[string]int{user1: 10},
+			compress:       true,
+			expectedFormat: IndexFileFormat2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db, err := bbolt.Open(path, 0o666, nil)
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+
+			var expectedBuckets []string
+			for _, bucketName := range sortedUserIDs(tc.buckets) {
+				testutil.AddRecordsToDB(t, path, 0, tc.buckets[bucketName], []byte(bucketName))
+				expectedBuckets = append(expectedBuckets, bucketName)
+			}
+			if tc.compress {
+				compressFile(t, path, gzipWriter)
+			}
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			content, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			result, err := InspectCompactedFile(path)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedFormat, result.Format)
+			require.Equal(t, expectedBuckets, result.Buckets)
+			for bucketName, entries := range tc.buckets {
+				require.Equal(t, entries, result.Entries[bucketName])
+			}
+
+			// the file is left untouched.
+			after, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, content, after)
+			afterInfo, err := os.Stat(path)
+			require.NoError(t, err)
+			require.Equal(t, info.ModTime(), afterInfo.ModTime())
+		})
+	}
+}
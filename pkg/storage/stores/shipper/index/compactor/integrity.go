@@ -0,0 +1,199 @@
+package compactor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/cespare/xxhash/v2"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// metaBucketName is the bucket in compacted files holding information about the file itself rather than index.
+	metaBucketName     = []byte("__meta__")
+	contentChecksumKey = []byte("content_checksum")
+)
+
+// isMetaBucket returns true if the bucket name refers to metaBucketName.
+func isMetaBucket(bucketName string) bool {
+	return bucketName == string(metaBucketName)
+}
+
+// computeContentChecksum computes a checksum of all the buckets and their entries in the db except the metaBucketName.
+func computeContentChecksum(tx *bbolt.Tx) uint64 {
+	digest := xxhash.New()
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	write := func(b []byte) {
+		n := binary.PutUvarint(lenBuf, uint64(len(b)))
+		_, _ = digest.Write(lenBuf[:n])
+		_, _ = digest.Write(b)
+	}
+
+	_ = tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		if isMetaBucket(string(name)) {
+			return nil
+		}
+
+		write(name)
+		return b.ForEach(func(k, v []byte) error {
+			write(k)
+			write(v)
+			return nil
+		})
+	})
+
+	return digest.Sum64()
+}
+
+// computeBucketsHash computes a hash of the names of all the buckets in the db except the metaBucketName and their number of entries.
+// It is cheaper than computeContentChecksum since it only walks the pages of the buckets without reading their entries.
+func computeBucketsHash(tx *bbolt.Tx) uint64 {
+	digest := xxhash.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		_, _ = digest.Write(buf[:n])
+	}
+
+	// buckets are iterated in the order of their names.
+	_ = tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		if isMetaBucket(string(name)) {
+			return nil
+		}
+
+		writeUvarint(uint64(len(name)))
+		_, _ = digest.Write(name)
+		writeUvarint(uint64(b.Stats().KeyN))
+		return nil
+	})
+
+	return digest.Sum64()
+}
+
+// recreatedDBMismatchError is returned when the content of a recreated db does not match the content of the db it got recreated from.
+type recreatedDBMismatchError struct {
+	sourceEntries, recreatedEntries   int64
+	sourceChecksum, recreatedChecksum uint64
+}
+
+func (e *recreatedDBMismatchError) Error() string {
+	return fmt.Sprintf("content of recreated db does not match its source db, source has %d entries with checksum %x, recreated db has %d entries with checksum %x",
+		e.sourceEntries, e.sourceChecksum, e.recreatedEntries, e.recreatedChecksum)
+}
+
+// verifyRecreatedDB compares the entries per bucket and the content checksum of the recreated db with the db it got recreated from.
+// It reads both the dbs entirely.
+func verifyRecreatedDB(source, recreated *bbolt.DB) error {
+	var sourceStats, recreatedStats IndexStats
+	var sourceChecksum, recreatedChecksum uint64
+	if err := source.View(func(tx *bbolt.Tx) error {
+		sourceStats = readIndexStats(tx)
+		sourceChecksum = computeContentChecksum(tx)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := recreated.View(func(tx *bbolt.Tx) error {
+		recreatedStats = readIndexStats(tx)
+		recreatedChecksum = computeContentChecksum(tx)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	mismatch := sourceChecksum != recreatedChecksum || len(sourceStats.Buckets) != len(recreatedStats.Buckets)
+	for bucketName, bucketStats := range sourceStats.Buckets {
+		if recreatedStats.Buckets[bucketName].Entries != bucketStats.Entries {
+			mismatch = true
+		}
+	}
+	if !mismatch {
+		return nil
+	}
+
+	err := &recreatedDBMismatchError{sourceChecksum: sourceChecksum, recreatedChecksum: recreatedChecksum}
+	for _, bucketStats := range sourceStats.Buckets {
+		err.sourceEntries += bucketStats.Entries
+	}
+	for _, bucketStats := range recreatedStats.Buckets {
+		err.recreatedEntries += bucketStats.Entries
+	}
+	return err
+}
+
+// writeIntegrityMarker stores the checksum of the content of the db in metaBucketName.
+// It lets readers detect truncated or partially written files when they are used as seed for compaction.
+func writeIntegrityMarker(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		checksum := make([]byte, 8)
+		binary.BigEndian.PutUint64(checksum, computeContentChecksum(tx))
+
+		b, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(contentChecksumKey, checksum)
+	})
+}
+
+// removeIntegrityMarker removes the integrity marker from the db if it has one.
+// It must be called when modifying a db without updating its integrity marker to not leave a stale one behind.
+// The marker is looked up in a read transaction first, for not writing to dbs without one, which is the case for most of them.
+func removeIntegrityMarker(db *bbolt.DB) error {
+	hasMarker := false
+	if err := db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(metaBucketName); b != nil {
+			hasMarker = b.Get(contentChecksumKey) != nil
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !hasMarker {
+		return nil
+	}
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(metaBucketName)
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete(contentChecksumKey)
+	})
+}
+
+// verifyIntegrityMarker verifies the content of the db against its integrity marker.
+// Files without an integrity marker are considered valid since they could have been built without integrity markers enabled.
+// Reading a truncated file can cause faults which get recovered and reported as an error.
+func verifyIntegrityMarker(db *bbolt.DB) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from panic verifying integrity of boltdb file: %v", r)
+		}
+	}()
+
+	return db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(metaBucketName)
+		if b == nil {
+			return nil
+		}
+
+		expected := b.Get(contentChecksumKey)
+		if expected == nil {
+			return nil
+		}
+		if len(expected) != 8 {
+			return fmt.Errorf("invalid integrity marker of length %d", len(expected))
+		}
+
+		if actual := computeContentChecksum(tx); actual != binary.BigEndian.Uint64(expected) {
+			return fmt.Errorf("content checksum mismatch, expected %x, got %x", binary.BigEndian.Uint64(expected), actual)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/index/indexfile"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestIntegrityMarker(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, []byte("user1"))
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// db without a marker is considered valid
+	require.NoError(t, verifyIntegrityMarker(db))
+
+	// removing the marker of a db without one does not write to it
+	txID := lastTxID(t, db)
+	require.NoError(t, removeIntegrityMarker(db))
+	require.Equal(t, txID, lastTxID(t, db))
+
+	require.NoError(t, writeIntegrityMarker(db))
+	require.NoError(t, verifyIntegrityMarker(db))
+
+	// marker bucket should not be considered for checksum so writing the marker again should not change it
+	require.NoError(t, writeIntegrityMarker(db))
+	require.NoError(t, verifyIntegrityMarker(db))
+
+	// modify the content without updating the marker
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("user1")).Put([]byte("new-key"), []byte("new-value"))
+	}))
+	require.Error(t, verifyIntegrityMarker(db))
+
+	// removing the marker should make it valid again
+	txID = lastTxID(t, db)
+	require.NoError(t, removeIntegrityMarker(db))
+	require.Greater(t, lastTxID(t, db), txID)
+	require.NoError(t, verifyIntegrityMarker(db))
+}
+
+// lastTxID returns the id of the last write transaction committed to the db.
+func lastTxID(t *testing.T, db *bbolt.DB) int {
+	var txID int
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		txID = tx.ID()
+		return nil
+	}))
+	return txID
+}
+
+func TestTable_TruncatedSeedDetection(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+		NumCompactedDBs:   1,
+	}, testutil.PerUserDBsConfig{}, Options{IntegrityMarkers: true})
+	defer cleanupTableCompactor(tCompactor)
+
+	// replace the seed file in the storage with a file with a mismatching integrity marker
+	seedPath := filepath.Join(t.TempDir(), "seed")
+	testutil.AddRecordsToDB(t, seedPath, 0, 100, local.IndexBucketName)
+	seedDB, err := openBoltdbFileWithNoSync(seedPath)
+	require.NoError(t, err)
+	require.NoError(t, writeIntegrityMarker(seedDB))
+	require.NoError(t, seedDB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(local.IndexBucketName).Put([]byte("new-key"), []byte("new-value"))
+	}))
+	require.NoError(t, seedDB.Close())
+
+	seedFile, err := os.Open(seedPath)
+	require.NoError(t, err)
+	defer seedFile.Close()
+
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	seedIdx := compactedFileIdx(commonIndexSet.sourceFiles, []string{defaultUploaderName})
+	require.NotEqual(t, -1, seedIdx)
+	require.NoError(t, commonIndexSet.objectClient.PutObject(context.Background(), filepath.Join(tableName, commonIndexSet.sourceFiles[seedIdx].Name), seedFile))
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesTruncatedSeedDetected))
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSeedReuse))
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesFreshCompaction))
+
+	// compacted index should not have the content of the discarded seed
+	compactedIndex := commonIndexSet.compactedIndex.(*CompactedIndex)
+	records := readDB(t, compactedIndex.compactedFile)
+	require.NotContains(t, records[string(local.IndexBucketName)], "new-key")
+	require.Len(t, records[string(local.IndexBucketName)], 200)
+
+	// integrity marker should be written while converting it to index file for upload
+	indexFile, err := compactedIndex.ToIndexFile()
+	require.NoError(t, err)
+	defer func() {
+		path := indexFile.Path()
+		require.NoError(t, indexFile.Close())
+		require.NoError(t, os.Remove(path))
+	}()
+
+	uploadedDB := indexFile.(*indexfile.IndexFile).GetBoltDB()
+	require.NoError(t, uploadedDB.View(func(tx *bbolt.Tx) error {
+		require.NotNil(t, tx.Bucket(metaBucketName))
+		return nil
+	}))
+	require.NoError(t, verifyIntegrityMarker(uploadedDB))
+}
@@ -0,0 +1,40 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/concurrency"
+)
+
+// rewriteInKeyOrder rewrites the given compacted db as per Options.RewriteInKeyOrder unless it got recreated already in this run.
+// Recreating a db copies the buckets in the order of their names and the entries of each bucket in the order of their keys into a
+// fresh file with fully filled pages, so entries sharing a key prefix end up in physically contiguous pages.
+func (t *tableCompactor) rewriteInKeyOrder(userID string, compactedIndex *CompactedIndex) error {
+	if !t.opts.RewriteInKeyOrder || compactedIndex.compactedFileRecreated {
+		return nil
+	}
+
+	if err := t.recreateCompactedDB(userID, compactedIndex); err != nil {
+		return err
+	}
+
+	t.metrics.compactTablesKeyOrderRewrites.Inc()
+	return nil
+}
+
+// rewriteUserCompactedDBsInKeyOrder rewrites the compacted dbs of all the users built while compacting the table as per
+// Options.RewriteInKeyOrder, with up to Options.RecreateConcurrency of them concurrently.
+func (t *tableCompactor) rewriteUserCompactedDBsInKeyOrder() error {
+	if !t.opts.RewriteInKeyOrder {
+		return nil
+	}
+
+	userCompactedIndexSets := t.userCompactedIndexSet.all()
+	userIDs := sortedUserIDs(userCompactedIndexSets)
+
+	return concurrency.ForEachJob(t.ctx, len(userIDs), t.recreateConcurrency(), func(_ context.Context, idx int) error {
+		t.heartbeat()
+		userID := userIDs[idx]
+		return t.rewriteInKeyOrder(userID, userCompactedIndexSets[userID].compactedIndex)
+	})
+}
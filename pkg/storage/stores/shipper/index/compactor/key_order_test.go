@@ -0,0 +1,53 @@
+package compactor
+
+import (
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_RewriteInKeyOrder(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts             Options
+		expectedRewrites float64
+	}{
+		"disabled": {},
+		"enabled": {
+			opts:             Options{RewriteInKeyOrder: true},
+			expectedRewrites: 4,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			numUsers := 3
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 5,
+			}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{
+					NumUnCompactedDBs: 2,
+				},
+				NumUsers: numUsers,
+			}, tc.opts)
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+			require.Equal(t, tc.expectedRewrites, prom_testutil.ToFloat64(tCompactor.metrics.compactTablesKeyOrderRewrites))
+
+			// the rewritten dbs are uploaded as recreated ones.
+			commonIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+			require.Equal(t, tc.opts.RewriteInKeyOrder, commonIndex.compactedFileRecreated)
+			userCompactedIndexSets := tCompactor.userCompactedIndexSet.all()
+			require.Len(t, userCompactedIndexSets, numUsers)
+			for _, userCompactedIndexSet := range userCompactedIndexSets {
+				require.Equal(t, tc.opts.RewriteInKeyOrder, userCompactedIndexSet.compactedIndex.compactedFileRecreated)
+			}
+
+			// the working dir of the table is in the temp dir set up with the object storage.
+			tempDir := filepath.Dir(filepath.Dir(tCompactor.commonIndexSet.GetWorkingDir()))
+			compareCompactedTable(t, filepath.Join(tempDir, objectsStorageDirName, tableName), tCompactor)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package compactor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	compactTablesDeferredSchedule        prometheus.Counter
+	compactTablesRetentionDroppedEntries prometheus.Counter
+	compactTablesPhaseDurationSeconds    *prometheus.HistogramVec
+	compactTablesInvalidTenantEntries    prometheus.Counter
+	compactTablesReadPacingDelaySeconds  prometheus.Counter
+	compactTablesRecreateOnly            prometheus.Counter
+	compactTablesTruncatedSeedDetected   prometheus.Counter
+	compactTablesReadConcurrency         prometheus.Gauge
+	compactTablesOutdatedSeedSchema      prometheus.Counter
+	compactTablesDeferredLowDisk         prometheus.Counter
+	compactTablesFutureTableSkipped      prometheus.Counter
+	compactTablesDurationSeconds         *prometheus.HistogramVec
+	compactTablesRecreateReclaimedBytes  *prometheus.CounterVec
+	compactTablesCorruptFiles            prometheus.Counter
+	compactTablesTransformDroppedEntries prometheus.Counter
+	compactTablesUserIndexSetsCreated    prometheus.Counter
+	compactTablesUserIndexSetsFetched    prometheus.Counter
+	compactTablesRecreateVerifyFailures  prometheus.Counter
+	compactTablesSeedReuse               prometheus.Counter
+	compactTablesFreshCompaction         prometheus.Counter
+	compactTablesCompactedFileSizeBytes  *prometheus.HistogramVec
+	compactTablesDuplicateEntriesDropped prometheus.Counter
+	compactTablesUserIndexSetLockWait    *prometheus.HistogramVec
+	compactTablesOpenCompactedDBs        prometheus.Gauge
+	compactTablesSourceFileSizeMismatch  prometheus.Counter
+	compactTablesKeyOrderRewrites        prometheus.Counter
+	compactTablesTenantEntries           *prometheus.CounterVec
+	compactTablesTenantBytes             *prometheus.CounterVec
+	compactTablesTenantSourceFiles       *prometheus.CounterVec
+	compactTablesRecreateSkipped         prometheus.Counter
+	compactTablesMultipleSeeds           prometheus.Counter
+	compactTablesEmptyFilesSkipped       prometheus.Counter
+	compactTablesCompactedFilePages      *prometheus.GaugeVec
+	compactTablesCompactedFileFreePages  *prometheus.GaugeVec
+	compactTablesSourceSchemaMismatch    prometheus.Counter
+	compactTablesOversizedFilesRejected  prometheus.Counter
+	compactTablesPausedWorkers           prometheus.Gauge
+	compactTablesSkipped                 prometheus.Counter
+	compactTablesTenantIndexOverLimit    *prometheus.CounterVec
+	compactTablesCorruptBucketsSkipped   prometheus.Counter
+}
+
+func newMetrics(r prometheus.Registerer) *metrics {
+	return &metrics{
+		compactTablesDeferredSchedule: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_deferred_schedule_total",
+			Help:      "Total number of times compaction of a table was deferred due to the configured schedule gate",
+		}),
+		compactTablesRetentionDroppedEntries: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_retention_dropped_entries_total",
+			Help:      "Total number of index entries dropped during compaction due to the configured retention period",
+		}),
+		compactTablesPhaseDurationSeconds: promauto.With(r).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_phase_duration_seconds",
+			Help:      "Time (in seconds) spent in each phase of compacting a table",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, []string{"phase"}),
+		compactTablesInvalidTenantEntries: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_invalid_tenant_entries_total",
+			Help:      "Total number of index entries of invalid tenants routed to the quarantine bucket during compaction",
+		}),
+		compactTablesReadPacingDelaySeconds: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_read_pacing_delay_seconds_total",
+			Help:      "Total time (in seconds) source file reads were delayed for pacing them during compaction",
+		}),
+		compactTablesRecreateOnly: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_recreate_only_total",
+			Help:      "Total number of tables which had their compacted dbs recreated in recreate only mode",
+		}),
+		compactTablesTruncatedSeedDetected: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_truncated_seed_detected_total",
+			Help:      "Total number of seed files discarded due to failing the integrity verification",
+		}),
+		compactTablesReadConcurrency: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_read_concurrency",
+			Help:      "Number of source files being read concurrently across the tables being compacted",
+		}),
+		compactTablesOutdatedSeedSchema: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_outdated_seed_schema_total",
+			Help:      "Total number of seed files found to be built with a schema version older than the one of their table",
+		}),
+		compactTablesDeferredLowDisk: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_deferred_low_disk_total",
+			Help:      "Total number of times compaction of a table was deferred due to low free disk space in the working dir",
+		}),
+		compactTablesFutureTableSkipped: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_future_table_skipped_total",
+			Help:      "Total number of times compaction of a table was skipped due to the table starting in the future",
+		}),
+		compactTablesDurationSeconds: promauto.With(r).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_duration_seconds",
+			Help:      "Time (in seconds) spent in successful compactions of a table, by whether the table has per user index or only common index",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, []string{"index_format"}),
+		compactTablesRecreateReclaimedBytes: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_recreate_reclaimed_bytes_total",
+			Help:      "Total number of bytes reclaimed by recreating compacted dbs, by whether the recreated db is a per user index or common index",
+		}, []string{"index_format"}),
+		compactTablesCorruptFiles: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_corrupt_files_total",
+			Help:      "Total number of corrupt source files skipped while compacting tables",
+		}),
+		compactTablesTransformDroppedEntries: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_transform_dropped_entries_total",
+			Help:      "Total number of index entries dropped during compaction by the configured entry transform",
+		}),
+		compactTablesUserIndexSetsCreated: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_user_index_sets_created_total",
+			Help:      "Total number of user index sets created for users getting entries from the common index without an existing user index",
+		}),
+		compactTablesUserIndexSetsFetched: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_user_index_sets_fetched_total",
+			Help:      "Total number of existing user index sets fetched for users getting entries from the common index",
+		}),
+		compactTablesRecreateVerifyFailures: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_recreate_verify_failures_total",
+			Help:      "Total number of recreated compacted dbs whose content did not match the dbs they got recreated from",
+		}),
+		compactTablesSeedReuse: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_seed_reuse_total",
+			Help:      "Total number of compactions of common index which reused a previously compacted file as seed file",
+		}),
+		compactTablesFreshCompaction: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_fresh_compaction_total",
+			Help:      "Total number of compactions of common index which built a new compacted file without a seed file",
+		}),
+		compactTablesCompactedFileSizeBytes: promauto.With(r).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_compacted_file_size_bytes",
+			Help:      "Size (in bytes) of the compacted files built by compacting tables, by whether the file is a per user index or common index",
+			Buckets:   prometheus.ExponentialBuckets(1024*1024, 4, 8),
+		}, []string{"index_format"}),
+		compactTablesDuplicateEntriesDropped: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_duplicate_entries_dropped_total",
+			Help:      "Total number of index entries dropped during compaction for being already written to their compacted file",
+		}),
+		compactTablesUserIndexSetLockWait: promauto.With(r).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_user_index_set_lock_wait_seconds",
+			Help:      "Time (in seconds) spent waiting for the lock of the user index sets of the table being compacted, by whether the lock is taken for reading or writing",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"mode"}),
+		compactTablesOpenCompactedDBs: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_open_compacted_dbs",
+			Help:      "Number of compacted dbs open across the tables being compacted",
+		}),
+		compactTablesSourceFileSizeMismatch: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_source_file_size_mismatches_total",
+			Help:      "Total number of downloaded source files with a size not matching the size listed by the object store",
+		}),
+		compactTablesKeyOrderRewrites: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_key_order_rewrites_total",
+			Help:      "Total number of compacted dbs rewritten in key order before their upload",
+		}),
+		compactTablesTenantEntries: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_tenant_entries_total",
+			Help:      "Total number of index entries compacted into per user indexes, by tenant for the tenants in the tenant metrics allowlist and \"other\" for all the other tenants",
+		}, []string{"tenant"}),
+		compactTablesTenantBytes: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_tenant_bytes_total",
+			Help:      "Total size (in bytes) of the index entries compacted into per user indexes, by tenant for the tenants in the tenant metrics allowlist and \"other\" for all the other tenants",
+		}, []string{"tenant"}),
+		compactTablesTenantSourceFiles: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_tenant_source_files_total",
+			Help:      "Total number of source files with index entries compacted into per user indexes, by tenant for the tenants in the tenant metrics allowlist and \"other\" for all the other tenants",
+		}, []string{"tenant"}),
+		compactTablesRecreateSkipped: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_recreate_skipped_total",
+			Help:      "Total number of compacted dbs due for recreation which did not get recreated for having too little to reclaim",
+		}),
+		compactTablesMultipleSeeds: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_multiple_seeds_total",
+			Help:      "Total number of compactions of common index which found multiple previously compacted files, like ones uploaded by racing compactors",
+		}),
+		compactTablesSourceSchemaMismatch: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_source_schema_mismatch_total",
+			Help:      "Total number of source files rejected for having keys not matching the schema version of their table",
+		}),
+		compactTablesOversizedFilesRejected: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_oversized_files_rejected_total",
+			Help:      "Total number of source files rejected for decompressing beyond the size limit while compacting tables",
+		}),
+		compactTablesPausedWorkers: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_paused_workers",
+			Help:      "Number of workers compacting tables which are currently blocked waiting for the compaction to be resumed",
+		}),
+		compactTablesSkipped: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_skipped_total",
+			Help:      "Total number of times compaction of the common index of a table was skipped since it had nothing to compact",
+		}),
+		compactTablesTenantIndexOverLimit: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_tenant_index_over_limit_total",
+			Help:      "Total number of times more entries than the limit got written into the index of a tenant while compacting a table",
+		}, []string{"tenant"}),
+		compactTablesCorruptBucketsSkipped: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_corrupt_buckets_skipped_total",
+			Help:      "Total number of buckets of source files skipped for failing to be read while compacting tables",
+		}),
+		compactTablesEmptyFilesSkipped: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_empty_files_skipped_total",
+			Help:      "Total number of empty source files skipped while compacting tables",
+		}),
+		compactTablesCompactedFilePages: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_compacted_file_pages",
+			Help:      "Number of pages of the last compacted file built by compacting tables, by whether the file is a per user index or common index",
+		}, []string{"index_format"}),
+		compactTablesCompactedFileFreePages: promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "loki_boltdb_shipper",
+			Name:      "compact_tables_compacted_file_free_pages",
+			Help:      "Number of free pages of the last compacted file built by compacting tables, by whether the file is a per user index or common index",
+		}, []string{"index_format"}),
+	}
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package compactor
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+func TestTableCompactor_openSourceBoltdbFile(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+
+	for _, mmapFlags := range []int{0, syscall.MAP_POPULATE} {
+		tCompactor := &tableCompactor{opts: Options{SourceFileMmapFlags: mmapFlags}}
+		db, err := tCompactor.openSourceBoltdbFile(dbPath)
+		require.NoError(t, err)
+		require.True(t, db.NoSync)
+		require.Equal(t, mmapFlags, db.MmapFlags)
+
+		numEntries := 0
+		require.NoError(t, readFile(util_log.Logger, downloadedDb{path: dbPath, db: db}, tCompactor.opts.newBatchSizer(), func(_ string, batch []indexEntry) error {
+			numEntries += len(batch)
+			return nil
+		}))
+		require.Equal(t, 100, numEntries)
+		require.NoError(t, db.Close())
+	}
+}
+
+func Benchmark_readFileMmapFlags(b *testing.B) {
+	dbPath := filepath.Join(b.TempDir(), "db")
+	testutil.AddRecordsToDB(b, dbPath, 0, 20000, local.IndexBucketName)
+
+	for _, tc := range []struct {
+		name      string
+		mmapFlags int
+	}{
+		{name: "default"},
+		{name: "MAP_POPULATE", mmapFlags: syscall.MAP_POPULATE},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			tCompactor := &tableCompactor{opts: Options{SourceFileMmapFlags: tc.mmapFlags}}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				db, err := tCompactor.openSourceBoltdbFile(dbPath)
+				require.NoError(b, err)
+
+				require.NoError(b, readFile(util_log.Logger, downloadedDb{path: dbPath, db: db}, tCompactor.opts.newBatchSizer(), func(_ string, _ []indexEntry) error {
+					return nil
+				}))
+				require.NoError(b, db.Close())
+			}
+		})
+	}
+}
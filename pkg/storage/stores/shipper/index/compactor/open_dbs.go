@@ -0,0 +1,102 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/bbolt"
+)
+
+// openDBLimiter bounds the number of compacted dbs open at the same time as per Options.MaxOpenCompactedDBs across all the tables
+// being compacted, and tracks them in a gauge. A db counts as open from the time it is opened for building a compacted db until
+// the compactor is done with it, which is when it gets closed or handed over for upload as an index file.
+// It is safe for concurrent use.
+type openDBLimiter struct {
+	// sem is only set when Options.MaxOpenCompactedDBs is configured.
+	sem   chan struct{}
+	gauge prometheus.Gauge
+
+	dbsMtx sync.Mutex
+	dbs    map[*bbolt.DB]struct{}
+}
+
+func newOpenDBLimiter(maxOpenDBs int, gauge prometheus.Gauge) *openDBLimiter {
+	l := &openDBLimiter{gauge: gauge, dbs: map[*bbolt.DB]struct{}{}}
+	if maxOpenDBs > 0 {
+		l.sem = make(chan struct{}, maxOpenDBs)
+	}
+
+	return l
+}
+
+// acquire blocks until a db can be opened without exceeding the limit, or until the context is done.
+// The slot needs to be handed over to the opened db with add, or given back with cancel if opening the db failed.
+func (l *openDBLimiter) acquire(ctx context.Context) error {
+	if l == nil || l.sem == nil {
+		return nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancel gives back a slot taken with acquire for a db which failed to be opened.
+func (l *openDBLimiter) cancel() {
+	if l != nil && l.sem != nil {
+		<-l.sem
+	}
+}
+
+// add tracks a db opened with a slot taken with acquire.
+func (l *openDBLimiter) add(db *bbolt.DB) {
+	if l == nil {
+		return
+	}
+
+	l.dbsMtx.Lock()
+	defer l.dbsMtx.Unlock()
+
+	l.dbs[db] = struct{}{}
+	l.gauge.Inc()
+}
+
+// replace tracks the db recreated from a tracked db in place of it, without taking another slot.
+func (l *openDBLimiter) replace(old, db *bbolt.DB) {
+	if l == nil {
+		return
+	}
+
+	l.dbsMtx.Lock()
+	defer l.dbsMtx.Unlock()
+
+	if _, ok := l.dbs[old]; !ok {
+		return
+	}
+	delete(l.dbs, old)
+	l.dbs[db] = struct{}{}
+}
+
+// release gives back the slot of a tracked db once the compactor is done with it. Releasing a db which is not tracked,
+// or which got released already, is a no-op, like with a nil openDBLimiter.
+func (l *openDBLimiter) release(db *bbolt.DB) {
+	if l == nil {
+		return
+	}
+
+	l.dbsMtx.Lock()
+	defer l.dbsMtx.Unlock()
+
+	if _, ok := l.dbs[db]; !ok {
+		return
+	}
+	delete(l.dbs, db)
+	l.gauge.Dec()
+	if l.sem != nil {
+		<-l.sem
+	}
+}
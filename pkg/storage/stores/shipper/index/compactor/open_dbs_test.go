@@ -0,0 +1,93 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestOpenDBLimiter(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "open_dbs"})
+	l := newOpenDBLimiter(1, gauge)
+
+	db1, db2 := &bbolt.DB{}, &bbolt.DB{}
+	require.NoError(t, l.acquire(context.Background()))
+	l.add(db1)
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(gauge))
+
+	// opening another db blocks until the context is done while the limit is hit.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l.acquire(ctx), context.DeadlineExceeded)
+
+	// replacing a db keeps its slot.
+	l.replace(db1, db2)
+	l.release(db1)
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(gauge))
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- l.acquire(context.Background())
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot while the limit is hit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// releasing a db more than once gives back its slot only once.
+	l.release(db2)
+	l.release(db2)
+	require.NoError(t, <-acquired)
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(gauge))
+	l.cancel()
+
+	// no limit is enforced by default.
+	l = newOpenDBLimiter(0, gauge)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.acquire(context.Background()))
+	}
+}
+
+func TestTable_MaxOpenCompactedDBs(t *testing.T) {
+	numUsers := 5
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{MaxOpenCompactedDBs: numUsers + 1})
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Len(t, tCompactor.userCompactedIndexSet.all(), numUsers)
+
+	// the compacted dbs of the common index and of all the users stay open until they are cleaned up.
+	openDBs := tCompactor.metrics.compactTablesOpenCompactedDBs
+	require.Equal(t, float64(numUsers+1), prom_testutil.ToFloat64(openDBs))
+
+	cleanupTableCompactor(tCompactor)
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(openDBs))
+	require.Len(t, tCompactor.openDBs.sem, 0)
+
+	// dbs handed over for upload are not counted as open anymore.
+	tCompactor = setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{}, Options{MaxOpenCompactedDBs: 1})
+	require.NoError(t, tCompactor.CompactTable())
+	compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+	idxFile, err := compactedIndex.ToIndexFile()
+	require.NoError(t, err)
+	defer idxFile.Close()
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesOpenCompactedDBs))
+	require.Len(t, tCompactor.openDBs.sem, 0)
+	require.FileExists(t, idxFile.Path())
+}
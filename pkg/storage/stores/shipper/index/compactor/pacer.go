@@ -0,0 +1,69 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// readPacer spaces out the start of source file reads by a fixed interval to smooth out the IO.
+// It is safe for concurrent use and a nil readPacer does not pace at all.
+type readPacer struct {
+	interval time.Duration
+
+	mtx        sync.Mutex
+	nextSlot   time.Time
+	totalDelay time.Duration
+}
+
+func newReadPacer(interval time.Duration) *readPacer {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &readPacer{interval: interval}
+}
+
+// wait blocks until it is time for the next read to start or the context is done.
+func (p *readPacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mtx.Lock()
+	now := time.Now()
+	slot := p.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	p.nextSlot = slot.Add(p.interval)
+	delay := slot.Sub(now)
+	p.totalDelay += delay
+	p.mtx.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// delay returns the total delay incurred by the reads for pacing them.
+func (p *readPacer) delay() time.Duration {
+	if p == nil {
+		return 0
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.totalDelay
+}
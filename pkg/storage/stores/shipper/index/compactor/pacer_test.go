@@ -0,0 +1,43 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/concurrency"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPacer(t *testing.T) {
+	t.Run("no pacing", func(t *testing.T) {
+		pacer := newReadPacer(0)
+		require.Nil(t, pacer)
+		require.NoError(t, pacer.wait(context.Background()))
+		require.Equal(t, time.Duration(0), pacer.delay())
+	})
+
+	t.Run("reads are spaced out", func(t *testing.T) {
+		interval := 20 * time.Millisecond
+		numReads := 5
+		pacer := newReadPacer(interval)
+
+		start := time.Now()
+		require.NoError(t, concurrency.ForEachJob(context.Background(), numReads, numReads, func(ctx context.Context, _ int) error {
+			return pacer.wait(ctx)
+		}))
+
+		// first read starts immediately
+		require.GreaterOrEqual(t, time.Since(start), time.Duration(numReads-1)*interval)
+		require.GreaterOrEqual(t, pacer.delay(), time.Duration(numReads-1)*interval)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		pacer := newReadPacer(time.Hour)
+		require.NoError(t, pacer.wait(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, pacer.wait(ctx), context.Canceled)
+	})
+}
@@ -0,0 +1,75 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Pauser pauses and resumes the compaction of the tables using its Paused method as Options.Paused, like from a signal handler
+// for relieving the pressure on the object store during incidents without losing the progress of the tables being compacted.
+// It is safe for concurrent use and the zero value is not paused.
+type Pauser struct {
+	mtx     sync.Mutex
+	resumed chan struct{}
+}
+
+// Pause pauses the compaction until Resume gets called. Pausing an already paused Pauser is a noop.
+func (p *Pauser) Pause() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+// Resume resumes the compaction paused with Pause. Resuming a Pauser which is not paused is a noop.
+func (p *Pauser) Resume() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// Paused returns nil when the compaction is not paused, or a channel closed once it gets resumed.
+func (p *Pauser) Paused() <-chan struct{} {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.resumed
+}
+
+// waitWhilePaused blocks while Options.Paused reports the compaction as paused, or until the context is done.
+func (t *tableCompactor) waitWhilePaused(ctx context.Context, logger log.Logger) error {
+	if t.opts.Paused == nil {
+		return nil
+	}
+
+	resumed := t.opts.Paused()
+	if resumed == nil {
+		return nil
+	}
+
+	level.Info(logger).Log("msg", "compaction of table paused, waiting for it to be resumed")
+	t.metrics.compactTablesPausedWorkers.Inc()
+	defer t.metrics.compactTablesPausedWorkers.Dec()
+
+	// the compaction could get paused again right after being resumed.
+	for resumed != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resumed:
+		}
+		resumed = t.opts.Paused()
+	}
+
+	level.Info(logger).Log("msg", "compaction of table resumed")
+	return nil
+}
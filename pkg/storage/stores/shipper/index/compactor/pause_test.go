@@ -0,0 +1,79 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestPauser(t *testing.T) {
+	var pauser Pauser
+	require.Nil(t, pauser.Paused())
+	pauser.Resume()
+	require.Nil(t, pauser.Paused())
+
+	pauser.Pause()
+	resumed := pauser.Paused()
+	require.NotNil(t, resumed)
+	pauser.Pause()
+	require.Equal(t, resumed, pauser.Paused())
+
+	pauser.Resume()
+	require.Nil(t, pauser.Paused())
+	select {
+	case <-resumed:
+	default:
+		t.Fatal("resuming should close the channel returned while paused")
+	}
+}
+
+func TestTable_PausedCompaction(t *testing.T) {
+	pauser := &Pauser{}
+	pauser.Pause()
+
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 5,
+		NumCompactedDBs:   1,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{NumUnCompactedDBs: 2},
+		NumUsers:  2,
+	}, Options{Paused: pauser.Paused})
+	defer cleanupTableCompactor(tCompactor)
+
+	done := make(chan error)
+	go func() {
+		done <- tCompactor.CompactTable()
+	}()
+
+	require.Eventually(t, func() bool {
+		return prom_testutil.ToFloat64(tCompactor.metrics.compactTablesPausedWorkers) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("compaction should not complete while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pauser.Resume()
+	require.NoError(t, <-done)
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesPausedWorkers))
+	require.NotNil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+}
+
+func TestTableCompactor_WaitWhilePausedRespectsContext(t *testing.T) {
+	pauser := &Pauser{}
+	tCompactor := newReadAheadTableCompactor(Options{Paused: pauser.Paused})
+	require.NoError(t, tCompactor.waitWhilePaused(context.Background(), log.NewNopLogger()))
+
+	pauser.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, tCompactor.waitWhilePaused(ctx, log.NewNopLogger()), context.DeadlineExceeded)
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesPausedWorkers))
+}
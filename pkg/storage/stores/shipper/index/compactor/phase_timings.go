@@ -0,0 +1,49 @@
+package compactor
+
+import (
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	phasePrefetch        = "prefetch"
+	phaseCommonMerge     = "common_merge"
+	phaseCommonRecreate  = "common_recreate"
+	phasePerUserRecreate = "per_user_recreate"
+	phaseFinalize        = "finalize"
+)
+
+// PhaseTimings holds the wall-clock time spent in each phase of compacting a table.
+type PhaseTimings struct {
+	// Prefetch is the time spent in downloading and opening common index files and fetching the index of tenants found in them.
+	Prefetch time.Duration
+	// CommonMerge is the time spent in merging the common index files.
+	CommonMerge time.Duration
+	// CommonRecreate is the time spent in recreating the compacted db of the common index and rewriting it in key order.
+	CommonRecreate time.Duration
+	// PerUserRecreate is the time spent in recreating the compacted dbs of users and compacting user indexes which received no updates.
+	PerUserRecreate time.Duration
+	// Finalize is the time spent in setting the compacted index for the common and user index sets.
+	Finalize time.Duration
+}
+
+func (p PhaseTimings) observe(m *metrics) {
+	m.compactTablesPhaseDurationSeconds.WithLabelValues(phasePrefetch).Observe(p.Prefetch.Seconds())
+	m.compactTablesPhaseDurationSeconds.WithLabelValues(phaseCommonMerge).Observe(p.CommonMerge.Seconds())
+	m.compactTablesPhaseDurationSeconds.WithLabelValues(phaseCommonRecreate).Observe(p.CommonRecreate.Seconds())
+	m.compactTablesPhaseDurationSeconds.WithLabelValues(phasePerUserRecreate).Observe(p.PerUserRecreate.Seconds())
+	m.compactTablesPhaseDurationSeconds.WithLabelValues(phaseFinalize).Observe(p.Finalize.Seconds())
+}
+
+func (p PhaseTimings) log(logger log.Logger) {
+	level.Debug(logger).Log(
+		"msg", "table compaction phase timings",
+		phasePrefetch, p.Prefetch,
+		phaseCommonMerge, p.CommonMerge,
+		phaseCommonRecreate, p.CommonRecreate,
+		phasePerUserRecreate, p.PerUserRecreate,
+		phaseFinalize, p.Finalize,
+	)
+}
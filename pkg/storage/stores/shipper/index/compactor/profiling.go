@@ -0,0 +1,27 @@
+package compactor
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+const (
+	profilingPhaseCommonMerge = "common_merge"
+	profilingPhaseUserMerge   = "user_merge"
+	profilingPhaseRecreate    = "recreate"
+)
+
+// doWithProfilingLabels runs f with pprof labels for the table and the phase of compaction when Options.EnableProfilingLabels is set.
+// It lets CPU profiles collected during compaction be filtered by table and phase.
+func (t *tableCompactor) doWithProfilingLabels(ctx context.Context, phase string, f func(ctx context.Context) error) error {
+	if !t.opts.EnableProfilingLabels {
+		return f(ctx)
+	}
+
+	var err error
+	pprof.Do(ctx, pprof.Labels("table", t.commonIndexSet.GetTableName(), "phase", phase), func(ctx context.Context) {
+		err = f(ctx)
+	})
+
+	return err
+}
@@ -0,0 +1,35 @@
+package compactor
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableCompactor_doWithProfilingLabels(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		tCompactor := &tableCompactor{
+			commonIndexSet: &mockIndexSet{tableName: tableName},
+			opts:           Options{EnableProfilingLabels: enabled},
+		}
+
+		called := false
+		err := tCompactor.doWithProfilingLabels(context.Background(), profilingPhaseRecreate, func(ctx context.Context) error {
+			called = true
+
+			table, ok := pprof.Label(ctx, "table")
+			require.Equal(t, enabled, ok)
+			phase, ok := pprof.Label(ctx, "phase")
+			require.Equal(t, enabled, ok)
+			if enabled {
+				require.Equal(t, tableName, table)
+				require.Equal(t, profilingPhaseRecreate, phase)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.True(t, called)
+	}
+}
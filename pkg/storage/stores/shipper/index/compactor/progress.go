@@ -0,0 +1,63 @@
+package compactor
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultProgressInterval = 10 * time.Second
+
+// ProgressCallback receives the number of source files of the common index of a table merged so far out of the total number
+// of source files to merge, not including the seed file. Skipped corrupt or empty source files are counted as merged.
+type ProgressCallback func(tableName string, done, total int)
+
+// progressReporter reports the progress of merging the source files of the common index of a table as per Options.ProgressCallback.
+// The first and the last progress are always reported, others at most once per interval. Calls to the callback are serialized.
+// A nil progressReporter reports nothing.
+type progressReporter struct {
+	callback  ProgressCallback
+	tableName string
+	total     int
+	interval  time.Duration
+
+	mtx        sync.Mutex
+	done       int
+	lastReport time.Time
+}
+
+// newProgressReporter builds a progressReporter for the given total number of source files to merge and reports the start of merging them,
+// or returns nil when Options.ProgressCallback is not configured.
+func (t *tableCompactor) newProgressReporter(total int) *progressReporter {
+	if t.opts.ProgressCallback == nil {
+		return nil
+	}
+
+	p := &progressReporter{
+		callback:   t.opts.ProgressCallback,
+		tableName:  t.commonIndexSet.GetTableName(),
+		total:      total,
+		interval:   t.opts.progressInterval(),
+		lastReport: time.Now(),
+	}
+	p.callback(p.tableName, 0, total)
+
+	return p
+}
+
+// fileDone records a merged source file and reports the progress if the interval has passed since the last report.
+func (p *progressReporter) fileDone() {
+	if p == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.done++
+	if p.done < p.total && time.Since(p.lastReport) < p.interval {
+		return
+	}
+
+	p.lastReport = time.Now()
+	p.callback(p.tableName, p.done, p.total)
+}
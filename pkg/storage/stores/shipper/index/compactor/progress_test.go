@@ -0,0 +1,48 @@
+package compactor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_ProgressCallback(t *testing.T) {
+	type progress struct {
+		table       string
+		done, total int
+	}
+
+	for _, tc := range []struct {
+		interval         time.Duration
+		expectedProgress []progress
+	}{
+		{
+			interval:         time.Hour,
+			expectedProgress: []progress{{tableName, 0, 5}, {tableName, 5, 5}},
+		},
+		{
+			interval:         time.Nanosecond,
+			expectedProgress: []progress{{tableName, 0, 5}, {tableName, 1, 5}, {tableName, 2, 5}, {tableName, 3, 5}, {tableName, 4, 5}, {tableName, 5, 5}},
+		},
+	} {
+		t.Run(fmt.Sprintf("interval=%s", tc.interval), func(t *testing.T) {
+			var reported []progress
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 5,
+			}, testutil.PerUserDBsConfig{}, Options{
+				ProgressInterval: tc.interval,
+				ProgressCallback: func(table string, done, total int) {
+					reported = append(reported, progress{table: table, done: done, total: total})
+				},
+			})
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+			require.Equal(t, tc.expectedProgress, reported)
+		})
+	}
+}
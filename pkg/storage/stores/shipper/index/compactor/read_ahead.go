@@ -0,0 +1,89 @@
+package compactor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/dskit/concurrency"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+type downloadResult struct {
+	db  downloadedDb
+	err error
+}
+
+// forEachSourceFileWithReadAhead downloads the given source files in order with up to Options.CompactionReadAhead files
+// being downloaded or waiting to be processed, and processes the downloaded files with the given number of workers.
+// Files are processed in order when there is a single worker.
+func (t *tableCompactor) forEachSourceFileWithReadAhead(ctx context.Context, userID string, idxSet compactor.IndexSet, sourceFiles []storage.IndexFile, workers int, process func(ctx context.Context, db downloadedDb) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan downloadResult, len(sourceFiles))
+	for i := range results {
+		results[i] = make(chan downloadResult, 1)
+	}
+
+	// tokens are taken in the order of files, so the next file to process always gets one before the files after it.
+	tokens := make(chan struct{}, t.opts.CompactionReadAhead)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for idx := range sourceFiles {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				db, err := t.downloadSourceFile(ctx, userID, idxSet, sourceFiles[idx])
+				results[idx] <- downloadResult{db: db, err: err}
+			}(idx)
+		}
+	}()
+
+	err := concurrency.ForEachJob(ctx, len(sourceFiles), workers, func(ctx context.Context, idx int) error {
+		var result downloadResult
+		select {
+		case result = <-results[idx]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-tokens }()
+		defer result.db.cleanup(idxSet.GetLogger())
+
+		if result.err != nil || result.db.db == nil {
+			return result.err
+		}
+
+		if err := t.waitWhilePaused(ctx, idxSet.GetLogger()); err != nil {
+			return err
+		}
+		t.heartbeat()
+		t.metrics.compactTablesReadConcurrency.Inc()
+		defer t.metrics.compactTablesReadConcurrency.Dec()
+
+		return process(ctx, result.db)
+	})
+
+	// stop downloading files ahead and cleanup the ones which did not get processed due to a failure.
+	cancel()
+	wg.Wait()
+	for _, result := range results {
+		select {
+		case r := <-result:
+			r.db.cleanup(idxSet.GetLogger())
+		default:
+		}
+	}
+
+	return err
+}
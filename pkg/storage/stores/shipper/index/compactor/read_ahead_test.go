@@ -0,0 +1,169 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// latencyIndexSet is an IndexSet serving source files from a local directory with a fixed latency per download.
+type latencyIndexSet struct {
+	sourceDir, workingDir string
+	sourceFiles           []storage.IndexFile
+	latency               time.Duration
+	failSourceFile        string
+}
+
+func newLatencyIndexSet(t testing.TB, numFiles, numRecordsPerFile int, latency time.Duration) *latencyIndexSet {
+	idxSet := &latencyIndexSet{
+		sourceDir:  t.TempDir(),
+		workingDir: t.TempDir(),
+		latency:    latency,
+	}
+
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("db-%d", i)
+		testutil.AddRecordsToDB(t, filepath.Join(idxSet.sourceDir, name), i*numRecordsPerFile, numRecordsPerFile, local.IndexBucketName)
+		idxSet.sourceFiles = append(idxSet.sourceFiles, storage.IndexFile{Name: name, ModifiedAt: time.Now()})
+	}
+
+	return idxSet
+}
+
+func (l *latencyIndexSet) GetTableName() string {
+	return tableName
+}
+
+func (l *latencyIndexSet) ListSourceFiles() []storage.IndexFile {
+	return l.sourceFiles
+}
+
+func (l *latencyIndexSet) GetSourceFile(indexFile storage.IndexFile) (string, error) {
+	time.Sleep(l.latency)
+	if indexFile.Name == l.failSourceFile {
+		return "", fmt.Errorf("failed to download %s", indexFile.Name)
+	}
+
+	src, err := os.Open(filepath.Join(l.sourceDir, indexFile.Name))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst := filepath.Join(l.workingDir, indexFile.Name)
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, src)
+	return dst, err
+}
+
+func (l *latencyIndexSet) GetLogger() log.Logger {
+	return util_log.Logger
+}
+
+func (l *latencyIndexSet) GetWorkingDir() string {
+	return l.workingDir
+}
+
+func (l *latencyIndexSet) SetCompactedIndex(_ compactor.CompactedIndex, _ bool) error {
+	return nil
+}
+
+func newReadAheadTableCompactor(opts Options) *tableCompactor {
+	return newTableCompactor(context.Background(), nil, nil, nil, config.PeriodConfig{}, opts, newMetrics(nil))
+}
+
+func TestTable_CompactionReadAhead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{name: "concurrent", opts: Options{CompactionReadAhead: 2}},
+		{name: "in order", opts: Options{CompactionReadAhead: 2, DeterministicOutput: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idxSet := newLatencyIndexSet(t, 10, 100, time.Millisecond)
+			compactedIndex, err := newReadAheadTableCompactor(tc.opts).compactUserIndexes(context.Background(), "user1", idxSet)
+			require.NoError(t, err)
+			defer compactedIndex.Cleanup()
+
+			records := readDB(t, compactedIndex.compactedFile)
+			require.Len(t, records[string(local.IndexBucketName)], 1000)
+
+			// only the compacted file should be left in the working dir
+			files, err := os.ReadDir(idxSet.workingDir)
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+		})
+	}
+
+	t.Run("failed download", func(t *testing.T) {
+		idxSet := newLatencyIndexSet(t, 10, 100, time.Millisecond)
+		idxSet.failSourceFile = "db-5"
+
+		_, err := newReadAheadTableCompactor(Options{CompactionReadAhead: 2, DeterministicOutput: true}).compactUserIndexes(context.Background(), "user1", idxSet)
+		require.EqualError(t, err, "failed to download db-5")
+
+		// downloaded source files should be cleaned up
+		files, err := os.ReadDir(idxSet.workingDir)
+		require.NoError(t, err)
+		for _, file := range files {
+			require.NotContains(t, file.Name(), "db-")
+		}
+	})
+}
+
+func TestTable_CompactUserIndexesCanceled(t *testing.T) {
+	for _, readAhead := range []int{0, 2} {
+		t.Run(fmt.Sprintf("readAhead=%d", readAhead), func(t *testing.T) {
+			idxSet := newLatencyIndexSet(t, 10, 100, time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := newReadAheadTableCompactor(Options{CompactionReadAhead: readAhead}).compactUserIndexes(ctx, "user1", idxSet)
+			require.ErrorIs(t, err, context.Canceled)
+
+			// the partially compacted file and downloaded source files should be cleaned up
+			files, err := os.ReadDir(idxSet.workingDir)
+			require.NoError(t, err)
+			require.Empty(t, files)
+		})
+	}
+}
+
+func Benchmark_CompactionReadAhead(b *testing.B) {
+	idxSet := newLatencyIndexSet(b, 20, 1000, 5*time.Millisecond)
+
+	// merge the files one at a time to compare read ahead with the interleaved download and merge of files
+	for _, readAhead := range []int{0, 4} {
+		b.Run(fmt.Sprintf("readAhead=%d", readAhead), func(b *testing.B) {
+			tCompactor := newReadAheadTableCompactor(Options{CompactionReadAhead: readAhead, DeterministicOutput: true})
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				compactedIndex, err := tCompactor.compactUserIndexes(context.Background(), "user1", idxSet)
+				require.NoError(b, err)
+				compactedIndex.Cleanup()
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package compactor
+
+import (
+	"golang.org/x/sync/semaphore"
+)
+
+// readBudget is a concurrency budget for reading the source files of user indexes, shared by all the user indexes of a table.
+// It bounds the total number of goroutines when multi-file user indexes get compacted concurrently while fetching them for
+// compacting the common index, instead of each of them spinning up readDBsConcurrency goroutines.
+type readBudget struct {
+	sem *semaphore.Weighted
+}
+
+func newReadBudget(size int) *readBudget {
+	return &readBudget{sem: semaphore.NewWeighted(int64(size))}
+}
+
+// acquireWorkers returns the number of workers to use for processing numJobs jobs along with a func to release them.
+// The calling goroutine is always counted as a worker without taking it from the budget, so it returns at least 1 worker
+// and never blocks. Additional workers are taken from the budget only while it has capacity left.
+func (b *readBudget) acquireWorkers(numJobs int) (int, func()) {
+	workers := 1
+	for workers < numJobs && b.sem.TryAcquire(1) {
+		workers++
+	}
+
+	return workers, func() {
+		if workers > 1 {
+			b.sem.Release(int64(workers - 1))
+		}
+	}
+}
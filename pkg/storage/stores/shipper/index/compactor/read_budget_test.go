@@ -0,0 +1,36 @@
+package compactor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBudget_acquireWorkers(t *testing.T) {
+	budget := newReadBudget(3)
+
+	// the calling goroutine is not taken from the budget
+	workers, release1 := budget.acquireWorkers(1)
+	require.Equal(t, 1, workers)
+
+	workers, release2 := budget.acquireWorkers(3)
+	require.Equal(t, 3, workers)
+
+	// only one worker is left in the budget
+	workers, release3 := budget.acquireWorkers(5)
+	require.Equal(t, 2, workers)
+
+	// budget is exhausted but we still get the calling goroutine as worker
+	workers, release4 := budget.acquireWorkers(5)
+	require.Equal(t, 1, workers)
+
+	release1()
+	release2()
+	release3()
+	release4()
+
+	// all the workers are back in the budget
+	workers, release := budget.acquireWorkers(10)
+	require.Equal(t, 4, workers)
+	release()
+}
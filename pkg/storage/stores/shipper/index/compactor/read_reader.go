@@ -0,0 +1,74 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.etcd.io/bbolt"
+)
+
+// readReader is like readFile but for the boltdb file of the given size read from r, like one cached in memory, for ingesting index
+// files without a path of their own. bbolt can only open files, so the content gets copied to a temp file in dir, or in the default
+// temp dir when empty, which is removed once read, while r is left untouched.
+//
+// Memory implications: the content is streamed to the temp file without getting buffered again, so ingesting it does not double the
+// memory used by r, but it uses as much disk space as its size in dir until it is read. The temp file gets mmapped by bbolt while it is
+// read like any other source file, so its pages compete with r in the page cache.
+func readReader(logger log.Logger, r io.ReaderAt, size int64, dir string, sizer *batchSizer, writeBatch func(userID string, batch []indexEntry) error) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid size %d of index file to read", size)
+	}
+
+	tmp, err := os.CreateTemp(dir, "index-reader-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil {
+			level.Error(logger).Log("msg", "failed to remove temp copy of index file", "path", tmp.Name(), "err", err)
+		}
+	}()
+
+	n, err := io.Copy(tmp, io.NewSectionReader(r, 0, size))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("read %d bytes of index file of size %d", n, size)
+	}
+
+	db, err := openBoltdbFileWithNoSyncAndOptions(tmp.Name(), &bbolt.Options{ReadOnly: true, Timeout: defaultBoltdbOpenTimeout})
+	if err != nil {
+		return err
+	}
+
+	dbPair := downloadedDb{path: tmp.Name(), db: db}
+	defer func() {
+		if err := db.Close(); err != nil {
+			level.Error(logger).Log("msg", "failed to close temp copy of index file", "path", tmp.Name(), "err", err)
+		}
+	}()
+
+	return readFile(logger, dbPair, sizer, writeBatch)
+}
+
+// MergeReader copies the index entries of each bucket of the boltdb file of the given size read from r, like one already in memory,
+// into the bucket of the same name in the compacted index, except the bucket holding meta information of the file. Entries are written
+// in batches and overwrite existing entries with the same key like with Merge. r is not modified, and the file gets copied to a temp
+// file in the working dir of the compacted index while merging it, which uses as much disk space as its size.
+// The context is checked between the batches.
+func (c *CompactedIndex) MergeReader(ctx context.Context, r io.ReaderAt, size int64) error {
+	return readReader(c.logger, r, size, c.workingDir, Options{}.newBatchSizer(), func(bucketName string, batch []indexEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return c.writeBatchToBucket(bucketName, batch)
+	})
+}
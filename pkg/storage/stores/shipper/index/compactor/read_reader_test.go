@@ -0,0 +1,78 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+// indexFileInMemory builds an index file with 100 entries in the index bucket and 50 in the bucket of user1, and returns its content.
+func indexFileInMemory(t *testing.T) []byte {
+	path := filepath.Join(t.TempDir(), "db")
+	testutil.AddRecordsToDB(t, path, 0, 100, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, path, 0, 50, []byte("user1"))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return content
+}
+
+func TestReadReader(t *testing.T) {
+	content := indexFileInMemory(t)
+	original := append([]byte(nil), content...)
+	dir := t.TempDir()
+
+	entries := map[string]int{}
+	err := readReader(util_log.Logger, bytes.NewReader(content), int64(len(content)), dir, Options{}.newBatchSizer(), func(bucketName string, batch []indexEntry) error {
+		entries[bucketName] += len(batch)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{string(local.IndexBucketName): 100, "user1": 50}, entries)
+
+	// the content is left untouched and its temp copy is removed.
+	require.Equal(t, original, content)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// the size must match the content.
+	noop := func(string, []indexEntry) error { return nil }
+	require.Error(t, readReader(util_log.Logger, bytes.NewReader(content), int64(len(content))+1, dir, Options{}.newBatchSizer(), noop))
+	require.Error(t, readReader(util_log.Logger, bytes.NewReader(content), 0, dir, Options{}.newBatchSizer(), noop))
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestCompactedIndex_MergeReader(t *testing.T) {
+	content := indexFileInMemory(t)
+	workingDir := t.TempDir()
+
+	db, err := openBoltdbFileWithNoSync(filepath.Join(workingDir, "compacted"))
+	require.NoError(t, err)
+	compactedIndex := newCompactedIndex(db, tableName, workingDir, config.PeriodConfig{}, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	// merging the same content twice overwrites the entries written the first time.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, compactedIndex.MergeReader(context.Background(), bytes.NewReader(content), int64(len(content))))
+	}
+
+	records := readDB(t, db)
+	require.Len(t, records[string(local.IndexBucketName)], 100)
+	require.Len(t, records["user1"], 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, compactedIndex.MergeReader(ctx, bytes.NewReader(content), int64(len(content))), context.Canceled)
+}
@@ -0,0 +1,65 @@
+package compactor
+
+import (
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+// RemovedSourceFilesCallback receives the names of the source files of a table which were removed from the storage once the compacted
+// indexes replacing them got uploaded, keyed by user id with an empty user id for the common index, and the error the compaction of
+// the table failed with, if any. Files can have been removed before a failure, like when the removal of other files failed.
+type RemovedSourceFilesCallback func(tableName string, removedSourceFiles map[string][]string, err error)
+
+// SetCompactedIndexAuditFunc receives a change made to the index set of a user of a table, or of the common index for an empty user id,
+// with the names of the source files replaced by the change and whether a compacted file gets uploaded in place of them.
+// No compacted file gets uploaded when all the entries of the common index got moved to the indexes of users.
+type SetCompactedIndexAuditFunc func(tableName, userID string, sourceFiles []string, upload bool)
+
+// setCompactedIndex sets the compacted index for the given index set with its source files to be removed and records the size and
+// bbolt stats of the compacted file, after passing the change to Options.SetCompactedIndexAuditFunc.
+// In dry run mode, it only adds the changes to the index set to the dry run report, and while exporting the table with ExportTo it only
+// merges the compacted index into the export file.
+func (t *tableCompactor) setCompactedIndex(userID string, idxSet compactor.IndexSet, compactedIndex compactor.CompactedIndex) error {
+	if err := t.observeCompactedFileSize(userID, compactedIndex); err != nil {
+		return err
+	}
+	if err := t.observeBoltStats(idxSet.GetLogger(), userID, compactedIndex); err != nil {
+		return err
+	}
+
+	if t.export != nil {
+		return t.export.add(userID, compactedIndex)
+	}
+
+	sourceFiles := idxSet.ListSourceFiles()
+	if t.dryRun != nil {
+		return t.dryRun.add(userID, sourceFiles, compactedIndex)
+	}
+
+	names := make([]string, 0, len(sourceFiles))
+	for _, sourceFile := range sourceFiles {
+		names = append(names, sourceFile.Name)
+	}
+	if t.opts.SetCompactedIndexAuditFunc != nil {
+		t.opts.SetCompactedIndexAuditFunc(idxSet.GetTableName(), userID, names, compactedIndex != nil)
+	}
+
+	if err := t.moveToWorkingDir(compactedIndex); err != nil {
+		return err
+	}
+	if err := idxSet.SetCompactedIndex(compactedIndex, true); err != nil {
+		return err
+	}
+
+	// the index set owns the compacted db once handed over, so it must not get removed anymore when the compaction of the table fails.
+	if c, ok := compactedIndex.(*CompactedIndex); ok && c != nil && c.compactedFile != nil {
+		t.tempDBs.remove(c.compactedFile)
+	}
+	return nil
+}
+
+// TableCompactionDone passes the source files removed from the storage while compacting a table to Options.RemovedSourceFilesCallback.
+func (i indexCompactor) TableCompactionDone(tableName string, removedSourceFiles map[string][]string, err error) {
+	if i.opts.RemovedSourceFilesCallback != nil {
+		i.opts.RemovedSourceFilesCallback(tableName, removedSourceFiles, err)
+	}
+}
@@ -0,0 +1,52 @@
+package compactor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/config"
+)
+
+// RetentionPeriodFunc returns the retention period for the index entries of a tenant.
+// A zero or negative value means the tenant does not have retention configured.
+type RetentionPeriodFunc func(userID string) time.Duration
+
+// validateRetentionSchema returns an error for schema versions of the given period config whose chunk index entries can't be decoded
+// by dropExpiredEntries. Schemas v9 and later write the chunk index entries with the same range key format, which is the one decoded by
+// parseChunkRef, while the earlier schemas use other key formats.
+func validateRetentionSchema(periodConfig config.PeriodConfig) error {
+	version, err := periodConfig.VersionAsInt()
+	if err != nil {
+		return fmt.Errorf("can't apply retention to index entries of invalid schema version %q: %w", periodConfig.Schema, err)
+	}
+	if version < 9 {
+		return fmt.Errorf("can't apply retention to index entries of schema version %s, retention requires v9 or later", periodConfig.Schema)
+	}
+
+	return nil
+}
+
+// dropExpiredEntries removes chunk index entries from the batch whose chunk ended before now-retention of the owning tenant.
+// The tenant and chunk time range are decoded from the keys the same way as ForEachChunk does,
+// so only chunk index entries are considered while series and label entries are always kept.
+// Entries which can't be parsed are kept as well. The keys must be of a schema accepted by validateRetentionSchema.
+// The filtering is done in-place and the filtered batch is returned along with the number of dropped entries.
+func dropExpiredEntries(batch []indexEntry, retentionPeriod RetentionPeriodFunc, now model.Time) ([]indexEntry, int) {
+	filtered := batch[:0]
+	for _, entry := range batch {
+		ref, ok, err := parseChunkRef(decodeKey(entry.k))
+		if err != nil || !ok {
+			filtered = append(filtered, entry)
+			continue
+		}
+
+		period := retentionPeriod(unsafeGetString(ref.UserID))
+		if period <= 0 || ref.Through >= now.Add(-period) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered, len(batch) - len(filtered)
+}
@@ -0,0 +1,166 @@
+package compactor
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func Test_dropExpiredEntries(t *testing.T) {
+	now := model.Now()
+	for _, tt := range allSchemas {
+		tt := tt
+		t.Run(tt.schema, func(t *testing.T) {
+			lbls := labels.Labels{labels.Label{Name: "foo", Value: "bar"}}
+			// user1 has retention of 2 days while user2 has no retention configured
+			oldUser1Chunk := createChunk(t, "user1", lbls, now.Add(-72*time.Hour), now.Add(-71*time.Hour))
+			newUser1Chunk := createChunk(t, "user1", lbls, now.Add(-2*time.Hour), now.Add(-time.Hour))
+			oldUser2Chunk := createChunk(t, "user2", lbls, now.Add(-72*time.Hour), now.Add(-71*time.Hour))
+
+			retentionPeriod := func(userID string) time.Duration {
+				if userID == "user1" {
+					return 48 * time.Hour
+				}
+				return 0
+			}
+
+			oldUser1Entries := buildChunkIndexEntries(t, tt.config, oldUser1Chunk)
+			newUser1Entries := buildChunkIndexEntries(t, tt.config, newUser1Chunk)
+			oldUser2Entries := buildChunkIndexEntries(t, tt.config, oldUser2Chunk)
+			nonChunkEntries := []indexEntry{{k: []byte("foo"), v: []byte("bar")}}
+
+			var batch []indexEntry
+			batch = append(batch, oldUser1Entries...)
+			batch = append(batch, newUser1Entries...)
+			batch = append(batch, oldUser2Entries...)
+			batch = append(batch, nonChunkEntries...)
+
+			var expected []indexEntry
+			expected = append(expected, newUser1Entries...)
+			expected = append(expected, oldUser2Entries...)
+			expected = append(expected, nonChunkEntries...)
+
+			filtered, dropped := dropExpiredEntries(batch, retentionPeriod, now)
+			require.Equal(t, len(oldUser1Entries), dropped)
+			require.Equal(t, expected, filtered)
+		})
+	}
+}
+
+func TestTable_RetentionClock(t *testing.T) {
+	now := model.Now()
+	lbls := labels.Labels{labels.Label{Name: "foo", Value: "bar"}}
+	c := createChunk(t, "user1", lbls, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	entries := buildChunkIndexEntries(t, allSchemas[2].config, c)
+
+	for _, tc := range []struct {
+		name          string
+		clock         time.Time
+		expectDropped bool
+	}{
+		{name: "chunk within retention", clock: now.Time()},
+		{name: "chunk past retention as per the clock", clock: now.Time().Add(72 * time.Hour), expectDropped: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{}, Options{
+				RetentionPeriod: func(string) time.Duration { return 48 * time.Hour },
+				Clock:           func() time.Time { return tc.clock },
+			})
+			defer cleanupTableCompactor(tCompactor)
+
+			batch := tCompactor.applyRetention(append([]indexEntry(nil), entries...))
+			if tc.expectDropped {
+				require.Empty(t, batch)
+				require.Equal(t, float64(len(entries)), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRetentionDroppedEntries))
+			} else {
+				require.Equal(t, entries, batch)
+				require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRetentionDroppedEntries))
+			}
+		})
+	}
+}
+
+func TestTable_RetentionSchema(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		schema      string
+		expectedErr string
+	}{
+		{name: "invalid schema", schema: "", expectedErr: "can't apply retention to index entries of invalid schema version"},
+		{name: "schema before v9", schema: "v6", expectedErr: "can't apply retention to index entries of schema version v6, retention requires v9 or later"},
+		{name: "v9", schema: "v9"},
+		{name: "v12", schema: "v12"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 2,
+			}, testutil.PerUserDBsConfig{}, Options{RetentionPeriod: func(string) time.Duration { return 48 * time.Hour }})
+			defer cleanupTableCompactor(tCompactor)
+			tCompactor.periodConfig = config.PeriodConfig{Schema: tc.schema}
+			tCompactor.retentionErr = validateRetentionSchema(tCompactor.periodConfig)
+
+			commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, tCompactor.CompactTable(), tc.expectedErr)
+				require.Nil(t, commonIndexSet.compactedIndex)
+				return
+			}
+			require.NoError(t, tCompactor.CompactTable())
+			require.NotNil(t, commonIndexSet.compactedIndex)
+		})
+	}
+}
+
+// buildChunkIndexEntries returns the chunk index entries built for the given chunk.
+func buildChunkIndexEntries(t *testing.T, periodConfig config.PeriodConfig, c chunk.Chunk) []indexEntry {
+	db, err := openBoltdbFileWithNoSync(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	var entries []indexEntry
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(local.IndexBucketName)
+		if err != nil {
+			return err
+		}
+
+		indexer, err := newChunkIndexer(bucket, periodConfig, periodConfig.IndexTables.TableFor(c.From))
+		if err != nil {
+			return err
+		}
+
+		if _, err := indexer.IndexChunk(c); err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			ref, ok, err := parseChunkRef(decodeKey(k))
+			if err != nil || !ok {
+				return err
+			}
+			require.Equal(t, c.UserID, string(ref.UserID))
+
+			entries = append(entries, indexEntry{
+				k: append([]byte{}, k...),
+				v: append([]byte{}, v...),
+			})
+			return nil
+		})
+	}))
+	require.NotEmpty(t, entries)
+
+	return entries
+}
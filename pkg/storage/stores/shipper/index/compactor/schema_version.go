@@ -0,0 +1,94 @@
+package compactor
+
+import (
+	"fmt"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/config"
+)
+
+// SeedSchemaPolicy sets how compaction handles seed files built with a schema version older than the one of the table.
+type SeedSchemaPolicy int
+
+const (
+	// SeedSchemaPolicyRebuild records the schema version in compacted files and builds a new compacted file
+	// instead of appending to a seed file with an older schema version. The entries of the seed file are merged like any other source file.
+	// It is the default policy.
+	SeedSchemaPolicyRebuild SeedSchemaPolicy = iota
+	// SeedSchemaPolicyDisabled neither records nor checks the schema version of compacted files.
+	SeedSchemaPolicyDisabled
+	// SeedSchemaPolicyFail records the schema version in compacted files and fails the compaction of tables
+	// having a seed file with an older schema version with a *SeedSchemaOutdatedError.
+	SeedSchemaPolicyFail
+)
+
+var schemaVersionKey = []byte("schema_version")
+
+// SeedSchemaOutdatedError is the error for a seed file built with a schema version older than the one of the table.
+type SeedSchemaOutdatedError struct {
+	SeedFile       string
+	SeedSchema     string
+	ExpectedSchema string
+}
+
+func (e *SeedSchemaOutdatedError) Error() string {
+	return fmt.Sprintf("seed file %s was built with schema %s which is older than the schema %s of the table", e.SeedFile, e.SeedSchema, e.ExpectedSchema)
+}
+
+// writeSchemaVersion stores the given schema version in metaBucketName.
+func writeSchemaVersion(db *bbolt.DB, schema string) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(schemaVersionKey, []byte(schema))
+	})
+}
+
+// readSchemaVersion returns the schema version stored in the db or an empty string if it does not have one.
+func readSchemaVersion(db *bbolt.DB) (string, error) {
+	var schema string
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(metaBucketName)
+		if b == nil {
+			return nil
+		}
+
+		schema = string(b.Get(schemaVersionKey))
+		return nil
+	})
+
+	return schema, err
+}
+
+// verifySeedSchemaVersion returns a *SeedSchemaOutdatedError if the seed file was built with a schema version older than the one of the given period config.
+// Seed files without a schema version are considered valid since they could have been built without recording it.
+func verifySeedSchemaVersion(db *bbolt.DB, seedFile string, periodConfig config.PeriodConfig) error {
+	seedSchema, err := readSchemaVersion(db)
+	if err != nil || seedSchema == "" {
+		return err
+	}
+
+	seedVersion, err := (&config.PeriodConfig{Schema: seedSchema}).VersionAsInt()
+	if err != nil {
+		return fmt.Errorf("invalid schema version %s in seed file %s: %w", seedSchema, seedFile, err)
+	}
+
+	expectedVersion, err := periodConfig.VersionAsInt()
+	if err != nil {
+		return err
+	}
+
+	if seedVersion < expectedVersion {
+		return &SeedSchemaOutdatedError{
+			SeedFile:       seedFile,
+			SeedSchema:     seedSchema,
+			ExpectedSchema: periodConfig.Schema,
+		}
+	}
+
+	return nil
+}
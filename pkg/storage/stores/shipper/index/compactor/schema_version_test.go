@@ -0,0 +1,127 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/index/indexfile"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestVerifySeedSchemaVersion(t *testing.T) {
+	db, err := openBoltdbFileWithNoSync(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	periodConfig := config.PeriodConfig{Schema: "v11"}
+
+	// db without a schema version is valid
+	require.NoError(t, verifySeedSchemaVersion(db, "db", periodConfig))
+
+	for _, tc := range []struct {
+		seedSchema string
+		outdated   bool
+	}{
+		{seedSchema: "v9", outdated: true},
+		{seedSchema: "v11"},
+		{seedSchema: "v12"},
+	} {
+		require.NoError(t, writeSchemaVersion(db, tc.seedSchema))
+		err := verifySeedSchemaVersion(db, "db", periodConfig)
+		if !tc.outdated {
+			require.NoError(t, err)
+			continue
+		}
+
+		var outdatedErr *SeedSchemaOutdatedError
+		require.ErrorAs(t, err, &outdatedErr)
+		require.Equal(t, SeedSchemaOutdatedError{SeedFile: "db", SeedSchema: tc.seedSchema, ExpectedSchema: "v11"}, *outdatedErr)
+	}
+
+	require.NoError(t, writeSchemaVersion(db, "invalid"))
+	require.Error(t, verifySeedSchemaVersion(db, "db", periodConfig))
+}
+
+func TestTable_SeedSchemaPolicy(t *testing.T) {
+	setup := func(t *testing.T, policy SeedSchemaPolicy) *tableCompactor {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   1,
+		}, testutil.PerUserDBsConfig{}, Options{SeedSchemaPolicy: policy})
+		tCompactor.periodConfig = config.PeriodConfig{Schema: "v11"}
+
+		// replace the seed file in the storage with a file built with an older schema version
+		seedPath := filepath.Join(t.TempDir(), "seed")
+		testutil.AddRecordsToDB(t, seedPath, 1000, 100, local.IndexBucketName)
+		seedDB, err := openBoltdbFileWithNoSync(seedPath)
+		require.NoError(t, err)
+		require.NoError(t, writeSchemaVersion(seedDB, "v9"))
+		require.NoError(t, seedDB.Close())
+
+		seedFile, err := os.Open(seedPath)
+		require.NoError(t, err)
+		defer seedFile.Close()
+
+		commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+		seedIdx := compactedFileIdx(commonIndexSet.sourceFiles, []string{defaultUploaderName})
+		require.NotEqual(t, -1, seedIdx)
+		require.NoError(t, commonIndexSet.objectClient.PutObject(context.Background(), filepath.Join(tableName, commonIndexSet.sourceFiles[seedIdx].Name), seedFile))
+
+		return tCompactor
+	}
+
+	// outdated seed files are rebuilt by default.
+	for name, policy := range map[string]SeedSchemaPolicy{"default": Options{}.SeedSchemaPolicy, "rebuild": SeedSchemaPolicyRebuild} {
+		policy := policy
+		t.Run(name, func(t *testing.T) {
+			tCompactor := setup(t, policy)
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+			require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesOutdatedSeedSchema))
+
+			// entries of the seed file should be merged into the new compacted file
+			compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+			records := readDB(t, compactedIndex.compactedFile)
+			require.Len(t, records[string(local.IndexBucketName)], 300)
+
+			indexFile, err := compactedIndex.ToIndexFile()
+			require.NoError(t, err)
+			defer func() {
+				path := indexFile.Path()
+				require.NoError(t, indexFile.Close())
+				require.NoError(t, os.Remove(path))
+			}()
+
+			schema, err := readSchemaVersion(indexFile.(*indexfile.IndexFile).GetBoltDB())
+			require.NoError(t, err)
+			require.Equal(t, "v11", schema)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		tCompactor := setup(t, SeedSchemaPolicyDisabled)
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+		require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesOutdatedSeedSchema))
+		require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSeedReuse))
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		tCompactor := setup(t, SeedSchemaPolicyFail)
+		defer cleanupTableCompactor(tCompactor)
+
+		var outdatedErr *SeedSchemaOutdatedError
+		require.ErrorAs(t, tCompactor.CompactTable(), &outdatedErr)
+		require.Equal(t, "v9", outdatedErr.SeedSchema)
+		require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesOutdatedSeedSchema))
+	})
+}
@@ -0,0 +1,65 @@
+package compactor
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// seedFileGuard enforces that the seed file of the common index, which is the compacted file the other source files get merged into,
+// is never read as a source file while compacting the table and is consumed exactly once, since reading it would write its entries
+// to itself and downloading another source file with its name would overwrite it while being written to.
+type seedFileGuard struct {
+	idx  int
+	name string
+}
+
+// newSeedFileGuard builds the guard for the seed file at the given index of the source files, or -1 when there is no seed file.
+func newSeedFileGuard(sourceFiles []storage.IndexFile, seedIdx int) seedFileGuard {
+	g := seedFileGuard{idx: seedIdx}
+	if seedIdx != -1 {
+		g.name = sourceFiles[seedIdx].Name
+	}
+	return g
+}
+
+// skip returns true for the seed file, which must be skipped while reading the source files, and an error wrapping
+// ErrSeedFileReadAsSource for another source file with the name of the seed file.
+func (g seedFileGuard) skip(idx int, name string) (bool, error) {
+	if g.idx == -1 {
+		return false, nil
+	}
+	if idx == g.idx {
+		return true, nil
+	}
+	if name == g.name {
+		return false, errors.Wrapf(ErrSeedFileReadAsSource, "source file %s at position %d has the name of the seed file at position %d", name, idx, g.idx)
+	}
+	return false, nil
+}
+
+// checkRead returns an error wrapping ErrSeedFileReadAsSource when the source file about to be read is the compacted file at the given path.
+func (g seedFileGuard) checkRead(sourceFile string, db downloadedDb, compactedFilePath string) error {
+	if db.path == compactedFilePath {
+		return errors.Wrapf(ErrSeedFileReadAsSource, "source file %s is the compacted file %s", sourceFile, compactedFilePath)
+	}
+	return nil
+}
+
+// checkConsumed returns an error wrapping ErrSeedFileReadAsSource unless the seed file is present exactly once in the given consumed files.
+func (g seedFileGuard) checkConsumed(consumedFiles []string) error {
+	if g.idx == -1 {
+		return nil
+	}
+
+	count := 0
+	for _, name := range consumedFiles {
+		if name == g.name {
+			count++
+		}
+	}
+	if count != 1 {
+		return errors.Wrapf(ErrSeedFileReadAsSource, "seed file %s consumed %d times", g.name, count)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package compactor
+
+import (
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestSeedFileGuard(t *testing.T) {
+	sourceFiles := []storage.IndexFile{{Name: "0"}, {Name: "compactor-1"}, {Name: "2"}}
+
+	// without a seed file, nothing is skipped.
+	noSeed := newSeedFileGuard(sourceFiles, -1)
+	for i, sourceFile := range sourceFiles {
+		skip, err := noSeed.skip(i, sourceFile.Name)
+		require.NoError(t, err)
+		require.False(t, skip)
+	}
+	require.NoError(t, noSeed.checkConsumed(nil))
+
+	guard := newSeedFileGuard(sourceFiles, 1)
+	skip, err := guard.skip(1, "compactor-1")
+	require.NoError(t, err)
+	require.True(t, skip)
+	skip, err = guard.skip(2, "2")
+	require.NoError(t, err)
+	require.False(t, skip)
+
+	// another source file with the name of the seed file would get downloaded over it.
+	_, err = guard.skip(3, "compactor-1")
+	require.ErrorIs(t, err, ErrSeedFileReadAsSource)
+
+	require.NoError(t, guard.checkRead("2", downloadedDb{path: "/work/2"}, "/work/compactor-1"))
+	require.ErrorIs(t, guard.checkRead("2", downloadedDb{path: "/work/compactor-1"}, "/work/compactor-1"), ErrSeedFileReadAsSource)
+
+	require.NoError(t, guard.checkConsumed([]string{"0", "compactor-1"}))
+	require.ErrorIs(t, guard.checkConsumed([]string{"0"}), ErrSeedFileReadAsSource)
+	require.ErrorIs(t, guard.checkConsumed([]string{"compactor-1", "0", "compactor-1"}), ErrSeedFileReadAsSource)
+}
+
+func TestTable_SeedFileNotReadAsSource(t *testing.T) {
+	var readEntries atomic.Int64
+	opts := Options{
+		TransformEntry: func(bucket string, k, v []byte) (string, []byte, []byte, bool) {
+			readEntries.Inc()
+			return bucket, k, v, false
+		},
+	}
+
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 3,
+		NumCompactedDBs:   1,
+	}, testutil.PerUserDBsConfig{}, opts)
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	// only the entries of the 3 uncompacted files of 100 entries each are read, while the seed file gets them merged into it.
+	require.Equal(t, int64(300), readEntries.Load())
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSeedReuse))
+}
+
+func TestTable_SeedFileListedTwice(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 3,
+		NumCompactedDBs:   1,
+	}, testutil.PerUserDBsConfig{}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	// a source file listed with the name of the seed file would get downloaded over the seed file while merging into it.
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	seedIdx := compactedFileIdx(commonIndexSet.sourceFiles, []string{defaultUploaderName})
+	require.NotEqual(t, -1, seedIdx)
+	commonIndexSet.sourceFiles = append(commonIndexSet.sourceFiles, commonIndexSet.sourceFiles[seedIdx])
+
+	require.ErrorIs(t, tCompactor.CompactTable(), ErrSeedFileReadAsSource)
+	require.Nil(t, commonIndexSet.compactedIndex)
+}
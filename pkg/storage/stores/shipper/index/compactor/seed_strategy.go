@@ -0,0 +1,106 @@
+package compactor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// SeedFileStrategy selects the seed file to copy the other source files of the common index into, among the given source files.
+// Previously compacted files are the ones with a name starting with one of the given uploader names.
+// It returns the index of the seed file or -1 for building a new compacted file, along with the reason for the choice which gets logged.
+type SeedFileStrategy func(commonIndexes []storage.IndexFile, uploaderNames []string) (idx int, reason string)
+
+// SeedFirstCompactedFile selects the first previously compacted file as seed.
+func SeedFirstCompactedFile(commonIndexes []storage.IndexFile, uploaderNames []string) (int, string) {
+	idx := compactedFileIdx(commonIndexes, uploaderNames)
+	if idx == -1 {
+		return -1, "no previously compacted file"
+	}
+
+	return idx, "first previously compacted file"
+}
+
+// SeedNewestCompactedFile selects the most recently modified previously compacted file as seed,
+// which avoids picking a stale compacted file left behind by a failed upload.
+func SeedNewestCompactedFile(commonIndexes []storage.IndexFile, uploaderNames []string) (int, string) {
+	idx := -1
+	for i, file := range commonIndexes {
+		if !isCompactedFile(file.Name, uploaderNames) {
+			continue
+		}
+		if idx == -1 || file.ModifiedAt.After(commonIndexes[idx].ModifiedAt) {
+			idx = i
+		}
+	}
+
+	if idx == -1 {
+		return -1, "no previously compacted file"
+	}
+
+	return idx, fmt.Sprintf("newest previously compacted file modified at %s", commonIndexes[idx].ModifiedAt)
+}
+
+// SeedLargestCompactedFile selects the largest previously compacted file as seed, or the first one among the largest ones, which
+// minimizes the entries to copy when racing compactors uploaded multiple compacted files. It is the default strategy, which selects
+// the same file as SeedFirstCompactedFile when there is a single compacted file or when the object store does not report sizes.
+func SeedLargestCompactedFile(commonIndexes []storage.IndexFile, uploaderNames []string) (int, string) {
+	idx := -1
+	for i, file := range commonIndexes {
+		if !isCompactedFile(file.Name, uploaderNames) {
+			continue
+		}
+		if idx == -1 || file.Size > commonIndexes[idx].Size {
+			idx = i
+		}
+	}
+
+	if idx == -1 {
+		return -1, "no previously compacted file"
+	}
+
+	return idx, fmt.Sprintf("largest previously compacted file of %d bytes", commonIndexes[idx].Size)
+}
+
+// seedFileIdx returns the index of the seed file selected by Options.SeedFileStrategy, defaulting to SeedLargestCompactedFile.
+func (t *tableCompactor) seedFileIdx(commonIndexes []storage.IndexFile) (int, string, error) {
+	// entries of the seed file are copied as is instead of being read, so they would not get split.
+	if t.opts.SplitCommonIndex != nil {
+		return -1, "splitting common index", nil
+	}
+
+	strategy := t.opts.SeedFileStrategy
+	if strategy == nil {
+		strategy = SeedLargestCompactedFile
+	}
+
+	idx, reason := strategy(commonIndexes, t.opts.uploaderNames())
+	if idx < -1 || idx >= len(commonIndexes) {
+		return 0, "", fmt.Errorf("seed file strategy selected index %d out of range of %d source files", idx, len(commonIndexes))
+	}
+
+	return idx, reason, nil
+}
+
+// checkMultipleSeeds logs a warning and records it in a metric when there are multiple previously compacted files among the given
+// source files of the common index, like when compactors racing on the same table uploaded their compacted files. Only one of them is
+// used as seed while the others get merged into it like the other source files, and removed along with them once the compaction succeeds.
+func (t *tableCompactor) checkMultipleSeeds(idxSet compactor.IndexSet, commonIndexes []storage.IndexFile) {
+	var compactedFiles []string
+	for _, file := range commonIndexes {
+		if isCompactedFile(file.Name, t.opts.uploaderNames()) {
+			compactedFiles = append(compactedFiles, file.Name)
+		}
+	}
+	if len(compactedFiles) < 2 {
+		return
+	}
+
+	level.Warn(idxSet.GetLogger()).Log("msg", "found multiple previously compacted files of common index, possibly uploaded by racing compactors, merging them",
+		"files", strings.Join(compactedFiles, ","))
+	t.metrics.compactTablesMultipleSeeds.Inc()
+}
@@ -0,0 +1,168 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestSeedFileStrategies(t *testing.T) {
+	now := time.Now()
+	indexes := []storage.IndexFile{
+		{Name: "1", ModifiedAt: now, Size: 3000},
+		{Name: "compactor-1", ModifiedAt: now.Add(-2 * time.Hour), Size: 1000},
+		{Name: "2", ModifiedAt: now.Add(time.Hour)},
+		{Name: "compactor-2", ModifiedAt: now.Add(-time.Hour), Size: 1000},
+		{Name: "compactor-3", ModifiedAt: now.Add(-3 * time.Hour), Size: 2000},
+	}
+
+	idx, _ := SeedFirstCompactedFile(indexes, []string{defaultUploaderName})
+	require.Equal(t, 1, idx)
+
+	idx, _ = SeedNewestCompactedFile(indexes, []string{defaultUploaderName})
+	require.Equal(t, 3, idx)
+
+	idx, _ = SeedLargestCompactedFile(indexes, []string{defaultUploaderName})
+	require.Equal(t, 4, idx)
+	// the first of the largest files is selected, like when the object store does not report sizes.
+	idx, _ = SeedLargestCompactedFile(indexes[:4], []string{defaultUploaderName})
+	require.Equal(t, 1, idx)
+
+	for _, strategy := range []SeedFileStrategy{SeedFirstCompactedFile, SeedNewestCompactedFile, SeedLargestCompactedFile} {
+		idx, _ = strategy(indexes[:1], []string{defaultUploaderName})
+		require.Equal(t, -1, idx)
+
+		idx, _ = strategy(nil, []string{defaultUploaderName})
+		require.Equal(t, -1, idx)
+	}
+
+	// files of other trusted uploaders are recognized as compacted files.
+	idx, _ = SeedFirstCompactedFile(append([]storage.IndexFile{{Name: "reindexer-1"}}, indexes...), []string{defaultUploaderName, "reindexer"})
+	require.Equal(t, 0, idx)
+	idx, _ = SeedNewestCompactedFile(indexes, []string{"other"})
+	require.Equal(t, -1, idx)
+
+	tCompactor := &tableCompactor{opts: Options{SeedFileStrategy: func(_ []storage.IndexFile, _ []string) (int, string) {
+		return len(indexes), "out of range"
+	}}}
+	_, _, err := tCompactor.seedFileIdx(indexes)
+	require.Error(t, err)
+}
+
+func TestTable_SeedFileStrategy(t *testing.T) {
+	var (
+		seenIndexes []storage.IndexFile
+		selectedIdx int
+	)
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+		NumCompactedDBs:   2,
+	}, testutil.PerUserDBsConfig{}, Options{SeedFileStrategy: func(commonIndexes []storage.IndexFile, uploaderNames []string) (int, string) {
+		seenIndexes = commonIndexes
+		selectedIdx, _ = SeedNewestCompactedFile(commonIndexes, uploaderNames)
+		return selectedIdx, "newest"
+	}})
+	defer cleanupTableCompactor(tCompactor)
+
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	for i := range commonIndexSet.sourceFiles {
+		if commonIndexSet.sourceFiles[i].Name == "compactor-0" {
+			commonIndexSet.sourceFiles[i].ModifiedAt = time.Now().Add(time.Hour)
+		}
+	}
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Len(t, seenIndexes, 4)
+	require.Equal(t, "compactor-0", seenIndexes[selectedIdx].Name)
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSeedReuse))
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesFreshCompaction))
+
+	compactedIndex := commonIndexSet.compactedIndex.(*CompactedIndex)
+	records := readDB(t, compactedIndex.compactedFile)
+	require.Len(t, records[string(local.IndexBucketName)], 500)
+}
+
+func TestTable_MultipleSeeds(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	// compacted files uploaded by racing compactors, the second one being the largest, and a file built by an ingester.
+	for name, records := range map[string][2]int{"compactor-0": {0, 100}, "compactor-1": {0, 5000}, "ingester-0": {5000, 50}} {
+		dbPath := filepath.Join(tempDir, name)
+		testutil.AddRecordsToDB(t, dbPath, records[0], records[1], local.IndexBucketName)
+		f, err := os.Open(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, name), f))
+		require.NoError(t, f.Close())
+	}
+
+	tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	// list the source files with their size like the object stores reporting it.
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	for i, sourceFile := range commonIndexSet.sourceFiles {
+		info, err := os.Stat(filepath.Join(objectStoragePath, tableName, sourceFile.Name))
+		require.NoError(t, err)
+		commonIndexSet.sourceFiles[i].Size = info.Size()
+	}
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesMultipleSeeds))
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSeedReuse))
+
+	// the largest compacted file is used as seed while the other one gets merged into it and removed like the other source files.
+	compactedIndex := commonIndexSet.compactedIndex.(*CompactedIndex)
+	require.Equal(t, "compactor-1", filepath.Base(compactedIndex.compactedFile.Path()))
+	require.True(t, commonIndexSet.removeSourceFiles)
+	require.Len(t, readDB(t, compactedIndex.compactedFile)[string(local.IndexBucketName)], 5050)
+}
+
+func TestTable_SeedUploaderNames(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	// a compacted file built by another trusted process and a file built by an ingester.
+	for name, records := range map[string][2]int{"reindexer-0": {0, 100}, "ingester-0": {100, 50}} {
+		dbPath := filepath.Join(tempDir, name)
+		testutil.AddRecordsToDB(t, dbPath, records[0], records[1], local.IndexBucketName)
+		f, err := os.Open(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, name), f))
+		require.NoError(t, f.Close())
+	}
+
+	tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{
+		UploaderName:      "compactor-b",
+		SeedUploaderNames: []string{"reindexer"},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+	require.Equal(t, filepath.Join(tCompactor.commonIndexSet.GetWorkingDir(), "reindexer-0"), compactedIndex.compactedFile.Path())
+	require.Len(t, readDB(t, compactedIndex.compactedFile)[string(local.IndexBucketName)], 150)
+
+	indexFile, err := compactedIndex.ToIndexFile()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, indexFile.Close())
+	}()
+	require.True(t, strings.HasPrefix(indexFile.Name(), "compactor-b-"), indexFile.Name())
+}
@@ -0,0 +1,70 @@
+package compactor
+
+import (
+	"strings"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// ShouldCompact returns whether the given source files of the common index of a table need to be compacted with the default Options,
+// and whether compacting them recreates the only compacted file among them for dropping its free pages.
+// It lets external schedulers prioritize tables without building a table compactor.
+func ShouldCompact(files []storage.IndexFile) (compact bool, recreate bool) {
+	return Options{}.ShouldCompact("", files)
+}
+
+// ShouldCompact is like the package level ShouldCompact, but with the settings of the Options affecting the decision.
+// The files need to be compacted if there are multiple of them or the only file is not a compacted one as per UploaderName and SeedUploaderNames. A compacted file is
+// compacted again for recreating it once it is older than RecreateCompactedDBOlderThan, or for splitting it as per SplitCommonIndex
+// or routing its buckets as per TenantAllowList and TenantDenyList. The table name is passed to ExcludeFromRecreate.
+func (o Options) ShouldCompact(tableName string, files []storage.IndexFile) (compact bool, recreate bool) {
+	recreate = o.mustRecreateCompactedDB(tableName, "", files)
+	if len(files) > 1 || recreate {
+		return true, recreate
+	}
+	if len(files) == 0 {
+		return false, false
+	}
+
+	return !isCompactedFile(files[0].Name, o.uploaderNames()) ||
+		o.SplitCommonIndex != nil || len(o.TenantAllowList) > 0 || len(o.TenantDenyList) > 0, false
+}
+
+// skipCompactionReason explains why ShouldCompact does not compact the given source files of the common index of a table.
+func (o Options) skipCompactionReason(tableName string, files []storage.IndexFile) string {
+	switch {
+	case len(files) == 0:
+		return "no source files"
+	case strings.Contains(files[0].Name, recreatedCompactedDBSuffix):
+		return "single compacted file already recreated"
+	case o.ExcludeFromRecreate != nil && o.ExcludeFromRecreate(tableName, ""):
+		return "single compacted file excluded from recreation"
+	default:
+		return "single compacted file too young to recreate"
+	}
+}
+
+// RecreateExclusionFunc returns true for excluding the compacted db of the given table and user from being recreated.
+// The user id is empty for the common index.
+type RecreateExclusionFunc func(tableName, userID string) bool
+
+// mustRecreateCompactedDB returns true if the compacted db of the given table and user, or of the common index for an empty user id,
+// should be recreated
+func (o Options) mustRecreateCompactedDB(tableName, userID string, sourceFiles []storage.IndexFile) bool {
+	if len(sourceFiles) != 1 {
+		// do not recreate if there are multiple source files
+		return false
+	} else if !isCompactedFile(sourceFiles[0].Name, o.uploaderNames()) {
+		// do not recreate if the only file we have is not the compacted one
+		return false
+	} else if o.now().Sub(sourceFiles[0].ModifiedAt) < o.recreateCompactedDBOlderThan() {
+		// do not recreate if the source file is younger than the threshold
+		return false
+	} else if o.ExcludeFromRecreate != nil && o.ExcludeFromRecreate(tableName, userID) {
+		// do not recreate if the db is excluded from recreation
+		return false
+	}
+
+	// recreate the compacted db only if we have not recreated it before
+	return !strings.Contains(sourceFiles[0].Name, recreatedCompactedDBSuffix)
+}
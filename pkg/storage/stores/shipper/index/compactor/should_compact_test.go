@@ -0,0 +1,131 @@
+package compactor
+
+import (
+	"testing"
+	"time"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestShouldCompact(t *testing.T) {
+	now := time.Now()
+	oldCompactedFile := storage.IndexFile{Name: defaultUploaderName + "-1", ModifiedAt: now.Add(-2 * defaultRecreateCompactedDBOlderThan)}
+	newCompactedFile := storage.IndexFile{Name: defaultUploaderName + "-1", ModifiedAt: now}
+	uncompactedFile := storage.IndexFile{Name: "ingester-1", ModifiedAt: now}
+
+	for name, tc := range map[string]struct {
+		opts               Options
+		files              []storage.IndexFile
+		expectedCompact    bool
+		expectedRecreate   bool
+		expectedSkipReason string
+	}{
+		"no files": {
+			expectedSkipReason: "no source files",
+		},
+		"single uncompacted file": {
+			files:           []storage.IndexFile{uncompactedFile},
+			expectedCompact: true,
+		},
+		"single new compacted file": {
+			files:              []storage.IndexFile{newCompactedFile},
+			expectedSkipReason: "single compacted file too young to recreate",
+		},
+		"single old compacted file": {
+			files:            []storage.IndexFile{oldCompactedFile},
+			expectedCompact:  true,
+			expectedRecreate: true,
+		},
+		"single old compacted file already recreated": {
+			files:              []storage.IndexFile{{Name: defaultUploaderName + "-1" + recreatedCompactedDBSuffix, ModifiedAt: oldCompactedFile.ModifiedAt}},
+			expectedSkipReason: "single compacted file already recreated",
+		},
+		"single compacted file younger than configured threshold": {
+			opts:               Options{RecreateCompactedDBOlderThan: 3 * defaultRecreateCompactedDBOlderThan},
+			files:              []storage.IndexFile{oldCompactedFile},
+			expectedSkipReason: "single compacted file too young to recreate",
+		},
+		"single new compacted file with tenant filter": {
+			opts:            Options{TenantDenyList: []string{"user1"}},
+			files:           []storage.IndexFile{newCompactedFile},
+			expectedCompact: true,
+		},
+		"single new compacted file with split common index": {
+			opts:            Options{SplitCommonIndex: UserIDFromIndexKey},
+			files:           []storage.IndexFile{newCompactedFile},
+			expectedCompact: true,
+		},
+		"single old compacted file of excluded table": {
+			opts: Options{ExcludeFromRecreate: func(tableName, userID string) bool {
+				return tableName == "test" && userID == ""
+			}},
+			files:              []storage.IndexFile{oldCompactedFile},
+			expectedSkipReason: "single compacted file excluded from recreation",
+		},
+		"single old compacted file of other excluded table": {
+			opts: Options{ExcludeFromRecreate: func(tableName, _ string) bool {
+				return tableName == "other"
+			}},
+			files:            []storage.IndexFile{oldCompactedFile},
+			expectedCompact:  true,
+			expectedRecreate: true,
+		},
+		"multiple files": {
+			files:           []storage.IndexFile{oldCompactedFile, uncompactedFile},
+			expectedCompact: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			compact, recreate := tc.opts.ShouldCompact(tableName, tc.files)
+			require.Equal(t, tc.expectedCompact, compact)
+			require.Equal(t, tc.expectedRecreate, recreate)
+			if !compact {
+				require.Equal(t, tc.expectedSkipReason, tc.opts.skipCompactionReason(tableName, tc.files))
+			}
+		})
+	}
+
+	compact, recreate := ShouldCompact([]storage.IndexFile{oldCompactedFile})
+	require.True(t, compact)
+	require.True(t, recreate)
+}
+
+func TestShouldCompact_Clock(t *testing.T) {
+	modifiedAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []storage.IndexFile{{Name: defaultUploaderName + "-1", ModifiedAt: modifiedAt}}
+
+	// simulates whether the compacted file would get recreated at the given time.
+	for _, tc := range []struct {
+		now              time.Time
+		expectedRecreate bool
+	}{
+		{now: modifiedAt.Add(time.Hour)},
+		{now: modifiedAt.Add(defaultRecreateCompactedDBOlderThan), expectedRecreate: true},
+		{now: modifiedAt.Add(24 * time.Hour), expectedRecreate: true},
+	} {
+		compact, recreate := Options{Clock: func() time.Time { return tc.now }}.ShouldCompact(tableName, files)
+		require.Equal(t, tc.expectedRecreate, compact)
+		require.Equal(t, tc.expectedRecreate, recreate)
+	}
+}
+
+func TestTable_SkippedCompaction(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{NumCompactedDBs: 1}, testutil.PerUserDBsConfig{}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSkipped))
+	require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+
+	// the table gets compacted once it has another source file.
+	tCompactor = setupTableCompactor(t, testutil.DBsConfig{NumUnCompactedDBs: 1, NumCompactedDBs: 1}, testutil.PerUserDBsConfig{}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSkipped))
+	require.NotNil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+}
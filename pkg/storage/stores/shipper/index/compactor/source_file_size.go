@@ -0,0 +1,23 @@
+package compactor
+
+import (
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+)
+
+// ErrSourceFileSizeMismatch is returned when the size of a downloaded source file does not match the size listed by the object store,
+// like with a truncated download not surfaced as an error. The index set compares the bytes read from the object store, before
+// decompressing them, with the listed size. The source file is left for the next compaction run to download it again instead of being
+// considered corrupt.
+var ErrSourceFileSizeMismatch = storage.ErrFileSizeMismatch
+
+// rejectSourceFileSizeMismatch records the given source file whose download did not match its listed size and returns the error
+// failing the compaction of its table.
+func (t *tableCompactor) rejectSourceFileSizeMismatch(idxSet compactor.IndexSet, sourceFile storage.IndexFile, err error) error {
+	level.Error(idxSet.GetLogger()).Log("msg", "downloaded source file does not match its listed size", "file", sourceFile.Name, "err", err)
+	t.metrics.compactTablesSourceFileSizeMismatch.Inc()
+	return errors.Wrapf(err, "file %s", sourceFile.Name)
+}
@@ -0,0 +1,92 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_VerifySourceFileSize(t *testing.T) {
+	for name, tc := range map[string]struct {
+		gzip        bool
+		sizeDelta   int64
+		truncate    bool
+		expectedErr bool
+	}{
+		"matching size": {},
+		"matching size of gzip compressed file": {
+			gzip: true,
+		},
+		"truncated download": {
+			sizeDelta:   1,
+			expectedErr: true,
+		},
+		"truncated gzip compressed file": {
+			gzip:        true,
+			truncate:    true,
+			expectedErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			tablePath := filepath.Join(objectStoragePath, tableName)
+			testutil.SetupTable(t, tablePath, testutil.DBsConfig{
+				NumUnCompactedDBs: 3,
+			}, testutil.PerUserDBsConfig{})
+
+			// the second source file gets uploaded compressed with gzip like the uploaders do.
+			sourceFiles, err := os.ReadDir(tablePath)
+			require.NoError(t, err)
+			require.Len(t, sourceFiles, 3)
+			sourceFilePath := filepath.Join(tablePath, sourceFiles[1].Name())
+			if tc.gzip {
+				compressFile(t, sourceFilePath, gzipWriter)
+				require.NoError(t, os.Rename(sourceFilePath, sourceFilePath+storage.GzipExtension))
+				sourceFilePath += storage.GzipExtension
+			}
+
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+			// a truncated download is not considered corrupt, so it is not skipped either.
+			tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{SkipCorruptSourceFiles: true})
+			defer cleanupTableCompactor(tCompactor)
+
+			// list the source files with their sizes reported by the object client.
+			commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+			objects, _, err := objectClient.List(context.Background(), tableName+"/", "/")
+			require.NoError(t, err)
+			require.Len(t, objects, len(commonIndexSet.sourceFiles))
+			for i, obj := range objects {
+				require.Positive(t, obj.Size)
+				commonIndexSet.sourceFiles[i] = storage.IndexFile{Name: path.Base(obj.Key), ModifiedAt: obj.ModifiedAt, Size: obj.Size}
+			}
+			commonIndexSet.sourceFiles[1].Size += tc.sizeDelta
+			require.Equal(t, filepath.Base(sourceFilePath), commonIndexSet.sourceFiles[1].Name)
+			if tc.truncate {
+				require.NoError(t, os.Truncate(sourceFilePath, commonIndexSet.sourceFiles[1].Size/2))
+			}
+
+			err = tCompactor.CompactTable()
+			if !tc.expectedErr {
+				require.NoError(t, err)
+				require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSourceFileSizeMismatch))
+				return
+			}
+
+			require.ErrorIs(t, err, ErrSourceFileSizeMismatch)
+			require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSourceFileSizeMismatch))
+			require.NoFileExists(t, filepath.Join(commonIndexSet.GetWorkingDir(), storage.DecompressedFileName(commonIndexSet.sourceFiles[1].Name)))
+			require.Nil(t, commonIndexSet.compactedIndex)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package compactor
+
+import (
+	"go.etcd.io/bbolt"
+)
+
+// sourceFileTx writes the batches of entries read from a single source file to the compacted files in a single bolt transaction
+// as per Options.WriteSourceFileInOneTx, instead of a transaction per batch. At most one transaction is kept open at a time for not
+// deadlocking with the goroutines merging other source files, so it is committed before writing to another compacted file, like for
+// the user buckets of the common index, and once Options.SourceFileTxMaxSize bytes of entries got written in it.
+// A nil sourceFileTx writes nothing, for writing each batch in its own transaction. It is not safe for concurrent use.
+type sourceFileTx struct {
+	maxSize     int64
+	fillPercent float64
+
+	db      *bbolt.DB
+	tx      *bbolt.Tx
+	written int64
+}
+
+// newSourceFileTx returns a sourceFileTx for merging a source file, or nil when Options.WriteSourceFileInOneTx is not set.
+func (t *tableCompactor) newSourceFileTx() *sourceFileTx {
+	if !t.opts.WriteSourceFileInOneTx {
+		return nil
+	}
+
+	return &sourceFileTx{
+		maxSize:     t.opts.sourceFileTxMaxSize(),
+		fillPercent: t.opts.compactedFileFillPercent(),
+	}
+}
+
+// put writes the batch to the given bucket of the compacted file in the open transaction, beginning a new one if needed.
+// The transaction is rolled back when writing fails, which fails the compaction of the table along with the batches written
+// in it so far.
+func (s *sourceFileTx) put(db *bbolt.DB, bucketName []byte, batch []indexEntry) error {
+	if s.tx != nil && (s.db != db || s.written >= s.maxSize) {
+		if err := s.commit(); err != nil {
+			return err
+		}
+	}
+
+	if s.tx == nil {
+		tx, err := db.Begin(true)
+		if err != nil {
+			return err
+		}
+		s.db, s.tx, s.written = db, tx, 0
+	}
+
+	if err := putBatchInBucket(s.tx, bucketName, s.fillPercent, batch); err != nil {
+		s.rollback()
+		return err
+	}
+	for _, entry := range batch {
+		s.written += int64(len(entry.k) + len(entry.v))
+	}
+
+	return nil
+}
+
+// commit commits the open transaction, if any, once all the entries of the source file got written.
+func (s *sourceFileTx) commit() error {
+	if s == nil || s.tx == nil {
+		return nil
+	}
+
+	err := s.tx.Commit()
+	s.db, s.tx = nil, nil
+	return err
+}
+
+// rollback rolls back the open transaction, if any, when merging the source file fails. It is a no-op after commit.
+func (s *sourceFileTx) rollback() {
+	if s == nil || s.tx == nil {
+		return
+	}
+
+	_ = s.tx.Rollback()
+	s.db, s.tx = nil, nil
+}
@@ -0,0 +1,97 @@
+package compactor
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestSourceFileTx(t *testing.T) {
+	openDB := func(name string) *bbolt.DB {
+		db, err := openBoltdbFileWithNoSync(filepath.Join(t.TempDir(), name))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, db.Close())
+		})
+		return db
+	}
+	entries := func(db *bbolt.DB) int {
+		n := 0
+		require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+			if b := tx.Bucket(local.IndexBucketName); b != nil {
+				n = b.Stats().KeyN
+			}
+			return nil
+		}))
+		return n
+	}
+	batch := func(start int) []indexEntry {
+		return []indexEntry{
+			{k: []byte{byte(start)}, v: []byte("0123456789")},
+			{k: []byte{byte(start + 1)}, v: []byte("0123456789")},
+		}
+	}
+
+	db1, db2 := openDB("db1"), openDB("db2")
+	fileTx := &sourceFileTx{maxSize: 30, fillPercent: bbolt.DefaultFillPercent}
+
+	// batches are only visible once the transaction gets committed.
+	require.NoError(t, fileTx.put(db1, local.IndexBucketName, batch(0)))
+	require.Equal(t, 0, entries(db1))
+
+	// the transaction is committed once it holds more than the max size.
+	require.NoError(t, fileTx.put(db1, local.IndexBucketName, batch(2)))
+	require.Equal(t, 0, entries(db1))
+	require.NoError(t, fileTx.put(db1, local.IndexBucketName, batch(4)))
+	require.Equal(t, 4, entries(db1))
+
+	// writing to another db commits the open transaction first.
+	require.NoError(t, fileTx.put(db2, local.IndexBucketName, batch(0)))
+	require.Equal(t, 6, entries(db1))
+	require.Equal(t, 0, entries(db2))
+
+	require.NoError(t, fileTx.commit())
+	require.Equal(t, 2, entries(db2))
+
+	// rolled back batches are dropped.
+	require.NoError(t, fileTx.put(db2, local.IndexBucketName, batch(2)))
+	fileTx.rollback()
+	require.Equal(t, 2, entries(db2))
+	require.NoError(t, fileTx.commit())
+
+	// a nil sourceFileTx does nothing.
+	var nilTx *sourceFileTx
+	nilTx.rollback()
+	require.NoError(t, nilTx.commit())
+}
+
+func TestTable_WriteSourceFileInOneTx(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"default tx max size": {WriteSourceFileInOneTx: true},
+		"small tx max size":   {WriteSourceFileInOneTx: true, SourceFileTxMaxSize: 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 5,
+			}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{
+					NumUnCompactedDBs: 2,
+					NumCompactedDBs:   2,
+				},
+				NumUsers: 3,
+			}, opts)
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+
+			// the working dir of the table is in the temp dir set up with the object storage.
+			tempDir := filepath.Dir(filepath.Dir(tCompactor.commonIndexSet.GetWorkingDir()))
+			compareCompactedTable(t, filepath.Join(tempDir, objectsStorageDirName, tableName), tCompactor)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package compactor
+
+import (
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+// sourceFilesAccounting counts what happened to each of the source files of the common index of a table while compacting it, for
+// verifying that none of them got silently left out. It is safe for concurrent use.
+type sourceFilesAccounting struct {
+	total        int
+	seed         atomic.Int64
+	checkpointed atomic.Int64
+	merged       atomic.Int64
+	skipped      atomic.Int64
+}
+
+func newSourceFilesAccounting(total int) *sourceFilesAccounting {
+	return &sourceFilesAccounting{total: total}
+}
+
+// check logs the totals and, with strict, returns an error wrapping ErrSourceFilesUnaccounted unless every source file got accounted for.
+func (a *sourceFilesAccounting) check(logger log.Logger, strict bool) error {
+	seed, checkpointed, merged, skipped := a.seed.Load(), a.checkpointed.Load(), a.merged.Load(), a.skipped.Load()
+	accounted := seed + checkpointed + merged + skipped
+	level.Debug(logger).Log(
+		"msg", "accounted for source files of common index",
+		"total", a.total,
+		"seed", seed,
+		"checkpointed", checkpointed,
+		"merged", merged,
+		"skipped", skipped,
+	)
+
+	if !strict || accounted == int64(a.total) {
+		return nil
+	}
+	return errors.Wrapf(ErrSourceFilesUnaccounted, "accounted for %d of %d source files (seed: %d, checkpointed: %d, merged: %d, skipped: %d)",
+		accounted, a.total, seed, checkpointed, merged, skipped)
+}
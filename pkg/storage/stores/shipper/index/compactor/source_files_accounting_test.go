@@ -0,0 +1,65 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestSourceFilesAccounting_Check(t *testing.T) {
+	accounting := newSourceFilesAccounting(5)
+	accounting.seed.Inc()
+	accounting.checkpointed.Inc()
+	accounting.merged.Add(2)
+
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	// the totals are logged even when not verified.
+	require.NoError(t, accounting.check(logger, false))
+	require.Contains(t, buf.String(), "total=5 seed=1 checkpointed=1 merged=2 skipped=0")
+	require.ErrorIs(t, accounting.check(logger, true), ErrSourceFilesUnaccounted)
+
+	accounting.skipped.Inc()
+	require.NoError(t, accounting.check(logger, true))
+}
+
+func TestTable_VerifySourceFilesAccounting(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		corruptFiles []string
+	}{
+		{
+			name: "all files merged",
+		},
+		{
+			name:         "corrupt seed file and source file skipped",
+			corruptFiles: []string{"compactor-0", "0"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 2,
+				NumCompactedDBs:   2,
+			}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{NumUnCompactedDBs: 2},
+				NumUsers:  2,
+			}, Options{VerifySourceFilesAccounting: true, SkipCorruptSourceFiles: true})
+			defer cleanupTableCompactor(tCompactor)
+
+			commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+			for _, name := range tc.corruptFiles {
+				require.NoError(t, commonIndexSet.objectClient.PutObject(context.Background(), path.Join(tableName, name), strings.NewReader("not an index file, just some text")))
+			}
+
+			require.NoError(t, tCompactor.CompactTable())
+			require.NotNil(t, commonIndexSet.compactedIndex)
+		})
+	}
+}
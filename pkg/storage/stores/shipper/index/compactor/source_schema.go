@@ -0,0 +1,152 @@
+package compactor
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/config"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+const labelNamesRangeKeyV1 = '9'
+
+// validateSourceSchema validates the given source file of the index set as per Options.ValidateSourceSchema, counting the rejected files.
+func (t *tableCompactor) validateSourceSchema(idxSet compactor.IndexSet, db *bbolt.DB, fileName string) error {
+	err := t.sourceSchema.validate(idxSet.GetLogger(), db, fileName)
+	if errors.Is(err, ErrSourceSchemaMismatch) {
+		t.metrics.compactTablesSourceSchemaMismatch.Inc()
+	}
+	return err
+}
+
+// sourceSchemaValidator checks the structure of the keys of source files against the schema version of the period config of their table
+// as per Options.ValidateSourceSchema. The keys only tell apart the v9 schema, the v10 schema adding the shard of series entries to their
+// hash value and the v11 schema and later ones adding the label names entries, so files of v11 and v12 are accepted for either of them.
+// The hash values are split by colons, which assumes the tenants and metric names of the entries have none, like the ones written by Loki.
+type sourceSchemaValidator struct {
+	schema    string
+	version   int
+	rowShards uint32
+}
+
+// newSourceSchemaValidator returns a validator for the schema version of the given period config, or an error for schema versions
+// before v9 since their keys can't be validated.
+func newSourceSchemaValidator(periodConfig config.PeriodConfig) (*sourceSchemaValidator, error) {
+	version, err := periodConfig.VersionAsInt()
+	if err != nil {
+		return nil, fmt.Errorf("can't validate source files against invalid schema version %q: %w", periodConfig.Schema, err)
+	}
+	if version < 9 {
+		return nil, fmt.Errorf("can't validate source files against schema version %s, validation requires v9 or later", periodConfig.Schema)
+	}
+
+	return &sourceSchemaValidator{
+		schema:    periodConfig.Schema,
+		version:   version,
+		rowShards: periodConfig.RowShards,
+	}, nil
+}
+
+// validate returns an error wrapping ErrSourceSchemaMismatch for the first key of the given source file not matching the schema version,
+// after logging the rejected file. The meta bucket holding information of compacted files is not checked. It is a no-op on a nil validator.
+func (v *sourceSchemaValidator) validate(logger log.Logger, db *bbolt.DB, fileName string) error {
+	if v == nil {
+		return nil
+	}
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			if isMetaBucket(string(name)) {
+				return nil
+			}
+
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if reason := v.checkKey(k); reason != "" {
+					return errors.Wrapf(ErrSourceSchemaMismatch, "source file %s does not match schema %s: %s in bucket %s, key %q", fileName, v.schema, reason, name, k)
+				}
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, ErrSourceSchemaMismatch) {
+		level.Error(logger).Log("msg", "rejecting source file not matching the schema of the table", "file", fileName, "schema", v.schema, "err", err)
+	}
+	return err
+}
+
+// checkKey returns the reason of the given key not matching the schema version, or an empty string if it matches.
+func (v *sourceSchemaValidator) checkKey(k []byte) string {
+	componentsRef := getComponents()
+	defer putComponents(componentsRef)
+
+	hashValue, rangeValue := decodeKey(k)
+	components := decodeRangeKey(rangeValue, componentsRef.components)
+	if len(components) == 0 || len(components[len(components)-1]) != 1 {
+		return "invalid range key"
+	}
+	keyType := components[len(components)-1][0]
+
+	hashParts := bytes.Count(hashValue, []byte{':'}) + 1
+	switch keyType {
+	case chunkTimeRangeKeyV3:
+		// userID:d<day>:seriesID with all the schema versions since v9.
+		if hashParts != 3 {
+			return "invalid hash value of chunk entry"
+		}
+	case seriesRangeKeyV1:
+		// userID:d<day>:metricName with v9, prefixed with the shard since v10.
+		return v.checkShardedHashValue(hashValue, hashParts, 3)
+	case labelSeriesRangeKeyV1:
+		// userID:d<day>:metricName:labelName with v9, prefixed with the shard since v10.
+		return v.checkShardedHashValue(hashValue, hashParts, 4)
+	case labelNamesRangeKeyV1:
+		// the hash value is the series id, written since v11.
+		if v.version < 11 {
+			return "label names entry written since schema v11"
+		}
+		if hashParts != 1 {
+			return "invalid hash value of label names entry"
+		}
+	default:
+		return fmt.Sprintf("range key type %q not written with the schema", keyType)
+	}
+
+	return ""
+}
+
+// checkShardedHashValue checks the hash value of a series or label entry, which has unshardedParts parts with the v9 schema and is
+// prefixed with the shard of the series since v10.
+func (v *sourceSchemaValidator) checkShardedHashValue(hashValue []byte, hashParts, unshardedParts int) string {
+	if v.version < 10 {
+		if hashParts != unshardedParts {
+			return "series entry with shard written since schema v10"
+		}
+		return ""
+	}
+
+	if hashParts != unshardedParts+1 {
+		return "series entry without shard written before schema v10"
+	}
+	shard := hashValue[:bytes.IndexByte(hashValue, ':')]
+	if len(shard) < 2 {
+		return "invalid shard of series entry"
+	}
+	var n uint32
+	for _, c := range shard {
+		if c < '0' || c > '9' {
+			return "invalid shard of series entry"
+		}
+		n = n*10 + uint32(c-'0')
+	}
+	if v.rowShards > 0 && n >= v.rowShards {
+		return fmt.Sprintf("shard %d of series entry out of the %d row shards of the schema", n, v.rowShards)
+	}
+
+	return ""
+}
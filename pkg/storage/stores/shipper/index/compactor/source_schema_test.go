@@ -0,0 +1,166 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/config"
+)
+
+// schemaKey builds an index key with the given hash value and range key type like the ones written with the series store schemas.
+func schemaKey(hashValue string, keyType byte) []byte {
+	return []byte(hashValue + "\x00" + "a\x00b\x00\x00" + string(keyType) + "\x00")
+}
+
+func TestSourceSchemaValidator_CheckKey(t *testing.T) {
+	var (
+		chunkKey         = schemaKey("user1:d19000:seriesID", chunkTimeRangeKeyV3)
+		seriesKey        = schemaKey("user1:d19000:logs", seriesRangeKeyV1)
+		labelKey         = schemaKey("user1:d19000:logs:foo", labelSeriesRangeKeyV1)
+		shardedSeriesKey = schemaKey("05:user1:d19000:logs", seriesRangeKeyV1)
+		shardedLabelKey  = schemaKey("05:user1:d19000:logs:foo", labelSeriesRangeKeyV1)
+		labelNamesKey    = schemaKey("seriesID", labelNamesRangeKeyV1)
+	)
+
+	for _, tc := range []struct {
+		schema    string
+		rowShards uint32
+		valid     [][]byte
+		invalid   [][]byte
+	}{
+		{
+			schema:  "v9",
+			valid:   [][]byte{chunkKey, seriesKey, labelKey},
+			invalid: [][]byte{shardedSeriesKey, shardedLabelKey, labelNamesKey},
+		},
+		{
+			schema:    "v10",
+			rowShards: 16,
+			valid:     [][]byte{chunkKey, shardedSeriesKey, shardedLabelKey},
+			invalid:   [][]byte{seriesKey, labelKey, labelNamesKey},
+		},
+		{
+			schema:    "v11",
+			rowShards: 4,
+			valid:     [][]byte{chunkKey, labelNamesKey},
+			invalid:   [][]byte{seriesKey, labelKey, shardedSeriesKey, shardedLabelKey},
+		},
+		{
+			schema:  "v12",
+			valid:   [][]byte{chunkKey, shardedSeriesKey, shardedLabelKey, labelNamesKey},
+			invalid: [][]byte{seriesKey, labelKey, schemaKey("ab:user1:d19000:logs", seriesRangeKeyV1)},
+		},
+	} {
+		t.Run(tc.schema, func(t *testing.T) {
+			v, err := newSourceSchemaValidator(config.PeriodConfig{Schema: tc.schema, RowShards: tc.rowShards})
+			require.NoError(t, err)
+
+			for _, k := range tc.valid {
+				require.Empty(t, v.checkKey(k), "%q", k)
+			}
+			for _, k := range append(tc.invalid, []byte("1"), schemaKey("user1:d19000:logs", '6')) {
+				require.NotEmpty(t, v.checkKey(k), "%q", k)
+			}
+		})
+	}
+
+	_, err := newSourceSchemaValidator(config.PeriodConfig{Schema: "v6"})
+	require.Error(t, err)
+	_, err = newSourceSchemaValidator(config.PeriodConfig{})
+	require.Error(t, err)
+}
+
+func TestTable_ValidateSourceSchema(t *testing.T) {
+	writeSourceFile := func(t *testing.T, objectClient *local.FSObjectClient, name string, keys ...[]byte) {
+		dbPath := filepath.Join(t.TempDir(), name)
+		db, err := openBoltdbFileWithNoSync(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(local.IndexBucketName)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := b.Put(k, []byte("v")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Close())
+
+		f, err := os.Open(dbPath)
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, name), f))
+	}
+
+	for name, tc := range map[string]struct {
+		opts        Options
+		schema      string
+		expectedErr error
+	}{
+		"validation disabled": {
+			schema: "v11",
+		},
+		"source files matching the schema": {
+			opts:   Options{ValidateSourceSchema: true},
+			schema: "v9",
+		},
+		"source files not matching the schema": {
+			opts:        Options{ValidateSourceSchema: true},
+			schema:      "v11",
+			expectedErr: ErrSourceSchemaMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: filepath.Join(tempDir, objectsStorageDirName)})
+			require.NoError(t, err)
+
+			// v9 entries without the shard of the series.
+			for i := 0; i < 2; i++ {
+				writeSourceFile(t, objectClient, fmt.Sprint(i),
+					schemaKey(fmt.Sprintf("user1:d1900%d:seriesID", i), chunkTimeRangeKeyV3),
+					schemaKey(fmt.Sprintf("user1:d1900%d:logs", i), seriesRangeKeyV1),
+					schemaKey(fmt.Sprintf("user1:d1900%d:logs:foo", i), labelSeriesRangeKeyV1),
+				)
+			}
+
+			tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), tc.opts)
+			defer cleanupTableCompactor(tCompactor)
+			tCompactor.periodConfig = config.PeriodConfig{Schema: tc.schema}
+			if tc.opts.ValidateSourceSchema {
+				tCompactor.sourceSchema, tCompactor.sourceSchemaErr = newSourceSchemaValidator(tCompactor.periodConfig)
+			}
+
+			err = tCompactor.CompactTable()
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				require.Contains(t, err.Error(), "series entry without shard")
+				require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+				require.GreaterOrEqual(t, prom_testutil.ToFloat64(tCompactor.metrics.compactTablesSourceSchemaMismatch), float64(1))
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+		})
+	}
+
+	// the compaction fails right away for schema versions which can't be validated.
+	tempDir := t.TempDir()
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: filepath.Join(tempDir, objectsStorageDirName)})
+	require.NoError(t, err)
+	tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{ValidateSourceSchema: true})
+	defer cleanupTableCompactor(tCompactor)
+	require.Error(t, tCompactor.CompactTable())
+}
@@ -0,0 +1,46 @@
+package compactor
+
+import (
+	"bytes"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+)
+
+// CommonIndexUserIDFunc returns the user owning an index entry of the common index by its key,
+// or ok as false for keeping the entry in the common index.
+type CommonIndexUserIDFunc func(k []byte) (userID string, ok bool)
+
+// UserIDFromIndexKey returns the user owning an index entry by the prefix of the hash value of its key.
+// All the hash values start with the user id followed by a colon with the v9 schema and later schema versions
+// and it can not be used with earlier schema versions.
+func UserIDFromIndexKey(k []byte) (string, bool) {
+	hashValue, _ := decodeKey(k)
+	idx := bytes.IndexByte(hashValue, ':')
+	if idx <= 0 {
+		return "", false
+	}
+
+	return string(hashValue[:idx]), true
+}
+
+// splitCommonIndexBatch moves the entries of the common index bucket to the buckets of their users as per Options.SplitCommonIndex
+// and calls writeBatch with the entries grouped by bucket. Batches of other buckets are written as is.
+func (t *tableCompactor) splitCommonIndexBatch(bucketName string, batch []indexEntry, writeBatch func(bucketName string, batch []indexEntry) error) error {
+	if t.opts.SplitCommonIndex == nil || bucketName != string(local.IndexBucketName) {
+		return writeBatch(bucketName, batch)
+	}
+
+	_, err := regroupBatch(bucketName, batch, func(entry indexEntry) (string, indexEntry, bool) {
+		if userID, ok := t.opts.SplitCommonIndex(entry.k); ok {
+			return userID, entry, false
+		}
+		return bucketName, entry, false
+	}, writeBatch)
+	return err
+}
+
+// movesEntriesToUsers returns true if entries could get moved to the index of users not found in the buckets of the source files
+// by Options.TransformEntry or Options.SplitCommonIndex.
+func (t *tableCompactor) movesEntriesToUsers() bool {
+	return t.opts.TransformEntry != nil || t.opts.SplitCommonIndex != nil
+}
@@ -0,0 +1,61 @@
+package compactor
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestUserIDFromIndexKey(t *testing.T) {
+	for _, tc := range []struct {
+		key            string
+		expectedUserID string
+		expectedOK     bool
+	}{
+		{key: "user1:d19000:logs\x00range", expectedUserID: "user1", expectedOK: true},
+		{key: "user1:d19000\x00range:with:colons", expectedUserID: "user1", expectedOK: true},
+		{key: "nocolon\x00range:with:colons"},
+		{key: ":d19000\x00range"},
+		{key: ""},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			userID, ok := UserIDFromIndexKey([]byte(tc.key))
+			require.Equal(t, tc.expectedOK, ok)
+			require.Equal(t, tc.expectedUserID, userID)
+		})
+	}
+}
+
+func TestTable_SplitCommonIndex(t *testing.T) {
+	// a single previously compacted file with records 0-199 which would not get compacted without splitting it.
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumCompactedDBs: 1,
+	}, testutil.PerUserDBsConfig{}, Options{
+		SplitCommonIndex: func(k []byte) (string, bool) {
+			_, rangeValue := decodeKey(k)
+			record, err := strconv.Atoi(string(rangeValue))
+			require.NoError(t, err)
+			if record < 100 {
+				return "", false
+			}
+			return fmt.Sprintf("user-%d", record%2), true
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	commonRecords := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+	require.Len(t, commonRecords[string(local.IndexBucketName)], 100)
+
+	require.Len(t, tCompactor.userCompactedIndexSet.all(), 2)
+	for _, userID := range []string{"user-0", "user-1"} {
+		records := readDB(t, tCompactor.userCompactedIndexSet.all()[userID].compactedIndex.compactedFile)
+		require.Len(t, records[string(local.IndexBucketName)], 50)
+	}
+}
@@ -0,0 +1,196 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.etcd.io/bbolt"
+)
+
+// splitBatchesPerFile is the number of batches of entries of max size written to each file while splitting a compacted index.
+// The size of each file is checked between the batches, so smaller batches fill the files closer to the max size.
+const splitBatchesPerFile = 8
+
+// splitAllocPages is the number of pages the files get grown by while splitting a compacted index. bbolt grows files by the size of
+// their mmap, which doubles each time, or by 16MB beyond it, which would leave files well past the size of their pages.
+const splitAllocPages = 4
+
+// splitEntryOverhead is the size of the header of each entry in the leaf pages of bbolt, which is accounted for in the size of the batches
+// since it is larger than the entries themselves for small ones.
+const splitEntryOverhead = 16
+
+// Split partitions the index entries of the compacted index by key range into compacted indexes with files of up to maxBytes each,
+// for tenants whose compacted file grows past the size where querying it gets slow. The entries are copied in the order of their
+// buckets and keys, so a compacted index is always split the same way, and each entry goes to exactly one of the compacted indexes.
+// The bucket holding meta information of the file is not copied since it gets written again while converting the files for upload.
+//
+// The files are built next to the compacted file and named after it, and their index files for upload get named after their position.
+// They are written in key order with full pages like a recreated db, so they are not recreated again. The compacted index is left as is,
+// so it is up to the caller to clean up either the compacted index or the returned ones. It returns no compacted index when there are
+// no entries, and an error leaving no files behind when an entry does not fit in a file of maxBytes.
+func (c *CompactedIndex) Split(maxBytes int64) ([]*CompactedIndex, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("max bytes for splitting compacted index must be > 0, got %d", maxBytes)
+	}
+	if c.compactedFile == nil {
+		return nil, fmt.Errorf("can't split compacted index without compacted file")
+	}
+
+	s := &compactedIndexSplitter{
+		c:             c,
+		maxBytes:      maxBytes,
+		batchMaxBytes: maxBytes / splitBatchesPerFile,
+		batch:         make([]indexEntry, 0, defaultBatchSize),
+	}
+	if err := c.ForEachEntry(context.Background(), s.add); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+	if err := s.flush(); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+	if err := s.checkSize(); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+
+	return s.parts, nil
+}
+
+// compactedIndexSplitter writes the entries of a compacted index to new files in batches, starting a new file whenever the next batch
+// could grow the current one past maxBytes.
+type compactedIndexSplitter struct {
+	c             *CompactedIndex
+	maxBytes      int64
+	batchMaxBytes int64
+
+	parts       []*CompactedIndex
+	partEntries int
+
+	batchBucket string
+	batch       []indexEntry
+	batchBytes  int64
+}
+
+// add adds an entry to the batch, writing the batch first when the entry is from another bucket or the batch is full.
+func (s *compactedIndexSplitter) add(bucketName string, k, v []byte) error {
+	if bucketName != s.batchBucket || len(s.batch) == cap(s.batch) || s.batchBytes >= s.batchMaxBytes {
+		if err := s.flush(); err != nil {
+			return err
+		}
+		s.batchBucket = bucketName
+	}
+
+	s.batch = append(s.batch, indexEntry{k: k, v: v})
+	s.batchBytes += splitEntryOverhead + int64(len(k)+len(v))
+	return nil
+}
+
+// flush writes the batch to the current file, or to a new one when the current file could grow past maxBytes with it.
+func (s *compactedIndexSplitter) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	startPart := len(s.parts) == 0
+	if !startPart && s.partEntries > 0 {
+		size, err := s.currentSize()
+		if err != nil {
+			return err
+		}
+		startPart = size+s.estimateGrowth() > s.maxBytes
+	}
+	if startPart {
+		if err := s.checkSize(); err != nil {
+			return err
+		}
+		if err := s.newPart(); err != nil {
+			return err
+		}
+	}
+
+	current := s.parts[len(s.parts)-1].compactedFile
+	if err := current.Update(func(tx *bbolt.Tx) error {
+		return putBatchInBucket(tx, []byte(s.batchBucket), 1, s.batch)
+	}); err != nil {
+		return err
+	}
+
+	s.partEntries += len(s.batch)
+	s.batch = s.batch[:0]
+	s.batchBytes = 0
+	return nil
+}
+
+// estimateGrowth returns an upper bound of the bytes the current file grows by with the batch. Pages are filled completely since the
+// entries are written in key order, so twice the size of the entries leaves room for the branch pages and the pages copied on write,
+// and a few more pages cover the ones of a new bucket and the growth of the file by splitAllocPages.
+func (s *compactedIndexSplitter) estimateGrowth() int64 {
+	pageSize := int64(s.parts[len(s.parts)-1].compactedFile.Info().PageSize)
+	return 2*s.batchBytes + (4+splitAllocPages)*pageSize
+}
+
+// currentSize returns the size of the current file on disk, which is what gets uploaded.
+func (s *compactedIndexSplitter) currentSize() (int64, error) {
+	info, err := os.Stat(s.parts[len(s.parts)-1].compactedFile.Path())
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// checkSize returns an error if the current file got past maxBytes, which happens when its first batch does not fit in a file of maxBytes.
+func (s *compactedIndexSplitter) checkSize() error {
+	if len(s.parts) == 0 {
+		return nil
+	}
+
+	size, err := s.currentSize()
+	if err != nil {
+		return err
+	}
+	if size > s.maxBytes {
+		return fmt.Errorf("can't split compacted index %s into files of up to %d bytes: split file of %d bytes is larger", s.c.compactedFile.Path(), s.maxBytes, size)
+	}
+
+	return nil
+}
+
+// newPart starts a new file for the following batches.
+func (s *compactedIndexSplitter) newPart() error {
+	path := fmt.Sprintf("%s.split-%d", s.c.compactedFile.Path(), len(s.parts))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := openBoltdbFileWithOptions(path, nil, !s.c.syncRecreatedDB)
+	if err != nil {
+		return err
+	}
+	db.AllocSize = splitAllocPages * db.Info().PageSize
+
+	part := *s.c
+	part.compactedFile = db
+	part.compactedFileRecreated = true
+	part.recreateSkipped = false
+	part.modified = false
+	part.openDBs = nil
+	part.boltdbTx = nil
+	part.chunkIndexer = nil
+	part.seriesCleaner = nil
+	part.splitPart = len(s.parts) + 1
+
+	s.parts = append(s.parts, &part)
+	s.partEntries = 0
+	return nil
+}
+
+// cleanup removes the files built so far.
+func (s *compactedIndexSplitter) cleanup() {
+	for _, part := range s.parts {
+		part.Cleanup()
+	}
+	s.parts = nil
+}
@@ -0,0 +1,121 @@
+package compactor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+func TestCompactedIndex_Split(t *testing.T) {
+	workingDir := t.TempDir()
+	dbPath := filepath.Join(workingDir, "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 20000, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, dbPath, 0, 20000, []byte("user1"))
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+	// the bucket holding meta information of the file is not copied.
+	require.NoError(t, writeIntegrityMarker(db))
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), workingDir, allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+	expectedRecords := readDB(t, db)
+	delete(expectedRecords, string(metaBucketName))
+
+	const maxBytes = 256 << 10
+	split := func() []*CompactedIndex {
+		parts, err := compactedIndex.Split(maxBytes)
+		require.NoError(t, err)
+		require.Greater(t, len(parts), 1)
+		return parts
+	}
+
+	parts := split()
+	records := map[string]map[string]string{}
+	var lastBucket, lastKeyStr string
+	for _, part := range parts {
+		// each file is under the max size.
+		info, err := os.Stat(part.compactedFile.Path())
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), int64(maxBytes))
+
+		// the key ranges of the files do not overlap and follow each other.
+		require.NoError(t, part.compactedFile.View(func(tx *bbolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+				firstKey, _ := b.Cursor().First()
+				if string(name) == lastBucket {
+					require.Greater(t, string(firstKey), lastKeyStr)
+				} else {
+					require.Greater(t, string(name), lastBucket)
+				}
+				lastKey, _ := b.Cursor().Last()
+				lastBucket, lastKeyStr = string(name), string(lastKey)
+				return nil
+			})
+		}))
+
+		for bucketName, bucketRecords := range readDB(t, part.compactedFile) {
+			if records[bucketName] == nil {
+				records[bucketName] = map[string]string{}
+			}
+			for k, v := range bucketRecords {
+				_, ok := records[bucketName][k]
+				require.False(t, ok, "entry %s of bucket %s got copied to multiple files", k, bucketName)
+				records[bucketName][k] = v
+			}
+		}
+	}
+
+	// the union of the files is the original index and the source is left untouched.
+	require.Equal(t, expectedRecords, records)
+	require.Len(t, readDB(t, db), 3)
+
+	// the files get named apart for upload.
+	names := map[string]struct{}{}
+	for _, part := range parts {
+		require.True(t, part.compactedFileRecreated)
+		name := part.compactedFile.Path()
+		idx, err := part.ToIndexFile()
+		require.NoError(t, err)
+		names[idx.Name()] = struct{}{}
+		require.NoError(t, idx.Close())
+		require.NoError(t, os.Remove(name))
+	}
+	require.Len(t, names, len(parts))
+
+	// the index gets split the same way again.
+	again := split()
+	require.Len(t, again, len(parts))
+	for _, part := range again {
+		part.Cleanup()
+	}
+}
+
+func TestCompactedIndex_SplitFailure(t *testing.T) {
+	workingDir := t.TempDir()
+	dbPath := filepath.Join(workingDir, "db")
+	testutil.AddRecordsToDB(t, dbPath, 0, 100, local.IndexBucketName)
+
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+
+	compactedIndex := newCompactedIndex(db, allSchemas[0].config.IndexTables.TableFor(allSchemas[0].from), workingDir, allSchemas[0].config, util_log.Logger)
+	defer compactedIndex.Cleanup()
+
+	_, err = compactedIndex.Split(0)
+	require.Error(t, err)
+
+	// the files are too small for holding any entry, and the files built so far get removed.
+	_, err = compactedIndex.Split(1024)
+	require.Error(t, err)
+	files, err := os.ReadDir(workingDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
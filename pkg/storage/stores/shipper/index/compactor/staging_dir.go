@@ -0,0 +1,121 @@
+package compactor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+
+	chunk_util "github.com/grafana/loki/pkg/storage/chunk/client/util"
+	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
+)
+
+// compactedDBDir returns the dir for building the compacted dbs of the given index set in, which is its working dir unless
+// Options.StagingDir is configured, in which case it is the path of the working dir relative to the one of the table under the staging dir.
+func (t *tableCompactor) compactedDBDir(idxSet compactor.IndexSet) string {
+	workingDir := idxSet.GetWorkingDir()
+	if t.opts.StagingDir == "" {
+		return workingDir
+	}
+
+	relPath, err := filepath.Rel(filepath.Dir(t.commonIndexSet.GetWorkingDir()), workingDir)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		relPath = filepath.Join(idxSet.GetTableName(), filepath.Base(workingDir))
+	}
+	return filepath.Join(t.opts.StagingDir, relPath)
+}
+
+// removeStagingDir removes the staging dir of the table as per Options.StagingDir once its compaction is done, along with the dbs left
+// in it like the ones replaced by recreating them, since the compacted dbs handed over to the index sets got moved to their working dirs.
+func (t *tableCompactor) removeStagingDir() {
+	if t.opts.StagingDir == "" {
+		return
+	}
+
+	stagingDir := filepath.Join(t.opts.StagingDir, t.commonIndexSet.GetTableName())
+	if err := os.RemoveAll(stagingDir); err != nil {
+		level.Error(t.commonIndexSet.GetLogger()).Log("msg", "failed to remove staging dir", "path", stagingDir, "err", err)
+	}
+}
+
+// moveToWorkingDir moves the compacted file of the given CompactedIndex built in the staging dir as per Options.StagingDir to the
+// working dir of its index set, for handing it over with SetCompactedIndex. It is a no-op for compacted files already in the working dir,
+// like source files opened as is.
+func (t *tableCompactor) moveToWorkingDir(compactedIndex compactor.CompactedIndex) error {
+	c, ok := compactedIndex.(*CompactedIndex)
+	if t.opts.StagingDir == "" || !ok || c == nil || c.compactedFile == nil {
+		return nil
+	}
+
+	srcPath := c.compactedFile.Path()
+	if filepath.Dir(srcPath) == filepath.Clean(c.workingDir) {
+		return nil
+	}
+	if err := chunk_util.EnsureDirectory(c.workingDir); err != nil {
+		return err
+	}
+
+	noSync := c.compactedFile.NoSync
+	if err := c.compactedFile.Close(); err != nil {
+		return err
+	}
+
+	dstPath := filepath.Join(c.workingDir, filepath.Base(srcPath))
+	if err := moveFile(srcPath, dstPath); err != nil {
+		return errors.Wrapf(err, "failed to move compacted db %s to working dir", srcPath)
+	}
+
+	db, err := openBoltdbFileWithOptions(dstPath, nil, noSync)
+	if err != nil {
+		return err
+	}
+
+	t.openDBs.replace(c.compactedFile, db)
+	t.tempDBs.remove(c.compactedFile)
+	t.tempDBs.add(db)
+	c.compactedFile = db
+	return nil
+}
+
+// moveFile atomically moves the file at srcPath to dstPath. Files on another file system than dstPath are copied to a temporary file
+// next to dstPath renamed to it once synced, and then removed.
+func moveFile(srcPath, dstPath string) error {
+	err := os.Rename(srcPath, dstPath)
+	var linkErr *os.LinkError
+	if err == nil || !errors.As(err, &linkErr) || !errors.Is(linkErr.Err, syscall.EXDEV) {
+		return err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Remove(srcPath)
+}
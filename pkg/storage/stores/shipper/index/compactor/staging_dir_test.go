@@ -0,0 +1,60 @@
+package compactor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_StagingDir(t *testing.T) {
+	stagingDir := t.TempDir()
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   1,
+		},
+		NumUsers: 3,
+	}, Options{StagingDir: stagingDir, RewriteInKeyOrder: true})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	// the compacted dbs, including the ones recreated in key order, are moved to the working dirs of their index sets.
+	commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+	commonCompactedIndex := commonIndexSet.compactedIndex.(*CompactedIndex)
+	require.True(t, commonCompactedIndex.compactedFileRecreated)
+	require.Equal(t, filepath.Join(stagingDir, tableName), commonCompactedIndex.stagingDir)
+	require.Equal(t, commonIndexSet.GetWorkingDir(), filepath.Dir(commonCompactedIndex.compactedFile.Path()))
+	for userID, userCompactedIndexSet := range tCompactor.userCompactedIndexSet.all() {
+		userIndexSet := tCompactor.existingUserIndexSet[userID].(*mockIndexSet)
+		require.Equal(t, userIndexSet.GetWorkingDir(), filepath.Dir(userCompactedIndexSet.compactedIndex.compactedFile.Path()))
+		require.Equal(t, filepath.Join(stagingDir, tableName, userID), userCompactedIndexSet.compactedIndex.stagingDir)
+	}
+
+	// the staging dir of the table is removed along with the dbs replaced by recreating them.
+	require.NoDirExists(t, filepath.Join(stagingDir, tableName))
+
+	tempDir := filepath.Dir(filepath.Dir(commonIndexSet.GetWorkingDir()))
+	compareCompactedTable(t, filepath.Join(tempDir, objectsStorageDirName, tableName), tCompactor)
+}
+
+func TestMoveFile(t *testing.T) {
+	tempDir := t.TempDir()
+	srcPath := filepath.Join(tempDir, "src")
+	dstPath := filepath.Join(tempDir, "dst")
+	require.NoError(t, os.WriteFile(srcPath, []byte("content"), 0o644))
+
+	require.NoError(t, moveFile(srcPath, dstPath))
+	require.NoFileExists(t, srcPath)
+	content, err := os.ReadFile(dstPath)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+
+	require.Error(t, moveFile(srcPath, dstPath))
+}
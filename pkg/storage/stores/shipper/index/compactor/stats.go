@@ -0,0 +1,81 @@
+package compactor
+
+import (
+	"go.etcd.io/bbolt"
+)
+
+// BucketStats holds the number of index entries of a bucket and the total size of their keys.
+type BucketStats struct {
+	Entries  int64
+	KeyBytes int64
+}
+
+// IndexStats holds the stats of the buckets of an index file, keyed by the name of the bucket.
+// Buckets of per user index are named after the user, while the common index uses the "index" bucket.
+type IndexStats struct {
+	Buckets map[string]BucketStats
+}
+
+// Entries returns the total number of index entries of all the buckets.
+func (s IndexStats) Entries() int64 {
+	total := int64(0)
+	for _, bucket := range s.Buckets {
+		total += bucket.Entries
+	}
+
+	return total
+}
+
+// KeyBytes returns the total size of the keys of the index entries of all the buckets.
+func (s IndexStats) KeyBytes() int64 {
+	total := int64(0)
+	for _, bucket := range s.Buckets {
+		total += bucket.KeyBytes
+	}
+
+	return total
+}
+
+// Stats returns the stats of the buckets of the compacted index, computed in a single read transaction.
+func (c *CompactedIndex) Stats() (IndexStats, error) {
+	// reuse the transaction opened for applying retention and deletion since opening another one could deadlock.
+	if c.boltdbTx != nil {
+		return readIndexStats(c.boltdbTx), nil
+	}
+
+	return ReadIndexStats(c.compactedFile)
+}
+
+// ReadIndexStats returns the stats of the buckets of the given boltdb index file, computed in a single read transaction.
+// The bucket holding meta information of the file is not included.
+func ReadIndexStats(db *bbolt.DB) (IndexStats, error) {
+	var stats IndexStats
+	err := db.View(func(tx *bbolt.Tx) error {
+		stats = readIndexStats(tx)
+		return nil
+	})
+
+	return stats, err
+}
+
+func readIndexStats(tx *bbolt.Tx) IndexStats {
+	stats := IndexStats{Buckets: map[string]BucketStats{}}
+	_ = tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		bucketName := string(name)
+		if isMetaBucket(bucketName) {
+			return nil
+		}
+
+		bucketStats := BucketStats{}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			bucketStats.Entries++
+			bucketStats.KeyBytes += int64(len(k))
+		}
+		stats.Buckets[bucketName] = bucketStats
+
+		return nil
+	})
+
+	return stats
+}
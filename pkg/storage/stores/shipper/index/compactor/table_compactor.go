@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,7 +15,9 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/concurrency"
+	"github.com/grafana/dskit/multierror"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
 	"go.etcd.io/bbolt"
 
 	"github.com/grafana/loki/pkg/storage/chunk/client/local"
@@ -49,20 +54,59 @@ import (
 //           It is an intermediate format built by ingesters when the flag to build per user index is enabled.                    //
 //                                                                                                                                //
 // FORMAT3 - `table1` has 1 folder each for `user1` and `user2` containing index files having index just for those users.         //
-//            Compactor builds index in this format from Format2.                                                                 //
+//            Compactor builds index in this format from Format2, and compacts multiple files of a user in this format            //
+//            down to one in the same format, along with the entries of the user from Format2 if any.                             //
 //                                                                                                                                //
-//                THING TO NOTE HERE IS COMPACTOR BUILDS INDEX IN FORMAT1 FROM FORMAT1 AND FORMAT3 FROM FORMAT2.                  //
+//     THING TO NOTE HERE IS COMPACTOR BUILDS INDEX IN FORMAT1 FROM FORMAT1 AND FORMAT3 FROM FORMAT2 AND FORMAT3.                 //
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 const (
-	readDBsConcurrency = 50
-	uploaderName       = "compactor"
+	readDBsConcurrency  = 50
+	defaultUploaderName = "compactor"
 
 	// we want to recreate compactedDB when the chances of it changing due to compaction or deletion of data are low.
 	// this is to avoid recreation of the DB too often which would be too costly in a large cluster.
-	recreateCompactedDBOlderThan = 12 * time.Hour
-	dropFreePagesTxMaxSize       = 100 * 1024 * 1024 // 100MB
-	recreatedCompactedDBSuffix   = ".r"
+	defaultRecreateCompactedDBOlderThan = 12 * time.Hour
+	defaultDropFreePagesTxMaxSize       = 100 * 1024 * 1024 // 100MB
+	defaultSourceFileTxMaxSize          = 100 * 1024 * 1024 // 100MB
+	recreatedCompactedDBSuffix          = ".r"
+
+	// invalidTenantBucket is the user index where entries of tenants failing validation are quarantined.
+	invalidTenantBucket = "__invalid__"
+
+	// values of the index_format label of the metrics for telling apart tables and dbs with per user index, FORMAT3, from the ones with only common index, FORMAT1.
+	indexFormatCommon  = "common"
+	indexFormatPerUser = "per_user"
+
+	// defaultBoltdbOpenTimeout is the default timeout for acquiring the file lock while opening boltdb files.
+	// It is the same as the one used while opening them with the default options.
+	defaultBoltdbOpenTimeout = 5 * time.Second
+)
+
+// errors returned while compacting the index of users, which are not retryable since they are caused by the state of the index sets.
+// They are wrapped with the user id where it helps debugging, so check them with errors.Is.
+var (
+	// ErrTenantIndexNotFound is returned when the compacted index of a user without an existing index set is requested.
+	ErrTenantIndexNotFound = errors.New("requested non-existing compacted tenant index")
+	// ErrEmptyIndexSet is returned when compacting the index of a user whose index set has no source files.
+	ErrEmptyIndexSet = errors.New("attempted to fetch empty index set")
+	// ErrUserIndexRequestedDuringCompaction is returned when entries of the common index are routed to a user whose index set
+	// was not initialized before merging the source files of the common index.
+	ErrUserIndexRequestedDuringCompaction = errors.New("index set for user is not initialized")
+	// ErrIndexFormatMismatch is returned when the index of a table is in a format inconsistent with the per user index setting
+	// of its period config.
+	ErrIndexFormatMismatch = errors.New("index format inconsistent with the per user index setting of the period config")
+	// ErrSourceSchemaMismatch is returned when a source file of a table has keys not matching the schema version of its period config.
+	ErrSourceSchemaMismatch = errors.New("source file keys inconsistent with the schema version of the period config")
+	// ErrSeedFileReadAsSource is returned when the seed file of the common index of a table would get read or consumed again while
+	// merging the other source files into it, which would corrupt the compacted file.
+	ErrSeedFileReadAsSource = errors.New("seed file read as source file")
+	// ErrUserIndexOverLimit is returned when more entries than Options.MaxEntriesPerUserIndex get written into the index of a user
+	// with Options.RejectUserIndexOverLimit.
+	ErrUserIndexOverLimit = errors.New("index of user over the limit of entries")
+	// ErrSourceFilesUnaccounted is returned with Options.VerifySourceFilesAccounting when source files of the common index of a table
+	// were neither consumed nor skipped by its compaction.
+	ErrSourceFilesUnaccounted = errors.New("source files neither consumed nor skipped")
 )
 
 // compactedIndexSet holds both the IndexSet and the CompactedIndex for ease.
@@ -102,9 +146,45 @@ type tableCompactor struct {
 	existingUserIndexSet    map[string]compactor.IndexSet
 	userIndexSetFactoryFunc compactor.MakeEmptyUserIndexSetFunc
 	periodConfig            config.PeriodConfig
-
-	userCompactedIndexSet    map[string]*compactedIndexSet
-	userCompactedIndexSetMtx sync.RWMutex
+	opts                    Options
+	metrics                 *metrics
+
+	userCompactedIndexSet *userIndexSetShards
+	transformedUsersMtx   sync.Mutex
+
+	// tenantFilter is only set when Options.TenantAllowList or Options.TenantDenyList is configured.
+	tenantFilter *tenantFilter
+	// tenantUsage is only set when Options.TenantUsageCallback is configured.
+	tenantUsage *tenantUsageTracker
+	// tenantMetrics is only set when Options.TenantMetricsAllowList is configured.
+	tenantMetrics *tenantMetrics
+	// userIndexLimit is only set when Options.MaxEntriesPerUserIndex is configured.
+	userIndexLimit *userIndexLimit
+	// dryRun is only set when Options.DryRunCallback is configured.
+	dryRun *dryRunReporter
+	// export is only set while exporting the table with ExportTo.
+	export *tableExporter
+	// tempDBs tracks the compacted dbs built in the working dirs for removing them when the compaction fails.
+	tempDBs *tempDBTracker
+	// openDBs bounds the compacted dbs open at the same time, shared with the other tables when built by the indexCompactor.
+	openDBs *openDBLimiter
+	// downloads bounds the source files downloaded at the same time, shared with the other tables when compacted with CompactTables.
+	downloads *downloadLimiter
+	// dedupers are only set when Options.DedupEntriesWindow is configured, by compacted file.
+	dedupers    map[*bbolt.DB]*entryDeduper
+	dedupersMtx sync.Mutex
+
+	// indexFormatErr is set when the per user indexes of the table are inconsistent with PeriodConfig.PerUserIndex.
+	indexFormatErr error
+	// sourceSchema is only set when Options.ValidateSourceSchema is configured, and sourceSchemaErr when it can't be for the schema version.
+	sourceSchema    *sourceSchemaValidator
+	sourceSchemaErr error
+	// retentionErr is set when Options.RetentionPeriod is configured for a schema version whose keys can't be decoded for retention.
+	retentionErr error
+
+	phaseTimings   PhaseTimings
+	readPacer      *readPacer
+	userReadBudget *readBudget
 }
 
 func newTableCompactor(
@@ -113,83 +193,205 @@ func newTableCompactor(
 	existingUserIndexSet map[string]compactor.IndexSet,
 	userIndexSetFactoryFunc compactor.MakeEmptyUserIndexSetFunc,
 	periodConfig config.PeriodConfig,
+	opts Options,
+	metrics *metrics,
 ) *tableCompactor {
-	return &tableCompactor{
+	t := &tableCompactor{
 		ctx:                     ctx,
 		commonIndexSet:          commonIndexSet,
 		existingUserIndexSet:    existingUserIndexSet,
 		userIndexSetFactoryFunc: userIndexSetFactoryFunc,
-		userCompactedIndexSet:   map[string]*compactedIndexSet{},
+		userCompactedIndexSet:   newUserIndexSetShards(opts.UserIndexSetShards, metrics),
 		periodConfig:            periodConfig,
+		opts:                    opts,
+		metrics:                 metrics,
+		readPacer:               newReadPacer(opts.CompactionReadInterval),
+		userReadBudget:          newReadBudget(readDBsConcurrency),
+		tenantFilter:            newTenantFilter(opts.TenantAllowList, opts.TenantDenyList),
+		tenantMetrics:           newTenantMetrics(opts.TenantMetricsAllowList, metrics),
+		tempDBs:                 newTempDBTracker(),
+		openDBs:                 newOpenDBLimiter(opts.MaxOpenCompactedDBs, metrics.compactTablesOpenCompactedDBs),
+		indexFormatErr:          validateIndexFormat(periodConfig, existingUserIndexSet),
+	}
+
+	t.userIndexLimit = newUserIndexLimit(opts, t.tenantMetrics, metrics)
+	if opts.TenantUsageCallback != nil {
+		t.tenantUsage = newTenantUsageTracker()
 	}
+	if opts.DryRunCallback != nil {
+		t.dryRun = newDryRunReporter()
+	}
+	if opts.DedupEntriesWindow > 0 {
+		t.dedupers = map[*bbolt.DB]*entryDeduper{}
+	}
+	if opts.ValidateSourceSchema {
+		t.sourceSchema, t.sourceSchemaErr = newSourceSchemaValidator(periodConfig)
+	}
+	if opts.RetentionPeriod != nil {
+		t.retentionErr = validateRetentionSchema(periodConfig)
+	}
+
+	return t
 }
 
-func (t *tableCompactor) CompactTable() error {
+func (t *tableCompactor) CompactTable() (err error) {
+	if t.indexFormatErr != nil {
+		return t.indexFormatErr
+	}
+	if t.sourceSchemaErr != nil {
+		return t.sourceSchemaErr
+	}
+	if t.retentionErr != nil {
+		return t.retentionErr
+	}
+
+	if !t.scheduleAllows() {
+		level.Info(t.commonIndexSet.GetLogger()).Log("msg", "deferring compaction of table due to schedule")
+		t.metrics.compactTablesDeferredSchedule.Inc()
+		return nil
+	}
+
+	if t.isFutureTable() {
+		level.Warn(t.commonIndexSet.GetLogger()).Log("msg", "skipping compaction of table which starts in the future, check the clock of the ingesters", "grace_period", t.opts.FutureTableGracePeriod)
+		t.metrics.compactTablesFutureTableSkipped.Inc()
+		return nil
+	}
+
+	if !t.hasMinFreeDiskSpace() {
+		t.metrics.compactTablesDeferredLowDisk.Inc()
+		return nil
+	}
+	compactionStart := time.Now()
+
+	// remove the compacted dbs not handed over to their index sets yet when the compaction fails midway.
+	defer func() {
+		if err != nil {
+			t.tempDBs.cleanup(t.commonIndexSet.GetLogger(), t.openDBs.release)
+		}
+		t.removeStagingDir()
+	}()
+
+	if t.opts.RecreateOnly {
+		if err := t.recreateCompactedDBs(); err != nil {
+			return err
+		}
+
+		t.metrics.compactTablesDurationSeconds.WithLabelValues(t.indexFormat()).Observe(time.Since(compactionStart).Seconds())
+		t.reportDryRun()
+		return nil
+	}
+
 	commonIndexes := t.commonIndexSet.ListSourceFiles()
 
 	// we need to perform compaction if we have more than 1 files in the storage or the only file we have is not a compaction file.
 	// if the files are already compacted we need to see if we need to recreate the compacted DB to reduce its space.
-	if len(commonIndexes) > 1 || (len(commonIndexes) == 1 && !strings.HasPrefix(commonIndexes[0].Name, uploaderName)) || mustRecreateCompactedDB(commonIndexes) {
-		var err error
-		commonIndex, err := t.compactCommonIndexes(t.ctx)
+	// previously compacted files also need to be compacted again for splitting them as per Options.SplitCommonIndex,
+	// or for moving the buckets kept in them for tenants selected for compaction once the tenant filter changes.
+	// the compacted index of the common index is only set along with the ones of the users at the end, see setCompactedIndexes.
+	var commonCompactedIndex compactor.CompactedIndex
+	compactCommonIndex, recreate := t.opts.ShouldCompact(t.commonIndexSet.GetTableName(), commonIndexes)
+	if t.export != nil && len(commonIndexes) > 0 {
+		// the whole index of the table gets exported.
+		compactCommonIndex = true
+	}
+	if compactCommonIndex {
+		commonIndex, consumedFiles, err := t.compactCommonIndexes(t.ctx)
 		if err != nil {
 			return err
 		}
+		consumedFiles.log(t.commonIndexSet.GetLogger())
+
+		recreateStart := time.Now()
 
 		commonIndexEmpty, err := commonIndex.isEmpty()
 		if err != nil {
 			return err
 		}
 
-		var commonCompactedIndex compactor.CompactedIndex
 		if commonIndexEmpty {
 			// compaction has resulted into empty commonIndex due to all the files being compacted away to per user index.
 			commonIndex.Cleanup()
 			commonIndex = nil
 		} else {
-			if mustRecreateCompactedDB(commonIndexes) {
-				if err := commonIndex.recreateCompactedDB(); err != nil {
+			if recreate {
+				if _, err := t.recreateReclaimableCompactedDB("", commonIndex); err != nil {
 					return err
 				}
 			}
+			if err := t.rewriteInKeyOrder("", commonIndex); err != nil {
+				return err
+			}
 			commonCompactedIndex = commonIndex
 		}
-
-		if err := t.commonIndexSet.SetCompactedIndex(commonCompactedIndex, true); err != nil {
-			return err
-		}
+		t.phaseTimings.CommonRecreate += time.Since(recreateStart)
+	} else {
+		level.Debug(t.commonIndexSet.GetLogger()).Log("msg", "skipping compaction of common index which does not need it",
+			"reason", t.opts.skipCompactionReason(t.commonIndexSet.GetTableName(), commonIndexes))
+		t.metrics.compactTablesSkipped.Inc()
 	}
 
 	// Make sure that compacted user indexes that received no
 	// updates from ingesters during this compactor run get
 	// processed: They may need to have multiple files compacted into
 	// one or be recreated to pack records
-	for userID, indexSet := range t.existingUserIndexSet {
-		if _, ok := t.userCompactedIndexSet[userID]; ok {
-			continue
-		}
-		// We did not have any updates for this indexSet during compaction.
-		// Now see if it has more than one files to compact it down to a single file or if it requires recreation to save space.
-		sourceFiles := indexSet.ListSourceFiles()
-		if len(sourceFiles) > 1 || mustRecreateCompactedDB(sourceFiles) {
-			userCompactedIndexSet, err := t.fetchUserCompactedIndexSet(userID)
-			if err != nil {
-				level.Error(indexSet.GetLogger()).Log("msg", "unable to fetch a non-updated compacted index. skipping", "err", err)
-				continue
-			}
-			t.userCompactedIndexSet[userID] = userCompactedIndexSet
+	// This is optional work, so skip it if the schedule does not allow it anymore.
+	// User indexes which received updates above still get set below to not lose the data from common index.
+	recreateStart := time.Now()
+	existingUserIndexSet := t.existingUserIndexSet
+	if !t.scheduleAllows() {
+		level.Info(t.commonIndexSet.GetLogger()).Log("msg", "deferring compaction of non-updated user indexes due to schedule")
+		t.metrics.compactTablesDeferredSchedule.Inc()
+		existingUserIndexSet = nil
+	}
+	if err := t.compactNonUpdatedUserIndexes(existingUserIndexSet); err != nil {
+		return err
+	}
+	if err := t.rewriteUserCompactedDBsInKeyOrder(); err != nil {
+		return err
+	}
+	t.phaseTimings.PerUserRecreate += time.Since(recreateStart)
 
-			if mustRecreateCompactedDB(sourceFiles) {
-				if err := userCompactedIndexSet.compactedIndex.recreateCompactedDB(); err != nil {
-					return err
-				}
-			}
+	finalizeStart := time.Now()
+	if err := t.setCompactedIndexes(compactCommonIndex, commonCompactedIndex); err != nil {
+		return err
+	}
+	t.phaseTimings.Finalize += time.Since(finalizeStart)
 
-		}
+	t.phaseTimings.observe(t.metrics)
+	t.phaseTimings.log(t.commonIndexSet.GetLogger())
+
+	if pacingDelay := t.readPacer.delay(); pacingDelay > 0 {
+		level.Info(t.commonIndexSet.GetLogger()).Log("msg", "paced reads of source files", "total_delay", pacingDelay)
+		t.metrics.compactTablesReadPacingDelaySeconds.Add(pacingDelay.Seconds())
 	}
 
-	for _, userCompactedIndexSet := range t.userCompactedIndexSet {
-		if err := userCompactedIndexSet.SetCompactedIndex(userCompactedIndexSet.compactedIndex, true); err != nil {
+	if t.tenantUsage != nil {
+		t.opts.TenantUsageCallback(t.commonIndexSet.GetTableName(), t.tenantUsage.get())
+	}
+
+	t.metrics.compactTablesDurationSeconds.WithLabelValues(t.indexFormat()).Observe(time.Since(compactionStart).Seconds())
+	t.reportDryRun()
+	return nil
+}
+
+// PhaseTimings returns the time spent in each phase of the last CompactTable run.
+func (t *tableCompactor) PhaseTimings() PhaseTimings {
+	return t.phaseTimings
+}
+
+// ForEachCompactedUserIndex calls f with the compacted index of each user built by the last CompactTable run, in the order of the
+// user ids, like for running custom checks on them. It is meant to be called once CompactTable returned, and before the compacted
+// indexes get handed over for upload by their index sets, which closes them. The iteration stops at the first error returned by f,
+// which is returned. Users left without a compacted index are skipped.
+func (t *tableCompactor) ForEachCompactedUserIndex(f func(userID string, compactedIndex *CompactedIndex) error) error {
+	userCompactedIndexSets := t.userCompactedIndexSet.all()
+	for _, userID := range sortedUserIDs(userCompactedIndexSets) {
+		compactedIndex := userCompactedIndexSets[userID].compactedIndex
+		if compactedIndex == nil {
+			continue
+		}
+
+		if err := f(userID, compactedIndex); err != nil {
 			return err
 		}
 	}
@@ -197,44 +399,398 @@ func (t *tableCompactor) CompactTable() error {
 	return nil
 }
 
-func (t *tableCompactor) fetchUserCompactedIndexSet(userID string) (*compactedIndexSet, error) {
+// scheduleAllows returns false if the configured ScheduleGate does not allow compaction at the moment.
+func (t *tableCompactor) scheduleAllows() bool {
+	return t.opts.ScheduleGate == nil || t.opts.ScheduleGate(t.opts.now())
+}
+
+// heartbeat calls Options.Heartbeat, if set, to signal that the compaction is making progress.
+func (t *tableCompactor) heartbeat() {
+	if t.opts.Heartbeat != nil {
+		t.opts.Heartbeat()
+	}
+}
+
+// isFutureTable returns true if the table starts later than Options.FutureTableGracePeriod from now.
+// Tables with names not ending with a table number are never considered to be in the future.
+func (t *tableCompactor) isFutureTable() bool {
+	if t.opts.FutureTableGracePeriod <= 0 {
+		return false
+	}
+
+	tableStart, ok := t.tableStart(t.commonIndexSet.GetTableName())
+	if !ok {
+		return false
+	}
+
+	return tableStart.After(model.TimeFromUnixNano(t.opts.now().UnixNano()).Add(t.opts.FutureTableGracePeriod))
+}
+
+// tableStart returns the start of the period of the given table, which is its table number after the prefix of the index tables of
+// the period config times their period. The period defaults to 24h, with the table number in the last 5 characters of the name,
+// when the period config has no period for the index tables. It returns false for tables without a table number.
+func (t *tableCompactor) tableStart(tableName string) (model.Time, bool) {
+	period := t.periodConfig.IndexTables.Period
+	if period <= 0 {
+		if len(tableName) < 5 {
+			return 0, false
+		}
+		return ExtractIntervalFromTableName(tableName).Start, true
+	}
+
+	prefix := t.periodConfig.IndexTables.Prefix
+	if !strings.HasPrefix(tableName, prefix) {
+		return 0, false
+	}
+	tableNumber, err := strconv.ParseInt(strings.TrimPrefix(tableName, prefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return model.TimeFromUnix(tableNumber * int64(period/time.Second)), true
+}
+
+// normalizeUserBucket returns the tenant owning the entries of the given bucket as per Options.NormalizeUserBucket.
+// The common index bucket is never normalized.
+func (t *tableCompactor) normalizeUserBucket(bucketName string) string {
+	if t.opts.NormalizeUserBucket == nil || bucketName == shipper_util.GetUnsafeString(local.IndexBucketName) {
+		return bucketName
+	}
+
+	return t.opts.NormalizeUserBucket(bucketName)
+}
+
+// routeUserBucket returns the user whose index should hold the entries of the given user bucket, which is the tenant of the bucket
+// after normalizing it. Buckets of tenants failing validation with Options.ValidateTenantID are routed to the invalidTenantBucket.
+func (t *tableCompactor) routeUserBucket(bucketName string) string {
+	tenant := t.normalizeUserBucket(bucketName)
+	if t.opts.ValidateTenantID == nil || t.opts.ValidateTenantID(tenant) {
+		return tenant
+	}
+
+	return invalidTenantBucket
+}
+
+// applyRetention drops the index entries which are past the retention period configured via Options.RetentionPeriod.
+func (t *tableCompactor) applyRetention(batch []indexEntry) []indexEntry {
+	if t.opts.RetentionPeriod == nil {
+		return batch
+	}
+
+	batch, dropped := dropExpiredEntries(batch, t.opts.RetentionPeriod, model.TimeFromUnixNano(t.opts.now().UnixNano()))
+	t.metrics.compactTablesRetentionDroppedEntries.Add(float64(dropped))
+	return batch
+}
+
+func (t *tableCompactor) fetchUserCompactedIndexSet(ctx context.Context, userID string) (*compactedIndexSet, error) {
 	userIndexSet, ok := t.existingUserIndexSet[userID]
 	if !ok {
-		return nil, errors.New("requested non-existing compacted tenant index")
+		return nil, errors.Wrapf(ErrTenantIndexNotFound, "user %s", userID)
 	}
 
+	compactedIndex, err := t.compactUserIndexSet(ctx, userID, userIndexSet)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompactedIndexSet(userIndexSet, compactedIndex), nil
+}
+
+// compactUserIndexSet compacts all the source files of the given user index set into a single CompactedIndex.
+// If the index set has a single source file, it is opened as is, without any compaction.
+// Multiple source files, in FORMAT3, get compacted down to one with compactUserIndexes, which writes the entries of the files to
+// the index bucket of the user without routing them to other users like compactCommonIndexes does.
+func (t *tableCompactor) compactUserIndexSet(ctx context.Context, userID string, userIndexSet compactor.IndexSet) (*CompactedIndex, error) {
 	sourceFiles := userIndexSet.ListSourceFiles()
 	if len(sourceFiles) > 1 {
-		compactedIndex, err := t.compactUserIndexes(userIndexSet)
+		return t.compactUserIndexes(ctx, userID, userIndexSet)
+	} else if len(sourceFiles) == 1 {
+		return t.openSourceFileAsCompactedIndex(userIndexSet, sourceFiles[0])
+	}
+	return nil, errors.Wrapf(ErrEmptyIndexSet, "user %s", userID)
+}
+
+// newCompactedIndex builds a CompactedIndex for the given compacted file of the index set.
+func (t *tableCompactor) newCompactedIndex(compactedFile *bbolt.DB, idxSet compactor.IndexSet) *CompactedIndex {
+	stagingDir := ""
+	if t.opts.StagingDir != "" {
+		stagingDir = t.compactedDBDir(idxSet)
+	}
+
+	return newCompactedIndexWithOptions(compactedFile, idxSet.GetTableName(), idxSet.GetWorkingDir(), stagingDir, t.periodConfig, idxSet.GetLogger(), t.opts, t.openDBs)
+}
+
+// openSourceFileAsCompactedIndex downloads the given source file and opens it as a CompactedIndex.
+func (t *tableCompactor) openSourceFileAsCompactedIndex(idxSet compactor.IndexSet, sourceFile storage.IndexFile) (*CompactedIndex, error) {
+	indexFile, err := t.getSourceFile(idxSet, sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	boltdb, err := t.openCompactedDB(indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.newCompactedIndex(boltdb, idxSet), nil
+}
+
+// setCompactedIndexes sets the compacted indexes for the index sets of the table once all the compacted dbs got built, the one of
+// the common index first if it got compacted. The index sets only act on them once CompactTable returns without an error: the
+// compacted dbs of the users get uploaded before the one of the common index, and the source files of an index set get removed
+// only after its compacted db got uploaded. A compaction cancelled before this point, like on shutdown, leaves the storage
+// untouched and sets none of the compacted indexes. Once started, the compacted indexes of all the index sets get set even if
+// the context gets cancelled meanwhile, which only takes a short time since they are only handed over, for not leaving the
+// index sets of some of the users without their compacted index.
+func (t *tableCompactor) setCompactedIndexes(compactCommonIndex bool, commonCompactedIndex compactor.CompactedIndex) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+
+	if compactCommonIndex {
+		if err := t.setCompactedIndex("", t.commonIndexSet, commonCompactedIndex); err != nil {
+			return err
+		}
+	}
+
+	if err := t.setUserCompactedIndexes(); err != nil {
+		return err
+	}
+	if t.export != nil {
+		t.export.finalized = true
+	}
+	return nil
+}
+
+// setUserCompactedIndexes sets the compacted index for all the user index sets built while compacting the table,
+// with up to Options.FinalizeConcurrency of them concurrently.
+// It does not stop at the first failure to let the compacted indexes of the other users get set, and returns all the failures.
+func (t *tableCompactor) setUserCompactedIndexes() error {
+	userCompactedIndexSets := t.userCompactedIndexSet.all()
+	userIDs := sortedUserIDs(userCompactedIndexSets)
+
+	var (
+		errs    multierror.MultiError
+		errsMtx sync.Mutex
+	)
+	err := concurrency.ForEachJob(context.Background(), len(userIDs), t.finalizeConcurrency(), func(_ context.Context, idx int) error {
+		t.heartbeat()
+		userID := userIDs[idx]
+		userCompactedIndexSet := userCompactedIndexSets[userID]
+		if err := t.setCompactedIndex(userID, userCompactedIndexSet, userCompactedIndexSet.compactedIndex); err != nil {
+			errsMtx.Lock()
+			defer errsMtx.Unlock()
+			errs.Add(errors.Wrapf(err, "failed to set compacted index for user %s", userID))
+		}
+
+		return nil
+	})
+	errs.Add(err)
+
+	return errs.Err()
+}
+
+// compactNonUpdatedUserIndexes compacts the given user indexes which did not receive any updates from the common index
+// if they have more than one file, or recreates them if they require recreation to save space,
+// with up to Options.RecreateConcurrency of them concurrently.
+// User indexes failing to be fetched are skipped while failing to recreate one stops the processing of the remaining ones.
+func (t *tableCompactor) compactNonUpdatedUserIndexes(existingUserIndexSet map[string]compactor.IndexSet) error {
+	var userIDs []string
+	for _, userID := range sortedUserIDs(existingUserIndexSet) {
+		if _, ok := t.userCompactedIndexSet.get(userID); ok || !t.tenantFilter.compacts(userID) {
+			continue
+		}
+
+		sourceFiles := existingUserIndexSet[userID].ListSourceFiles()
+		exported := t.export != nil && len(sourceFiles) > 0
+		if len(sourceFiles) > 1 || exported || t.opts.mustRecreateCompactedDB(t.commonIndexSet.GetTableName(), userID, sourceFiles) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	return concurrency.ForEachJob(t.ctx, len(userIDs), t.recreateConcurrency(), func(ctx context.Context, idx int) error {
+		userID := userIDs[idx]
+		indexSet := existingUserIndexSet[userID]
+		if err := t.waitWhilePaused(ctx, indexSet.GetLogger()); err != nil {
+			return err
+		}
+		t.heartbeat()
+		userCompactedIndexSet, err := t.fetchUserCompactedIndexSet(ctx, userID)
 		if err != nil {
-			return nil, err
+			level.Error(indexSet.GetLogger()).Log("msg", "unable to fetch a non-updated compacted index. skipping", "err", err)
+			return nil
 		}
-		return newCompactedIndexSet(userIndexSet, compactedIndex), nil
-	} else if len(sourceFiles) == 1 {
-		indexFile, err := userIndexSet.GetSourceFile(sourceFiles[0])
+
+		t.userCompactedIndexSet.set(userID, userCompactedIndexSet)
+
+		// do not start recreating the db if the recreation of another one failed.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if t.opts.mustRecreateCompactedDB(t.commonIndexSet.GetTableName(), userID, indexSet.ListSourceFiles()) {
+			_, err := t.recreateReclaimableCompactedDB(userID, userCompactedIndexSet.compactedIndex)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// recreateConcurrency returns the number of non-updated user indexes to compact or recreate concurrently.
+func (t *tableCompactor) recreateConcurrency() int {
+	if t.opts.RecreateConcurrency <= 0 {
+		return 1
+	}
+
+	return t.opts.RecreateConcurrency
+}
+
+// finalizeConcurrency returns the number of user index sets to set the compacted index for concurrently.
+func (t *tableCompactor) finalizeConcurrency() int {
+	if t.opts.FinalizeConcurrency <= 0 {
+		return 1
+	}
+
+	return t.opts.FinalizeConcurrency
+}
+
+// recreateCompactedDBs only recreates the compacted dbs of the table which are eligible for recreation without merging any files.
+// It is used when Options.RecreateOnly is set.
+func (t *tableCompactor) recreateCompactedDBs() error {
+	recreated := false
+	recreate := func(userID string, idxSet compactor.IndexSet) error {
+		t.heartbeat()
+		sourceFiles := idxSet.ListSourceFiles()
+		if !t.opts.mustRecreateCompactedDB(t.commonIndexSet.GetTableName(), userID, sourceFiles) {
+			return nil
+		}
+
+		compactedIndex, err := t.openSourceFileAsCompactedIndex(idxSet, sourceFiles[0])
 		if err != nil {
-			return nil, err
+			return err
 		}
-		boltdb, err := openBoltdbFileWithNoSync(indexFile)
+
+		recreatedDB, err := t.recreateReclaimableCompactedDB(userID, compactedIndex)
+		if err != nil || !recreatedDB {
+			// a db with too little to reclaim is left untouched.
+			compactedIndex.Cleanup()
+			return err
+		}
+
+		if err := t.setCompactedIndex(userID, idxSet, compactedIndex); err != nil {
+			compactedIndex.Cleanup()
+			return err
+		}
+
+		recreated = true
+		return nil
+	}
+
+	if err := recreate("", t.commonIndexSet); err != nil {
+		return err
+	}
+
+	for _, userID := range sortedUserIDs(t.existingUserIndexSet) {
+		if !t.tenantFilter.compacts(userID) {
+			continue
+		}
+		if err := recreate(userID, t.existingUserIndexSet[userID]); err != nil {
+			return err
+		}
+	}
+
+	if recreated {
+		t.metrics.compactTablesRecreateOnly.Inc()
+	}
+
+	return nil
+}
+
+// recreateCompactedDB recreates the compacted db of the given CompactedIndex of a user, or of the common index for an empty user id,
+// with profiling labels and records the bytes reclaimed by it.
+func (t *tableCompactor) recreateCompactedDB(userID string, compactedIndex *CompactedIndex) error {
+	return t.doWithProfilingLabels(t.ctx, profilingPhaseRecreate, func(_ context.Context) error {
+		reclaimedBytes, err := compactedIndex.recreateCompactedDB(t.opts.dropFreePagesTxMaxSize())
 		if err != nil {
-			return nil, err
+			var mismatchErr *recreatedDBMismatchError
+			if errors.As(err, &mismatchErr) {
+				t.metrics.compactTablesRecreateVerifyFailures.Inc()
+			}
+			return err
 		}
 
-		return newCompactedIndexSet(userIndexSet, newCompactedIndex(boltdb, userIndexSet.GetTableName(), userIndexSet.GetWorkingDir(), t.periodConfig, userIndexSet.GetLogger())), nil
+		t.tempDBs.add(compactedIndex.compactedFile)
+
+		format := indexFormatPerUser
+		if userID == "" {
+			format = indexFormatCommon
+		}
+		t.metrics.compactTablesRecreateReclaimedBytes.WithLabelValues(format).Add(float64(reclaimedBytes))
+		return nil
+	})
+}
+
+// recreateReclaimableCompactedDB recreates the compacted db of the given CompactedIndex like recreateCompactedDB, unless the estimate of
+// the bytes reclaimed by recreating it is below Options.RecreateMinReclaimableBytes, in which case the recreation is skipped and logged.
+// It returns whether the db got recreated.
+func (t *tableCompactor) recreateReclaimableCompactedDB(userID string, compactedIndex *CompactedIndex) (bool, error) {
+	if t.opts.RecreateMinReclaimableBytes > 0 {
+		if reclaimableBytes := compactedIndex.EstimateReclaimableBytes(); reclaimableBytes < t.opts.RecreateMinReclaimableBytes {
+			level.Info(compactedIndex.logger).Log("msg", "skipping recreation of compacted db with too little to reclaim",
+				"estimated_reclaimable_bytes", reclaimableBytes, "min_reclaimable_bytes", t.opts.RecreateMinReclaimableBytes)
+			compactedIndex.recreateSkipped = true
+			t.metrics.compactTablesRecreateSkipped.Inc()
+			return false, nil
+		}
 	}
-	return nil, errors.New("attempted to fetch empty index set")
 
+	return true, t.recreateCompactedDB(userID, compactedIndex)
+}
+
+// observeCompactedFileSize records the size of the compacted file of the given CompactedIndex of a user, or of the common index for
+// an empty user id. Nothing is recorded when the index set is left without a compacted index.
+func (t *tableCompactor) observeCompactedFileSize(userID string, compactedIndex compactor.CompactedIndex) error {
+	c, ok := compactedIndex.(*CompactedIndex)
+	if !ok || c == nil {
+		return nil
+	}
+
+	var size int64
+	if err := c.compactedFile.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	format := indexFormatPerUser
+	if userID == "" {
+		format = indexFormatCommon
+	}
+	t.metrics.compactTablesCompactedFileSizeBytes.WithLabelValues(format).Observe(float64(size))
+	return nil
+}
+
+// newCompactedDBPath returns the path of a new compacted db in the given dir, named after the current time as per Options.Clock.
+func (t *tableCompactor) newCompactedDBPath(workingDir string) string {
+	return filepath.Join(workingDir, fmt.Sprint(t.opts.now().Unix()))
+}
+
+// indexFormat returns the value of the index_format label of the metrics for the table.
+func (t *tableCompactor) indexFormat() string {
+	if len(t.existingUserIndexSet) > 0 || t.userCompactedIndexSet.len() > 0 {
+		return indexFormatPerUser
+	}
+
+	return indexFormatCommon
 }
 
 // This function should be safe to call from multiple concurrent
 // goroutines. However, the caller should guarantee that only a single
 // call is made per userID. This function does not guarantee that two
 // concurrent invocations will not fetch/create the same index twice.
-func (t *tableCompactor) fetchOrCreateUserCompactedIndexSet(userID string) error {
-	t.userCompactedIndexSetMtx.RLock()
-	_, ok := t.userCompactedIndexSet[userID]
-	t.userCompactedIndexSetMtx.RUnlock()
-	if ok {
+func (t *tableCompactor) fetchOrCreateUserCompactedIndexSet(ctx context.Context, userID string) error {
+	if _, ok := t.userCompactedIndexSet.get(userID); ok {
 		return nil
 	}
 
@@ -248,100 +804,258 @@ func (t *tableCompactor) fetchOrCreateUserCompactedIndexSet(userID string) error
 			return err
 		}
 
-		compactedFile, err := openBoltdbFileWithNoSync(filepath.Join(userIndexSet.GetWorkingDir(), fmt.Sprint(time.Now().Unix())))
+		compactedFile, err := t.openCompactedDB(t.newCompactedDBPath(t.compactedDBDir(userIndexSet)))
 		if err != nil {
 			return err
 		}
-		compactedIndex := newCompactedIndex(compactedFile, userIndexSet.GetTableName(), userIndexSet.GetWorkingDir(), t.periodConfig, userIndexSet.GetLogger())
+		compactedIndex := t.newCompactedIndex(compactedFile, userIndexSet)
 		result = newCompactedIndexSet(userIndexSet, compactedIndex)
+		t.metrics.compactTablesUserIndexSetsCreated.Inc()
 	} else {
-		r, err := t.fetchUserCompactedIndexSet(userID)
+		r, err := t.fetchUserCompactedIndexSet(ctx, userID)
 		result = r
 		if err != nil {
 			return err
 		}
+		t.metrics.compactTablesUserIndexSetsFetched.Inc()
 	}
 
-	t.userCompactedIndexSetMtx.Lock()
-	defer t.userCompactedIndexSetMtx.Unlock()
-	t.userCompactedIndexSet[userID] = result
+	t.userCompactedIndexSet.set(userID, result)
 	return nil
 }
 
 // Specialized compaction for user index files produced by the compactor
-func (t *tableCompactor) compactUserIndexes(idxSet compactor.IndexSet) (*CompactedIndex, error) {
-	indexes := idxSet.ListSourceFiles()
-	workingDir := idxSet.GetWorkingDir()
-	compactedDBName := filepath.Join(workingDir, fmt.Sprint(time.Now().Unix()))
+func (t *tableCompactor) compactUserIndexes(ctx context.Context, userID string, idxSet compactor.IndexSet) (*CompactedIndex, error) {
+	indexes := t.listSourceFiles(idxSet)
+	compactedDBDir := t.compactedDBDir(idxSet)
+	compactedDBName := t.newCompactedDBPath(compactedDBDir)
 
-	compactedFile, err := openBoltdbFileWithNoSync(compactedDBName)
+	compactedFile, err := t.openCompactedDB(compactedDBName)
 	if err != nil {
 		return nil, err
 	}
 
-	// go through each file and dump records in the local bucket of the new compacted file
-	err = concurrency.ForEachJob(t.ctx, len(indexes), readDBsConcurrency, func(ctx context.Context, idx int) error {
-		downloadAt, err := idxSet.GetSourceFile(indexes[idx])
-		if err != nil {
-			return err
-		}
-		dbPair := downloadedDb{
-			path: downloadAt,
-		}
-		defer dbPair.cleanup(idxSet.GetLogger())
-
-		db, err := openBoltdbFileWithNoSync(downloadAt)
+	// user indexes can get compacted concurrently while compacting the common index, so take the workers from a shared budget.
+	maxWorkers := t.mergeConcurrency()
+	if len(indexes) < maxWorkers {
+		maxWorkers = len(indexes)
+	}
+	workers, releaseWorkers := t.userReadBudget.acquireWorkers(maxWorkers)
+	defer releaseWorkers()
+
+	process := func(ctx context.Context, dbPair downloadedDb) error {
+		fileTx := t.newSourceFileTx()
+		defer fileTx.rollback()
+		fileMetrics := t.newTenantFileMetrics()
+
+		err := t.doWithProfilingLabels(ctx, profilingPhaseUserMerge, func(_ context.Context) error {
+			return t.readSourceFile(ctx, idxSet.GetLogger(), dbPair, func(bucketName string, batch []indexEntry) error {
+				return t.transformUserBatch(userID, bucketName, batch, func(batch []indexEntry) error {
+					batch = t.applyRetention(batch)
+					if err := t.userIndexLimit.add(idxSet.GetLogger(), userID, batch); err != nil {
+						return err
+					}
+					t.tenantUsage.add(userID, batch)
+					fileMetrics.add(userID, batch)
+					return t.writeBatch(fileTx, compactedFile, batch)
+				})
+			})
+		})
 		if err != nil {
 			return err
 		}
-		dbPair.db = db
-
-		err = readFile(idxSet.GetLogger(), dbPair, func(bucketName string, batch []indexEntry) error {
-			return writeBatch(compactedFile, batch)
-		})
-		if err != nil {
+		if err := fileTx.commit(); err != nil {
 			return err
 		}
 
+		fileMetrics.done()
 		return nil
-	})
+	}
+
+	// go through each file and dump records in the local bucket of the new compacted file
+	if t.opts.CompactionReadAhead > 0 {
+		err = t.forEachSourceFileWithReadAhead(ctx, userID, idxSet, indexes, workers, process)
+	} else {
+		err = concurrency.ForEachJob(ctx, len(indexes), workers, func(ctx context.Context, idx int) error {
+			if err := t.waitWhilePaused(ctx, idxSet.GetLogger()); err != nil {
+				return err
+			}
+			t.heartbeat()
+			t.metrics.compactTablesReadConcurrency.Inc()
+			defer t.metrics.compactTablesReadConcurrency.Dec()
+
+			dbPair, err := t.downloadSourceFile(ctx, userID, idxSet, indexes[idx])
+			defer dbPair.cleanup(idxSet.GetLogger())
+			if err != nil || dbPair.db == nil {
+				return err
+			}
+
+			return process(ctx, dbPair)
+		})
+	}
 
 	if err != nil {
+		// the source files are left for the next compaction run, so remove the partially compacted file.
+		partialCompactedDB := downloadedDb{path: compactedDBName, db: compactedFile}
+		partialCompactedDB.cleanup(idxSet.GetLogger())
+		t.openDBs.release(compactedFile)
 		return nil, err
 	}
 
-	return newCompactedIndex(compactedFile, idxSet.GetTableName(), workingDir, t.periodConfig, idxSet.GetLogger()), nil
+	return t.newCompactedIndex(compactedFile, idxSet), nil
 }
 
-func (t *tableCompactor) compactCommonIndexes(ctx context.Context) (*CompactedIndex, error) {
+// compactCommonIndexes compacts the source files of the common index, moving the entries of user buckets to the index of their user.
+// It also returns the stats of the source files consumed for logging a summary of the compaction.
+func (t *tableCompactor) compactCommonIndexes(ctx context.Context) (*CompactedIndex, consumedFilesStats, error) {
+	prefetchStart := time.Now()
 	idxSet := t.commonIndexSet
-	indexes := idxSet.ListSourceFiles()
-	compactedFileIdx := compactedFileIdx(indexes)
-	workingDir := idxSet.GetWorkingDir()
-	compactedDBName := filepath.Join(workingDir, fmt.Sprint(time.Now().Unix()))
+	indexes := t.listSourceFiles(idxSet)
+	checkpoint, err := t.resumeCheckpoint(idxSet, indexes)
+	if err != nil {
+		return nil, consumedFilesStats{}, err
+	}
+	t.checkMultipleSeeds(idxSet, indexes)
+	compactedFileIdx, seedReason, err := t.seedFileIdx(indexes)
+	if err != nil {
+		return nil, consumedFilesStats{}, err
+	}
+	compactedDBDir := t.compactedDBDir(idxSet)
+	compactedDBName := t.newCompactedDBPath(compactedDBDir)
+	if checkpoint != nil {
+		// the seed file and the other files consumed before the checkpoint are already merged into the compacted file of the checkpoint.
+		compactedFileIdx, seedReason = -1, "resuming from checkpoint"
+		compactedDBName = checkpoint.CompactedFile
+	}
 
 	// if we find a previously compacted file, use it as a seed file to copy other index into it
+	// a corrupt seed file skipped as per Options.SkipCorruptSourceFiles is discarded like one failing integrity verification.
+	seedDiscarded := false
 	if compactedFileIdx != -1 {
-		level.Info(idxSet.GetLogger()).Log("msg", fmt.Sprintf("using %s as seed file", indexes[compactedFileIdx].Name))
+		level.Info(idxSet.GetLogger()).Log("msg", fmt.Sprintf("using %s as seed file", indexes[compactedFileIdx].Name), "reason", seedReason)
 
-		var err error
-		compactedDBName, err = idxSet.GetSourceFile(indexes[compactedFileIdx])
+		seedFileName, err := t.getSourceFile(idxSet, indexes[compactedFileIdx])
 		if err != nil {
-			return nil, err
+			if !t.skipCorruptSourceFile("", idxSet, indexes[compactedFileIdx], err) {
+				return nil, consumedFilesStats{}, err
+			}
+			seedDiscarded = true
+		} else {
+			compactedDBName = seedFileName
 		}
+	} else {
+		level.Debug(idxSet.GetLogger()).Log("msg", "building a new compacted file without a seed file", "reason", seedReason)
 	}
 
-	compactedFile, err := openBoltdbFileWithNoSync(compactedDBName)
+	compactedFile, err := t.openCompactedDB(compactedDBName)
 	if err != nil {
-		return nil, err
+		if compactedFileIdx == -1 || seedDiscarded || !isCorruptBoltdbOpenErr(err) ||
+			!t.skipCorruptSourceFile("", idxSet, indexes[compactedFileIdx], newCorruptSourceFileError(indexes[compactedFileIdx].Name, err)) {
+			return nil, consumedFilesStats{}, err
+		}
+		downloadedSeed := downloadedDb{path: compactedDBName}
+		downloadedSeed.cleanup(idxSet.GetLogger())
+		seedDiscarded = true
+
+		compactedFile, err = t.openCompactedDB(t.newCompactedDBPath(compactedDBDir))
+		if err != nil {
+			return nil, consumedFilesStats{}, err
+		}
 	}
 
+	if compactedFileIdx != -1 && !seedDiscarded && t.opts.IntegrityMarkers {
+		if err := verifyIntegrityMarker(compactedFile); err != nil {
+			// the seed file is left out from the files to read and gets removed from the storage along with other source files.
+			level.Warn(idxSet.GetLogger()).Log("msg", "discarding seed file which failed integrity verification", "seed_file", indexes[compactedFileIdx].Name, "err", err)
+			t.metrics.compactTablesTruncatedSeedDetected.Inc()
+			downloadedSeed := downloadedDb{path: compactedDBName, db: compactedFile}
+			downloadedSeed.cleanup(idxSet.GetLogger())
+			t.openDBs.release(compactedFile)
+			seedDiscarded = true
+
+			compactedFile, err = t.openCompactedDB(t.newCompactedDBPath(compactedDBDir))
+			if err != nil {
+				return nil, consumedFilesStats{}, err
+			}
+		}
+	}
+
+	if compactedFileIdx != -1 && !seedDiscarded && t.opts.SeedSchemaPolicy != SeedSchemaPolicyDisabled {
+		if err := verifySeedSchemaVersion(compactedFile, indexes[compactedFileIdx].Name, t.periodConfig); err != nil {
+			var outdatedErr *SeedSchemaOutdatedError
+			if errors.As(err, &outdatedErr) {
+				t.metrics.compactTablesOutdatedSeedSchema.Inc()
+			}
+			downloadedSeed := downloadedDb{path: compactedDBName, db: compactedFile}
+			downloadedSeed.cleanup(idxSet.GetLogger())
+			t.openDBs.release(compactedFile)
+			if outdatedErr == nil || t.opts.SeedSchemaPolicy == SeedSchemaPolicyFail {
+				return nil, consumedFilesStats{}, err
+			}
+
+			// build a new compacted file and merge the seed file into it like any other source file.
+			level.Warn(idxSet.GetLogger()).Log("msg", "not using seed file built with an older schema version as seed", "seed_file", indexes[compactedFileIdx].Name, "err", err)
+			compactedFileIdx = -1
+			compactedFile, err = t.openCompactedDB(t.newCompactedDBPath(compactedDBDir))
+			if err != nil {
+				return nil, consumedFilesStats{}, err
+			}
+		}
+	}
+
+	if compactedFileIdx != -1 && !seedDiscarded {
+		if err := t.validateSourceSchema(idxSet, compactedFile, indexes[compactedFileIdx].Name); err != nil {
+			downloadedSeed := downloadedDb{path: compactedDBName, db: compactedFile}
+			downloadedSeed.cleanup(idxSet.GetLogger())
+			t.openDBs.release(compactedFile)
+			return nil, consumedFilesStats{}, err
+		}
+
+		seedHasUserBuckets, err := hasUserBuckets(compactedFile)
+		if err != nil {
+			return nil, consumedFilesStats{}, err
+		}
+
+		if seedHasUserBuckets {
+			// the buckets kept for tenants not selected for compaction need to be read for routing them as per the current tenant filter,
+			// so merge the seed file into a new compacted file like any other source file.
+			level.Info(idxSet.GetLogger()).Log("msg", "not using seed file with user buckets as seed", "seed_file", indexes[compactedFileIdx].Name)
+			downloadedSeed := downloadedDb{path: compactedDBName, db: compactedFile}
+			downloadedSeed.cleanup(idxSet.GetLogger())
+			t.openDBs.release(compactedFile)
+			compactedFileIdx = -1
+			compactedFile, err = t.openCompactedDB(t.newCompactedDBPath(compactedDBDir))
+			if err != nil {
+				return nil, consumedFilesStats{}, err
+			}
+		}
+	}
+
+	// a file resumed from a checkpoint is neither a reused seed file nor a brand-new compacted file.
+	if compactedFileIdx != -1 && !seedDiscarded {
+		t.metrics.compactTablesSeedReuse.Inc()
+	} else if checkpoint == nil {
+		t.metrics.compactTablesFreshCompaction.Inc()
+	}
+
+	var consumedFiles consumedFilesStats
+	if compactedFileIdx != -1 && !seedDiscarded {
+		if err := compactedFile.View(func(tx *bbolt.Tx) error {
+			consumedFiles.add(tx.Size())
+			return nil
+		}); err != nil {
+			return nil, consumedFilesStats{}, err
+		}
+	}
+
+	seedGuard := newSeedFileGuard(indexes, compactedFileIdx)
 	dbsToRead := make([]downloadedDb, len(indexes))
 	tenantsToFetch := make(map[string]struct{})
 	var fetchStateMx sync.Mutex
 
 	defer func() {
-		err := concurrency.ForEachJob(ctx, len(dbsToRead), readDBsConcurrency, func(ctx context.Context, idx int) error {
+		// the downloaded files also need to be cleaned up when the context got cancelled.
+		err := concurrency.ForEachJob(context.Background(), len(dbsToRead), readDBsConcurrency, func(ctx context.Context, idx int) error {
 			dbsToRead[idx].cleanup(idxSet.GetLogger())
 			return nil
 		})
@@ -353,14 +1067,19 @@ func (t *tableCompactor) compactCommonIndexes(ctx context.Context) (*CompactedIn
 	// fetch common index files and extract information about tenants that have records in a given file
 	err = concurrency.ForEachJob(ctx, len(indexes), readDBsConcurrency, func(ctx context.Context, idx int) error {
 		workNum := idx
-		// skip seed file
-		if workNum == compactedFileIdx {
+		// skip seed file and files consumed before the checkpoint
+		if skip, err := seedGuard.skip(workNum, indexes[workNum].Name); err != nil || skip {
+			return err
+		}
+		if checkpoint.isConsumed(indexes[workNum].Name) {
 			return nil
 		}
-		downloadAt, err := idxSet.GetSourceFile(indexes[idx])
-		if err != nil {
+		if err := t.waitWhilePaused(ctx, idxSet.GetLogger()); err != nil {
 			return err
 		}
+		t.heartbeat()
+		t.metrics.compactTablesReadConcurrency.Inc()
+		defer t.metrics.compactTablesReadConcurrency.Dec()
 
 		// We're updating the list of dbs to read in paralle,
 		// however the array's pre-allocated so this access is
@@ -368,24 +1087,39 @@ func (t *tableCompactor) compactCommonIndexes(ctx context.Context) (*CompactedIn
 		// NB: It is also important for the updates to happen as
 		// we fetch/open. In an error condition, this ensures
 		// cleanup happens
-		dbsToRead[idx].path = downloadAt
-
-		db, err := openBoltdbFileWithNoSync(downloadAt)
+		var err error
+		dbsToRead[idx], err = t.downloadSourceFile(ctx, "", idxSet, indexes[idx])
 		if err != nil {
 			return err
 		}
 
-		dbsToRead[idx].db = db
+		db := dbsToRead[idx].db
+		if db == nil {
+			// skipped corrupt or empty source file
+			return nil
+		}
 
 		return db.View(func(tx *bbolt.Tx) error {
+			fetchStateMx.Lock()
+			consumedFiles.add(tx.Size())
+			fetchStateMx.Unlock()
+
 			return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
 				bucketNameStr := string(name)
-				if bucketNameStr == shipper_util.GetUnsafeString(local.IndexBucketName) {
+				if err := t.checkBucketFormat(indexes[workNum].Name, bucketNameStr); err != nil {
+					return err
+				}
+				tenant := t.normalizeUserBucket(bucketNameStr)
+				if bucketNameStr == shipper_util.GetUnsafeString(local.IndexBucketName) || isMetaBucket(bucketNameStr) || !t.tenantFilter.compacts(tenant) {
 					return nil
 				}
+				userID := t.routeUserBucket(bucketNameStr)
 				fetchStateMx.Lock()
 				defer fetchStateMx.Unlock()
-				tenantsToFetch[bucketNameStr] = struct{}{}
+				if _, ok := tenantsToFetch[userID]; !ok && userID != tenant {
+					level.Warn(idxSet.GetLogger()).Log("msg", "found index for invalid tenant, routing it to quarantine bucket", "tenant", tenant, "quarantine_bucket", userID)
+				}
+				tenantsToFetch[userID] = struct{}{}
 				return nil
 			})
 		})
@@ -393,63 +1127,292 @@ func (t *tableCompactor) compactCommonIndexes(ctx context.Context) (*CompactedIn
 	})
 
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to fetch index files and extract tenants: ")
+		return nil, consumedFilesStats{}, errors.Wrap(err, "unable to fetch index files and extract tenants: ")
 	}
 
+	consumedFiles.UserBuckets = len(tenantsToFetch)
 	tenantIdsSlice := make([]string, 0, len(tenantsToFetch))
 	for tenant := range tenantsToFetch {
+		// the compacted files of users recorded in the checkpoint are already open.
+		if _, ok := t.userCompactedIndexSet.get(tenant); ok {
+			continue
+		}
+		// entries could get moved out of the buckets by Options.TransformEntry, so only create indexes of
+		// new users while merging once entries get written to them to not upload empty indexes.
+		if _, ok := t.existingUserIndexSet[tenant]; !ok && t.opts.TransformEntry != nil {
+			continue
+		}
 		tenantIdsSlice = append(tenantIdsSlice, tenant)
 	}
 
 	err = concurrency.ForEachJob(ctx, len(tenantIdsSlice), readDBsConcurrency, func(ctx context.Context, idx int) error {
 		userID := tenantIdsSlice[idx]
-		return t.fetchOrCreateUserCompactedIndexSet(userID)
+		return t.fetchOrCreateUserCompactedIndexSet(ctx, userID)
 	})
 
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to fetch tenant seed index: ")
+		return nil, consumedFilesStats{}, errors.Wrap(err, "unable to fetch tenant seed index: ")
+	}
+
+	filesToMerge := 0
+	for i := range indexes {
+		if i != compactedFileIdx && !checkpoint.isConsumed(indexes[i].Name) {
+			filesToMerge++
+		}
+	}
+	progress := t.newProgressReporter(filesToMerge)
+
+	var consumedBeforeMerge []string
+	if checkpoint != nil {
+		consumedBeforeMerge = append(consumedBeforeMerge, checkpoint.ConsumedFiles...)
 	}
+	if compactedFileIdx != -1 {
+		consumedBeforeMerge = append(consumedBeforeMerge, indexes[compactedFileIdx].Name)
+	}
+	if err := seedGuard.checkConsumed(consumedBeforeMerge); err != nil {
+		return nil, consumedFilesStats{}, err
+	}
+	checkpoints := t.newCheckpointer(idxSet, indexes, compactedFile.Path(), consumedBeforeMerge)
+
+	mergeStart := time.Now()
+	t.phaseTimings.Prefetch += mergeStart.Sub(prefetchStart)
+	defer func() {
+		t.phaseTimings.CommonMerge += time.Since(mergeStart)
+	}()
 
+	accounting := newSourceFilesAccounting(len(indexes))
 	// go through each file and build index in FORMAT1 from FORMAT1 indexes and FORMAT3 from FORMAT2 indexes
-	err = concurrency.ForEachJob(ctx, len(indexes), readDBsConcurrency, func(ctx context.Context, idx int) error {
+	err = concurrency.ForEachJob(ctx, len(indexes), t.mergeConcurrency(), func(ctx context.Context, idx int) error {
 		workNum := idx
-		// skip seed file
-		if workNum == compactedFileIdx {
+		// skip seed file and files consumed before the checkpoint
+		if skip, err := seedGuard.skip(workNum, indexes[workNum].Name); err != nil || skip {
+			if skip && seedDiscarded {
+				accounting.skipped.Inc()
+			} else if skip {
+				accounting.seed.Inc()
+			}
+			return err
+		}
+		if checkpoint.isConsumed(indexes[workNum].Name) {
+			accounting.checkpointed.Inc()
 			return nil
 		}
 		// not locking the mutex here since there should be no writers at this point
 		downloadedDB := dbsToRead[workNum]
+		if downloadedDB.db == nil {
+			// skipped corrupt or empty source file
+			accounting.skipped.Inc()
+			progress.fileDone()
+			return checkpoints.fileDone(indexes[workNum].Name)
+		}
+		if err := seedGuard.checkRead(indexes[workNum].Name, downloadedDB, compactedFile.Path()); err != nil {
+			return err
+		}
+		if err := t.waitWhilePaused(ctx, idxSet.GetLogger()); err != nil {
+			return err
+		}
+		t.heartbeat()
+		t.metrics.compactTablesReadConcurrency.Inc()
+		defer t.metrics.compactTablesReadConcurrency.Dec()
+
+		routing := t.newBucketRouting()
+		fileMetrics := t.newTenantFileMetrics()
+		fileTx := t.newSourceFileTx()
+		defer fileTx.rollback()
+		writeBatch := func(bucketName string, batch []indexEntry) error {
+			batch = t.applyRetention(batch)
+			tenant := t.normalizeUserBucket(bucketName)
+			if !t.tenantFilter.compacts(tenant) {
+				// keep the entries in the common index as is for compacting them once the tenant gets selected.
+				routing.route("", len(batch))
+				return t.writeBatchToBucket(fileTx, compactedFile, bucketName, batch)
+			}
 
-		err = readFile(idxSet.GetLogger(), downloadedDB, func(bucketName string, batch []indexEntry) error {
 			indexFile := compactedFile
+			routedUserID := ""
 			if bucketName != shipper_util.GetUnsafeString(local.IndexBucketName) {
-				t.userCompactedIndexSetMtx.RLock()
-				userIndexSet, ok := t.userCompactedIndexSet[bucketName]
-				t.userCompactedIndexSetMtx.RUnlock()
+				userID := t.routeUserBucket(bucketName)
+				if userID != tenant {
+					t.metrics.compactTablesInvalidTenantEntries.Add(float64(len(batch)))
+				}
+
+				userIndexSet, ok := t.userCompactedIndexSet.get(userID)
+				if !ok && t.movesEntriesToUsers() {
+					if err := t.fetchOrCreateTransformedUserCompactedIndexSet(ctx, userID); err != nil {
+						return err
+					}
+					userIndexSet, ok = t.userCompactedIndexSet.get(userID)
+				}
 				if !ok || userIndexSet.compactedIndex == nil {
-					return fmt.Errorf("index set for user %s is not initialized", bucketName)
+					return errors.Wrapf(ErrUserIndexRequestedDuringCompaction, "user %s", userID)
 				}
 
 				indexFile = userIndexSet.compactedIndex.compactedFile
+				if err := t.userIndexLimit.add(idxSet.GetLogger(), userID, batch); err != nil {
+					return err
+				}
+				t.tenantUsage.add(userID, batch)
+				fileMetrics.add(userID, batch)
+				routedUserID = userID
 			}
 
-			return writeBatch(indexFile, batch)
+			routing.route(routedUserID, len(batch))
+			return t.writeBatch(fileTx, indexFile, batch)
+		}
+
+		err := t.doWithProfilingLabels(ctx, profilingPhaseCommonMerge, func(_ context.Context) error {
+			return t.readSourceFile(ctx, idxSet.GetLogger(), downloadedDB, func(bucketName string, batch []indexEntry) error {
+				routing.addBucket(bucketName)
+				return t.transformBatch(bucketName, batch, func(bucketName string, batch []indexEntry) error {
+					return t.splitCommonIndexBatch(bucketName, batch, writeBatch)
+				})
+			})
 		})
-		return nil
+		if err != nil {
+			return err
+		}
+		if err := fileTx.commit(); err != nil {
+			return err
+		}
+
+		routing.log(idxSet.GetLogger(), indexes[workNum].Name)
+		fileMetrics.done()
+		accounting.merged.Inc()
+		progress.fileDone()
+		return checkpoints.fileDone(indexes[workNum].Name)
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, consumedFilesStats{}, err
+	}
+	if err := accounting.check(idxSet.GetLogger(), t.opts.VerifySourceFilesAccounting); err != nil {
+		return nil, consumedFilesStats{}, err
+	}
+	if err := checkpoints.remove(); err != nil {
+		return nil, consumedFilesStats{}, err
+	}
+
+	return t.newCompactedIndex(compactedFile, idxSet), consumedFiles, nil
+}
+
+// downloadSourceFile downloads the given source file of the index set of a user, or of the common index for an empty user id,
+// and opens it for reading. The returned downloadedDb must be cleaned up even when it fails to open the file.
+// A corrupt source file skipped as per Options.SkipCorruptSourceFiles, or an empty one, is returned without a db and without an error.
+func (t *tableCompactor) downloadSourceFile(ctx context.Context, userID string, idxSet compactor.IndexSet, sourceFile storage.IndexFile) (downloadedDb, error) {
+	if err := t.readPacer.wait(ctx); err != nil {
+		return downloadedDb{}, err
+	}
+	downloadAt, err := t.getSourceFile(idxSet, sourceFile)
+	if err != nil {
+		if t.skipCorruptSourceFile(userID, idxSet, sourceFile, err) {
+			return downloadedDb{}, nil
+		}
+		return downloadedDb{}, err
+	}
+	if skip, err := t.skipEmptySourceFile(idxSet, sourceFile, downloadAt); err != nil {
+		return downloadedDb{path: downloadAt}, err
+	} else if skip {
+		return downloadedDb{}, nil
+	}
+	dbPair := downloadedDb{
+		path: downloadAt,
+	}
+
+	db, err := t.openSourceBoltdbFile(downloadAt)
+	if err != nil {
+		if isCorruptBoltdbOpenErr(err) {
+			err = newCorruptSourceFileError(sourceFile.Name, err)
+		}
+		if t.skipCorruptSourceFile(userID, idxSet, sourceFile, err) {
+			dbPair.cleanup(idxSet.GetLogger())
+			return downloadedDb{}, nil
+		}
+		return dbPair, err
+	}
+	dbPair.db = db
+
+	if err := t.validateSourceSchema(idxSet, db, sourceFile.Name); err != nil {
+		return dbPair, err
+	}
+
+	return dbPair, nil
+}
+
+// listSourceFiles returns the source files of the given index set, sorted by name when Options.DeterministicOutput is set.
+func (t *tableCompactor) listSourceFiles(idxSet compactor.IndexSet) []storage.IndexFile {
+	sourceFiles := idxSet.ListSourceFiles()
+	if !t.opts.DeterministicOutput {
+		return sourceFiles
+	}
+
+	sorted := make([]storage.IndexFile, len(sourceFiles))
+	copy(sorted, sourceFiles)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted
+}
+
+// mergeConcurrency returns the number of source files to merge concurrently into compacted files.
+// Files are merged one at a time when Options.DeterministicOutput is set to keep the order of writes the same across runs.
+func (t *tableCompactor) mergeConcurrency() int {
+	if t.opts.DeterministicOutput {
+		return 1
 	}
 
-	return newCompactedIndex(compactedFile, idxSet.GetTableName(), workingDir, t.periodConfig, idxSet.GetLogger()), nil
+	return readDBsConcurrency
 }
 
-// compactedFileIdx returns index of previously compacted file(which starts with uploaderName).
+// writeBatch writes the batch to the given compacted file, in the transaction of the given sourceFileTx if not nil.
+// Batches are written in their own transaction when Options.DeterministicOutput is set since coalescing them depends on timing.
+func (t *tableCompactor) writeBatch(fileTx *sourceFileTx, indexFile *bbolt.DB, batch []indexEntry) error {
+	return t.writeDedupedBatch(indexFile, string(local.IndexBucketName), batch, func(batch []indexEntry) error {
+		if fileTx != nil {
+			return fileTx.put(indexFile, local.IndexBucketName, batch)
+		}
+		if t.opts.DeterministicOutput {
+			return writeBatchInOwnTx(indexFile, t.opts.compactedFileFillPercent(), batch)
+		}
+
+		return writeBatch(indexFile, t.opts.compactedFileFillPercent(), batch)
+	})
+}
+
+// writeBatchToBucket is like writeBatch but writes the batch to the given bucket of the compacted file.
+func (t *tableCompactor) writeBatchToBucket(fileTx *sourceFileTx, indexFile *bbolt.DB, bucketName string, batch []indexEntry) error {
+	write := indexFile.Batch
+	if t.opts.DeterministicOutput {
+		write = indexFile.Update
+	}
+
+	return t.writeDedupedBatch(indexFile, bucketName, batch, func(batch []indexEntry) error {
+		if fileTx != nil {
+			return fileTx.put(indexFile, []byte(bucketName), batch)
+		}
+		return write(func(tx *bbolt.Tx) error {
+			return putBatchInBucket(tx, []byte(bucketName), t.opts.compactedFileFillPercent(), batch)
+		})
+	})
+}
+
+// sortedUserIDs returns the user ids from the given map in sorted order.
+// It is used for processing users deterministically which makes the logs and failures reproducible across runs.
+func sortedUserIDs[V any](m map[string]V) []string {
+	userIDs := make([]string, 0, len(m))
+	for userID := range m {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	return userIDs
+}
+
+// compactedFileIdx returns index of previously compacted file(which starts with one of the given uploader names).
 // If it can't find a previously compacted file, it would return -1.
-func compactedFileIdx(commonIndexes []storage.IndexFile) int {
+func compactedFileIdx(commonIndexes []storage.IndexFile, uploaderNames []string) int {
 	for i, file := range commonIndexes {
-		if strings.HasPrefix(file.Name, uploaderName) {
+		if isCompactedFile(file.Name, uploaderNames) {
 			return i
 		}
 	}
@@ -457,75 +1420,185 @@ func compactedFileIdx(commonIndexes []storage.IndexFile) int {
 	return -1
 }
 
+// isCompactedFile returns true if the name of a source file starts with one of the given uploader names.
+func isCompactedFile(name string, uploaderNames []string) bool {
+	for _, uploaderName := range uploaderNames {
+		if strings.HasPrefix(name, uploaderName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openSourceBoltdbFile opens a source file for reading its index with the bbolt options configured for source files.
+func (t *tableCompactor) openSourceBoltdbFile(path string) (*bbolt.DB, error) {
+	return openBoltdbFileWithNoSyncAndOptions(path, &bbolt.Options{
+		Timeout:   t.opts.boltdbOpenTimeout(),
+		MmapFlags: t.opts.SourceFileMmapFlags,
+	})
+}
+
 // openBoltdbFileWithNoSync opens a boltdb file and configures it to not sync the file to disk.
 // Compaction process is idempotent and we do not retain the files so there is no need to sync them to disk.
 func openBoltdbFileWithNoSync(path string) (*bbolt.DB, error) {
-	boltdb, err := shipper_util.SafeOpenBoltdbFile(path)
+	return openBoltdbFileWithNoSyncAndOptions(path, nil)
+}
+
+// openBoltdbFileWithNoSyncAndOptions is like openBoltdbFileWithNoSync but opens the file with the given bbolt options.
+// Default options are used when options is nil.
+func openBoltdbFileWithNoSyncAndOptions(path string, options *bbolt.Options) (*bbolt.DB, error) {
+	return openBoltdbFileWithOptions(path, options, true)
+}
+
+// openBoltdbFileWithOptions opens a boltdb file with the given bbolt options and configures whether to skip syncing the file
+// to disk on each commit. Default options are used when options is nil.
+func openBoltdbFileWithOptions(path string, options *bbolt.Options, noSync bool) (*bbolt.DB, error) {
+	if err := ensureRegularFileOrNotExist(path); err != nil {
+		return nil, err
+	}
+
+	var (
+		boltdb *bbolt.DB
+		err    error
+	)
+	if options == nil {
+		boltdb, err = shipper_util.SafeOpenBoltdbFile(path)
+	} else {
+		boltdb, err = shipper_util.SafeOpenBoltdbFileWithOptions(path, options)
+	}
+	if errors.Is(err, bbolt.ErrTimeout) {
+		timeout := defaultBoltdbOpenTimeout
+		if options != nil {
+			timeout = options.Timeout
+		}
+		return nil, errors.Wrapf(err, "failed to acquire the lock of boltdb file %s within %s, it is likely open by another process", path, timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// no need to enforce write to disk, we'll upload and delete the file anyway.
-	boltdb.NoSync = true
+	// usually no need to enforce write to disk, we'll upload and delete the file anyway.
+	boltdb.NoSync = noSync
 
 	return boltdb, nil
 }
 
-// readFile reads an index file and sends batch of index to writeBatch func.
-func readFile(logger log.Logger, db downloadedDb, writeBatch func(userID string, batch []indexEntry) error) error {
-	batch := make([]indexEntry, 0, batchSize)
+// ensureRegularFileOrNotExist returns an error if the path exists and is not a regular file, like a directory or a symlink.
+// Opening such paths as boltdb files has undefined behaviour.
+// A non-existent path is allowed since boltdb would create a new file for it.
+func ensureRegularFileOrNotExist(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("can't open %s as boltdb file since it is not a regular file, mode: %s", path, fi.Mode().Type())
+	}
+
+	return nil
+}
+
+// readFile reads an index file and sends batch of index to writeBatch func, with the batches sized by the given batchSizer.
+func readFile(logger log.Logger, db downloadedDb, sizer *batchSizer, writeBatch func(userID string, batch []indexEntry) error) error {
+	return readFileSkippingBuckets(logger, db, sizer, writeBatch, nil)
+}
+
+// readFileSkippingBuckets is like readFile, but skips the buckets failing to be read when skipBucket is set instead of failing,
+// after passing it the error recovered from reading the bucket, like the faults of reading a corrupt page. The entries of a
+// skipped bucket read before the failure are still written. Failures of writeBatch always fail the reading of the file.
+func readFileSkippingBuckets(logger log.Logger, db downloadedDb, sizer *batchSizer, writeBatch func(userID string, batch []indexEntry) error, skipBucket func(bucketName string, err error)) error {
+	batch := make([]indexEntry, 0, sizer.limit())
 
 	return db.db.View(func(tx *bbolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
 			batch = batch[:0]
+			sizer.reset()
 			bucketNameStr := string(name)
-			err := b.ForEach(func(k, v []byte) error {
-				ie := indexEntry{
-					k: make([]byte, len(k)),
-					v: make([]byte, len(v)),
-				}
+			if isMetaBucket(bucketNameStr) {
+				return nil
+			}
+			if skipBucket == nil {
+				return readBucket(b, bucketNameStr, batch, sizer, writeBatch)
+			}
+
+			err := readBucketRecovering(b, bucketNameStr, batch, sizer, writeBatch)
+			var readErr *bucketReadError
+			if errors.As(err, &readErr) {
+				level.Warn(logger).Log("msg", "skipping bucket of source file which failed to be read", "file", db.path, "bucket", bucketNameStr, "err", readErr.err)
+				skipBucket(bucketNameStr, readErr.err)
+				return nil
+			}
+			return err
+		})
+	})
+}
 
-				// make a copy since k, v are only valid for the life of the transaction.
-				// See: https://godoc.org/github.com/boltdb/bolt#Cursor.Seek
-				copy(ie.k, k)
-				copy(ie.v, v)
+// bucketReadError is the error recovered from reading a bucket of a source file, as opposed to the errors of writing its batches.
+type bucketReadError struct {
+	err error
+}
 
-				batch = append(batch, ie)
+func (e *bucketReadError) Error() string {
+	return e.err.Error()
+}
 
-				if len(batch) == cap(batch) {
-					// batch is full, write the batch and create a new one.
-					err := writeBatch(bucketNameStr, batch)
-					if err != nil {
-						return err
-					}
-					batch = batch[:0]
-				}
+// readBucketRecovering is like readBucket, but recovers from the panics and faults of reading the bucket, returned as a bucketReadError.
+// Panics while writing batches are not recovered from.
+func readBucketRecovering(b *bbolt.Bucket, bucketName string, batch []indexEntry, sizer *batchSizer, writeBatch func(userID string, batch []indexEntry) error) (err error) {
+	writing := false
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if writing {
+				panic(r)
+			}
+			err = &bucketReadError{err: fmt.Errorf("recovered from panic reading bucket %s: %v", bucketName, r)}
+		}
+	}()
 
-				return nil
-			})
+	return readBucket(b, bucketName, batch, sizer, func(bucketName string, batch []indexEntry) error {
+		writing = true
+		defer func() { writing = false }()
+		return writeBatch(bucketName, batch)
+	})
+}
+
+// readBucket sends the entries of the given bucket to writeBatch in batches as per the sizer, reusing the given batch.
+func readBucket(b *bbolt.Bucket, bucketName string, batch []indexEntry, sizer *batchSizer, writeBatch func(userID string, batch []indexEntry) error) error {
+	err := b.ForEach(func(k, v []byte) error {
+		ie := indexEntry{
+			k: make([]byte, len(k)),
+			v: make([]byte, len(v)),
+		}
+
+		// make a copy since k, v are only valid for the life of the transaction.
+		// See: https://godoc.org/github.com/boltdb/bolt#Cursor.Seek
+		copy(ie.k, k)
+		copy(ie.v, v)
+
+		batch = append(batch, ie)
+
+		if sizer.add(len(batch), ie) {
+			// batch is full, write the batch and create a new one.
+			err := writeBatch(bucketName, batch)
 			if err != nil {
 				return err
 			}
+			batch = batch[:0]
+			sizer.reset()
+		}
 
-			// write the remaining batch which might have been left unwritten due to it not being full yet.
-			return writeBatch(bucketNameStr, batch)
-		})
+		return nil
 	})
-}
-
-// mustRecreateCompactedDB returns true if the compacted db should be recreated
-func mustRecreateCompactedDB(sourceFiles []storage.IndexFile) bool {
-	if len(sourceFiles) != 1 {
-		// do not recreate if there are multiple source files
-		return false
-	} else if !strings.HasPrefix(sourceFiles[0].Name, uploaderName) {
-		// do not recreate if the only file we have is not the compacted one
-		return false
-	} else if time.Since(sourceFiles[0].ModifiedAt) < recreateCompactedDBOlderThan {
-		// do not recreate if the source file is younger than the threshold
-		return false
+	if err != nil {
+		return err
 	}
 
-	// recreate the compacted db only if we have not recreated it before
-	return !strings.Contains(sourceFiles[0].Name, recreatedCompactedDBSuffix)
+	// write the remaining batch which might have been left unwritten due to it not being full yet.
+	return writeBatch(bucketName, batch)
 }
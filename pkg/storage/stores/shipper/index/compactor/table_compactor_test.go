@@ -2,19 +2,27 @@ package compactor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/bbolt"
+	"go.uber.org/atomic"
 
 	"github.com/grafana/loki/pkg/storage/chunk/client"
 	"github.com/grafana/loki/pkg/storage/chunk/client/local"
@@ -22,6 +30,8 @@ import (
 	"github.com/grafana/loki/pkg/storage/config"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/compactor"
 	"github.com/grafana/loki/pkg/storage/stores/indexshipper/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/index/compactor/compactortest"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/index/indexfile"
 	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
 	util_log "github.com/grafana/loki/pkg/util/log"
 )
@@ -45,6 +55,9 @@ type mockIndexSet struct {
 	objectClient      client.ObjectClient
 	compactedIndex    compactor.CompactedIndex
 	removeSourceFiles bool
+
+	// setCompactedIndexErr, when set, is returned by SetCompactedIndex for injecting failures.
+	setCompactedIndexErr error
 }
 
 func newMockIndexSet(userID, tableName, workingDir string, objectClient client.ObjectClient) (compactor.IndexSet, error) {
@@ -89,8 +102,8 @@ func (m *mockIndexSet) GetSourceFile(indexFile storage.IndexFile) (string, error
 		dst = strings.Trim(dst, ".gz")
 	}
 
-	err := storage.DownloadFileFromStorage(dst, storage.IsCompressedFile(indexFile.Name),
-		false, storage.LoggerWithFilename(util_log.Logger, indexFile.Name),
+	err := storage.DownloadFileFromStorageWithLimit(dst, storage.IsCompressedFile(indexFile.Name),
+		false, 0, indexFile.Size, storage.LoggerWithFilename(util_log.Logger, indexFile.Name),
 		func() (io.ReadCloser, error) {
 			rc, _, err := m.objectClient.GetObject(context.Background(), path.Join(m.tableName, m.userID, indexFile.Name))
 			return rc, err
@@ -112,6 +125,9 @@ func (m *mockIndexSet) GetWorkingDir() string {
 }
 
 func (m *mockIndexSet) SetCompactedIndex(compactedIndex compactor.CompactedIndex, removeSourceFiles bool) error {
+	if m.setCompactedIndexErr != nil {
+		return m.setCompactedIndexErr
+	}
 	m.compactedIndex = compactedIndex
 	m.removeSourceFiles = removeSourceFiles
 	return nil
@@ -302,7 +318,7 @@ func TestTable_Compaction(t *testing.T) {
 
 					tCompactor := newTableCompactor(context.Background(), commonIndexSet, existingUserIndexSets, func(userID string) (compactor.IndexSet, error) {
 						return newMockIndexSet(userID, tableName, filepath.Join(tableWorkingDirectory, userID), objectClient)
-					}, config.PeriodConfig{})
+					}, config.PeriodConfig{}, Options{}, newMetrics(nil))
 
 					require.NoError(t, tCompactor.CompactTable())
 
@@ -321,7 +337,7 @@ func TestTable_Compaction(t *testing.T) {
 					}
 
 					if perUserDBsConfig.NumCompactedDBs+perUserDBsConfig.NumUnCompactedDBs > 1 {
-						require.Equal(t, numUsers, len(tCompactor.userCompactedIndexSet))
+						require.Equal(t, numUsers, len(tCompactor.userCompactedIndexSet.all()))
 					}
 
 					// make sure we have same data after compaction
@@ -331,7 +347,7 @@ func TestTable_Compaction(t *testing.T) {
 					if compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex; compactedIndex != nil {
 						compactedIndex.Cleanup()
 					}
-					for _, cui := range tCompactor.userCompactedIndexSet {
+					for _, cui := range tCompactor.userCompactedIndexSet.all() {
 						cui.compactedIndex.Cleanup()
 					}
 				})
@@ -345,7 +361,9 @@ func TestTable_RecreateCompactedDB(t *testing.T) {
 		dbCount                   int
 		compactedDBMtime          time.Time
 		alreadyRecreated          bool
+		opts                      Options
 		shouldRecreateCompactedDB bool
+		shouldSkipRecreate        bool
 	}{
 		// must not recreate compacted db test cases:
 		"more than 1 file in table": {
@@ -353,18 +371,48 @@ func TestTable_RecreateCompactedDB(t *testing.T) {
 		},
 		"compacted db not old enough": {
 			dbCount:          1,
-			compactedDBMtime: time.Now().Add(-recreateCompactedDBOlderThan / 2),
+			compactedDBMtime: time.Now().Add(-defaultRecreateCompactedDBOlderThan / 2),
 		},
 		"compacted db old enough but already recreated": {
 			dbCount:          1,
-			compactedDBMtime: time.Now().Add(-(recreateCompactedDBOlderThan + time.Minute)),
+			compactedDBMtime: time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute)),
 			alreadyRecreated: true,
 		},
+		"compacted db not old enough with a higher threshold": {
+			dbCount:          1,
+			compactedDBMtime: time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute)),
+			opts:             Options{RecreateCompactedDBOlderThan: 2 * defaultRecreateCompactedDBOlderThan},
+		},
+		"compacted db old enough of excluded table": {
+			dbCount:          1,
+			compactedDBMtime: time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute)),
+			opts: Options{ExcludeFromRecreate: func(name, _ string) bool {
+				return name == fmt.Sprintf("%s12345", tableName)
+			}},
+		},
+		"compacted db old enough with too little to reclaim": {
+			dbCount:            1,
+			compactedDBMtime:   time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute)),
+			opts:               Options{RecreateMinReclaimableBytes: 1 << 30},
+			shouldSkipRecreate: true,
+		},
 
 		// must recreate compacted db test cases
 		"compacted db old enough": {
 			dbCount:                   1,
-			compactedDBMtime:          time.Now().Add(-(recreateCompactedDBOlderThan + time.Minute)),
+			compactedDBMtime:          time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute)),
+			shouldRecreateCompactedDB: true,
+		},
+		"compacted db old enough with a lower threshold": {
+			dbCount:                   1,
+			compactedDBMtime:          time.Now().Add(-2 * time.Hour),
+			opts:                      Options{RecreateCompactedDBOlderThan: time.Hour},
+			shouldRecreateCompactedDB: true,
+		},
+		"compacted db old enough with a small tx size": {
+			dbCount:                   1,
+			compactedDBMtime:          time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute)),
+			opts:                      Options{DropFreePagesTxMaxSize: 1024},
 			shouldRecreateCompactedDB: true,
 		},
 	} {
@@ -431,28 +479,42 @@ func TestTable_RecreateCompactedDB(t *testing.T) {
 
 			tCompactor := newTableCompactor(context.Background(), commonIndexSet, existingUserIndexSets, func(userID string) (compactor.IndexSet, error) {
 				return newMockIndexSet(userID, tableName, filepath.Join(tableWorkingDirectory, userID), objectClient)
-			}, config.PeriodConfig{})
+			}, config.PeriodConfig{}, tt.opts, newMetrics(nil))
 
 			require.NoError(t, tCompactor.CompactTable())
+			require.Equal(t, 1, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesDurationSeconds))
 
 			if tt.shouldRecreateCompactedDB {
 				require.True(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFileRecreated)
-				for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet {
+				for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet.all() {
 					require.True(t, userCompactedIndexSet.compactedIndex.compactedFileRecreated)
 				}
+				// reclaimed bytes are recorded for both common and per user index while the small test dbs may not shrink
+				require.Equal(t, 2, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesRecreateReclaimedBytes))
 
 				// ensure that we have right data in db after recreation
 				compareCompactedTable(t, tablePathInStorage, tCompactor)
+			} else if tt.shouldSkipRecreate {
+				// the dbs are uploaded as is, named like recreated ones for not considering them again.
+				commonCompactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+				require.False(t, commonCompactedIndex.compactedFileRecreated)
+				require.True(t, commonCompactedIndex.recreateSkipped)
+				for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet.all() {
+					require.False(t, userCompactedIndexSet.compactedIndex.compactedFileRecreated)
+					require.True(t, userCompactedIndexSet.compactedIndex.recreateSkipped)
+				}
+				require.Equal(t, float64(11), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRecreateSkipped))
+				require.Equal(t, 0, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesRecreateReclaimedBytes))
 			} else if tt.dbCount <= 1 {
 				require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
-				uploadedCompactedIndexSets := make([]*compactedIndexSet, 0, len(tCompactor.userCompactedIndexSet))
-				for _, is := range tCompactor.userCompactedIndexSet {
+				uploadedCompactedIndexSets := make([]*compactedIndexSet, 0, len(tCompactor.userCompactedIndexSet.all()))
+				for _, is := range tCompactor.userCompactedIndexSet.all() {
 					uploadedCompactedIndexSets = append(uploadedCompactedIndexSets, is)
 				}
 				require.Len(t, uploadedCompactedIndexSets, 0)
 			} else {
 				require.False(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFileRecreated)
-				for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet {
+				for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet.all() {
 					require.False(t, userCompactedIndexSet.compactedIndex.compactedFileRecreated)
 				}
 			}
@@ -461,13 +523,1273 @@ func TestTable_RecreateCompactedDB(t *testing.T) {
 			if compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex; compactedIndex != nil {
 				compactedIndex.Cleanup()
 			}
-			for _, cui := range tCompactor.userCompactedIndexSet {
+			for _, cui := range tCompactor.userCompactedIndexSet.all() {
 				cui.compactedIndex.Cleanup()
 			}
 		})
 	}
 }
 
+func TestTable_TenantUsageCallback(t *testing.T) {
+	numUsers := 5
+	commonDBsConfig := testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}
+	perUserDBsConfig := testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}
+
+	var (
+		reportedTableName string
+		reportedUsage     map[string]TenantUsage
+	)
+	tCompactor := setupTableCompactor(t, commonDBsConfig, perUserDBsConfig, Options{
+		TenantUsageCallback: func(tableName string, usage map[string]TenantUsage) {
+			reportedTableName = tableName
+			reportedUsage = usage
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	require.Equal(t, tableName, reportedTableName)
+	require.Len(t, reportedUsage, numUsers)
+	for i := 0; i < numUsers; i++ {
+		usage, ok := reportedUsage[testutil.BuildUserID(i)]
+		require.True(t, ok)
+		// each user has 100 records in each of the 2 uncompacted dbs
+		require.Equal(t, int64(200), usage.Entries)
+		require.Greater(t, usage.Bytes, int64(0))
+	}
+}
+
+func TestIndexCompactor_RemovedSourceFilesCallback(t *testing.T) {
+	var (
+		reportedTableName string
+		reportedFiles     map[string][]string
+		reportedErr       error
+	)
+	indexCompactor := newTestIndexCompactor(t, Options{
+		RemovedSourceFilesCallback: func(tableName string, removedSourceFiles map[string][]string, err error) {
+			reportedTableName = tableName
+			reportedFiles = removedSourceFiles
+			reportedErr = err
+		},
+	})
+
+	// the files removed by the compactor are reported along with the error the compaction of the table failed with.
+	observer, ok := indexCompactor.(compactor.TableCompactionObserver)
+	require.True(t, ok)
+	removed := map[string][]string{"": {"0", "1"}, "user1": {"2"}}
+	errRemoval := errors.New("failed to remove file")
+	observer.TableCompactionDone(tableName, removed, errRemoval)
+	require.Equal(t, tableName, reportedTableName)
+	require.Equal(t, removed, reportedFiles)
+	require.ErrorIs(t, reportedErr, errRemoval)
+
+	// it is a noop without a callback.
+	newTestIndexCompactor(t, Options{}).(compactor.TableCompactionObserver).TableCompactionDone(tableName, removed, nil)
+}
+
+func TestTable_SetCompactedIndexAuditFunc(t *testing.T) {
+	type audit struct {
+		tableName   string
+		sourceFiles []string
+		upload      bool
+	}
+
+	numUsers := 3
+	var (
+		auditsMtx sync.Mutex
+		audits    = map[string]audit{}
+	)
+	// the common index only has user buckets, so it gets compacted away to the user indexes.
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{
+		FinalizeConcurrency: numUsers,
+		SetCompactedIndexAuditFunc: func(tableName, userID string, sourceFiles []string, upload bool) {
+			auditsMtx.Lock()
+			defer auditsMtx.Unlock()
+			audits[userID] = audit{tableName: tableName, sourceFiles: sourceFiles, upload: upload}
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	expectedAudits := map[string]audit{
+		"": {tableName: tableName, sourceFiles: sourceFileNames(tCompactor.commonIndexSet)},
+	}
+	for i := 0; i < numUsers; i++ {
+		userID := testutil.BuildUserID(i)
+		expectedAudits[userID] = audit{tableName: tableName, sourceFiles: []string{}, upload: true}
+	}
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, expectedAudits, audits)
+	require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+}
+
+func TestTable_DryRun(t *testing.T) {
+	numUsers := 5
+	commonDBsConfig := testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}
+	perUserDBsConfig := testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   1,
+		},
+		NumUsers: numUsers,
+	}
+
+	var (
+		reportedTableName string
+		report            DryRunReport
+	)
+	tCompactor := setupTableCompactor(t, commonDBsConfig, perUserDBsConfig, Options{
+		DryRunCallback: func(tableName string, r DryRunReport) {
+			reportedTableName = tableName
+			report = r
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	expectedSourceFiles := map[string][]string{
+		"": sourceFileNames(tCompactor.commonIndexSet),
+	}
+	for i := 0; i < numUsers; i++ {
+		userID := testutil.BuildUserID(i)
+		expectedSourceFiles[userID] = sourceFileNames(tCompactor.existingUserIndexSet[userID])
+	}
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.Equal(t, tableName, reportedTableName)
+	require.Len(t, report.IndexSets, numUsers+1)
+
+	for userID, expected := range expectedSourceFiles {
+		sort.Strings(expected)
+		require.Equal(t, expected, report.IndexSets[userID].SourceFiles)
+		require.True(t, report.IndexSets[userID].Upload)
+		require.False(t, report.IndexSets[userID].Recreated)
+		require.Positive(t, report.IndexSets[userID].RewrittenBytes)
+	}
+	require.Positive(t, report.RewrittenBytes())
+
+	// compacted indexes should not be set for any of the index sets
+	require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+	for userID, idxSet := range tCompactor.existingUserIndexSet {
+		require.Nil(t, idxSet.(*mockIndexSet).compactedIndex, userID)
+	}
+
+	// the compactor skips retention and leaves the storage untouched in dry run mode.
+	dryRun, ok := newTestIndexCompactor(t, Options{DryRunCallback: func(string, DryRunReport) {}}).(compactor.DryRunIndexCompactor)
+	require.True(t, ok)
+	require.True(t, dryRun.DryRun())
+	require.False(t, newTestIndexCompactor(t, Options{}).(compactor.DryRunIndexCompactor).DryRun())
+}
+
+func sourceFileNames(idxSet compactor.IndexSet) []string {
+	var names []string
+	for _, sourceFile := range idxSet.ListSourceFiles() {
+		names = append(names, sourceFile.Name)
+	}
+
+	return names
+}
+
+// failingSetCompactedIndexSet fails all the SetCompactedIndex calls.
+type failingSetCompactedIndexSet struct {
+	compactor.IndexSet
+}
+
+func (f failingSetCompactedIndexSet) SetCompactedIndex(_ compactor.CompactedIndex, _ bool) error {
+	return errors.New("failed to set compacted index")
+}
+
+func TestOpenBoltdbFileWithNoSync_NonRegularFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// directory
+	_, err := openBoltdbFileWithNoSync(tempDir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a regular file")
+
+	// symlink to a regular file
+	dbPath := filepath.Join(tempDir, "db")
+	db, err := openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	symlinkPath := filepath.Join(tempDir, "symlink")
+	require.NoError(t, os.Symlink(dbPath, symlinkPath))
+	_, err = openBoltdbFileWithNoSync(symlinkPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a regular file")
+
+	// existing regular file
+	db, err = openBoltdbFileWithNoSync(dbPath)
+	require.NoError(t, err)
+	require.True(t, db.NoSync)
+	require.NoError(t, db.Close())
+}
+
+func TestOpenBoltdbFileWithOptions_NoSync(t *testing.T) {
+	for _, noSync := range []bool{true, false} {
+		t.Run(fmt.Sprintf("noSync=%v", noSync), func(t *testing.T) {
+			db, err := openBoltdbFileWithOptions(filepath.Join(t.TempDir(), "db"), nil, noSync)
+			require.NoError(t, err)
+			require.Equal(t, noSync, db.NoSync)
+			require.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestBoltdbOpenTimeout(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "db")
+
+	// hold the lock of the file like another process would.
+	heldDB, err := bbolt.Open(dbPath, 0o666, nil)
+	require.NoError(t, err)
+	defer heldDB.Close()
+
+	opts := Options{BoltdbOpenTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err = newTestIndexCompactor(t, opts).OpenCompactedIndexFile(context.Background(), dbPath, tableName, "", tempDir, config.PeriodConfig{}, util_log.Logger)
+	require.ErrorIs(t, err, bbolt.ErrTimeout)
+	require.Contains(t, err.Error(), dbPath)
+	require.Less(t, time.Since(start), defaultBoltdbOpenTimeout)
+
+	_, err = newReadAheadTableCompactor(opts).openSourceBoltdbFile(dbPath)
+	require.ErrorIs(t, err, bbolt.ErrTimeout)
+
+	// the file opens once the lock gets released.
+	require.NoError(t, heldDB.Close())
+	db, err := newReadAheadTableCompactor(opts).openSourceBoltdbFile(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestTable_ScheduleGate(t *testing.T) {
+	commonDBsConfig := testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}
+	perUserDBsConfig := testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   2,
+		},
+		NumUsers: 5,
+	}
+
+	t.Run("deferred at start", func(t *testing.T) {
+		tCompactor := setupTableCompactor(t, commonDBsConfig, perUserDBsConfig, Options{
+			ScheduleGate: func(_ time.Time) bool {
+				return false
+			},
+		})
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+		require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+		require.False(t, tCompactor.commonIndexSet.(*mockIndexSet).removeSourceFiles)
+		require.Len(t, tCompactor.userCompactedIndexSet.all(), 0)
+		require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesDeferredSchedule))
+	})
+
+	t.Run("deferred after compacting common index", func(t *testing.T) {
+		calls := 0
+		tCompactor := setupTableCompactor(t, commonDBsConfig, perUserDBsConfig, Options{
+			ScheduleGate: func(_ time.Time) bool {
+				calls++
+				return calls == 1
+			},
+		})
+		defer cleanupTableCompactor(tCompactor)
+
+		// add a user which only has compacted files in storage and no updates in common index
+		userID := "non-updated-user"
+		tCompactor.existingUserIndexSet[userID] = &mockIndexSet{
+			userID:      userID,
+			tableName:   tableName,
+			sourceFiles: []storage.IndexFile{{Name: "compactor-1"}, {Name: "compactor-2"}},
+		}
+
+		require.NoError(t, tCompactor.CompactTable())
+
+		// in-flight work should have been completed
+		require.True(t, tCompactor.commonIndexSet.(*mockIndexSet).removeSourceFiles)
+		require.Len(t, tCompactor.userCompactedIndexSet.all(), perUserDBsConfig.NumUsers)
+		for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet.all() {
+			require.True(t, userCompactedIndexSet.IndexSet.(*mockIndexSet).removeSourceFiles)
+		}
+
+		// non-updated user index should have been left for the next run
+		require.NotContains(t, tCompactor.userCompactedIndexSet.all(), userID)
+		require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesDeferredSchedule))
+	})
+}
+
+func TestTable_CancelledBeforeSettingCompactedIndexes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel the compaction once the common index got compacted, like on shutdown.
+	calls := 0
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   1,
+		},
+		NumUsers: 5,
+	}, Options{
+		ScheduleGate: func(_ time.Time) bool {
+			calls++
+			if calls == 2 {
+				cancel()
+			}
+			return true
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+	tCompactor.ctx = ctx
+
+	require.ErrorIs(t, tCompactor.CompactTable(), context.Canceled)
+
+	// none of the compacted indexes got set, neither for the common index nor for the users.
+	require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+	require.False(t, tCompactor.commonIndexSet.(*mockIndexSet).removeSourceFiles)
+	require.NotEmpty(t, tCompactor.userCompactedIndexSet.all())
+	for _, userCompactedIndexSet := range tCompactor.userCompactedIndexSet.all() {
+		require.Nil(t, userCompactedIndexSet.IndexSet.(*mockIndexSet).compactedIndex)
+		require.False(t, userCompactedIndexSet.IndexSet.(*mockIndexSet).removeSourceFiles)
+	}
+}
+
+func TestTable_MinFreeDiskBytes(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		minFreeDiskBytes int64
+		expectDeferred   bool
+	}{
+		{name: "disabled"},
+		{name: "enough free space", minFreeDiskBytes: 1},
+		{name: "low free space", minFreeDiskBytes: math.MaxInt64, expectDeferred: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 2,
+			}, testutil.PerUserDBsConfig{}, Options{MinFreeDiskBytes: tc.minFreeDiskBytes})
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+			if tc.expectDeferred {
+				require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+				require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesDeferredLowDisk))
+			} else {
+				require.NotNil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+				require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesDeferredLowDisk))
+			}
+		})
+	}
+}
+
+func TestTable_FutureTableGracePeriod(t *testing.T) {
+	activeTableNumber := time.Now().Unix() / 86400
+	weeklyPeriodConfig := config.PeriodConfig{IndexTables: config.PeriodicTableConfig{Prefix: "index_", Period: 168 * time.Hour}}
+	activeWeeklyTableNumber := time.Now().Unix() / int64((168 * time.Hour).Seconds())
+	for _, tc := range []struct {
+		name          string
+		periodConfig  config.PeriodConfig
+		gracePeriod   time.Duration
+		tableName     string
+		expectSkipped bool
+	}{
+		{name: "active table", gracePeriod: 24 * time.Hour, tableName: fmt.Sprintf("index_%d", activeTableNumber)},
+		{name: "next table within grace period", gracePeriod: 24 * time.Hour, tableName: fmt.Sprintf("index_%d", activeTableNumber+1)},
+		{name: "future table", gracePeriod: 24 * time.Hour, tableName: fmt.Sprintf("index_%d", activeTableNumber+3), expectSkipped: true},
+		{name: "table name without table number", gracePeriod: 24 * time.Hour, tableName: tableName},
+		{name: "active table with 168h period", periodConfig: weeklyPeriodConfig, gracePeriod: 168 * time.Hour, tableName: fmt.Sprintf("index_%d", activeWeeklyTableNumber)},
+		{name: "next table within grace period with 168h period", periodConfig: weeklyPeriodConfig, gracePeriod: 168 * time.Hour, tableName: fmt.Sprintf("index_%d", activeWeeklyTableNumber+1)},
+		{name: "future table with 168h period", periodConfig: weeklyPeriodConfig, gracePeriod: 168 * time.Hour, tableName: fmt.Sprintf("index_%d", activeWeeklyTableNumber+3), expectSkipped: true},
+		{name: "table name without prefix with 168h period", periodConfig: weeklyPeriodConfig, gracePeriod: 168 * time.Hour, tableName: fmt.Sprintf("other_%d", activeWeeklyTableNumber+3)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 2,
+			}, testutil.PerUserDBsConfig{}, Options{FutureTableGracePeriod: tc.gracePeriod})
+			tCompactor.periodConfig = tc.periodConfig
+			commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+			tCompactor.commonIndexSet = tableNameOverrideIndexSet{IndexSet: commonIndexSet, tableName: tc.tableName}
+
+			require.NoError(t, tCompactor.CompactTable())
+			if tc.expectSkipped {
+				require.Nil(t, commonIndexSet.compactedIndex)
+				require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesFutureTableSkipped))
+			} else {
+				require.NotNil(t, commonIndexSet.compactedIndex)
+				commonIndexSet.compactedIndex.Cleanup()
+				require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesFutureTableSkipped))
+			}
+		})
+	}
+}
+
+// tableNameOverrideIndexSet overrides the table name of an IndexSet without changing where its files are stored.
+type tableNameOverrideIndexSet struct {
+	compactor.IndexSet
+	tableName string
+}
+
+func (o tableNameOverrideIndexSet) GetTableName() string {
+	return o.tableName
+}
+
+func TestTable_Heartbeat(t *testing.T) {
+	numUsers := 5
+	var heartbeats atomic.Int64
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 5,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{Heartbeat: func() {
+		heartbeats.Inc()
+	}})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	// 5 common files are read twice, once for finding the users and once for merging them.
+	// Each user has 2 files to merge and then gets its compacted index set.
+	require.Equal(t, int64(5*2+numUsers*(1+2+1)), heartbeats.Load())
+}
+
+func TestTable_PhaseTimings(t *testing.T) {
+	perUserDBsConfig := testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 5,
+		},
+		NumUsers: 5,
+	}
+
+	t.Run("common index compacted", func(t *testing.T) {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+			NumUnCompactedDBs: 5,
+		}, perUserDBsConfig, Options{})
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+
+		phaseTimings := tCompactor.PhaseTimings()
+		require.Greater(t, phaseTimings.Prefetch, time.Duration(0))
+		require.Greater(t, phaseTimings.CommonMerge, time.Duration(0))
+		require.Greater(t, phaseTimings.CommonRecreate, time.Duration(0))
+		require.Greater(t, phaseTimings.PerUserRecreate, time.Duration(0))
+		require.Greater(t, phaseTimings.Finalize, time.Duration(0))
+
+		// we should have one histogram per phase
+		require.Equal(t, 5, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesPhaseDurationSeconds))
+	})
+
+	t.Run("common index not compacted", func(t *testing.T) {
+		// the users only have files in their own index sets, so only the user indexes get compacted.
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+			DBsConfig: testutil.DBsConfig{
+				NumCompactedDBs: 2,
+			},
+			NumUsers: 5,
+		}, Options{})
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+
+		phaseTimings := tCompactor.PhaseTimings()
+		require.Zero(t, phaseTimings.CommonRecreate)
+		require.Greater(t, phaseTimings.PerUserRecreate, time.Duration(0))
+	})
+}
+
+func TestTable_ForEachCompactedUserIndex(t *testing.T) {
+	numUsers := 3
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	var userIDs []string
+	require.NoError(t, tCompactor.ForEachCompactedUserIndex(func(userID string, compactedIndex *CompactedIndex) error {
+		userIDs = append(userIDs, userID)
+		require.NotEmpty(t, readDB(t, compactedIndex.compactedFile))
+		return nil
+	}))
+	require.Equal(t, []string{testutil.BuildUserID(0), testutil.BuildUserID(1), testutil.BuildUserID(2)}, userIDs)
+
+	// the iteration stops at the first error.
+	userIDs = nil
+	errCheck := errors.New("check failed")
+	require.ErrorIs(t, tCompactor.ForEachCompactedUserIndex(func(userID string, _ *CompactedIndex) error {
+		userIDs = append(userIDs, userID)
+		return errCheck
+	}), errCheck)
+	require.Len(t, userIDs, 1)
+}
+
+func TestTable_ValidateTenantID(t *testing.T) {
+	numUsers := 5
+	invalidUsers := map[string]struct{}{
+		testutil.BuildUserID(0): {},
+		testutil.BuildUserID(1): {},
+	}
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{
+		ValidateTenantID: func(userID string) bool {
+			_, ok := invalidUsers[userID]
+			return !ok
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	require.Len(t, tCompactor.userCompactedIndexSet.all(), numUsers-len(invalidUsers)+1)
+	require.Contains(t, tCompactor.userCompactedIndexSet.all(), invalidTenantBucket)
+	for userID := range invalidUsers {
+		require.NotContains(t, tCompactor.userCompactedIndexSet.all(), userID)
+	}
+
+	// each invalid user has 100 records in each of the 2 uncompacted dbs
+	require.Equal(t, float64(400), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesInvalidTenantEntries))
+	quarantinedRecords := readDB(t, tCompactor.userCompactedIndexSet.all()[invalidTenantBucket].compactedIndex.compactedFile)
+	require.Len(t, quarantinedRecords[string(local.IndexBucketName)], 200)
+}
+
+func TestTable_NormalizeUserBucket(t *testing.T) {
+	// normalizes the sub-tenant buckets of a sharded tenant, like "tenantA/0", to the tenant.
+	normalize := func(bucketName string) string {
+		tenant, _, _ := strings.Cut(bucketName, "/")
+		return tenant
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{
+			name: "sub-tenant buckets merged into the index of their tenant",
+			opts: Options{NormalizeUserBucket: normalize},
+		},
+		{
+			name: "tenant denied after normalizing its buckets",
+			opts: Options{NormalizeUserBucket: normalize, TenantDenyList: []string{"tenantA"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			tablePath := filepath.Join(objectStoragePath, tableName)
+			require.NoError(t, util.EnsureDirectory(tablePath))
+
+			// the shards of tenantA overlap in both files with the first 25 entries written to tenantA/1 also written to tenantA/0.
+			testutil.AddRecordsToDB(t, filepath.Join(tablePath, "db-0"), 0, 100, []byte("tenantA/0"))
+			testutil.AddRecordsToDB(t, filepath.Join(tablePath, "db-0"), 75, 75, []byte("tenantA/1"))
+			testutil.AddRecordsToDB(t, filepath.Join(tablePath, "db-1"), 150, 50, []byte("tenantA/1"))
+			testutil.AddRecordsToDB(t, filepath.Join(tablePath, "db-1"), 0, 50, []byte("tenantB"))
+
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+			tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), tc.opts)
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+
+			userIndexSets := tCompactor.userCompactedIndexSet.all()
+			require.Contains(t, userIndexSets, "tenantB")
+			require.Len(t, readDB(t, userIndexSets["tenantB"].compactedIndex.compactedFile)[string(local.IndexBucketName)], 50)
+			require.NotContains(t, userIndexSets, "tenantA/0")
+			require.NotContains(t, userIndexSets, "tenantA/1")
+			require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesInvalidTenantEntries))
+
+			if len(tc.opts.TenantDenyList) > 0 {
+				// the buckets of the denied tenant are kept as is in the compacted common index.
+				commonRecords := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+				require.Len(t, userIndexSets, 1)
+				require.Len(t, commonRecords["tenantA/0"], 100)
+				require.Len(t, commonRecords["tenantA/1"], 125)
+				return
+			}
+
+			// nothing is left in the common index once the buckets got moved to the indexes of their tenant.
+			require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+			require.Len(t, userIndexSets, 2)
+			require.Contains(t, userIndexSets, "tenantA")
+			userRecords := readDB(t, userIndexSets["tenantA"].compactedIndex.compactedFile)
+			require.Len(t, userRecords, 1)
+			require.Len(t, userRecords[string(local.IndexBucketName)], 200)
+		})
+	}
+}
+
+func TestTable_UserIndexSetsCreatedAndFetched(t *testing.T) {
+	numUsers := 5
+	for _, tc := range []struct {
+		name                   string
+		numCompactedPerUserDBs int
+		expectedCreated        float64
+		expectedFetched        float64
+	}{
+		{
+			name:            "no existing user index sets",
+			expectedCreated: float64(numUsers),
+		},
+		{
+			name:                   "existing user index sets",
+			numCompactedPerUserDBs: 1,
+			expectedFetched:        float64(numUsers),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{
+					NumUnCompactedDBs: 2,
+					NumCompactedDBs:   tc.numCompactedPerUserDBs,
+				},
+				NumUsers: numUsers,
+			}, Options{})
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+			require.Equal(t, tc.expectedCreated, prom_testutil.ToFloat64(tCompactor.metrics.compactTablesUserIndexSetsCreated))
+			require.Equal(t, tc.expectedFetched, prom_testutil.ToFloat64(tCompactor.metrics.compactTablesUserIndexSetsFetched))
+		})
+	}
+}
+
+func TestTable_RecreateOnly(t *testing.T) {
+	numUsers := 5
+
+	t.Run("recreates eligible compacted dbs", func(t *testing.T) {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+			NumCompactedDBs: 1,
+		}, testutil.PerUserDBsConfig{
+			DBsConfig: testutil.DBsConfig{
+				NumCompactedDBs: 1,
+			},
+			NumUsers: numUsers,
+		}, Options{RecreateOnly: true})
+		defer cleanupTableCompactor(tCompactor)
+
+		makeSourceFilesOld := func(idxSet compactor.IndexSet) {
+			for i := range idxSet.(*mockIndexSet).sourceFiles {
+				idxSet.(*mockIndexSet).sourceFiles[i].ModifiedAt = time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute))
+			}
+		}
+		makeSourceFilesOld(tCompactor.commonIndexSet)
+		for _, idxSet := range tCompactor.existingUserIndexSet {
+			makeSourceFilesOld(idxSet)
+		}
+
+		require.NoError(t, tCompactor.CompactTable())
+
+		require.True(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFileRecreated)
+		require.Len(t, tCompactor.existingUserIndexSet, numUsers)
+		for _, idxSet := range tCompactor.existingUserIndexSet {
+			compactedIndex := idxSet.(*mockIndexSet).compactedIndex
+			require.True(t, compactedIndex.(*CompactedIndex).compactedFileRecreated)
+			compactedIndex.Cleanup()
+		}
+		require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRecreateOnly))
+	})
+
+	t.Run("does not merge files", func(t *testing.T) {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+			NumUnCompactedDBs: 5,
+		}, testutil.PerUserDBsConfig{
+			DBsConfig: testutil.DBsConfig{
+				NumUnCompactedDBs: 5,
+				NumCompactedDBs:   2,
+			},
+			NumUsers: numUsers,
+		}, Options{RecreateOnly: true})
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+
+		require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+		require.False(t, tCompactor.commonIndexSet.(*mockIndexSet).removeSourceFiles)
+		for _, idxSet := range tCompactor.existingUserIndexSet {
+			require.Nil(t, idxSet.(*mockIndexSet).compactedIndex)
+		}
+		require.Len(t, tCompactor.userCompactedIndexSet.all(), 0)
+		require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRecreateOnly))
+	})
+
+	t.Run("leaves dbs with too little to reclaim untouched", func(t *testing.T) {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+			NumCompactedDBs: 1,
+		}, testutil.PerUserDBsConfig{
+			DBsConfig: testutil.DBsConfig{
+				NumCompactedDBs: 1,
+			},
+			NumUsers: numUsers,
+		}, Options{RecreateOnly: true, RecreateMinReclaimableBytes: 1 << 30})
+		defer cleanupTableCompactor(tCompactor)
+
+		makeSourceFilesOld := func(idxSet compactor.IndexSet) {
+			for i := range idxSet.(*mockIndexSet).sourceFiles {
+				idxSet.(*mockIndexSet).sourceFiles[i].ModifiedAt = time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute))
+			}
+		}
+		makeSourceFilesOld(tCompactor.commonIndexSet)
+		for _, idxSet := range tCompactor.existingUserIndexSet {
+			makeSourceFilesOld(idxSet)
+		}
+
+		require.NoError(t, tCompactor.CompactTable())
+
+		require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+		for _, idxSet := range tCompactor.existingUserIndexSet {
+			require.Nil(t, idxSet.(*mockIndexSet).compactedIndex)
+		}
+		require.Equal(t, float64(numUsers+1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRecreateSkipped))
+		require.Equal(t, float64(0), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesRecreateOnly))
+	})
+}
+
+// setCompactedIndexRecorder records the order of SetCompactedIndex calls on user index sets.
+type setCompactedIndexRecorder struct {
+	compactor.IndexSet
+	userID string
+	order  *[]string
+}
+
+func (s setCompactedIndexRecorder) SetCompactedIndex(compactedIndex compactor.CompactedIndex, removeSourceFiles bool) error {
+	*s.order = append(*s.order, s.userID)
+	return s.IndexSet.SetCompactedIndex(compactedIndex, removeSourceFiles)
+}
+
+func TestTable_DeterministicUserOrder(t *testing.T) {
+	numUsers := 20
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{})
+
+	var order []string
+	for userID, idxSet := range tCompactor.existingUserIndexSet {
+		tCompactor.existingUserIndexSet[userID] = setCompactedIndexRecorder{
+			IndexSet: idxSet,
+			userID:   userID,
+			order:    &order,
+		}
+	}
+
+	require.NoError(t, tCompactor.CompactTable())
+	for _, cui := range tCompactor.userCompactedIndexSet.all() {
+		cui.compactedIndex.Cleanup()
+	}
+
+	require.Len(t, order, numUsers)
+	require.True(t, sort.StringsAreSorted(order))
+}
+
+func TestTable_FinalizeConcurrency(t *testing.T) {
+	numUsers := 20
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{FinalizeConcurrency: 4})
+	defer cleanupTableCompactor(tCompactor)
+
+	failingUsers := []string{testutil.BuildUserID(3), testutil.BuildUserID(11)}
+	for _, userID := range failingUsers {
+		tCompactor.existingUserIndexSet[userID] = failingSetCompactedIndexSet{tCompactor.existingUserIndexSet[userID]}
+	}
+
+	// the compacted index of all the other users should get set despite the failures
+	err := tCompactor.CompactTable()
+	require.Error(t, err)
+	for _, userID := range failingUsers {
+		require.Contains(t, err.Error(), fmt.Sprintf("failed to set compacted index for user %s", userID))
+	}
+
+	for userID, idxSet := range tCompactor.existingUserIndexSet {
+		if _, ok := idxSet.(failingSetCompactedIndexSet); ok {
+			continue
+		}
+		require.NotNil(t, idxSet.(*mockIndexSet).compactedIndex, userID)
+		require.True(t, idxSet.(*mockIndexSet).removeSourceFiles, userID)
+	}
+}
+
+func TestTable_RecreateConcurrency(t *testing.T) {
+	numUsers := 20
+	setup := func(t *testing.T) *tableCompactor {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+			DBsConfig: testutil.DBsConfig{
+				NumCompactedDBs: 1,
+			},
+			NumUsers: numUsers,
+		}, Options{RecreateConcurrency: 4})
+
+		for _, idxSet := range tCompactor.existingUserIndexSet {
+			sourceFiles := idxSet.(*mockIndexSet).sourceFiles
+			for i := range sourceFiles {
+				sourceFiles[i].ModifiedAt = time.Now().Add(-(defaultRecreateCompactedDBOlderThan + time.Minute))
+			}
+		}
+
+		return tCompactor
+	}
+
+	t.Run("all recreated", func(t *testing.T) {
+		tCompactor := setup(t)
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+		require.Len(t, tCompactor.userCompactedIndexSet.all(), numUsers)
+		for userID, idxSet := range tCompactor.existingUserIndexSet {
+			compactedIndex := idxSet.(*mockIndexSet).compactedIndex
+			require.NotNil(t, compactedIndex, userID)
+			require.True(t, compactedIndex.(*CompactedIndex).compactedFileRecreated, userID)
+		}
+	})
+
+	t.Run("failed recreate", func(t *testing.T) {
+		tCompactor := setup(t)
+		defer cleanupTableCompactor(tCompactor)
+
+		failingUserID := testutil.BuildUserID(0)
+		tCompactor.existingUserIndexSet[failingUserID] = missingWorkingDirIndexSet{tCompactor.existingUserIndexSet[failingUserID]}
+
+		// recreation of the remaining user indexes should stop and no compacted index should be set
+		require.Error(t, tCompactor.CompactTable())
+		require.Less(t, len(tCompactor.userCompactedIndexSet.all()), numUsers)
+		for userID, idxSet := range tCompactor.existingUserIndexSet {
+			if userID == failingUserID {
+				continue
+			}
+			require.Nil(t, idxSet.(*mockIndexSet).compactedIndex, userID)
+		}
+	})
+}
+
+// missingWorkingDirIndexSet reports a working dir which does not exist, failing the recreation of its compacted db.
+type missingWorkingDirIndexSet struct {
+	compactor.IndexSet
+}
+
+func (m missingWorkingDirIndexSet) GetWorkingDir() string {
+	return filepath.Join(m.IndexSet.GetWorkingDir(), "missing")
+}
+
+func TestTable_DeterministicOutput(t *testing.T) {
+	// there are more source files in the common index than the merge concurrency, so they get merged concurrently without the option.
+	numCommonDBs := readDBsConcurrency + 10
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	testutil.SetupTable(t, filepath.Join(objectStoragePath, tableName), testutil.DBsConfig{
+		NumUnCompactedDBs: numCommonDBs,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 10,
+			NumCompactedDBs:   2,
+		},
+		NumUsers: 5,
+	})
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	// compact compacts the table with the source files of the common index listed in the given order. It returns the name and content
+	// of the index files built for upload for each index set, along with the order in which the source files of the common index got merged.
+	compact := func(opts Options, listSourceFiles func([]storage.IndexFile) []storage.IndexFile) (map[string][2]string, []string) {
+		tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(t.TempDir(), tableName), opts)
+		commonIndexSet := tCompactor.commonIndexSet.(*mockIndexSet)
+		orderRecordingIndexSet := &orderRecordingIndexSet{IndexSet: commonIndexSet, sourceFiles: listSourceFiles(commonIndexSet.ListSourceFiles())}
+		tCompactor.commonIndexSet = orderRecordingIndexSet
+		require.NoError(t, tCompactor.CompactTable())
+		tCompactor.commonIndexSet = commonIndexSet
+		defer cleanupTableCompactor(tCompactor)
+
+		files := map[string][2]string{}
+		addFile := func(userID string, compactedIndex *CompactedIndex) {
+			indexFile, err := compactedIndex.ToIndexFile()
+			require.NoError(t, err)
+
+			path := indexFile.Path()
+			require.NoError(t, indexFile.Close())
+			content, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.NoError(t, os.Remove(path))
+
+			files[userID] = [2]string{indexFile.(*indexfile.IndexFile).Name(), string(content)}
+		}
+
+		addFile("", commonIndexSet.compactedIndex.(*CompactedIndex))
+		for userID, cui := range tCompactor.userCompactedIndexSet.all() {
+			addFile(userID, cui.compactedIndex)
+		}
+
+		return files, orderRecordingIndexSet.downloaded
+	}
+
+	var sortedNames []string
+	shuffled := func(seed int64) func([]storage.IndexFile) []storage.IndexFile {
+		return func(sourceFiles []storage.IndexFile) []storage.IndexFile {
+			sortedNames = sortedNames[:0]
+			for _, sourceFile := range sourceFiles {
+				sortedNames = append(sortedNames, sourceFile.Name)
+			}
+			sort.Strings(sortedNames)
+
+			listed := append([]storage.IndexFile(nil), sourceFiles...)
+			rand.New(rand.NewSource(seed)).Shuffle(len(listed), func(i, j int) {
+				listed[i], listed[j] = listed[j], listed[i]
+			})
+			return listed
+		}
+	}
+
+	// the source files are listed in a different order for each run, which must change neither the merge order nor the compacted files.
+	files, mergeOrder := compact(Options{DeterministicOutput: true}, shuffled(0))
+	require.Len(t, files, 6)
+	require.Greater(t, len(sortedNames), readDBsConcurrency)
+	require.Equal(t, sortedNames, mergeOrder)
+	for run := int64(1); run < 5; run++ {
+		runFiles, runMergeOrder := compact(Options{DeterministicOutput: true}, shuffled(run))
+		require.Equal(t, sortedNames, runMergeOrder, "merge order of run %d", run)
+		require.Equal(t, len(files), len(runFiles))
+		for userID, file := range files {
+			require.Equal(t, file[0], runFiles[userID][0], "name of compacted file for user %q in run %d", userID, run)
+			require.True(t, file[1] == runFiles[userID][1], "content of compacted file for user %q in run %d", userID, run)
+		}
+	}
+
+	// without the option, the source files are merged concurrently in the order they are listed. With more files than the merge
+	// concurrency, the last listed file only starts getting merged after others are done, so the files can't get merged in sorted order.
+	reversed := func(sourceFiles []storage.IndexFile) []storage.IndexFile {
+		listed := append([]storage.IndexFile(nil), sourceFiles...)
+		sort.Slice(listed, func(i, j int) bool {
+			return listed[i].Name > listed[j].Name
+		})
+		return listed
+	}
+	_, mergeOrder = compact(Options{}, reversed)
+	require.Len(t, mergeOrder, len(sortedNames))
+	require.NotEqual(t, sortedNames, mergeOrder)
+}
+
+// orderRecordingIndexSet lists the given source files in their order instead of the ones of the IndexSet, and records the order in
+// which the source files get downloaded.
+type orderRecordingIndexSet struct {
+	compactor.IndexSet
+	sourceFiles []storage.IndexFile
+
+	mtx        sync.Mutex
+	downloaded []string
+}
+
+func (o *orderRecordingIndexSet) ListSourceFiles() []storage.IndexFile {
+	return o.sourceFiles
+}
+
+func (o *orderRecordingIndexSet) GetSourceFile(indexFile storage.IndexFile) (string, error) {
+	o.mtx.Lock()
+	o.downloaded = append(o.downloaded, indexFile.Name)
+	o.mtx.Unlock()
+
+	return o.IndexSet.GetSourceFile(indexFile)
+}
+
+func TestTable_Clock(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var gateTimes []time.Time
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{}, Options{
+		Clock: func() time.Time { return now },
+		ScheduleGate: func(now time.Time) bool {
+			gateTimes = append(gateTimes, now)
+			return true
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+	require.NotEmpty(t, gateTimes)
+	for _, gateTime := range gateTimes {
+		require.Equal(t, now, gateTime)
+	}
+
+	// the files built in the working dir are named after the time of the clock.
+	compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex)
+	require.Equal(t, filepath.Join(tCompactor.commonIndexSet.GetWorkingDir(), "1600000000"), compactedIndex.compactedFile.Path())
+
+	indexFile, err := compactedIndex.ToIndexFile()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, indexFile.Close())
+	}()
+	require.Equal(t, defaultUploaderName+"-1600000000", indexFile.Name())
+}
+
+func TestTable_ContentHashInFileName(t *testing.T) {
+	tCompactor1 := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 3,
+	}, testutil.PerUserDBsConfig{}, Options{
+		ContentHashInFileName: true,
+		Clock:                 func() time.Time { return time.Unix(1600000000, 0) },
+	})
+	defer cleanupTableCompactor(tCompactor1)
+
+	// another compactor racing on the same source files at a different time.
+	objectClient := tCompactor1.commonIndexSet.(*mockIndexSet).objectClient
+	tCompactor2 := newTestTableCompactor(t, objectClient, filepath.Join(t.TempDir(), tableName), Options{
+		ContentHashInFileName: true,
+		Clock:                 func() time.Time { return time.Unix(1600000060, 0) },
+	})
+	defer cleanupTableCompactor(tCompactor2)
+
+	indexFileName := func(tCompactor *tableCompactor) string {
+		require.NoError(t, tCompactor.CompactTable())
+		indexFile, err := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).ToIndexFile()
+		require.NoError(t, err)
+		require.NoError(t, indexFile.Close())
+		require.NoError(t, os.Remove(indexFile.Path()))
+
+		return indexFile.Name()
+	}
+
+	name1, name2 := indexFileName(tCompactor1), indexFileName(tCompactor2)
+	require.Regexp(t, "^"+defaultUploaderName+"-1600000000-[0-9a-f]{16}$", name1)
+	require.Regexp(t, "^"+defaultUploaderName+"-1600000060-[0-9a-f]{16}$", name2)
+	require.Equal(t, strings.TrimPrefix(name1, defaultUploaderName+"-1600000000"), strings.TrimPrefix(name2, defaultUploaderName+"-1600000060"))
+}
+
+func TestTable_CompactedFileOptions(t *testing.T) {
+	compactedFileSize := func(opts Options) int64 {
+		tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+			NumUnCompactedDBs: 10,
+		}, testutil.PerUserDBsConfig{
+			DBsConfig: testutil.DBsConfig{
+				NumUnCompactedDBs: 2,
+			},
+			NumUsers: 2,
+		}, opts)
+		defer cleanupTableCompactor(tCompactor)
+
+		require.NoError(t, tCompactor.CompactTable())
+		// sizes are recorded for both common and per user index.
+		require.Equal(t, 2, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesCompactedFileSizeBytes))
+
+		compactedFile := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile
+		require.Len(t, readDB(t, compactedFile)[string(local.IndexBucketName)], 1000)
+		var size int64
+		require.NoError(t, compactedFile.View(func(tx *bbolt.Tx) error {
+			size = tx.Size()
+			return nil
+		}))
+		return size
+	}
+
+	defaultSize := compactedFileSize(Options{})
+	// the entries get written in order, so filling the pages completely leaves a smaller file.
+	tunedSize := compactedFileSize(Options{CompactedFileFillPercent: 1, CompactedFileInitialMmapSize: 1 << 20})
+	require.Less(t, tunedSize, defaultSize)
+}
+
+func TestCompactUserIndex(t *testing.T) {
+	// the metrics are registered once and shared by all the calls.
+	reg := prometheus.NewRegistry()
+	metrics := NewCompactUserIndexMetrics(reg)
+	for _, numCompactedDBs := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("numCompactedDBs=%d", numCompactedDBs), func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			userID := testutil.BuildUserID(0)
+
+			testutil.SetupTable(t, filepath.Join(objectStoragePath, tableName), testutil.DBsConfig{}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{
+					NumCompactedDBs: numCompactedDBs,
+				},
+				NumUsers: 1,
+			})
+
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+
+			userIndexSet, err := newMockIndexSet(userID, tableName, filepath.Join(tempDir, workingDirName, tableName, userID), objectClient)
+			require.NoError(t, err)
+
+			compactedIndex, err := CompactUserIndex(context.Background(), userID, userIndexSet, config.PeriodConfig{}, Options{TenantMetricsAllowList: []string{userID}}, metrics)
+			if numCompactedDBs == 0 {
+				// an empty user index is left alone like while compacting a table.
+				require.NoError(t, err)
+				require.Nil(t, compactedIndex)
+				require.Nil(t, userIndexSet.(*mockIndexSet).compactedIndex)
+				return
+			}
+			require.NoError(t, err)
+			defer compactedIndex.Cleanup()
+
+			expectedRecords := readIndexFromFiles(t, filepath.Join(objectStoragePath, tableName, userID))
+			require.Equal(t, expectedRecords, readDB(t, compactedIndex.compactedFile))
+
+			// the index set should not have been touched
+			require.Nil(t, userIndexSet.(*mockIndexSet).compactedIndex)
+
+			// the metrics are exported with the registerer of the metrics, and the source files are only read when there are multiple of them.
+			expectedMetrics := ""
+			if numCompactedDBs > 1 {
+				expectedMetrics = fmt.Sprintf(`
+				# HELP loki_boltdb_shipper_compact_tables_tenant_source_files_total Total number of source files with index entries compacted into per user indexes, by tenant for the tenants in the tenant metrics allowlist and "other" for all the other tenants
+				# TYPE loki_boltdb_shipper_compact_tables_tenant_source_files_total counter
+				loki_boltdb_shipper_compact_tables_tenant_source_files_total{tenant=%q} %d
+				`, userID, numCompactedDBs)
+			}
+			require.NoError(t, prom_testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics), "loki_boltdb_shipper_compact_tables_tenant_source_files_total"))
+		})
+	}
+}
+
+func TestTable_UserIndexSetLockWait(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: 2,
+	}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+	// the wait is recorded for both read and write locks.
+	require.Equal(t, 2, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesUserIndexSetLockWait))
+}
+
+func TestTable_FetchNonExistingUserCompactedIndexSet(t *testing.T) {
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumCompactedDBs: 1,
+	}, testutil.PerUserDBsConfig{}, Options{})
+	defer cleanupTableCompactor(tCompactor)
+
+	_, err := tCompactor.fetchUserCompactedIndexSet(context.Background(), testutil.BuildUserID(0))
+	require.ErrorIs(t, err, ErrTenantIndexNotFound)
+	require.EqualError(t, err, "user "+testutil.BuildUserID(0)+": requested non-existing compacted tenant index")
+}
+
+func TestTable_CompactFormat3Indexes(t *testing.T) {
+	for name, tc := range map[string]struct {
+		commonUserBuckets bool
+		expectedRecords   int
+	}{
+		"only per user index": {
+			expectedRecords: 150,
+		},
+		"with entries of the user in the common index": {
+			commonUserBuckets: true,
+			expectedRecords:   200,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			userID := testutil.BuildUserID(0)
+			table := compactortest.NewTable(t, tableName)
+			defer table.Cleanup()
+
+			// two FORMAT3 files of the user with overlapping entries.
+			userIndexSet := table.ExistingUserIndexSet(userID)
+			userIndexSet.AddSourceFile(t, userID+"-0", 0, 100, local.IndexBucketName)
+			userIndexSet.AddSourceFile(t, userID+"-1", 50, 100, local.IndexBucketName)
+			table.SeedCommonIndex(1, 10)
+			if tc.commonUserBuckets {
+				table.SeedUserBuckets(1, 200, userID)
+			}
+
+			compactTestTable(t, table, Options{})
+
+			compactedIndex, removeSourceFiles := userIndexSet.CompactedIndex()
+			require.NotNil(t, compactedIndex)
+			require.True(t, removeSourceFiles)
+			records := readDB(t, compactedIndex.(*CompactedIndex).compactedFile)
+			require.Len(t, records, 1)
+			require.Len(t, records[string(local.IndexBucketName)], tc.expectedRecords)
+		})
+	}
+}
+
+// setupTableCompactor sets up a table in a temp dir as per the given configs and returns a tableCompactor for it.
+func setupTableCompactor(t *testing.T, commonDBsConfig testutil.DBsConfig, perUserDBsConfig testutil.PerUserDBsConfig, opts Options) *tableCompactor {
+	tempDir := t.TempDir()
+
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	tableWorkingDirectory := filepath.Join(tempDir, workingDirName, tableName)
+
+	testutil.SetupTable(t, filepath.Join(objectStoragePath, tableName), commonDBsConfig, perUserDBsConfig)
+
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	return newTestTableCompactor(t, objectClient, tableWorkingDirectory, opts)
+}
+
+// newTestTableCompactor builds a tableCompactor for the table already setup in the given object client.
+func newTestTableCompactor(t *testing.T, objectClient client.ObjectClient, tableWorkingDirectory string, opts Options) *tableCompactor {
+	_, commonPrefixes, err := objectClient.List(context.Background(), tableName, "/")
+	require.NoError(t, err)
+
+	existingUserIndexSets := make(map[string]compactor.IndexSet, len(commonPrefixes))
+	for _, commonPrefix := range commonPrefixes {
+		userID := path.Base(string(commonPrefix))
+		idxSet, err := newMockIndexSet(userID, tableName, filepath.Join(tableWorkingDirectory, userID), objectClient)
+		require.NoError(t, err)
+
+		existingUserIndexSets[userID] = idxSet
+	}
+
+	commonIndexSet, err := newMockIndexSet("", tableName, tableWorkingDirectory, objectClient)
+	require.NoError(t, err)
+
+	return newTableCompactor(context.Background(), commonIndexSet, existingUserIndexSets, func(userID string) (compactor.IndexSet, error) {
+		return newMockIndexSet(userID, tableName, filepath.Join(tableWorkingDirectory, userID), objectClient)
+	}, config.PeriodConfig{}, opts, newMetrics(nil))
+}
+
+func cleanupTableCompactor(tCompactor *tableCompactor) {
+	if compactedIndex := tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex; compactedIndex != nil {
+		compactedIndex.Cleanup()
+	}
+	for _, cui := range tCompactor.userCompactedIndexSet.all() {
+		cui.compactedIndex.Cleanup()
+	}
+}
+
 func compareCompactedTable(t *testing.T, srcTable string, tableCompactor *tableCompactor) {
 	expectedRecords := make(map[string]map[string]string)
 	compactedRecords := make(map[string]map[string]string)
@@ -495,7 +1817,7 @@ func compareCompactedTable(t *testing.T, srcTable string, tableCompactor *tableC
 		}
 	}
 
-	for userID, compactedIndex := range tableCompactor.userCompactedIndexSet {
+	for userID, compactedIndex := range tableCompactor.userCompactedIndexSet.all() {
 		for _, userRecords := range readDB(t, compactedIndex.IndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile) {
 			if _, ok := compactedRecords[userID]; !ok {
 				compactedRecords[userID] = make(map[string]string)
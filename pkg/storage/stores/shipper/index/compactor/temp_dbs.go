@@ -0,0 +1,87 @@
+package compactor
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.etcd.io/bbolt"
+
+	chunk_util "github.com/grafana/loki/pkg/storage/chunk/client/util"
+)
+
+// tempDBTracker tracks the boltdb files opened in the working dirs for building compacted dbs while compacting a table,
+// for removing them when the compaction fails midway. Dbs stop being tracked once handed over to their index sets, which own them then.
+type tempDBTracker struct {
+	dbsMtx sync.Mutex
+	dbs    map[string]*bbolt.DB
+}
+
+func newTempDBTracker() *tempDBTracker {
+	return &tempDBTracker{dbs: map[string]*bbolt.DB{}}
+}
+
+func (d *tempDBTracker) add(db *bbolt.DB) {
+	d.dbsMtx.Lock()
+	defer d.dbsMtx.Unlock()
+
+	d.dbs[db.Path()] = db
+}
+
+// remove stops tracking the given db, like once it got handed over to its index set which then owns it.
+func (d *tempDBTracker) remove(db *bbolt.DB) {
+	d.dbsMtx.Lock()
+	defer d.dbsMtx.Unlock()
+
+	if d.dbs[db.Path()] == db {
+		delete(d.dbs, db.Path())
+	}
+}
+
+// cleanup closes and removes all the tracked dbs and calls release with each of them once closed.
+// Dbs which have already been closed or removed are skipped silently.
+func (d *tempDBTracker) cleanup(logger log.Logger, release func(db *bbolt.DB)) {
+	d.dbsMtx.Lock()
+	defer d.dbsMtx.Unlock()
+
+	for path, db := range d.dbs {
+		if err := db.Close(); err != nil {
+			level.Error(logger).Log("msg", "failed to close db", "path", path, "err", err)
+		}
+		release(db)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			level.Error(logger).Log("msg", "failed to remove file", "path", path, "err", err)
+		}
+	}
+	d.dbs = map[string]*bbolt.DB{}
+}
+
+// openCompactedDB opens the boltdb file at the given path for building a compacted db with the initial mmap size configured for
+// compacted files, and tracks it for removing it when the compaction of the table fails. It blocks while the number of open compacted
+// dbs is at Options.MaxOpenCompactedDBs.
+func (t *tableCompactor) openCompactedDB(path string) (*bbolt.DB, error) {
+	if t.opts.StagingDir != "" {
+		if err := chunk_util.EnsureDirectory(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.openDBs.acquire(t.ctx); err != nil {
+		return nil, err
+	}
+
+	db, err := openBoltdbFileWithNoSyncAndOptions(path, &bbolt.Options{
+		Timeout:         t.opts.boltdbOpenTimeout(),
+		InitialMmapSize: t.opts.CompactedFileInitialMmapSize,
+	})
+	if err != nil {
+		t.openDBs.cancel()
+		return nil, err
+	}
+
+	t.openDBs.add(db)
+	t.tempDBs.add(db)
+	return db, nil
+}
@@ -0,0 +1,99 @@
+package compactor
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_CompactionFailureRemovesTempDBs(t *testing.T) {
+	errSetCompactedIndex := errors.New("failed to set compacted index")
+
+	for name, tc := range map[string]struct {
+		stagingDir   bool
+		failIndexSet func(tCompactor *tableCompactor) *mockIndexSet
+		// numHandedOver is the number of index sets getting their compacted index before the failure.
+		numHandedOver int
+	}{
+		"common index set": {
+			failIndexSet: func(tCompactor *tableCompactor) *mockIndexSet {
+				return tCompactor.commonIndexSet.(*mockIndexSet)
+			},
+		},
+		"user index set": {
+			failIndexSet: func(tCompactor *tableCompactor) *mockIndexSet {
+				return tCompactor.existingUserIndexSet[testutil.BuildUserID(1)].(*mockIndexSet)
+			},
+			// the common index set and the index sets of the other 2 users.
+			numHandedOver: 3,
+		},
+		"user index set with staging dir": {
+			stagingDir: true,
+			failIndexSet: func(tCompactor *tableCompactor) *mockIndexSet {
+				return tCompactor.existingUserIndexSet[testutil.BuildUserID(1)].(*mockIndexSet)
+			},
+			numHandedOver: 3,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := Options{}
+			if tc.stagingDir {
+				opts.StagingDir = t.TempDir()
+			}
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 3,
+			}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{
+					NumUnCompactedDBs: 2,
+					NumCompactedDBs:   1,
+				},
+				NumUsers: 3,
+			}, opts)
+			failedIndexSet := tc.failIndexSet(tCompactor)
+			failedIndexSet.setCompactedIndexErr = errSetCompactedIndex
+
+			require.ErrorContains(t, tCompactor.CompactTable(), errSetCompactedIndex.Error())
+			require.Nil(t, failedIndexSet.compactedIndex)
+
+			// the compacted dbs handed over before the failure are owned by their index sets, so they are left open for them to clean them up.
+			indexSets := []*mockIndexSet{tCompactor.commonIndexSet.(*mockIndexSet)}
+			for _, cui := range tCompactor.userCompactedIndexSet.all() {
+				indexSets = append(indexSets, cui.IndexSet.(*mockIndexSet))
+			}
+			var handedOver []*CompactedIndex
+			for _, indexSet := range indexSets {
+				if indexSet.compactedIndex == nil {
+					continue
+				}
+				compactedIndex := indexSet.compactedIndex.(*CompactedIndex)
+				require.FileExists(t, compactedIndex.compactedFile.Path())
+				require.NoError(t, compactedIndex.compactedFile.View(func(_ *bbolt.Tx) error {
+					return nil
+				}))
+				handedOver = append(handedOver, compactedIndex)
+			}
+			require.Len(t, handedOver, tc.numHandedOver)
+			for _, compactedIndex := range handedOver {
+				compactedIndex.Cleanup()
+			}
+
+			var leftFiles []string
+			require.NoError(t, filepath.WalkDir(tCompactor.commonIndexSet.GetWorkingDir(), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() {
+					leftFiles = append(leftFiles, path)
+				}
+				return nil
+			}))
+			require.Empty(t, leftFiles)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package compactor
+
+import (
+	"go.etcd.io/bbolt"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+)
+
+// tenantFilter selects the tenants whose index gets compacted as per Options.TenantAllowList and Options.TenantDenyList.
+// A nil tenantFilter selects all the tenants.
+type tenantFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// newTenantFilter builds a tenantFilter for the given lists, or returns nil when both of them are empty.
+func newTenantFilter(allowList, denyList []string) *tenantFilter {
+	if len(allowList) == 0 && len(denyList) == 0 {
+		return nil
+	}
+
+	toSet := func(list []string) map[string]struct{} {
+		set := make(map[string]struct{}, len(list))
+		for _, userID := range list {
+			set[userID] = struct{}{}
+		}
+		return set
+	}
+
+	return &tenantFilter{
+		allow: toSet(allowList),
+		deny:  toSet(denyList),
+	}
+}
+
+// compacts returns true if the index of the given tenant should be compacted.
+func (f *tenantFilter) compacts(userID string) bool {
+	if f == nil {
+		return true
+	}
+
+	if _, ok := f.deny[userID]; ok {
+		return false
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	_, ok := f.allow[userID]
+	return ok
+}
+
+// hasUserBuckets returns true if the given boltdb file has buckets other than the common index bucket and the meta bucket,
+// like a compacted file of the common index keeping the buckets of tenants not selected by the tenantFilter.
+func hasUserBuckets(db *bbolt.DB) (bool, error) {
+	found := false
+	err := db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			if bucketName := string(name); bucketName != string(local.IndexBucketName) && !isMetaBucket(bucketName) {
+				found = true
+			}
+			return nil
+		})
+	})
+
+	return found, err
+}
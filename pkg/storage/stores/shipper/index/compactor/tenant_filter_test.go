@@ -0,0 +1,91 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTenantFilter(t *testing.T) {
+	require.True(t, newTenantFilter(nil, nil).compacts("user1"))
+
+	allow := newTenantFilter([]string{"user1", "user2"}, []string{"user2"})
+	require.True(t, allow.compacts("user1"))
+	require.False(t, allow.compacts("user2"))
+	require.False(t, allow.compacts("user3"))
+
+	deny := newTenantFilter(nil, []string{"user2"})
+	require.True(t, deny.compacts("user1"))
+	require.False(t, deny.compacts("user2"))
+}
+
+func TestTable_TenantDenyList(t *testing.T) {
+	numUsers := 3
+	deniedUser := testutil.BuildUserID(0)
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+			NumCompactedDBs:   1,
+		},
+		NumUsers: numUsers,
+	}, Options{TenantDenyList: []string{deniedUser}})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	// the per user index of the denied user is left untouched.
+	require.Len(t, tCompactor.userCompactedIndexSet.all(), numUsers-1)
+	require.NotContains(t, tCompactor.userCompactedIndexSet.all(), deniedUser)
+	deniedIndexSet := tCompactor.existingUserIndexSet[deniedUser].(*mockIndexSet)
+	require.Nil(t, deniedIndexSet.compactedIndex)
+	require.False(t, deniedIndexSet.removeSourceFiles)
+	objects, _, err := deniedIndexSet.objectClient.List(context.Background(), path.Join(tableName, deniedUser)+"/", "/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+
+	// entries of the denied user from the common index are kept in its bucket of the compacted common index.
+	commonRecords := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+	require.Len(t, commonRecords, 2)
+	require.Len(t, commonRecords[string(local.IndexBucketName)], 200)
+	require.Len(t, commonRecords[deniedUser], 200)
+}
+
+func TestTable_TenantAllowList(t *testing.T) {
+	tempDir := t.TempDir()
+	objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+	objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+	require.NoError(t, err)
+
+	// a previously compacted file of the common index keeping the bucket of a tenant which was not selected for compaction.
+	allowedUser := testutil.BuildUserID(0)
+	seedPath := filepath.Join(tempDir, "seed")
+	testutil.AddRecordsToDB(t, seedPath, 0, 50, local.IndexBucketName)
+	testutil.AddRecordsToDB(t, seedPath, 0, 100, []byte(allowedUser))
+	seed, err := os.Open(seedPath)
+	require.NoError(t, err)
+	defer seed.Close()
+	require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, defaultUploaderName+"-0"), seed))
+
+	tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{TenantAllowList: []string{allowedUser}})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	commonRecords := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+	require.Len(t, commonRecords, 1)
+	require.Len(t, commonRecords[string(local.IndexBucketName)], 50)
+
+	userRecords := readDB(t, tCompactor.userCompactedIndexSet.all()[allowedUser].compactedIndex.compactedFile)
+	require.Len(t, userRecords[string(local.IndexBucketName)], 100)
+	require.Equal(t, float64(1), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesUserIndexSetsCreated))
+}
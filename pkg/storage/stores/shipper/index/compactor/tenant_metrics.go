@@ -0,0 +1,94 @@
+package compactor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherTenantsLabel is the tenant label of the per tenant compaction metrics aggregating the tenants not in Options.TenantMetricsAllowList.
+const otherTenantsLabel = "other"
+
+// tenantMetrics exports the entries, bytes and source files compacted per tenant for the tenants in Options.TenantMetricsAllowList,
+// and under the otherTenantsLabel for all the other tenants, for bounding the cardinality of the metrics. A nil tenantMetrics records nothing.
+type tenantMetrics struct {
+	allow   map[string]struct{}
+	entries *prometheus.CounterVec
+	bytes   *prometheus.CounterVec
+	files   *prometheus.CounterVec
+}
+
+// newTenantMetrics builds a tenantMetrics for the given allowlist, or returns nil when it is empty.
+func newTenantMetrics(allowList []string, metrics *metrics) *tenantMetrics {
+	if len(allowList) == 0 {
+		return nil
+	}
+
+	allow := make(map[string]struct{}, len(allowList))
+	for _, userID := range allowList {
+		allow[userID] = struct{}{}
+	}
+
+	return &tenantMetrics{
+		allow:   allow,
+		entries: metrics.compactTablesTenantEntries,
+		bytes:   metrics.compactTablesTenantBytes,
+		files:   metrics.compactTablesTenantSourceFiles,
+	}
+}
+
+// label returns the tenant label of the metrics of the given tenant, which is otherTenantsLabel for all the tenants of a nil tenantMetrics.
+func (m *tenantMetrics) label(userID string) string {
+	if m == nil {
+		return otherTenantsLabel
+	}
+	if _, ok := m.allow[userID]; ok {
+		return userID
+	}
+	return otherTenantsLabel
+}
+
+// tenantFileMetrics records the entries of a source file compacted per tenant, for counting the file once per tenant it has entries of.
+// A nil tenantFileMetrics records nothing. It is not safe for concurrent use, since each source file gets merged by a single goroutine.
+type tenantFileMetrics struct {
+	m       *tenantMetrics
+	tenants map[string]struct{}
+}
+
+// newTenantFileMetrics returns a tenantFileMetrics for a source file, or nil when Options.TenantMetricsAllowList is not configured.
+func (t *tableCompactor) newTenantFileMetrics() *tenantFileMetrics {
+	if t.tenantMetrics == nil {
+		return nil
+	}
+
+	return &tenantFileMetrics{
+		m:       t.tenantMetrics,
+		tenants: map[string]struct{}{},
+	}
+}
+
+// add records a batch of entries of the source file compacted into the index of the given tenant.
+func (f *tenantFileMetrics) add(userID string, batch []indexEntry) {
+	if f == nil || len(batch) == 0 {
+		return
+	}
+
+	bytes := 0
+	for _, entry := range batch {
+		bytes += len(entry.k) + len(entry.v)
+	}
+
+	label := f.m.label(userID)
+	f.m.entries.WithLabelValues(label).Add(float64(len(batch)))
+	f.m.bytes.WithLabelValues(label).Add(float64(bytes))
+	f.tenants[label] = struct{}{}
+}
+
+// done counts the source file once for each tenant label it got entries compacted for, once it got merged.
+func (f *tenantFileMetrics) done() {
+	if f == nil {
+		return
+	}
+
+	for label := range f.tenants {
+		f.m.files.WithLabelValues(label).Inc()
+	}
+}
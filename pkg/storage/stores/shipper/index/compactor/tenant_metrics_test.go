@@ -0,0 +1,79 @@
+package compactor
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_TenantMetrics(t *testing.T) {
+	for name, tc := range map[string]struct {
+		allowList      []string
+		expectedSeries int
+	}{
+		"disabled": {},
+		"enabled": {
+			allowList:      []string{testutil.BuildUserID(0), "missing-user"},
+			expectedSeries: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			objectStoragePath := filepath.Join(tempDir, objectsStorageDirName)
+			objectClient, err := local.NewFSObjectClient(local.FSConfig{Directory: objectStoragePath})
+			require.NoError(t, err)
+
+			// source files of the common index with entries of three tenants.
+			for _, name := range []string{"1", "2"} {
+				dbPath := filepath.Join(tempDir, name)
+				testutil.AddRecordsToDB(t, dbPath, 0, 10, local.IndexBucketName)
+				for i, numRecords := range []int{100, 50, 20} {
+					testutil.AddRecordsToDB(t, dbPath, 0, numRecords, []byte(testutil.BuildUserID(i)))
+				}
+				f, err := os.Open(dbPath)
+				require.NoError(t, err)
+				require.NoError(t, objectClient.PutObject(context.Background(), path.Join(tableName, name), f))
+				require.NoError(t, f.Close())
+			}
+
+			var usage map[string]TenantUsage
+			tCompactor := newTestTableCompactor(t, objectClient, filepath.Join(tempDir, workingDirName, tableName), Options{
+				TenantMetricsAllowList: tc.allowList,
+				TenantUsageCallback: func(_ string, u map[string]TenantUsage) {
+					usage = u
+				},
+			})
+			defer cleanupTableCompactor(tCompactor)
+
+			require.NoError(t, tCompactor.CompactTable())
+
+			require.Equal(t, tc.expectedSeries, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesTenantEntries))
+			require.Equal(t, tc.expectedSeries, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesTenantBytes))
+			require.Equal(t, tc.expectedSeries, prom_testutil.CollectAndCount(tCompactor.metrics.compactTablesTenantSourceFiles))
+			if tc.expectedSeries == 0 {
+				return
+			}
+
+			// the tenants not in the allowlist are aggregated under the other label.
+			allowed, other := usage[testutil.BuildUserID(0)], usage[testutil.BuildUserID(1)]
+			other.Entries += usage[testutil.BuildUserID(2)].Entries
+			other.Bytes += usage[testutil.BuildUserID(2)].Bytes
+			for label, expected := range map[string]TenantUsage{testutil.BuildUserID(0): allowed, otherTenantsLabel: other} {
+				require.Equal(t, float64(expected.Entries), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesTenantEntries.WithLabelValues(label)))
+				require.Equal(t, float64(expected.Bytes), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesTenantBytes.WithLabelValues(label)))
+				// each source file is counted once per label, even with entries of several tenants under the other label.
+				require.Equal(t, float64(2), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesTenantSourceFiles.WithLabelValues(label)))
+			}
+			require.Equal(t, int64(200), allowed.Entries)
+			require.Equal(t, int64(140), other.Entries)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package compactor
+
+import (
+	"sync"
+)
+
+// TenantUsage holds the size of the index of a tenant seen while compacting a table.
+type TenantUsage struct {
+	Entries int64
+	Bytes   int64
+}
+
+// TenantUsageCallback receives the index usage per tenant for a compacted table.
+// It is called once per table, so it is suitable for exporting stats for a large number of tenants.
+type TenantUsageCallback func(tableName string, usage map[string]TenantUsage)
+
+// tenantUsageTracker accumulates TenantUsage for the tenant buckets seen while compacting a table.
+// It is safe for concurrent use.
+type tenantUsageTracker struct {
+	mtx   sync.Mutex
+	usage map[string]TenantUsage
+}
+
+func newTenantUsageTracker() *tenantUsageTracker {
+	return &tenantUsageTracker{
+		usage: map[string]TenantUsage{},
+	}
+}
+
+func (t *tenantUsageTracker) add(userID string, batch []indexEntry) {
+	if t == nil || len(batch) == 0 {
+		return
+	}
+
+	bytes := int64(0)
+	for _, entry := range batch {
+		bytes += int64(len(entry.k) + len(entry.v))
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	usage := t.usage[userID]
+	usage.Entries += int64(len(batch))
+	usage.Bytes += bytes
+	t.usage[userID] = usage
+}
+
+func (t *tenantUsageTracker) get() map[string]TenantUsage {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	usage := make(map[string]TenantUsage, len(t.usage))
+	for userID, u := range t.usage {
+		usage[userID] = u
+	}
+
+	return usage
+}
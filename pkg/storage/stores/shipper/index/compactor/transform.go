@@ -0,0 +1,95 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+)
+
+// EntryTransformFunc rewrites an index entry of the given bucket while compacting it, like for renaming tenants online.
+// It returns the bucket to write the entry to along with its new key and value, or drop as true for skipping the entry.
+// Returning the bucket, key and value as is keeps the entry unchanged.
+type EntryTransformFunc func(bucket string, k, v []byte) (newBucket string, newK, newV []byte, drop bool)
+
+// transformBatch applies Options.TransformEntry to the entries of the batch read from the given bucket
+// and calls writeBatch with the transformed entries grouped by their new bucket.
+func (t *tableCompactor) transformBatch(bucketName string, batch []indexEntry, writeBatch func(bucketName string, batch []indexEntry) error) error {
+	if t.opts.TransformEntry == nil {
+		return writeBatch(bucketName, batch)
+	}
+
+	dropped, err := regroupBatch(bucketName, batch, func(entry indexEntry) (string, indexEntry, bool) {
+		newBucket, k, v, drop := t.opts.TransformEntry(bucketName, entry.k, entry.v)
+		return newBucket, indexEntry{k: k, v: v}, drop
+	}, writeBatch)
+	t.metrics.compactTablesTransformDroppedEntries.Add(float64(dropped))
+	return err
+}
+
+// regroupBatch rewrites the entries of the batch read from the given bucket and calls writeBatch with the rewritten entries
+// grouped by their new bucket, returning the number of dropped entries. Entries staying in the bucket are rewritten in-place
+// and written first. Empty batches are not written to not create indexes for users whose entries all got moved or dropped.
+func regroupBatch(bucketName string, batch []indexEntry, rewrite func(entry indexEntry) (newBucket string, newEntry indexEntry, drop bool), writeBatch func(bucketName string, batch []indexEntry) error) (int, error) {
+	var (
+		movedBuckets []string
+		moved        map[string][]indexEntry
+		numMoved     int
+	)
+	kept := batch[:0]
+	for _, entry := range batch {
+		newBucket, entry, drop := rewrite(entry)
+		if drop {
+			continue
+		}
+
+		if newBucket == bucketName {
+			kept = append(kept, entry)
+			continue
+		}
+
+		if moved == nil {
+			moved = map[string][]indexEntry{}
+		}
+		if _, ok := moved[newBucket]; !ok {
+			movedBuckets = append(movedBuckets, newBucket)
+		}
+		moved[newBucket] = append(moved[newBucket], entry)
+		numMoved++
+	}
+	dropped := len(batch) - len(kept) - numMoved
+
+	if len(kept) > 0 {
+		if err := writeBatch(bucketName, kept); err != nil {
+			return dropped, err
+		}
+	}
+
+	for _, newBucket := range movedBuckets {
+		if err := writeBatch(newBucket, moved[newBucket]); err != nil {
+			return dropped, err
+		}
+	}
+
+	return dropped, nil
+}
+
+// transformUserBatch applies Options.TransformEntry to the entries of the batch read from a per user index file of the given user.
+// Entries of per user index files can be rewritten or dropped, but not moved to another bucket.
+func (t *tableCompactor) transformUserBatch(userID, bucketName string, batch []indexEntry, writeBatch func(batch []indexEntry) error) error {
+	return t.transformBatch(bucketName, batch, func(newBucket string, batch []indexEntry) error {
+		if newBucket != bucketName {
+			return fmt.Errorf("moving index entries of per user index of %s from bucket %s to %s is not supported", userID, bucketName, newBucket)
+		}
+
+		return writeBatch(batch)
+	})
+}
+
+// fetchOrCreateTransformedUserCompactedIndexSet is like fetchOrCreateUserCompactedIndexSet for users whose index gets entries moved
+// into it by Options.TransformEntry or Options.SplitCommonIndex while merging the common index. The calls are serialized since any of the workers merging
+// the common index could be the first one to see the user.
+func (t *tableCompactor) fetchOrCreateTransformedUserCompactedIndexSet(ctx context.Context, userID string) error {
+	t.transformedUsersMtx.Lock()
+	defer t.transformedUsersMtx.Unlock()
+
+	return t.fetchOrCreateUserCompactedIndexSet(ctx, userID)
+}
@@ -0,0 +1,100 @@
+package compactor
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_TransformEntry(t *testing.T) {
+	numUsers := 5
+	tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+		NumUnCompactedDBs: 2,
+	}, testutil.PerUserDBsConfig{
+		DBsConfig: testutil.DBsConfig{
+			NumUnCompactedDBs: 2,
+		},
+		NumUsers: numUsers,
+	}, Options{
+		TransformEntry: func(bucket string, k, v []byte) (string, []byte, []byte, bool) {
+			switch bucket {
+			case testutil.BuildUserID(0):
+				// merge into another user
+				return testutil.BuildUserID(1), k, v, false
+			case testutil.BuildUserID(2):
+				// rename along with the key
+				return "renamed", append([]byte("renamed/"), k...), v, false
+			case testutil.BuildUserID(3):
+				return "", nil, nil, true
+			}
+			return bucket, k, v, false
+		},
+	})
+	defer cleanupTableCompactor(tCompactor)
+
+	require.NoError(t, tCompactor.CompactTable())
+
+	require.Len(t, tCompactor.userCompactedIndexSet.all(), 3)
+	for _, userID := range []string{testutil.BuildUserID(0), testutil.BuildUserID(2), testutil.BuildUserID(3)} {
+		require.NotContains(t, tCompactor.userCompactedIndexSet.all(), userID)
+	}
+
+	// each user has 100 records in each of the 2 uncompacted dbs, with the same keys for all the users.
+	require.Equal(t, float64(200), prom_testutil.ToFloat64(tCompactor.metrics.compactTablesTransformDroppedEntries))
+	for _, userID := range []string{testutil.BuildUserID(1), testutil.BuildUserID(4)} {
+		records := readDB(t, tCompactor.userCompactedIndexSet.all()[userID].compactedIndex.compactedFile)
+		require.Len(t, records[string(local.IndexBucketName)], 200)
+	}
+
+	renamedRecords := readDB(t, tCompactor.userCompactedIndexSet.all()["renamed"].compactedIndex.compactedFile)
+	require.Len(t, renamedRecords[string(local.IndexBucketName)], 200)
+	for k := range renamedRecords[string(local.IndexBucketName)] {
+		require.True(t, bytes.HasPrefix([]byte(k), []byte("renamed/")), k)
+	}
+
+	commonRecords := readDB(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex.(*CompactedIndex).compactedFile)
+	require.Len(t, commonRecords[string(local.IndexBucketName)], 200)
+}
+
+func TestTable_TransformUserIndexEntries(t *testing.T) {
+	t.Run("rewrite and drop", func(t *testing.T) {
+		idxSet := newLatencyIndexSet(t, 2, 100, time.Millisecond)
+		tableCompactor := newReadAheadTableCompactor(Options{
+			TransformEntry: func(bucket string, k, v []byte) (string, []byte, []byte, bool) {
+				// keep only the records of the first file
+				if record, err := strconv.Atoi(string(v)); err == nil && record >= 100 {
+					return "", nil, nil, true
+				}
+				return bucket, k, []byte("rewritten"), false
+			},
+		})
+		compactedIndex, err := tableCompactor.compactUserIndexes(context.Background(), "user1", idxSet)
+		require.NoError(t, err)
+		defer compactedIndex.Cleanup()
+
+		records := readDB(t, compactedIndex.compactedFile)
+		require.Len(t, records[string(local.IndexBucketName)], 100)
+		for _, v := range records[string(local.IndexBucketName)] {
+			require.Equal(t, "rewritten", v)
+		}
+		require.Equal(t, float64(100), prom_testutil.ToFloat64(tableCompactor.metrics.compactTablesTransformDroppedEntries))
+	})
+
+	t.Run("moving entries fails", func(t *testing.T) {
+		idxSet := newLatencyIndexSet(t, 2, 100, time.Millisecond)
+		_, err := newReadAheadTableCompactor(Options{
+			TransformEntry: func(bucket string, k, v []byte) (string, []byte, []byte, bool) {
+				return "user2", k, v, false
+			},
+		}).compactUserIndexes(context.Background(), "user1", idxSet)
+		require.Error(t, err)
+	})
+}
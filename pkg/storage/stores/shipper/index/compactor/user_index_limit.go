@@ -0,0 +1,65 @@
+package compactor
+
+import (
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// userIndexLimit counts the entries written into the index of each user while compacting a table, for reporting the users going over
+// Options.MaxEntriesPerUserIndex, like the ones with a label explosion. It is safe for concurrent use and a nil userIndexLimit does not
+// count anything.
+type userIndexLimit struct {
+	maxEntries    int64
+	reject        bool
+	overLimit     *prometheus.CounterVec
+	tenantMetrics *tenantMetrics
+
+	mtx     sync.Mutex
+	entries map[string]int64
+}
+
+// newUserIndexLimit builds the userIndexLimit as per Options.MaxEntriesPerUserIndex, or returns nil when it is not configured.
+func newUserIndexLimit(opts Options, tenantMetrics *tenantMetrics, metrics *metrics) *userIndexLimit {
+	if opts.MaxEntriesPerUserIndex <= 0 {
+		return nil
+	}
+
+	return &userIndexLimit{
+		maxEntries:    opts.MaxEntriesPerUserIndex,
+		reject:        opts.RejectUserIndexOverLimit,
+		overLimit:     metrics.compactTablesTenantIndexOverLimit,
+		tenantMetrics: tenantMetrics,
+		entries:       map[string]int64{},
+	}
+}
+
+// add counts the given batch of entries written into the index of the given user. The user going over the limit gets reported once,
+// and an error wrapping ErrUserIndexOverLimit is returned for each batch written over the limit with Options.RejectUserIndexOverLimit.
+func (l *userIndexLimit) add(logger log.Logger, userID string, batch []indexEntry) error {
+	if l == nil || len(batch) == 0 {
+		return nil
+	}
+
+	l.mtx.Lock()
+	before := l.entries[userID]
+	after := before + int64(len(batch))
+	l.entries[userID] = after
+	l.mtx.Unlock()
+
+	if after <= l.maxEntries {
+		return nil
+	}
+	if before <= l.maxEntries {
+		level.Warn(logger).Log("msg", "index of user is over the limit of entries", "user", userID, "entries", after, "limit", l.maxEntries)
+		l.overLimit.WithLabelValues(l.tenantMetrics.label(userID)).Inc()
+	}
+	if l.reject {
+		return errors.Wrapf(ErrUserIndexOverLimit, "index of user %s has more than %d entries", userID, l.maxEntries)
+	}
+
+	return nil
+}
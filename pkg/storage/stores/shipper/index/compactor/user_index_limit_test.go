@@ -0,0 +1,58 @@
+package compactor
+
+import (
+	"testing"
+
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestTable_MaxEntriesPerUserIndex(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts              Options
+		expectedErr       error
+		expectedOverLimit map[string]float64
+	}{
+		"users under the limit": {
+			opts:              Options{MaxEntriesPerUserIndex: 200},
+			expectedOverLimit: map[string]float64{otherTenantsLabel: 0},
+		},
+		"users over the limit": {
+			opts:              Options{MaxEntriesPerUserIndex: 150},
+			expectedOverLimit: map[string]float64{otherTenantsLabel: 2},
+		},
+		"users over the limit with tenant metrics allow list": {
+			opts:              Options{MaxEntriesPerUserIndex: 150, TenantMetricsAllowList: []string{testutil.BuildUserID(0)}},
+			expectedOverLimit: map[string]float64{testutil.BuildUserID(0): 1, otherTenantsLabel: 1},
+		},
+		"users over the limit rejected": {
+			opts:        Options{MaxEntriesPerUserIndex: 150, RejectUserIndexOverLimit: true},
+			expectedErr: ErrUserIndexOverLimit,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// each user gets 100 entries from each of the 2 source files of the common index with per user buckets.
+			tCompactor := setupTableCompactor(t, testutil.DBsConfig{
+				NumUnCompactedDBs: 2,
+			}, testutil.PerUserDBsConfig{
+				DBsConfig: testutil.DBsConfig{NumUnCompactedDBs: 2},
+				NumUsers:  2,
+			}, tc.opts)
+			defer cleanupTableCompactor(tCompactor)
+
+			err := tCompactor.CompactTable()
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				require.Nil(t, tCompactor.commonIndexSet.(*mockIndexSet).compactedIndex)
+				return
+			}
+			require.NoError(t, err)
+
+			for label, expected := range tc.expectedOverLimit {
+				require.Equal(t, expected, prom_testutil.ToFloat64(tCompactor.metrics.compactTablesTenantIndexOverLimit.WithLabelValues(label)), label)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package compactor
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// defaultUserIndexSetShards is the default number of shards of the user compacted index sets of a table.
+const defaultUserIndexSetShards = 16
+
+// values of the mode label of the metric of the time spent waiting for the lock of the user compacted index sets.
+const (
+	lockModeRead  = "read"
+	lockModeWrite = "write"
+)
+
+// userIndexSetShards holds the compacted index sets of the users of a table being compacted, sharded by a hash of the user id
+// as per Options.UserIndexSetShards for reducing the lock contention between the workers merging the source files of tables
+// with thousands of tenants. It is safe for concurrent use.
+type userIndexSetShards struct {
+	shards  []*userIndexSetShard
+	metrics *metrics
+}
+
+type userIndexSetShard struct {
+	mtx  sync.RWMutex
+	sets map[string]*compactedIndexSet
+}
+
+func newUserIndexSetShards(numShards int, metrics *metrics) *userIndexSetShards {
+	if numShards <= 0 {
+		numShards = defaultUserIndexSetShards
+	}
+
+	s := &userIndexSetShards{shards: make([]*userIndexSetShard, numShards), metrics: metrics}
+	for i := range s.shards {
+		s.shards[i] = &userIndexSetShard{sets: map[string]*compactedIndexSet{}}
+	}
+
+	return s
+}
+
+func (s *userIndexSetShards) shard(userID string) *userIndexSetShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// get returns the compacted index set of the given user, recording the time spent waiting for the lock of its shard.
+func (s *userIndexSetShards) get(userID string) (*compactedIndexSet, bool) {
+	shard := s.shard(userID)
+	start := time.Now()
+	shard.mtx.RLock()
+	s.metrics.compactTablesUserIndexSetLockWait.WithLabelValues(lockModeRead).Observe(time.Since(start).Seconds())
+	defer shard.mtx.RUnlock()
+
+	set, ok := shard.sets[userID]
+	return set, ok
+}
+
+// set sets the compacted index set of the given user, recording the time spent waiting for the lock of its shard.
+func (s *userIndexSetShards) set(userID string, set *compactedIndexSet) {
+	shard := s.shard(userID)
+	start := time.Now()
+	shard.mtx.Lock()
+	s.metrics.compactTablesUserIndexSetLockWait.WithLabelValues(lockModeWrite).Observe(time.Since(start).Seconds())
+	defer shard.mtx.Unlock()
+
+	shard.sets[userID] = set
+}
+
+// len returns the number of users having a compacted index set.
+func (s *userIndexSetShards) len() int {
+	n := 0
+	for _, shard := range s.shards {
+		shard.mtx.RLock()
+		n += len(shard.sets)
+		shard.mtx.RUnlock()
+	}
+
+	return n
+}
+
+// all returns a copy of the compacted index sets of all the users by user id, for iterating over them.
+func (s *userIndexSetShards) all() map[string]*compactedIndexSet {
+	all := make(map[string]*compactedIndexSet, s.len())
+	for _, shard := range s.shards {
+		shard.mtx.RLock()
+		for userID, set := range shard.sets {
+			all[userID] = set
+		}
+		shard.mtx.RUnlock()
+	}
+
+	return all
+}
@@ -0,0 +1,62 @@
+package compactor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserIndexSetShards(t *testing.T) {
+	for _, numShards := range []int{0, 1, 16} {
+		t.Run(fmt.Sprintf("shards=%d", numShards), func(t *testing.T) {
+			s := newUserIndexSetShards(numShards, newMetrics(nil))
+			if numShards == 0 {
+				require.Len(t, s.shards, defaultUserIndexSetShards)
+			}
+
+			expected := map[string]*compactedIndexSet{}
+			for i := 0; i < 100; i++ {
+				userID := fmt.Sprintf("user%d", i)
+				expected[userID] = &compactedIndexSet{}
+				s.set(userID, expected[userID])
+			}
+
+			require.Equal(t, 100, s.len())
+			require.Equal(t, expected, s.all())
+			set, ok := s.get("user1")
+			require.True(t, ok)
+			require.Same(t, expected["user1"], set)
+			_, ok = s.get("unknown")
+			require.False(t, ok)
+		})
+	}
+}
+
+// Benchmark_UserIndexSetShards simulates the workers merging source files of a table with thousands of tenants, which look up the
+// index set of a user for each batch of entries and create the index sets of users seen for the first time.
+func Benchmark_UserIndexSetShards(b *testing.B) {
+	const numUsers = 5000
+	userIDs := make([]string, numUsers)
+	for i := range userIDs {
+		userIDs[i] = fmt.Sprintf("user%d", i)
+	}
+
+	for _, numShards := range []int{1, defaultUserIndexSetShards} {
+		b.Run(fmt.Sprintf("shards=%d", numShards), func(b *testing.B) {
+			s := newUserIndexSetShards(numShards, newMetrics(nil))
+			b.SetParallelism(readDBsConcurrency)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					userID := userIDs[i%numUsers]
+					if _, ok := s.get(userID); !ok || i%100 == 0 {
+						s.set(userID, &compactedIndexSet{})
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package compactor
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grafana/dskit/multierror"
+)
+
+// CleanupWorkingDir removes the files left behind in the working dir of the compactor by compactions which did not clean up after
+// themselves like when the compactor process got killed. It is meant to be called at startup, and removes the files in the working dir
+// and its sub dirs which are older than olderThan, except the compacted files named after the default uploader name, the files of
+// checkpoints recorded as per Options.CheckpointEveryNFiles for resuming the compaction of tables, and files locked by an open boltdb file.
+func CleanupWorkingDir(workingDir string, olderThan time.Duration) error {
+	keep, err := checkpointedFiles(workingDir)
+	if err != nil {
+		return err
+	}
+
+	var errs multierror.MultiError
+	err = filepath.WalkDir(workingDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), defaultUploaderName) {
+			return nil
+		}
+		if _, ok := keep[absPath(path)]; ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			errs.Add(err)
+			return nil
+		}
+		if time.Since(info.ModTime()) < olderThan {
+			return nil
+		}
+
+		locked, err := isFileLocked(path)
+		if err != nil {
+			errs.Add(err)
+			return nil
+		}
+		if locked {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			errs.Add(err)
+		}
+		return nil
+	})
+	if err != nil {
+		errs.Add(err)
+	}
+
+	return errs.Err()
+}
+
+// checkpointedFiles returns the paths of the checkpoints in the given working dir and the compacted files recorded in them.
+func checkpointedFiles(workingDir string) (map[string]struct{}, error) {
+	keep := map[string]struct{}{}
+	err := filepath.WalkDir(workingDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Name() != checkpointFileName {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var checkpoint compactionCheckpoint
+		if err := json.Unmarshal(data, &checkpoint); err != nil {
+			// an invalid checkpoint gets removed like any other stale file.
+			return nil
+		}
+
+		keep[absPath(path)] = struct{}{}
+		keep[absPath(checkpoint.CompactedFile)] = struct{}{}
+		for _, userCompactedFile := range checkpoint.UserCompactedFiles {
+			keep[absPath(userCompactedFile)] = struct{}{}
+		}
+		return nil
+	})
+
+	return keep, err
+}
+
+// absPath returns the absolute path of the given path for comparing paths, or the path as is if it can't be made absolute.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return path
+}
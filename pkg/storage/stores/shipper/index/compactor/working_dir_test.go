@@ -0,0 +1,58 @@
+package compactor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client/local"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/testutil"
+)
+
+func TestCleanupWorkingDir(t *testing.T) {
+	workingDir := t.TempDir()
+	tableDir := filepath.Join(workingDir, "table")
+	userDir := filepath.Join(tableDir, "user1")
+	require.NoError(t, os.MkdirAll(userDir, 0o755))
+
+	old := time.Now().Add(-2 * time.Hour)
+	createFile := func(path string, modifiedAt time.Time) string {
+		testutil.AddRecordsToDB(t, path, 0, 10, local.IndexBucketName)
+		require.NoError(t, os.Chtimes(path, modifiedAt, modifiedAt))
+		return path
+	}
+
+	staleTempDB := createFile(filepath.Join(tableDir, "1600000000"), old)
+	staleUserTempDB := createFile(filepath.Join(userDir, "1600000001"), old)
+	recentTempDB := createFile(filepath.Join(tableDir, "1600000002"), time.Now())
+	compactedFile := createFile(filepath.Join(tableDir, defaultUploaderName+"-1"), old)
+	checkpointedDB := createFile(filepath.Join(tableDir, "1600000003"), old)
+	checkpointedUserDB := createFile(filepath.Join(userDir, "1600000004"), old)
+	openDB := createFile(filepath.Join(tableDir, "1600000005"), old)
+
+	data, err := json.Marshal(compactionCheckpoint{
+		CompactedFile:      checkpointedDB,
+		UserCompactedFiles: map[string]string{"user1": checkpointedUserDB},
+	})
+	require.NoError(t, err)
+	checkpointPath := filepath.Join(tableDir, checkpointFileName)
+	require.NoError(t, os.WriteFile(checkpointPath, data, 0o644))
+	require.NoError(t, os.Chtimes(checkpointPath, old, old))
+
+	db, err := openBoltdbFileWithNoSync(openDB)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, os.Chtimes(openDB, old, old))
+
+	require.NoError(t, CleanupWorkingDir(workingDir, time.Hour))
+
+	require.NoFileExists(t, staleTempDB)
+	require.NoFileExists(t, staleUserTempDB)
+	for _, path := range []string{recentTempDB, compactedFile, checkpointedDB, checkpointedUserDB, checkpointPath, openDB} {
+		require.FileExists(t, path)
+	}
+}
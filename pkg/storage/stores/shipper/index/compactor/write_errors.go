@@ -0,0 +1,51 @@
+package compactor
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/multierror"
+	"github.com/pkg/errors"
+)
+
+// errTooManyWriteBatchErrors stops reading a source file once Options.MaxWriteBatchErrors errors have been collected from it.
+var errTooManyWriteBatchErrors = errors.New("too many errors writing batches")
+
+// readSourceFile reads a source file with readFile and sends batches of index to writeBatch func.
+// With Options.MaxWriteBatchErrors set, it keeps reading the file after writeBatch fails until that many errors are collected
+// and returns them combined, while cancellation of the context still stops it right away.
+// With Options.SkipCorruptBuckets set, the buckets failing to be read are skipped, see readFileSkippingBuckets.
+func (t *tableCompactor) readSourceFile(ctx context.Context, logger log.Logger, db downloadedDb, writeBatch func(bucketName string, batch []indexEntry) error) error {
+	var skipBucket func(bucketName string, err error)
+	if t.opts.SkipCorruptBuckets {
+		skipBucket = func(string, error) {
+			t.metrics.compactTablesCorruptBucketsSkipped.Inc()
+		}
+	}
+
+	if t.opts.MaxWriteBatchErrors <= 0 {
+		return readFileSkippingBuckets(logger, db, t.opts.newBatchSizer(), writeBatch, skipBucket)
+	}
+
+	var errs multierror.MultiError
+	err := readFileSkippingBuckets(logger, db, t.opts.newBatchSizer(), func(bucketName string, batch []indexEntry) error {
+		err := writeBatch(bucketName, batch)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		errs.Add(errors.Wrapf(err, "failed to write batch of bucket %s", bucketName))
+		if len(errs) >= t.opts.MaxWriteBatchErrors {
+			return errTooManyWriteBatchErrors
+		}
+		return nil
+	}, skipBucket)
+	if err != nil && !errors.Is(err, errTooManyWriteBatchErrors) {
+		errs.Add(err)
+	}
+
+	return errs.Err()
+}
@@ -0,0 +1,36 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTable_MaxWriteBatchErrors(t *testing.T) {
+	for _, tc := range []struct {
+		maxWriteBatchErrors int
+		expectedErrors      int
+	}{
+		{expectedErrors: 1},
+		{maxWriteBatchErrors: 3, expectedErrors: 3},
+		{maxWriteBatchErrors: 100, expectedErrors: 10},
+	} {
+		t.Run(fmt.Sprintf("maxWriteBatchErrors=%d", tc.maxWriteBatchErrors), func(t *testing.T) {
+			// moving entries out of a per user index fails writing each of the 10 batches of the source file.
+			idxSet := newLatencyIndexSet(t, 1, 100, time.Millisecond)
+			_, err := newReadAheadTableCompactor(Options{
+				BatchSize:           10,
+				MaxWriteBatchErrors: tc.maxWriteBatchErrors,
+				TransformEntry: func(bucket string, k, v []byte) (string, []byte, []byte, bool) {
+					return "user2", k, v, false
+				},
+			}).compactUserIndexes(context.Background(), "user1", idxSet)
+			require.Error(t, err)
+			require.Equal(t, tc.expectedErrors, strings.Count(err.Error(), "user2"))
+		})
+	}
+}
@@ -39,12 +39,20 @@ func SafeOpenBoltdbFile(path string) (*bbolt.DB, error) {
 	// Open the file in a separate goroutine because we want to change
 	// the behavior of a Fault for just this operation and not for the
 	// calling goroutine
-	go safeOpenBoltDbFile(path, result)
+	go safeOpenBoltDbFile(path, nil, result)
 	res := <-result
 	return res.boltdb, res.err
 }
 
-func safeOpenBoltDbFile(path string, ret chan *result) {
+// SafeOpenBoltdbFileWithOptions is like SafeOpenBoltdbFile but opens the DB file with the given bbolt options.
+func SafeOpenBoltdbFileWithOptions(path string, options *bbolt.Options) (*bbolt.DB, error) {
+	result := make(chan *result)
+	go safeOpenBoltDbFile(path, options, result)
+	res := <-result
+	return res.boltdb, res.err
+}
+
+func safeOpenBoltDbFile(path string, options *bbolt.Options, ret chan *result) {
 	// boltdb can throw faults which are not caught by recover unless we turn them into panics
 	debug.SetPanicOnFault(true)
 	res := &result{}
@@ -59,7 +67,15 @@ func safeOpenBoltDbFile(path string, ret chan *result) {
 		ret <- res
 	}()
 
-	b, err := local.OpenBoltdbFile(path)
+	var (
+		b   *bbolt.DB
+		err error
+	)
+	if options == nil {
+		b, err = local.OpenBoltdbFile(path)
+	} else {
+		b, err = bbolt.Open(path, 0o666, options)
+	}
 	res.boltdb = b
 	res.err = err
 }